@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/markdaws/gohome/pkg/cmd"
+	"github.com/markdaws/gohome/pkg/gohome"
+	"github.com/markdaws/gohome/pkg/log"
+)
+
+const automationUsage = `
+Automation commands:
+  ghadmin --config=./config.json automation dryrun <script.yaml>
+    	Lists the commands the automation script would execute if it was triggered now, no
+    	commands are sent to any of the devices
+  ghadmin --config=./config.json automation simulate <automation dir> <timeline.yaml> [expected.txt]
+    	Replays the timeline of feature changes, sunrise, sunset and time jumps against the automation
+    	in the directory using a simulated clock, and lists the automation that fired and the commands
+    	they would have executed. If an expected output file is specified the command exits with a non
+    	zero status if the output does not match it
+  ghadmin --config=./config.json automation lint <automation dir>
+    	Strictly checks all of the automation scripts in the directory, listing every problem found
+    	with its file, line and column. Unknown keys, invalid values and unknown features are all
+    	reported. Exits with a non zero status if any problems are found`
+
+// automationCmd runs the automation sub command specified in the first argument
+func automationCmd(configPath string, args []string) {
+	if len(args) == 0 {
+		fmt.Println("missing automation command" + automationUsage)
+		os.Exit(1)
+	}
+
+	switch args[0] {
+	case "dryrun":
+		automationDryRun(configPath, args[1:])
+	case "simulate":
+		automationSimulate(configPath, args[1:])
+	case "lint":
+		automationLint(configPath, args[1:])
+	default:
+		fmt.Println("unknown automation command: " + args[0] + automationUsage)
+		os.Exit(1)
+	}
+}
+
+func automationDryRun(configPath string, args []string) {
+	if configPath == "" {
+		fmt.Println("The config option must be specified when running automation commands")
+		os.Exit(1)
+	}
+	if len(args) != 1 {
+		fmt.Println("missing values, automation dryrun <script.yaml>")
+		os.Exit(1)
+	}
+
+	cfg := loadConfig(configPath)
+
+	log.Silent = true
+	sys := loadSystem(cfg.SystemPath)
+	auto := loadAutomationScript(sys, args[0])
+	group, err := auto.DryRun()
+	log.Silent = false
+
+	if err != nil {
+		fmt.Println("Failed to build the automation commands:", err)
+		os.Exit(1)
+	}
+
+	fmt.Println("Automation:", auto.Name)
+	fmt.Print(formatCommands(group.Cmds, "  "))
+	fmt.Printf("%d command(s), nothing was sent to the devices\n", len(group.Cmds))
+}
+
+func automationSimulate(configPath string, args []string) {
+	if configPath == "" {
+		fmt.Println("The config option must be specified when running automation commands")
+		os.Exit(1)
+	}
+	if len(args) != 2 && len(args) != 3 {
+		fmt.Println("missing values, automation simulate <automation dir> <timeline.yaml> [expected.txt]")
+		os.Exit(1)
+	}
+
+	cfg := loadConfig(configPath)
+
+	log.Silent = true
+	sys := loadSystem(cfg.SystemPath)
+	autos := loadAutomationDir(sys, args[0])
+
+	b, err := ioutil.ReadFile(args[1])
+	if err != nil {
+		fmt.Println("Failed to read timeline:", err)
+		os.Exit(1)
+	}
+	timeline, err := gohome.ParseTimeline(sys, string(b))
+	if err != nil {
+		fmt.Println("Invalid timeline:", args[1], err)
+		os.Exit(1)
+	}
+
+	sim := &gohome.Simulator{System: sys, Automation: autos}
+	runs, err := sim.Run(timeline)
+	log.Silent = false
+	if err != nil {
+		fmt.Println("Failed to simulate the automation:", err)
+		os.Exit(1)
+	}
+
+	var out bytes.Buffer
+	for _, run := range runs {
+		fmt.Fprintln(&out, run.String())
+		out.WriteString(formatCommands(run.Cmds, "  "))
+	}
+	fmt.Fprintf(&out, "%d run(s), nothing was sent to the devices\n", len(runs))
+	fmt.Print(out.String())
+
+	if len(args) == 3 {
+		expected, err := ioutil.ReadFile(args[2])
+		if err != nil {
+			fmt.Println("Failed to read expected output:", err)
+			os.Exit(1)
+		}
+		if line, want, got, ok := compareOutput(string(expected), out.String()); !ok {
+			fmt.Printf("Output does not match %s, line %d\n  expected: %s\n  actual:   %s\n", args[2], line, want, got)
+			os.Exit(1)
+		}
+		fmt.Println("Output matches", args[2])
+	}
+}
+
+func automationLint(configPath string, args []string) {
+	if configPath == "" {
+		fmt.Println("The config option must be specified when running automation commands")
+		os.Exit(1)
+	}
+	if len(args) != 1 {
+		fmt.Println("missing values, automation lint <automation dir>")
+		os.Exit(1)
+	}
+
+	cfg := loadConfig(configPath)
+
+	log.Silent = true
+	sys := loadSystem(cfg.SystemPath)
+	log.Silent = false
+
+	infos, err := ioutil.ReadDir(args[0])
+	if err != nil {
+		fmt.Println("Failed to read automation directory:", err)
+		os.Exit(1)
+	}
+
+	files, problems := 0, 0
+	for _, info := range infos {
+		if info.IsDir() || !strings.HasSuffix(info.Name(), ".yaml") {
+			continue
+		}
+		path := filepath.Join(args[0], info.Name())
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			fmt.Println("Failed to read automation script:", err)
+			os.Exit(1)
+		}
+
+		files++
+		log.Silent = true
+		errs := gohome.LintAutomation(sys, string(b))
+		log.Silent = false
+		for _, err := range errs {
+			msg := err.Msg
+			if err.Key != "" {
+				msg = err.Key + ": " + msg
+			}
+			fmt.Printf("%s:%d:%d: %s\n", path, err.Line, err.Column, msg)
+		}
+		problems += len(errs)
+	}
+
+	fmt.Printf("%d file(s) checked, %d problem(s) found\n", files, problems)
+	if problems > 0 {
+		os.Exit(1)
+	}
+}
+
+// compareOutput compares the lines of the expected and actual output, ignoring trailing whitespace
+// and blank lines at the end. If they don't match it returns the line number and contents of the
+// first line that is different
+func compareOutput(expected, actual string) (int, string, string, bool) {
+	split := func(s string) []string {
+		lines := strings.Split(strings.TrimRight(strings.Replace(s, "\r\n", "\n", -1), " \t\n"), "\n")
+		for i, line := range lines {
+			lines[i] = strings.TrimRight(line, " \t")
+		}
+		return lines
+	}
+
+	want, got := split(expected), split(actual)
+	for i := 0; i < len(want) || i < len(got); i++ {
+		var w, g string
+		if i < len(want) {
+			w = want[i]
+		}
+		if i < len(got) {
+			g = got[i]
+		}
+		if i >= len(want) || i >= len(got) || w != g {
+			return i + 1, w, g, false
+		}
+	}
+	return 0, "", "", true
+}
+
+// loadAutomationDir loads all of the automation scripts in the directory, exiting if any of them are invalid
+func loadAutomationDir(sys *gohome.System, dir string) []*gohome.Automation {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		fmt.Println("Failed to read automation directory:", err)
+		os.Exit(1)
+	}
+
+	var autos []*gohome.Automation
+	for _, info := range infos {
+		if info.IsDir() || !strings.HasSuffix(info.Name(), ".yaml") {
+			continue
+		}
+		path := filepath.Join(dir, info.Name())
+		auto := loadAutomationScript(sys, path)
+		auto.Path = path
+		autos = append(autos, auto)
+	}
+	return autos
+}
+
+// formatCommands returns a numbered list of the commands, one per line, each line starts with indent
+func formatCommands(cmds []cmd.Command, indent string) string {
+	var b bytes.Buffer
+	for i, command := range cmds {
+		switch xCmd := command.(type) {
+		case *cmd.FeatureSetAttrs:
+			fmt.Fprintf(&b, "%s%d. FeatureSetAttrs: %s [%s]\n", indent, i+1, xCmd.FeatureName, xCmd.FeatureID)
+
+			keys := make([]string, 0, len(xCmd.Attrs))
+			for key := range xCmd.Attrs {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				fmt.Fprintf(&b, "%s     %s: %v\n", indent, key, xCmd.Attrs[key].Value)
+			}
+			if xCmd.Transition > 0 {
+				fmt.Fprintf(&b, "%s     transition: %s\n", indent, xCmd.Transition)
+			}
+		case *cmd.SceneSet:
+			fmt.Fprintf(&b, "%s%d. SceneSet: %s [%s]\n", indent, i+1, xCmd.SceneName, xCmd.SceneID)
+		default:
+			fmt.Fprintf(&b, "%s%d. %s\n", indent, i+1, command.FriendlyString())
+		}
+	}
+	return b.String()
+}
+
+// loadAutomationScript loads the automation script at path, exiting if the script is invalid
+func loadAutomationScript(sys *gohome.System, path string) *gohome.Automation {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		fmt.Println("Failed to read automation script:", err)
+		os.Exit(1)
+	}
+
+	auto, err := gohome.NewAutomation(sys, string(b))
+	if err != nil {
+		fmt.Println("Invalid automation script:", path, err)
+		os.Exit(1)
+	}
+	return auto
+}
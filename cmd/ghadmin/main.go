@@ -36,6 +36,12 @@ func main() {
 
 	configPath := flag.String("config", "", "Specifies the path and file name to the goHOME config file")
 
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
+		flag.PrintDefaults()
+		fmt.Fprintln(os.Stderr, automationUsage)
+	}
+
 	flag.Parse()
 
 	if *version {
@@ -73,6 +79,11 @@ func main() {
 		return
 	}
 
+	if flag.Arg(0) == "automation" {
+		automationCmd(*configPath, flag.Args()[1:])
+		return
+	}
+
 	fmt.Println("Please specify an option\n\n")
 	flag.PrintDefaults()
 	os.Exit(1)
@@ -132,24 +143,7 @@ func setPass(login, password, configPath string) {
 		os.Exit(1)
 	}
 
-	var cfg *gohome.Config
-	file, err := os.Open(configPath)
-	if err != nil {
-		fmt.Println("Error trying to open:", configPath)
-		os.Exit(1)
-	}
-
-	decoder := json.NewDecoder(file)
-	err = decoder.Decode(&cfg)
-	if err != nil {
-		fmt.Println("Failed to parse:", err)
-		os.Exit(1)
-	}
-
-	if cfg.SystemPath == "" {
-		fmt.Println("systemPath key/value not found in:", configPath)
-		os.Exit(1)
-	}
+	cfg := loadConfig(configPath)
 
 	log.Silent = true
 	sys := loadSystem(cfg.SystemPath)
@@ -179,7 +173,7 @@ func setPass(login, password, configPath string) {
 		addedUser = true
 	}
 
-	err = user.SetPassword(password)
+	err := user.SetPassword(password)
 	if err != nil {
 		fmt.Println("Failed to set the password:", err)
 		os.Exit(1)
@@ -198,6 +192,29 @@ func setPass(login, password, configPath string) {
 	}
 }
 
+func loadConfig(configPath string) *gohome.Config {
+	var cfg *gohome.Config
+	file, err := os.Open(configPath)
+	if err != nil {
+		fmt.Println("Error trying to open:", configPath)
+		os.Exit(1)
+	}
+	defer file.Close()
+
+	decoder := json.NewDecoder(file)
+	err = decoder.Decode(&cfg)
+	if err != nil {
+		fmt.Println("Failed to parse:", err)
+		os.Exit(1)
+	}
+
+	if cfg.SystemPath == "" {
+		fmt.Println("systemPath key/value not found in:", configPath)
+		os.Exit(1)
+	}
+	return cfg
+}
+
 func loadSystem(systemPath string) *gohome.System {
 	sys, err := store.LoadSystem(systemPath)
 	if err == store.ErrFileNotFound {
@@ -5,6 +5,7 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"path/filepath"
 	"time"
 
 	"github.com/go-home-iot/event-bus"
@@ -53,12 +54,16 @@ func main() {
 	eb := evtbus.NewBus(1000, 100)
 	sys.Services.EvtBus = eb
 
-	// Processes all commands in the system in an async fashion, init with
-	// 3 parallel workers and capacity to store up to 1000 commands to be processed
-	cp := gohome.NewCommandProcessor(sys, 3, 1000)
+	// Processes all commands in the system in an async fashion, each hub has its own
+	// lane so hubs are sent commands in parallel, with capacity to store up to 1000
+	// command groups to be processed
+	cp := gohome.NewCommandProcessor(sys, 1000)
 	cp.Start()
 	sys.Services.CmdProcessor = cp
 
+	// Keeps the values features had before the last few scenes were set, so the scenes can be undone
+	sys.Services.SceneHistory = gohome.NewSceneHistory(10)
+
 	// The UPNP service lets us listen for notifications from UPNP devices
 	upnpService := upnp.NewSubServer()
 	sys.Services.UPNP = upnpService
@@ -85,6 +90,13 @@ func main() {
 	log.V("Initing devices...")
 	sys.InitDevices()
 
+	sys.Latitude = cfg.Location.Latitude
+	sys.Longitude = cfg.Location.Longitude
+
+	// A single scheduler runs all of the time triggers and the sunrise/sunset events
+	sys.Services.Scheduler = gohome.NewScheduler(clock.SystemTime{})
+	sys.Services.Scheduler.Start()
+
 	// TimeHelper helps fire events like sunrise/sunset that extensions and triggers
 	// can use to fire events
 	th := &gohome.TimeHelper{
@@ -92,6 +104,7 @@ func main() {
 		System:    sys,
 		Latitude:  cfg.Location.Latitude,
 		Longitude: cfg.Location.Longitude,
+		Scheduler: sys.Services.Scheduler,
 	}
 	eb.AddProducer(th)
 
@@ -106,32 +119,31 @@ func main() {
 		}
 	}()
 
-	// Load all of the automation scripts
-	autos, err := gohome.LoadAutomation(sys, cfg.AutomationPath)
+	// Keep the last 50 runs of each piece of automation, so users can see why automation did or didn't run
+	sys.Services.AutomationHistory = gohome.NewAutomationHistory(50)
+
+	// Record when each time trigger was scheduled to run, so runs missed while the server was down can
+	// be caught up. Configs created before this setting existed keep the file next to the system file
+	runsPath := cfg.ScheduledRunsPath
+	if runsPath == "" {
+		runsPath = filepath.Join(filepath.Dir(cfg.SystemPath), "scheduled_runs.json")
+	}
+	scheduledRuns, err := gohome.LoadScheduledRuns(runsPath)
 	if err != nil {
-		log.V("error loading automation scripts: %s", err)
+		log.E("%s, missed runs will not be caught up", err)
+		scheduledRuns = &gohome.ScheduledRuns{Path: runsPath}
 	}
-	for _, auto := range autos {
-		auto := auto
-
-		// When the automation is triggered, fire off the actions
-		auto.Triggered = func(actions *gohome.CommandGroup) {
-			sys.Services.EvtBus.Enqueue(&gohome.AutomationTriggeredEvt{
-				Name: auto.Name,
-			})
-
-			log.V("automation[%s] - trigger fired, enqueuing actions", auto.Name)
-			sys.Services.CmdProcessor.Enqueue(*actions)
-		}
-
-		sys.AddAutomation(auto)
-		if auto.Enabled {
-			log.V("automation - starting: %s", auto.Name)
-			eb.AddConsumer(auto)
-		} else {
-			log.V("automation - disabled: %s", auto.Name)
-		}
+	sys.Services.ScheduledRuns = scheduledRuns
+
+	// Load all of the automation scripts, the watcher loads all the scripts when it starts
+	// then reloads any scripts that are added, changed or removed
+	sys.Services.AutomationWatcher = &gohome.AutomationWatcher{
+		Path:     cfg.AutomationPath,
+		System:   sys,
+		Time:     clock.SystemTime{},
+		Interval: time.Second * 2,
 	}
+	eb.AddProducer(sys.Services.AutomationWatcher)
 
 	// Log we started the system
 	sys.Services.EvtBus.Enqueue(&gohome.ServerStartedEvt{})
@@ -7,6 +7,38 @@ type Time interface {
 	After(time.Duration) <-chan time.Time
 }
 
+// Tracker is implemented by clocks that keep count of the work started by their timers, so whatever
+// moves the clock forward can wait for the work to finish before moving it again, see Virtual. A
+// goroutine waiting on the clock's timers must release each timer, once it has finished the work the
+// timer started or when it stops waiting on the timer. Work started some other way, such as an event
+// passed to the goroutine, is counted with Add and Done
+type Tracker interface {
+	Release(timer <-chan time.Time)
+	Add()
+	Done()
+}
+
+// Release releases the timer if t is a Tracker
+func Release(t Time, timer <-chan time.Time) {
+	if tracker, ok := t.(Tracker); ok {
+		tracker.Release(timer)
+	}
+}
+
+// Add counts work that has been started if t is a Tracker
+func Add(t Time) {
+	if tracker, ok := t.(Tracker); ok {
+		tracker.Add()
+	}
+}
+
+// Done counts work that has finished if t is a Tracker
+func Done(t Time) {
+	if tracker, ok := t.(Tracker); ok {
+		tracker.Done()
+	}
+}
+
 type SystemTime struct{}
 
 func (st SystemTime) Now() time.Time {
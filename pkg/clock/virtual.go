@@ -0,0 +1,162 @@
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Virtual is a clock whose time only moves when it is told to, so that time can be simulated without
+// waiting for it to pass. Channels returned by After receive the time when the clock is moved to the
+// time they expire.
+//
+// Virtual is a Tracker, a timer that has fired counts as busy until it is released, so Wait can be used
+// to wait for the work started by moving the clock to finish
+type Virtual struct {
+	mutex  sync.Mutex
+	now    time.Time
+	timers []virtualTimer
+
+	// fired is the timers that have fired but not been released, busy is the count of those timers
+	// plus the work counted by Add
+	fired map[<-chan time.Time]bool
+	busy  int
+	idle  *sync.Cond
+}
+
+type virtualTimer struct {
+	at time.Time
+	ch chan time.Time
+}
+
+// NewVirtual returns a virtual clock set to now
+func NewVirtual(now time.Time) *Virtual {
+	v := &Virtual{now: now, fired: make(map[<-chan time.Time]bool)}
+	v.idle = sync.NewCond(&v.mutex)
+	return v
+}
+
+// Now returns the current time of the clock
+func (v *Virtual) Now() time.Time {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	return v.now
+}
+
+// After returns a channel that receives the time once the clock has moved forward by d
+func (v *Virtual) After(d time.Duration) <-chan time.Time {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		v.fired[ch] = true
+		v.busy++
+		ch <- v.now
+		return ch
+	}
+
+	// Keep the timers in the order they expire, timers expiring at the same time fire in the order
+	// they were created
+	at := v.now.Add(d)
+	i := len(v.timers)
+	for i > 0 && v.timers[i-1].at.After(at) {
+		i--
+	}
+	v.timers = append(v.timers, virtualTimer{})
+	copy(v.timers[i+1:], v.timers[i:])
+	v.timers[i] = virtualTimer{at: at, ch: ch}
+	return ch
+}
+
+// Next returns the time the next timer expires, the bool return value is false if there are no timers
+func (v *Virtual) Next() (time.Time, bool) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	if len(v.timers) == 0 {
+		return time.Time{}, false
+	}
+	return v.timers[0].at, true
+}
+
+// Fire moves the clock to the time the next timer expires and fires it, if it expires at or before
+// until. Returns false if there is no timer expiring by until, in which case the clock doesn't move
+func (v *Virtual) Fire(until time.Time) bool {
+	v.mutex.Lock()
+	if len(v.timers) == 0 || v.timers[0].at.After(until) {
+		v.mutex.Unlock()
+		return false
+	}
+
+	timer := v.timers[0]
+	v.timers = v.timers[1:]
+	if timer.at.After(v.now) {
+		v.now = timer.at
+	}
+	v.fired[timer.ch] = true
+	v.busy++
+	v.mutex.Unlock()
+
+	timer.ch <- timer.at
+	return true
+}
+
+// Set moves the clock to t without firing any timers, the clock can't move backwards
+func (v *Virtual) Set(t time.Time) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	if t.After(v.now) {
+		v.now = t
+	}
+}
+
+// Release is called once the work started by the timer firing has finished, or when the timer is no
+// longer needed. A timer that hasn't fired yet is removed, so it never fires
+func (v *Virtual) Release(timer <-chan time.Time) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	if v.fired[timer] {
+		delete(v.fired, timer)
+		v.done()
+		return
+	}
+	for i, t := range v.timers {
+		if (<-chan time.Time)(t.ch) == timer {
+			v.timers = append(v.timers[:i], v.timers[i+1:]...)
+			return
+		}
+	}
+}
+
+// Add counts work that wasn't started by a timer, Done must be called once it has finished
+func (v *Virtual) Add() {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.busy++
+}
+
+// Done is called once the work counted by Add has finished
+func (v *Virtual) Done() {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.done()
+}
+
+func (v *Virtual) done() {
+	v.busy--
+	if v.busy == 0 {
+		v.idle.Broadcast()
+	}
+}
+
+// Wait waits until every timer that has fired has been released and all of the work counted by Add
+// has finished
+func (v *Virtual) Wait() {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	for v.busy > 0 {
+		v.idle.Wait()
+	}
+}
@@ -6,3 +6,27 @@ package cmd
 type Builder interface {
 	Build(Command) (*Func, error)
 }
+
+// TransitionBuilder is implemented by builders whose hardware can natively fade some attributes to
+// their new values over time. When a FeatureSetAttrs command has a transition and the builder
+// doesn't implement this interface, or CanTransition returns false, the transition is done in
+// software by sending a series of commands that step the values
+type TransitionBuilder interface {
+	Builder
+	CanTransition(*FeatureSetAttrs) bool
+}
+
+// RateLimitedBuilder is implemented by builders whose hardware stops responding if it is sent too many
+// commands in a short period of time. The command processor never sends commands to the hub faster than
+// the rate limit allows, commands that would exceed it wait their turn
+type RateLimitedBuilder interface {
+	Builder
+	RateLimit() RateLimit
+}
+
+// RateLimit is a token bucket, up to Burst commands can be sent back to back, after that commands are
+// sent at PerSecond commands per second. If PerSecond is not greater than zero there is no limit
+type RateLimit struct {
+	PerSecond float64
+	Burst     int
+}
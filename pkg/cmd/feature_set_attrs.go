@@ -2,6 +2,7 @@ package cmd
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/markdaws/gohome/pkg/attr"
 )
@@ -13,6 +14,10 @@ type FeatureSetAttrs struct {
 	FeatureType string
 	FeatureName string
 	Attrs       map[string]*attr.Attribute
+
+	// Transition is how long the attributes take to change from their current values to the new
+	// values e.g. a light fading up over 2 seconds. Zero means the values change immediately
+	Transition time.Duration
 }
 
 func (c *FeatureSetAttrs) GetID() string {
@@ -0,0 +1,17 @@
+package cmd
+
+// SceneUndo restores the features set by the most recently set scene to the values they had before the
+// scene was set
+type SceneUndo struct {
+	ID string
+}
+
+func (c *SceneUndo) GetID() string {
+	return c.ID
+}
+func (c *SceneUndo) FriendlyString() string {
+	return "Undo the last scene"
+}
+func (c *SceneUndo) String() string {
+	return "cmd.SceneUndo"
+}
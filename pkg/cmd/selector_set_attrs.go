@@ -0,0 +1,31 @@
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/markdaws/gohome/pkg/attr"
+	"github.com/markdaws/gohome/pkg/feature"
+)
+
+// SelectorSetAttrs sets the attributes on all of the features that match the selector. The features
+// are selected each time the command executes, so features added after the command was created are
+// included. Features that don't have some of the attributes only have the attributes they do have set
+type SelectorSetAttrs struct {
+	ID       string
+	Selector feature.Selector
+	Attrs    map[string]*attr.Attribute
+
+	// Transition is how long the attributes of each feature take to change to the new values
+	Transition time.Duration
+}
+
+func (c *SelectorSetAttrs) GetID() string {
+	return c.ID
+}
+func (c *SelectorSetAttrs) FriendlyString() string {
+	return fmt.Sprintf("SelectorSetAttrs[Selector: %s]", c.Selector.String())
+}
+func (c *SelectorSetAttrs) String() string {
+	return "cmd.SelectorSetAttrs"
+}
@@ -38,6 +38,16 @@ func (b *cmdBuilder) Build(c cmd.Command) (*cmd.Func, error) {
 				return nil, err
 			}
 
+			if command.Transition > 0 {
+				return &cmd.Func{
+					Func: func() error {
+						return getWriterAndExec(d, func(d lutronExt.Device, w io.Writer) error {
+							return setLevelWithFade(level, f.Address, command.Transition, w)
+						})
+					},
+				}, nil
+			}
+
 			return &cmd.Func{
 				Func: func() error {
 					return getWriterAndExec(d, func(d lutronExt.Device, w io.Writer) error {
@@ -67,6 +77,36 @@ func (b *cmdBuilder) Build(c cmd.Command) (*cmd.Func, error) {
 	return nil, nil
 }
 
+// CanTransition returns true for light zones, the hub fades the level of the zone itself
+func (b *cmdBuilder) CanTransition(c *cmd.FeatureSetAttrs) bool {
+	f := b.System.FeatureByID(c.FeatureID)
+	return f != nil && f.Type == feature.FTLightZone
+}
+
+// RateLimit keeps the number of commands sent to the Smart Bridge low, the bridge stops responding
+// for 30 seconds to a minute if it receives too many commands in a short period of time
+func (b *cmdBuilder) RateLimit() cmd.RateLimit {
+	return cmd.RateLimit{PerSecond: 4, Burst: 10}
+}
+
+// setLevelWithFade sets the level of the zone, the hub fades from the current level to the new level
+// over the fade duration. The lutron library doesn't support fade times so the command is written here
+func setLevelWithFade(level float32, zoneAddr string, fade time.Duration, w io.Writer) error {
+	_, err := io.WriteString(w, fmt.Sprintf("#OUTPUT,%s,1,%.2f,%s\r\n", zoneAddr, level, formatFade(fade)))
+	return err
+}
+
+// formatFade formats the fade time the way the hub expects, either SS.ss or HH:MM:SS for fades of
+// a minute or more
+func formatFade(fade time.Duration) string {
+	if fade < time.Minute {
+		return fmt.Sprintf("%.2f", fade.Seconds())
+	}
+
+	secs := int(fade / time.Second)
+	return fmt.Sprintf("%d:%02d:%02d", secs/3600, (secs/60)%60, secs%60)
+}
+
 func getWriterAndExec(d *gohome.Device, f func(lutronExt.Device, io.Writer) error) error {
 	var hub *gohome.Device = d
 	if d.Hub != nil {
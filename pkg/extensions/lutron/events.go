@@ -258,6 +258,14 @@ func (p *event) StartProducing(b *evtbus.Bus) {
 			if err != nil {
 				log.V("%s error streaming events, streaming stopped: %s", p.Device, err)
 			}
+
+			// Let the system know we are no longer receiving events from the device
+			if p.producing {
+				b.Enqueue(&gohome.DeviceLostEvt{
+					DeviceName: p.Device.Name,
+					DeviceID:   p.Device.ID,
+				})
+			}
 		}
 	}()
 }
@@ -0,0 +1,130 @@
+package feature
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Selector selects a set of features, for example all of the light zones with Outside in their name.
+// A feature must match all of the fields that are set to be selected. The Name, Device and Exclude
+// patterns are either globs e.g. *Outside*, which ignore case, or regular expressions wrapped in
+// slashes e.g. /^Outside (Front|Back)$/
+type Selector struct {
+	// Type is the feature type e.g. LightZone, empty matches any type
+	Type string `json:"type,omitempty" yaml:"type"`
+
+	// AIDs is a list of automation IDs, the feature must have one of the automation IDs
+	AIDs []string `json:"aids,omitempty" yaml:"aids"`
+
+	// Name is a pattern matched against the name of the feature
+	Name string `json:"name,omitempty" yaml:"name"`
+
+	// Device is a pattern matched against the ID and name of the device that owns the feature
+	Device string `json:"device,omitempty" yaml:"device"`
+
+	// Exclude is a list of patterns, features whose ID, automation ID or name match any of the
+	// patterns are not selected
+	Exclude []string `json:"exclude,omitempty" yaml:"exclude"`
+}
+
+// Validate returns an error if any of the patterns are invalid, or if the selector doesn't filter on
+// anything, in which case it would select every feature in the system
+func (s *Selector) Validate() error {
+	if s.Type == "" && len(s.AIDs) == 0 && s.Name == "" && s.Device == "" {
+		return fmt.Errorf("selector must have at least one of the type, aids, name or device keys")
+	}
+
+	patterns := append([]string{s.Name, s.Device}, s.Exclude...)
+	for _, pattern := range patterns {
+		if pattern == "" {
+			continue
+		}
+		if _, err := matchPattern(pattern, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Match returns true if the feature matches the selector, deviceName is the name of the device
+// that owns the feature
+func (s *Selector) Match(f *Feature, deviceName string) bool {
+	if s.Type != "" && s.Type != f.Type {
+		return false
+	}
+
+	if len(s.AIDs) > 0 {
+		found := false
+		for _, aid := range s.AIDs {
+			if aid == f.AutomationID {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if s.Name != "" && !matches(s.Name, f.Name) {
+		return false
+	}
+
+	if s.Device != "" && !matches(s.Device, f.DeviceID) && !matches(s.Device, deviceName) {
+		return false
+	}
+
+	for _, exclude := range s.Exclude {
+		if exclude == f.ID || (f.AutomationID != "" && exclude == f.AutomationID) || matches(exclude, f.Name) {
+			return false
+		}
+	}
+	return true
+}
+
+// String returns a human readable version of the selector e.g. name: *Outside*, exclude: garage
+func (s *Selector) String() string {
+	var parts []string
+	if s.Type != "" {
+		parts = append(parts, "type: "+s.Type)
+	}
+	if len(s.AIDs) > 0 {
+		parts = append(parts, "aids: "+strings.Join(s.AIDs, "|"))
+	}
+	if s.Name != "" {
+		parts = append(parts, "name: "+s.Name)
+	}
+	if s.Device != "" {
+		parts = append(parts, "device: "+s.Device)
+	}
+	if len(s.Exclude) > 0 {
+		parts = append(parts, "exclude: "+strings.Join(s.Exclude, "|"))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// matches returns true if the value matches the pattern, invalid patterns don't match anything
+func matches(pattern, value string) bool {
+	ok, err := matchPattern(pattern, value)
+	return err == nil && ok
+}
+
+// matchPattern matches the value against a glob, or a regular expression if the pattern is wrapped
+// in slashes
+func matchPattern(pattern, value string) (bool, error) {
+	if len(pattern) > 1 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		ok, err := regexp.MatchString(pattern[1:len(pattern)-1], value)
+		if err != nil {
+			return false, fmt.Errorf("invalid regular expression: %s, %s", pattern, err)
+		}
+		return ok, nil
+	}
+
+	ok, err := path.Match(strings.ToLower(pattern), strings.ToLower(value))
+	if err != nil {
+		return false, fmt.Errorf("invalid pattern: %s, %s", pattern, err)
+	}
+	return ok, nil
+}
@@ -3,7 +3,9 @@ package gohome
 import (
 	"fmt"
 	"io/ioutil"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-home-iot/event-bus"
@@ -22,8 +24,12 @@ type automationSys interface {
 	NewID() string
 	SceneByID(ID string) *Scene
 	FeaturesByType(featureType string) map[string]*feature.Feature
+	SelectFeatures(sel *feature.Selector) []*feature.Feature
 	FeatureByID(ID string) *feature.Feature
 	FeatureByAID(AID string) *feature.Feature
+	FeatureValues(ID string) (map[string]*attr.Attribute, bool)
+	SceneActive(ID string) bool
+	Coordinates() (float64, float64)
 }
 
 // Automation represents an automation instance. Each piece of automation has a trigger which is a set
@@ -33,163 +39,298 @@ type Automation struct {
 	TempID  string
 	Enabled bool
 	Trigger Trigger
+
+	// Path is the path of the file the automation was loaded from, empty if it was not loaded from a file
+	Path string
+
+	// Script is the source of the automation, YAML or JSON
+	Script string
 	evtbus.Consumer
 	Triggered func(actions *CommandGroup)
+
+	// Resumed is called with the commands that execute after a delay or wait_until action, and the
+	// commands that restore features after an action with a for value
+	Resumed func(actions *CommandGroup)
+
+	// Retrigger is the policy used when the automation triggers while it is still running, one of
+	// the Retrigger values, empty is the same as RetriggerRestart
+	Retrigger string
+
+	// Skipped is called when the automation is triggered but does not execute because the only_if
+	// condition is false, reason describes the part of the condition that was false
+	Skipped func(reason string)
+
+	// Suppressed is called when the trigger fires but the automation does not run because of its
+	// cooldown, debounce or max_runs_per settings
+	Suppressed func(reason string)
+
+	// History if not nil records each time the automation triggers
+	History *AutomationHistory
+
+	// Time is used to evaluate the only_if condition and to time delay, wait_until and for actions,
+	// defaults to the system time if nil
+	Time clock.Time
+
+	sys    automationSys
+	config automationIntermediate
+
+	// firing is held while Triggered is called, chain is the names of the automation that caused the
+	// current call to Triggered, if it was triggered by other automation
+	firing sync.Mutex
+	chain  []string
+
+	// starting serializes starting runs, runMutex protects current and queued
+	starting sync.Mutex
+	runMutex sync.Mutex
+	current  *automationRun
+	queued   []queuedRun
+	done     chan struct{}
 }
 
 func (a *Automation) ConsumerName() string {
 	return fmt.Sprintf("automation - %s", a.Name)
 }
 
+// StartConsuming starts the trigger. Feature changes are also passed to any running actions that are
+// waiting for a wait_until condition
 func (a *Automation) StartConsuming(ch chan evtbus.Event) {
-	a.Trigger.StartConsuming(ch)
+	a.runMutex.Lock()
+	a.done = make(chan struct{})
+	done := a.done
+	a.runMutex.Unlock()
+
+	triggerCh := make(chan evtbus.Event, 100)
+	a.Trigger.StartConsuming(triggerCh)
+
+	go func() {
+		defer close(triggerCh)
+		for {
+			select {
+			case evt, more := <-ch:
+				if !more {
+					return
+				}
+				if e, ok := evt.(*FeatureAttrsChangedEvt); ok {
+					a.notify(e)
+				}
+				select {
+				case triggerCh <- evt:
+				case <-done:
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+}
+
+// handleEvent passes the event to the automation on the calling goroutine, rather than through the
+// channel passed to StartConsuming, so the event has been handled by the time it returns. The automation
+// must have been started, used by the Simulator
+func (a *Automation) handleEvent(evt evtbus.Event) {
+	if e, ok := evt.(*FeatureAttrsChangedEvt); ok {
+		a.notify(e)
+	}
+	walkTriggers(a.Trigger, func(trigger Trigger) {
+		switch t := trigger.(type) {
+		case *FeatureTrigger:
+			t.handleEvent(evt)
+		case *EventTrigger:
+			t.handleEvent(evt)
+		}
+	})
 }
 
+// StopConsuming stops the trigger and any running actions
 func (a *Automation) StopConsuming() {
+	a.runMutex.Lock()
+	if a.done != nil {
+		close(a.done)
+		a.done = nil
+	}
+	a.runMutex.Unlock()
+
 	a.Trigger.StopConsuming()
+	a.stopRuns()
 }
 
-type condition struct {
-	AttrLocalID *string     `yaml:"attr"`
-	Op          *string     `yaml:"op"`
-	Value       interface{} `yaml:"value"`
-	feature     *feature.Feature
-	And         []*condition `yaml:"and"`
-	Or          []*condition `yaml:"or"`
-}
-
-func (c *condition) Evaluate(e *FeatureAttrsChangedEvt) bool {
-	if c.feature.ID != e.FeatureID {
-		return false
-	}
-
-	attribute, ok := e.Attrs[*c.AttrLocalID]
-	if !ok {
-		return false
-	}
-
-	switch attribute.DataType {
-	case attr.DTInt32:
-		a := attribute.Value.(int32)
-		b := toInt32(c.Value)
-		if b == nil {
-			return false
-		}
-		switch *c.Op {
-		case "<":
-			return a < *b
-		case ">":
-			return a > *b
-		case "==":
-			return a == *b
-		case "!=":
-			return a != *b
-		case "<=":
-			return a <= *b
-		case ">=":
-			return a >= *b
-		}
-
-	case attr.DTFloat32:
-		a := attribute.Value.(float32)
-		b := toFloat32(c.Value)
-		if b == nil {
-			return false
-		}
-		switch *c.Op {
-		case "<":
-			return a < *b
-		case ">":
-			return a > *b
-		case "==":
-			return a == *b
-		case "!=":
-			return a != *b
-		case "<=":
-			return a <= *b
-		case ">=":
-			return a >= *b
-		}
-
-	case attr.DTString:
-		a := attribute.Value.(string)
-		b := c.Value.(string)
-		switch *c.Op {
-		case "<":
-			return a < b
-		case ">":
-			return a > b
-		case "==":
-			return a == b
-		case "!=":
-			return a != b
-		case "<=":
-			return a <= b
-		case ">=":
-			return a >= b
-		}
-
-	case attr.DTBool:
-		switch *c.Op {
-		case "==":
-			return attribute.Value == c.Value
-		case "!=":
-			return attribute.Value != c.Value
-		}
-	}
-
-	return false
+// fire calls Triggered with the actions, chain is the names of the automation that caused this
+// automation to trigger
+func (a *Automation) fire(actions *CommandGroup, chain []string) {
+	a.firing.Lock()
+	defer a.firing.Unlock()
+
+	if a.Triggered == nil {
+		return
+	}
+
+	a.chain = chain
+	a.Triggered(actions)
+	a.chain = nil
+}
+
+// skip is called when the automation triggers but the actions are not executed, rec is the record of
+// the run, which is marked as skipped
+func (a *Automation) skip(rec *runRecorder, reason string) {
+	log.V("automation[%s] - skipped, %s", a.Name, reason)
+	rec.finish(RunStatusSkipped, reason, a.now())
+	if a.Skipped != nil {
+		a.Skipped(reason)
+	}
+}
+
+// suppress is called when the trigger fires but the cooldown, debounce or max_runs_per settings stop
+// the automation from running
+func (a *Automation) suppress(reason string) {
+	log.V("automation[%s] - suppressed, %s", a.Name, reason)
+	if a.Suppressed != nil {
+		a.Suppressed(reason)
+	}
+}
+
+func (a *Automation) now() time.Time {
+	return a.clock().Now()
+}
+
+func (a *Automation) clock() clock.Time {
+	if a.Time == nil {
+		return clock.SystemTime{}
+	}
+	return a.Time
+}
+
+// SetTime sets the clock used by the automation and all of its triggers, so that the automation can
+// be run against a simulated time
+func (a *Automation) SetTime(t clock.Time) {
+	a.Time = t
+	setTriggerTime(a.Trigger, t)
+}
+
+func setTriggerTime(trigger Trigger, t clock.Time) {
+	walkTriggers(trigger, func(trigger Trigger) {
+		switch x := trigger.(type) {
+		case *TimeTrigger:
+			// Any scheduler is using a different clock, StartAutomation assigns the system scheduler
+			x.Time = t
+			x.Scheduler = nil
+		case *FeatureTrigger:
+			x.Time = t
+		}
+	})
+}
+
+// walkTriggers calls fn with the trigger and each of the triggers it contains
+func walkTriggers(trigger Trigger, fn func(Trigger)) {
+	fn(trigger)
+	switch x := trigger.(type) {
+	case *MultiTrigger:
+		for _, child := range x.Triggers {
+			walkTriggers(child, fn)
+		}
+	case *throttledTrigger:
+		walkTriggers(x.trigger, fn)
+	}
+}
+
+// DryRun resolves the actions of the automation against the current state of the system and returns
+// the commands that would be sent to the command processor if the automation was triggered right now.
+// Nothing is sent to any of the devices
+func (a *Automation) DryRun() (*CommandGroup, error) {
+	group, err := parseActions(a.sys, a.config)
+	if err != nil {
+		return nil, newAutomationError(a.Script, err)
+	}
+	return group, nil
 }
 
 // helper type to deserialize the yaml in to our internal object model
 type automationIntermediate struct {
-	Name    string `yaml:"name"`
-	Enabled *bool  `yaml:"enabled"`
-	Trigger *struct {
-		Time *struct {
-			At   string `yaml:"at"`
-			Days string `yaml:"days"`
-		} `yaml:"time"`
-		Feature *struct {
-			ID        *string    `yaml:"id"`
-			AID       *string    `yaml:"aid"`
-			Condition *condition `yaml:"condition"`
-			Count     int        `yaml:"count"`
-			Duration  int        `yaml:"duration"`
-		} `yaml:"feature"`
-	} `yaml:"trigger"`
-	Actions []struct {
-		Scene *struct {
-			ID string `yaml:"id"`
-		} `yaml:"scene"`
-		LightZone *struct {
-			ID         *string  `yaml:"id"`
-			AID        *string  `yaml:"aid"`
-			OnOff      *string  `yaml:"on_off"`
-			Brightness *float64 `yaml:"brightness"`
-		} `yaml:"light_zone"`
-		Outlet *struct {
-			ID    *string `yaml:"id"`
-			AID   *string `yaml:"aid"`
-			OnOff *string `yaml:"on_off"`
-		} `yaml:"outlet"`
-		Switch *struct {
-			ID    *string `yaml:"id"`
-			AID   *string `yaml:"aid"`
-			OnOff *string `yaml:"on_off"`
-		} `yaml:"switch"`
-		WindowTreatment *struct {
-			ID         *string  `yaml:"id"`
-			AID        *string  `yaml:"aid"`
-			OpenClosed *string  `yaml:"open_closed"`
-			Offset     *float64 `yaml:"offset"`
-		} `yaml:"window_treatment"`
-		HeatZone *struct {
-			ID         *string  `yaml:"id"`
-			AID        *string  `yaml:"aid"`
-			TargetTemp *float64 `yaml:"target_temp"`
-		} `yaml:"heat_zone"`
-	} `yaml:"actions"`
+	Name       string                 `yaml:"name"`
+	Enabled    *bool                  `yaml:"enabled"`
+	Trigger    *triggerIntermediate   `yaml:"trigger"`
+	Triggers   []*triggerIntermediate `yaml:"triggers"`
+	OnlyIf     *condition             `yaml:"only_if"`
+	Retrigger  string                 `yaml:"retrigger"`
+	Cooldown   string                 `yaml:"cooldown"`
+	Debounce   string                 `yaml:"debounce"`
+	MaxRunsPer *maxRunsPer            `yaml:"max_runs_per"`
+	CatchUp    interface{}            `yaml:"catch_up"`
+	Actions    []actionIntermediate   `yaml:"actions"`
+}
+
+// actionIntermediate is a single action, it either sets the state of some features or pauses the
+// execution of the following actions
+type actionIntermediate struct {
+	Scene *struct {
+		ID string `yaml:"id"`
+	} `yaml:"scene"`
+	SceneUndo *bool `yaml:"scene_undo"`
+	LightZone *struct {
+		ID         *string           `yaml:"id"`
+		AID        *string           `yaml:"aid"`
+		Selector   *feature.Selector `yaml:"selector"`
+		OnOff      *string           `yaml:"on_off"`
+		Brightness *float64          `yaml:"brightness"`
+		Transition string            `yaml:"transition"`
+	} `yaml:"light_zone"`
+	Outlet *struct {
+		ID       *string           `yaml:"id"`
+		AID      *string           `yaml:"aid"`
+		Selector *feature.Selector `yaml:"selector"`
+		OnOff    *string           `yaml:"on_off"`
+	} `yaml:"outlet"`
+	Switch *struct {
+		ID       *string           `yaml:"id"`
+		AID      *string           `yaml:"aid"`
+		Selector *feature.Selector `yaml:"selector"`
+		OnOff    *string           `yaml:"on_off"`
+	} `yaml:"switch"`
+	WindowTreatment *struct {
+		ID         *string           `yaml:"id"`
+		AID        *string           `yaml:"aid"`
+		Selector   *feature.Selector `yaml:"selector"`
+		OpenClosed *string           `yaml:"open_closed"`
+		Offset     *float64          `yaml:"offset"`
+	} `yaml:"window_treatment"`
+	HeatZone *struct {
+		ID         *string           `yaml:"id"`
+		AID        *string           `yaml:"aid"`
+		Selector   *feature.Selector `yaml:"selector"`
+		TargetTemp *float64          `yaml:"target_temp"`
+	} `yaml:"heat_zone"`
+	Delay     string     `yaml:"delay"`
+	WaitUntil *waitUntil `yaml:"wait_until"`
+
+	// For restores the previous values of the features changed by the action after the duration
+	For string `yaml:"for"`
+
+	delay, holdFor time.Duration
+}
+
+// triggerIntermediate is a single trigger, an automation can have one trigger or a list of triggers
+type triggerIntermediate struct {
+	Time *struct {
+		At   string `yaml:"at"`
+		Cron string `yaml:"cron"`
+		Days string `yaml:"days"`
+	} `yaml:"time"`
+	Feature *struct {
+		ID        *string    `yaml:"id"`
+		AID       *string    `yaml:"aid"`
+		Condition *condition `yaml:"condition"`
+		Count     int        `yaml:"count"`
+		Duration  int        `yaml:"duration"`
+		For       string     `yaml:"for"`
+	} `yaml:"feature"`
+	Event *struct {
+		Type       string  `yaml:"type"`
+		Login      *string `yaml:"login"`
+		Success    *bool   `yaml:"success"`
+		Device     *string `yaml:"device"`
+		Automation *string `yaml:"automation"`
+		LastClient bool    `yaml:"last_client"`
+	} `yaml:"event"`
 }
 
 // LoadAutomation loads all of the automation files from the specified path
@@ -217,6 +358,7 @@ func LoadAutomation(sys automationSys, path string) (map[string]*Automation, err
 			log.E("automation - failed to create automation: %s, %s", fullPath, err)
 			continue
 		}
+		auto.Path = fullPath
 		autos[auto.Name] = auto
 	}
 	return autos, nil
@@ -224,6 +366,14 @@ func LoadAutomation(sys automationSys, path string) (map[string]*Automation, err
 
 // NewAutomation creates a new automation instance
 func NewAutomation(sys automationSys, config string) (*Automation, error) {
+	auto, err := newAutomation(sys, config)
+	if err != nil {
+		return nil, newAutomationError(config, err)
+	}
+	return auto, nil
+}
+
+func newAutomation(sys automationSys, config string) (*Automation, error) {
 
 	var auto automationIntermediate
 	err := yaml.Unmarshal([]byte(config), &auto)
@@ -233,15 +383,19 @@ func NewAutomation(sys automationSys, config string) (*Automation, error) {
 	}
 
 	if auto.Name == "" {
-		return nil, fmt.Errorf("missing name key, all automation must have a name")
+		return nil, &AutomationError{Key: "name", Msg: "missing name key, all automation must have a name"}
+	}
+
+	if auto.Trigger == nil && len(auto.Triggers) == 0 {
+		return nil, &AutomationError{Key: "trigger", Msg: "missing trigger key, trigger must be defined"}
 	}
 
-	if auto.Trigger == nil {
-		return nil, fmt.Errorf("missing trigger key, trigger must be defined")
+	if auto.Trigger != nil && len(auto.Triggers) > 0 {
+		return nil, &AutomationError{Key: "triggers", Msg: "automation can have a trigger or triggers key, not both"}
 	}
 
 	if len(auto.Actions) == 0 {
-		return nil, fmt.Errorf("missing actions key, no actions specified")
+		return nil, &AutomationError{Key: "actions", Msg: "missing actions key, no actions specified"}
 	}
 
 	// Defaults to true if not present
@@ -250,6 +404,10 @@ func NewAutomation(sys automationSys, config string) (*Automation, error) {
 		*auto.Enabled = true
 	}
 
+	if err = parseActionTiming(sys, auto); err != nil {
+		return nil, err
+	}
+
 	// We parse the actions, but don't use them here, they are built just to make sure
 	// there are no syntax issues, but we generate commands at the time the trigger
 	// fires to make sure we have the latest state. For example if the user has written
@@ -267,185 +425,296 @@ func NewAutomation(sys automationSys, config string) (*Automation, error) {
 		// Automation doesn't have a permanent ID since we load them from files each time the
 		// system starts, we give it a temp ID so that the client can reference it in API calls
 		// but it is called TempID since you shouldn't store it for any reason
-		TempID:  slugify.Slugify(auto.Name),
-		Enabled: *auto.Enabled,
+		TempID:    slugify.Slugify(auto.Name),
+		Enabled:   *auto.Enabled,
+		Retrigger: auto.Retrigger,
+		Script:    config,
+		sys:       sys,
+		config:    auto,
 	}
 
-	// This is called when the trigger triggers, we build the commands at this point
-	triggered := func() {
-		actions, err := parseActions(sys, auto)
+	if auto.OnlyIf != nil {
+		if err = parseCondition(sys, nil, auto.OnlyIf, "only_if"); err != nil {
+			return nil, err
+		}
+		if t := auto.OnlyIf.transition(); t != nil {
+			return nil, &AutomationError{
+				Key: "only_if",
+				Msg: fmt.Sprintf("only_if can't contain a transition: %s, use a feature trigger", t),
+			}
+		}
+	}
+
+	throttle, err := parseThrottle(auto)
+	if err != nil {
+		return nil, err
+	}
+
+	catchUp, err := parseCatchUp(auto)
+	if err != nil {
+		return nil, err
+	}
+
+	// This is called when the trigger triggers, we build the commands at this point. ti is the trigger
+	// that fired and source describes it, chain contains the names of the automation that caused this
+	// automation to trigger, if it was triggered by another automation triggering
+	fire := func(ti *triggerIntermediate, source string, chain []string) {
+		rec := finalAuto.newRunRecorder(source, chain)
+		if ti.Feature != nil {
+			rec.triggerCondition(ti.Feature.Condition, ti.Feature.For)
+		}
+		if auto.OnlyIf != nil {
+			failed := auto.OnlyIf.failed(nil, finalAuto.now())
+			rec.condition("only_if", auto.OnlyIf, failed)
+			if failed != nil {
+				finalAuto.skip(rec, "only_if condition is false: "+failed.String())
+				return
+			}
+		}
+
+		steps, err := parseSteps(sys, auto)
 		if err != nil {
 			log.V("unable to build commands for automation: %s. %s", finalAuto.Name, err)
+			rec.finish(RunStatusStopped, "unable to build commands: "+err.Error(), finalAuto.now())
 			return
 		}
+		finalAuto.run(steps, chain, rec)
+	}
 
-		if finalAuto.Triggered != nil {
-			finalAuto.Triggered(actions)
+	// fireFrom returns the function called when the trigger fires, if the automation is throttled the
+	// throttle decides if the automation runs
+	fireFrom := func(ti *triggerIntermediate) func(chain []string) {
+		source := triggerSummary(ti)
+		return func(chain []string) {
+			if throttle == nil {
+				fire(ti, source, chain)
+				return
+			}
+			throttle.fire(func() { fire(ti, source, chain) })
 		}
 	}
 
-	trigger, err := parseTrigger(sys, auto, triggered)
-	if err != nil {
-		return nil, err
+	if auto.Trigger != nil {
+		finalAuto.Trigger, err = parseTrigger(sys, auto.Name, auto.Trigger, "trigger", fireFrom(auto.Trigger))
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		multi := &MultiTrigger{}
+		for i, t := range auto.Triggers {
+			trigger, err := parseTrigger(sys, auto.Name, t, fmt.Sprintf("triggers[%d]", i), fireFrom(t))
+			if err != nil {
+				return nil, err
+			}
+			multi.Triggers = append(multi.Triggers, trigger)
+		}
+		finalAuto.Trigger = multi
+	}
+
+	if auto.CatchUp != nil {
+		timeTriggers := 0
+		walkTriggers(finalAuto.Trigger, func(trigger Trigger) {
+			if t, ok := trigger.(*TimeTrigger); ok {
+				t.CatchUp = catchUp
+				timeTriggers++
+			}
+		})
+		if timeTriggers == 0 {
+			return nil, &AutomationError{Key: "catch_up", Msg: "catch_up can only be used with a time trigger"}
+		}
 	}
-	finalAuto.Trigger = trigger
 
+	if throttle != nil {
+		throttle.trigger = finalAuto.Trigger
+		throttle.auto = finalAuto
+		finalAuto.Trigger = throttle
+	}
 	return finalAuto, nil
 }
 
+// parseActions returns the commands generated by all of the actions, ignoring any delays or waits
 func parseActions(sys automationSys, auto automationIntermediate) (*CommandGroup, error) {
+	steps, err := parseSteps(sys, auto)
+	if err != nil {
+		return nil, err
+	}
 
 	cmdGroup := CommandGroup{Desc: auto.Name}
+	for _, step := range steps {
+		cmdGroup.Cmds = append(cmdGroup.Cmds, step.cmds...)
+	}
+	return &cmdGroup, nil
+}
 
-	for _, action := range auto.Actions {
-		if action.Scene != nil {
-			scene := sys.SceneByID(action.Scene.ID)
-			if scene == nil {
-				return nil, fmt.Errorf("invalid scene ID: %s", action.Scene.ID)
-			}
+// parseSteps returns a step for each of the actions, containing the commands generated by the action
+// or how long the action pauses the execution of the following actions
+func parseSteps(sys automationSys, auto automationIntermediate) ([]*actionStep, error) {
+	var steps []*actionStep
+	for i := range auto.Actions {
+		action := &auto.Actions[i]
+		if action.Delay != "" || action.WaitUntil != nil {
+			steps = append(steps, &actionStep{delay: action.delay, wait: action.WaitUntil})
+			continue
+		}
 
-			cmdGroup.Cmds = append(cmdGroup.Cmds, &cmd.SceneSet{
-				ID:        sys.NewID(),
-				SceneID:   scene.ID,
-				SceneName: scene.Name,
-			})
-		} else if action.LightZone != nil {
-			lz := action.LightZone
-			if lz.ID == nil && lz.AID == nil {
-				// The user did not specify an ID, so we apply the attributes to all light zones
-				lightZones := sys.FeaturesByType(feature.FTLightZone)
-				if len(lightZones) == 0 {
-					continue
-				}
+		cmds, err := buildActionCommands(sys, i, action)
+		if err != nil {
+			return nil, err
+		}
+		steps = append(steps, &actionStep{cmds: cmds, holdFor: action.holdFor})
+	}
+	return steps, nil
+}
 
-				for _, zn := range lightZones {
-					command := buildLightZoneCommand(zn, lz.OnOff, lz.Brightness)
-					if command == nil {
-						continue
-					}
-					cmdGroup.Cmds = append(cmdGroup.Cmds, command)
-				}
-			} else {
-				zn, err := getFeature(sys, lz.ID, lz.AID)
-				if err != nil {
-					return nil, err
-				}
+// buildActionCommands returns the commands for an action that sets the state of features, i is the
+// index of the action in the actions list
+func buildActionCommands(sys automationSys, i int, action *actionIntermediate) ([]cmd.Command, error) {
+	if action.Scene != nil {
+		scene := sys.SceneByID(action.Scene.ID)
+		if scene == nil {
+			return nil, actionError(i, "scene", fmt.Errorf("invalid scene ID: %s", action.Scene.ID))
+		}
 
-				command := buildLightZoneCommand(zn, lz.OnOff, lz.Brightness)
-				// command might not apply to this particular zone
-				if command == nil {
-					continue
-				}
-				cmdGroup.Cmds = append(cmdGroup.Cmds, command)
-			}
-		} else if action.WindowTreatment != nil {
-			if action.WindowTreatment.ID == nil && action.WindowTreatment.AID == nil {
-				// The user did not specify an ID, so we apply the attributes to all window treatments
-				treatments := sys.FeaturesByType(feature.FTWindowTreatment)
-				if len(treatments) == 0 {
-					continue
-				}
+		return []cmd.Command{&cmd.SceneSet{
+			ID:        sys.NewID(),
+			SceneID:   scene.ID,
+			SceneName: scene.Name,
+		}}, nil
+	}
 
-				for _, wt := range treatments {
-					command := buildWindowTreatmentCommand(wt, action.WindowTreatment.OpenClosed, action.WindowTreatment.Offset)
-					if command == nil {
-						continue
-					}
-					cmdGroup.Cmds = append(cmdGroup.Cmds, command)
-				}
-			} else {
-				wt, err := getFeature(sys, action.WindowTreatment.ID, action.WindowTreatment.AID)
-				if err != nil {
-					return nil, err
-				}
+	if action.SceneUndo != nil {
+		if !*action.SceneUndo {
+			return nil, actionError(i, "scene_undo", fmt.Errorf("scene_undo must be true"))
+		}
+		return []cmd.Command{&cmd.SceneUndo{ID: sys.NewID()}}, nil
+	}
 
-				command := buildWindowTreatmentCommand(wt, action.WindowTreatment.OpenClosed, action.WindowTreatment.Offset)
-				if command == nil {
-					continue
-				}
-				cmdGroup.Cmds = append(cmdGroup.Cmds, command)
+	var features []*feature.Feature
+	var build func(f *feature.Feature) cmd.Command
+	var err error
+	switch {
+	case action.LightZone != nil:
+		lz := action.LightZone
+		var transition time.Duration
+		if lz.Transition != "" {
+			transition, err = parsePositiveDuration(fmt.Sprintf("actions[%d].light_zone.transition", i), lz.Transition)
+			if err != nil {
+				return nil, err
 			}
-		} else if action.Outlet != nil {
-			if action.Outlet.ID == nil && action.Outlet.AID == nil {
-				outlets := sys.FeaturesByType(feature.FTOutlet)
-				if len(outlets) == 0 {
-					continue
-				}
+		}
+		features, err = actionFeatures(sys, i, "light_zone", feature.FTLightZone, lz.ID, lz.AID, lz.Selector)
+		build = func(f *feature.Feature) cmd.Command {
+			return buildLightZoneCommand(f, lz.OnOff, lz.Brightness, transition)
+		}
+	case action.WindowTreatment != nil:
+		wt := action.WindowTreatment
+		features, err = actionFeatures(sys, i, "window_treatment", feature.FTWindowTreatment, wt.ID, wt.AID, wt.Selector)
+		build = func(f *feature.Feature) cmd.Command {
+			return buildWindowTreatmentCommand(f, wt.OpenClosed, wt.Offset)
+		}
+	case action.Outlet != nil:
+		o := action.Outlet
+		features, err = actionFeatures(sys, i, "outlet", feature.FTOutlet, o.ID, o.AID, o.Selector)
+		build = func(f *feature.Feature) cmd.Command {
+			return buildOutletCommand(f, o.OnOff)
+		}
+	case action.Switch != nil:
+		sw := action.Switch
+		features, err = actionFeatures(sys, i, "switch", feature.FTSwitch, sw.ID, sw.AID, sw.Selector)
+		build = func(f *feature.Feature) cmd.Command {
+			return buildSwitchCommand(f, sw.OnOff)
+		}
+	case action.HeatZone != nil:
+		hz := action.HeatZone
+		features, err = actionFeatures(sys, i, "heat_zone", feature.FTHeatZone, hz.ID, hz.AID, hz.Selector)
+		build = func(f *feature.Feature) cmd.Command {
+			return buildHeatZoneCommand(f, hz.TargetTemp)
+		}
+	default:
+		return nil, &AutomationError{Key: fmt.Sprintf("actions[%d]", i), Msg: "unsupported action type"}
+	}
+	if err != nil {
+		return nil, err
+	}
 
-				for _, outlet := range outlets {
-					command := buildOutletCommand(outlet, action.Outlet.OnOff)
-					if command == nil {
-						continue
-					}
-					cmdGroup.Cmds = append(cmdGroup.Cmds, command)
-				}
-			} else {
-				outlet, err := getFeature(sys, action.Outlet.ID, action.Outlet.AID)
-				if err != nil {
-					return nil, err
-				}
-				command := buildOutletCommand(outlet, action.Outlet.OnOff)
-				if command == nil {
-					continue
-				}
-				cmdGroup.Cmds = append(cmdGroup.Cmds, command)
-			}
-		} else if action.Switch != nil {
-			if action.Switch.ID == nil && action.Switch.AID == nil {
-				switches := sys.FeaturesByType(feature.FTSwitch)
-				if len(switches) == 0 {
-					continue
-				}
+	var cmds []cmd.Command
+	for _, f := range features {
+		// command might not apply to this particular feature
+		if command := build(f); command != nil {
+			cmds = append(cmds, command)
+		}
+	}
+	return cmds, nil
+}
 
-				for _, sw := range switches {
-					command := buildSwitchCommand(sw, action.Switch.OnOff)
-					if command == nil {
-						continue
-					}
-					cmdGroup.Cmds = append(cmdGroup.Cmds, command)
-				}
-			} else {
-				sw, err := getFeature(sys, action.Switch.ID, action.Switch.AID)
-				if err != nil {
-					return nil, err
-				}
-				command := buildSwitchCommand(sw, action.Switch.OnOff)
-				if command == nil {
-					continue
-				}
-				cmdGroup.Cmds = append(cmdGroup.Cmds, command)
+// actionFeatures returns the features an action applies to. If the action specifies an id or aid it is
+// that feature, if it has a selector it is all of the features of the type that match the selector,
+// otherwise it is all of the features of the type
+func actionFeatures(
+	sys automationSys, i int, actionType, featureType string, id, aid *string, sel *feature.Selector,
+) ([]*feature.Feature, error) {
+	if sel != nil {
+		key := fmt.Sprintf("actions[%d].%s.selector", i, actionType)
+		if id != nil || aid != nil {
+			return nil, &AutomationError{Key: key, Msg: "selector can not be used with the id or aid keys"}
+		}
+		if sel.Type != "" && sel.Type != featureType {
+			return nil, &AutomationError{
+				Key: key + ".type",
+				Msg: fmt.Sprintf("invalid type: %s, %s actions can only select %s features", sel.Type, actionType, featureType),
 			}
-		} else if action.HeatZone != nil {
-			if action.HeatZone.ID == nil && action.HeatZone.AID == nil {
-				zones := sys.FeaturesByType(feature.FTHeatZone)
-				if len(zones) == 0 {
-					continue
-				}
+		}
 
-				for _, hz := range zones {
-					command := buildHeatZoneCommand(hz, action.HeatZone.TargetTemp)
-					if command == nil {
-						continue
-					}
-					cmdGroup.Cmds = append(cmdGroup.Cmds, command)
-				}
-			} else {
-				hz, err := getFeature(sys, action.HeatZone.ID, action.HeatZone.AID)
-				if err != nil {
-					return nil, err
-				}
-				command := buildHeatZoneCommand(hz, action.HeatZone.TargetTemp)
-				if command == nil {
-					continue
-				}
-				cmdGroup.Cmds = append(cmdGroup.Cmds, command)
-			}
-		} else {
-			return nil, fmt.Errorf("unsupported action type")
+		// The selector is shared by each execution of the automation, so don't modify it
+		typed := *sel
+		typed.Type = featureType
+		if err := typed.Validate(); err != nil {
+			return nil, &AutomationError{Key: key, Msg: err.Error()}
 		}
+		return sys.SelectFeatures(&typed), nil
 	}
 
-	return &cmdGroup, nil
+	if id == nil && aid == nil {
+		// The user did not specify an ID, so we apply the attributes to all features of the type
+		return sortedFeatures(sys.FeaturesByType(featureType)), nil
+	}
+
+	f, err := getFeature(sys, id, aid)
+	if err != nil {
+		return nil, actionError(i, actionType, err)
+	}
+	return []*feature.Feature{f}, nil
+}
+
+// actionError returns an AutomationError for the action at the specified index in the actions list
+func actionError(i int, actionType string, err error) error {
+	return &AutomationError{Key: fmt.Sprintf("actions[%d].%s", i, actionType), Msg: err.Error()}
+}
+
+// sortedFeatures returns the features sorted by name, so that actions applied to all features of a
+// type generate their commands in the same order each time
+func sortedFeatures(features map[string]*feature.Feature) []*feature.Feature {
+	sorted := make(featuresByName, 0, len(features))
+	for _, f := range features {
+		sorted = append(sorted, f)
+	}
+	sort.Sort(sorted)
+	return sorted
+}
+
+type featuresByName []*feature.Feature
+
+func (slice featuresByName) Len() int {
+	return len(slice)
+}
+func (slice featuresByName) Less(i, j int) bool {
+	if slice[i].Name == slice[j].Name {
+		return slice[i].ID < slice[j].ID
+	}
+	return slice[i].Name < slice[j].Name
+}
+func (slice featuresByName) Swap(i, j int) {
+	slice[i], slice[j] = slice[j], slice[i]
 }
 
 func getFeature(sys automationSys, id, aid *string) (*feature.Feature, error) {
@@ -493,6 +762,7 @@ func buildOutletCommand(outlet *feature.Feature, onOffVal *string) cmd.Command {
 	onoff.Value = val
 	return &cmd.FeatureSetAttrs{
 		FeatureID:   outlet.ID,
+		FeatureType: outlet.Type,
 		FeatureName: outlet.Name,
 		Attrs:       feature.NewAttrs(onoff),
 	}
@@ -509,6 +779,7 @@ func buildHeatZoneCommand(hz *feature.Feature, targetTempVal *float64) cmd.Comma
 
 	return &cmd.FeatureSetAttrs{
 		FeatureID:   hz.ID,
+		FeatureType: hz.Type,
 		FeatureName: hz.Name,
 		Attrs:       feature.NewAttrs(targetTemp),
 	}
@@ -539,12 +810,15 @@ func buildSwitchCommand(sw *feature.Feature, onOffVal *string) cmd.Command {
 	onoff.Value = val
 	return &cmd.FeatureSetAttrs{
 		FeatureID:   sw.ID,
+		FeatureType: sw.Type,
 		FeatureName: sw.Name,
 		Attrs:       feature.NewAttrs(onoff),
 	}
 }
 
-func buildLightZoneCommand(zn *feature.Feature, onOffVal *string, brightnessVal *float64) cmd.Command {
+func buildLightZoneCommand(
+	zn *feature.Feature, onOffVal *string, brightnessVal *float64, transition time.Duration,
+) cmd.Command {
 	onoff, brightness, _ := feature.LightZoneCloneAttrs(zn)
 
 	// NOTE: If we get an error we just log it an move on, since we want to try to execute as much
@@ -563,7 +837,7 @@ func buildLightZoneCommand(zn *feature.Feature, onOffVal *string, brightnessVal
 		onoff = nil
 	}
 
-	if brightnessVal != nil {
+	if brightnessVal != nil && brightness != nil {
 		brightness.Value = float32(*brightnessVal)
 	} else {
 		brightness = nil
@@ -571,8 +845,10 @@ func buildLightZoneCommand(zn *feature.Feature, onOffVal *string, brightnessVal
 
 	return &cmd.FeatureSetAttrs{
 		FeatureID:   zn.ID,
+		FeatureType: zn.Type,
 		FeatureName: zn.Name,
 		Attrs:       feature.NewAttrs(onoff, brightness),
+		Transition:  transition,
 	}
 }
 
@@ -601,66 +877,101 @@ func buildWindowTreatmentCommand(wt *feature.Feature, openClosedVal *string, off
 
 	return &cmd.FeatureSetAttrs{
 		FeatureID:   wt.ID,
+		FeatureType: wt.Type,
 		FeatureName: wt.Name,
 		Attrs:       feature.NewAttrs(openclosed, offset),
 	}
 }
 
-func parseCondition(f *feature.Feature, c *condition) error {
-	if c.AttrLocalID != nil {
-		c.feature = f
-
-		_, ok := f.Attrs[*c.AttrLocalID]
-		if !ok {
-			return fmt.Errorf("invalid attr key: %s", *c.AttrLocalID)
-		}
-
-		if c.Op == nil {
-			return fmt.Errorf("missing op key")
-		}
-
-		if c.Value == nil {
-			return fmt.Errorf("missing value key")
-		}
+// parseTrigger creates the trigger, fire is called with the names of the automation that caused the
+// trigger to fire, which is only set for event triggers that respond to other automation triggering.
+// key is the location of the trigger in the script, used to report errors
+func parseTrigger(sys automationSys, name string, ti *triggerIntermediate, key string, fire func(chain []string)) (Trigger, error) {
+	if ti == nil {
+		return nil, &AutomationError{Key: key, Msg: "trigger is empty"}
+	}
 
-		return nil
-	} else {
-		return fmt.Errorf("condition is missing an 'attr' key")
+	triggered := func() {
+		fire(nil)
 	}
 
-	return nil
-}
+	if ti.Feature != nil {
+		if ti.Feature.Condition == nil {
+			return nil, &AutomationError{Key: key + ".feature", Msg: "feature trigger missing condition key"}
+		}
 
-func parseTrigger(sys automationSys, auto automationIntermediate, triggered func()) (Trigger, error) {
-	if auto.Trigger.Feature != nil {
-		if auto.Trigger.Feature.Condition == nil {
-			return nil, fmt.Errorf("feature trigger missing condition key")
+		ft, err := getFeature(sys, ti.Feature.ID, ti.Feature.AID)
+		if err != nil {
+			return nil, &AutomationError{Key: key + ".feature", Msg: err.Error()}
 		}
 
-		ft, err := getFeature(sys, auto.Trigger.Feature.ID, auto.Trigger.Feature.AID)
+		err = parseCondition(sys, ft, ti.Feature.Condition, key+".feature.condition")
 		if err != nil {
 			return nil, err
 		}
 
-		err = parseCondition(ft, auto.Trigger.Feature.Condition)
+		var holdFor time.Duration
+		if ti.Feature.For != "" {
+			holdFor, err = time.ParseDuration(ti.Feature.For)
+			if err != nil || holdFor <= 0 {
+				return nil, &AutomationError{
+					Key: key + ".feature.for",
+					Msg: fmt.Sprintf("invalid for value: %s, must be a duration such as 30s, 10m or 1h30m",
+						ti.Feature.For),
+				}
+			}
+			if ti.Feature.Count > 0 {
+				return nil, &AutomationError{Key: key + ".feature.for", Msg: "for can not be used with the count key"}
+			}
+			if t := ti.Feature.Condition.transition(); t != nil {
+				return nil, &AutomationError{
+					Key: key + ".feature.for",
+					Msg: fmt.Sprintf("for can not be used with a transition: %s", t),
+				}
+			}
+		}
+
 		return &FeatureTrigger{
-			Count:     auto.Trigger.Feature.Count,
-			Duration:  time.Duration(auto.Trigger.Feature.Duration) * time.Millisecond,
+			FeatureID: ft.ID,
+			Count:     ti.Feature.Count,
+			Duration:  time.Duration(ti.Feature.Duration) * time.Millisecond,
+			For:       holdFor,
+			Time:      clock.SystemTime{},
 			Triggered: triggered,
-			Condition: auto.Trigger.Feature.Condition,
+			Condition: ti.Feature.Condition,
 		}, nil
 
-	} else if auto.Trigger.Time != nil {
-		t := auto.Trigger.Time
+	} else if ti.Time != nil {
+		t := ti.Time
 
 		var mode string
 		var at time.Time
-		switch t.At {
-		case "sunrise":
-			mode = TimeTriggerModeSunrise
-		case "sunset":
-			mode = TimeTriggerModeSunset
-		default:
+		var offset time.Duration
+		var schedule *CronSchedule
+		if t.Cron != "" {
+			if t.At != "" {
+				return nil, &AutomationError{Key: key + ".time", Msg: "time trigger can have an at or cron key, not both"}
+			}
+			if t.Days != "" {
+				return nil, &AutomationError{
+					Key: key + ".time.days",
+					Msg: "days is not supported with the cron key, use the day of week field of the cron expression",
+				}
+			}
+
+			var err error
+			schedule, err = ParseCron(t.Cron)
+			if err != nil {
+				return nil, &AutomationError{Key: key + ".time.cron", Msg: err.Error()}
+			}
+			mode = TimeTriggerModeCron
+		} else if solarMode, solarOffset, ok, err := parseSolarTime(t.At); ok {
+			if err != nil {
+				return nil, &AutomationError{Key: key + ".time.at", Msg: err.Error()}
+			}
+			mode = solarMode
+			offset = solarOffset
+		} else {
 			mode = TimeTriggerModeExact
 
 			// This is a time, we support just a time or a datetime:
@@ -675,50 +986,69 @@ func parseTrigger(sys automationSys, auto automationIntermediate, triggered func
 				at, err = time.Parse("15:04:05 MST", t.At+" "+zoneName)
 
 				if err != nil {
-					return nil, fmt.Errorf("invalid time input: %s, must be either HH:MM:SS or yyyy/MM/dd HH:mm:ss", t.At)
+					return nil, &AutomationError{
+						Key: key + ".time.at",
+						Msg: fmt.Sprintf("invalid time input: %s, must be either HH:MM:SS or yyyy/MM/dd HH:mm:ss", t.At),
+					}
 				}
 			}
 		}
 
-		var days uint32
-		if strings.Index(t.Days, "sun") != -1 {
-			days |= TimeTriggerDaysSun
-		}
-		if strings.Index(t.Days, "mon") != -1 {
-			days |= TimeTriggerDaysMon
-		}
-		if strings.Index(t.Days, "tues") != -1 {
-			days |= TimeTriggerDaysTues
-		}
-		if strings.Index(t.Days, "wed") != -1 {
-			days |= TimeTriggerDaysWed
-		}
-		if strings.Index(t.Days, "thurs") != -1 {
-			days |= TimeTriggerDaysThurs
-		}
-		if strings.Index(t.Days, "fri") != -1 {
-			days |= TimeTriggerDaysFri
-		}
-		if strings.Index(t.Days, "sat") != -1 {
-			days |= TimeTriggerDaysSat
-		}
+		days := parseDays(t.Days)
 		if t.Days == "" {
 			days |= TimeTriggerDaysSun | TimeTriggerDaysMon | TimeTriggerDaysTues | TimeTriggerDaysWed |
 				TimeTriggerDaysThurs | TimeTriggerDaysFri | TimeTriggerDaysSat
 		}
 
+		latitude, longitude := sys.Coordinates()
 		timeTrigger := &TimeTrigger{
-			Name:      auto.Name,
-			At:        at,
-			Mode:      mode,
-			Days:      days,
-			Time:      clock.SystemTime{},
-			Triggered: triggered,
+			Name:        name,
+			At:          at,
+			Mode:        mode,
+			Offset:      offset,
+			Days:        days,
+			Cron:        schedule,
+			Latitude:    latitude,
+			Longitude:   longitude,
+			Time:        clock.SystemTime{},
+			Triggered:   triggered,
+			RunKey:      name + "/" + key,
+			Description: triggerSummary(ti),
 		}
 		return timeTrigger, nil
+	} else if ti.Event != nil {
+		return parseEventTrigger(name, ti, key, fire)
 	} else {
-		return nil, fmt.Errorf("unsupported trigger type")
+		return nil, &AutomationError{Key: key, Msg: "unsupported trigger type"}
+	}
+}
+
+// parseSolarTime parses a time relative to a solar event, such as sunset-30m or civil_dawn+1h15m. The
+// first bool return value is false if the value is not relative to a solar event, in which case the
+// value should be parsed as an exact time
+func parseSolarTime(at string) (string, time.Duration, bool, error) {
+	at = strings.TrimSpace(at)
+	mode := at
+	offsetStr := ""
+	if i := strings.IndexAny(at, "+-"); i != -1 {
+		mode = strings.TrimSpace(at[:i])
+		offsetStr = strings.Replace(at[i:], " ", "", -1)
+	}
+
+	if !isSolarMode(mode) {
+		return "", 0, false, nil
+	}
+
+	if offsetStr == "" {
+		return mode, 0, true, nil
+	}
+
+	offset, err := time.ParseDuration(offsetStr)
+	if err != nil {
+		return "", 0, true, fmt.Errorf("invalid offset: %s, must be a duration such as %s-30m or %s+1h15m",
+			offsetStr, mode, mode)
 	}
+	return mode, offset, true, nil
 }
 
 // When we unmarshal the scripts, the yaml parser will either return float64 or int for numbers
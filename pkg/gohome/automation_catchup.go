@@ -0,0 +1,125 @@
+package gohome
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/markdaws/gohome/pkg/log"
+)
+
+// The catch_up policies
+const (
+	// CatchUpSkip - runs missed while the trigger was not running are skipped, this is the default
+	CatchUpSkip = "skip"
+
+	// CatchUpRunOnceIfMissedWithin - the most recent missed run is executed when the trigger starts,
+	// if it was missed within the duration
+	CatchUpRunOnceIfMissedWithin = "run_once_if_missed_within"
+)
+
+// ScheduledRuns persists the last time each time trigger was scheduled to run, so that when the server
+// starts the triggers can tell which runs were missed while it was down
+type ScheduledRuns struct {
+	// Path is the path of the JSON file the times are saved to, if empty the times are only kept in memory
+	Path string
+
+	mutex sync.Mutex
+	runs  map[string]time.Time
+}
+
+// LoadScheduledRuns loads the times saved in the file at path, it is not an error if the file does
+// not exist yet
+func LoadScheduledRuns(path string) (*ScheduledRuns, error) {
+	s := &ScheduledRuns{Path: path, runs: make(map[string]time.Time)}
+
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read scheduled runs file: %s", err)
+	}
+	if err = json.Unmarshal(b, &s.runs); err != nil {
+		return nil, fmt.Errorf("failed to parse scheduled runs file: %s, %s", path, err)
+	}
+	return s, nil
+}
+
+// Last returns the last time the trigger with the key was scheduled to run, the bool return value is
+// false if nothing has been recorded for the trigger
+func (s *ScheduledRuns) Last(key string) (time.Time, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	at, ok := s.runs[key]
+	return at, ok
+}
+
+// Record saves the time the trigger with the key was scheduled to run
+func (s *ScheduledRuns) Record(key string, at time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.runs == nil {
+		s.runs = make(map[string]time.Time)
+	}
+	s.runs[key] = at
+	if s.Path == "" {
+		return
+	}
+
+	b, err := json.MarshalIndent(s.runs, "", "  ")
+	if err != nil {
+		log.E("ScheduledRuns - failed to encode scheduled runs: %s", err)
+		return
+	}
+
+	// Write to a temp file then rename so that a crash while writing can't corrupt the file
+	tmp := s.Path + ".tmp"
+	if err = ioutil.WriteFile(tmp, b, 0644); err != nil {
+		log.E("ScheduledRuns - failed to write scheduled runs file: %s", err)
+		return
+	}
+	if err = os.Rename(tmp, s.Path); err != nil {
+		log.E("ScheduledRuns - failed to write scheduled runs file: %s", err)
+	}
+}
+
+// parseCatchUp returns the catch up window of the automation, 0 if missed runs are skipped. The value is
+// either skip or a map with the run_once_if_missed_within key
+func parseCatchUp(auto automationIntermediate) (time.Duration, error) {
+	switch v := auto.CatchUp.(type) {
+	case nil:
+		return 0, nil
+	case string:
+		if v == CatchUpSkip {
+			return 0, nil
+		}
+	case map[interface{}]interface{}:
+		var window time.Duration
+		for key, value := range v {
+			name := fmt.Sprintf("%v", key)
+			if name != CatchUpRunOnceIfMissedWithin {
+				return 0, &AutomationError{Key: "catch_up." + name, Msg: fmt.Sprintf("unknown key: %s", name)}
+			}
+
+			var err error
+			window, err = parsePositiveDuration("catch_up."+name, fmt.Sprintf("%v", value))
+			if err != nil {
+				return 0, err
+			}
+		}
+		if window > 0 {
+			return window, nil
+		}
+	}
+
+	return 0, &AutomationError{
+		Key: "catch_up",
+		Msg: fmt.Sprintf("invalid catch_up value, must be either %s or have a %s key e.g. %s: 2h",
+			CatchUpSkip, CatchUpRunOnceIfMissedWithin, CatchUpRunOnceIfMissedWithin),
+	}
+}
@@ -0,0 +1,134 @@
+package gohome_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-home-iot/event-bus"
+	"github.com/markdaws/gohome/pkg/gohome"
+	"github.com/stretchr/testify/require"
+)
+
+// catchUpTrigger returns a trigger that fires at 19:00 each day, its timers never expire so it can
+// only fire by catching up a missed run. last is the last recorded run, zero if there is no record
+func catchUpTrigger(now, last time.Time, window time.Duration) (*gohome.TimeTrigger, chan time.Time) {
+	mt := &MockTime{
+		now:   now,
+		after: func(mt *MockTime, d time.Duration) <-chan time.Time { return make(chan time.Time) },
+	}
+
+	runs := &gohome.ScheduledRuns{}
+	if !last.IsZero() {
+		runs.Record("Lights/trigger", last)
+	}
+
+	fired := make(chan time.Time, 10)
+	trigger := &gohome.TimeTrigger{
+		Time: mt,
+		Mode: gohome.TimeTriggerModeExact,
+		At:   time.Date(0, 1, 1, 19, 0, 0, 0, time.UTC),
+		Days: gohome.TimeTriggerDaysSun | gohome.TimeTriggerDaysMon | gohome.TimeTriggerDaysTues |
+			gohome.TimeTriggerDaysWed | gohome.TimeTriggerDaysThurs | gohome.TimeTriggerDaysFri |
+			gohome.TimeTriggerDaysSat,
+		CatchUp:   window,
+		Runs:      runs,
+		RunKey:    "Lights/trigger",
+		Triggered: func() { fired <- mt.Now() },
+	}
+
+	ch := make(chan evtbus.Event)
+	trigger.StartConsuming(ch)
+	return trigger, fired
+}
+
+func TestCatchUp(t *testing.T) {
+	now := time.Date(2016, time.December, 5, 20, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		last   time.Time
+		window time.Duration
+		fires  bool
+	}{
+		{"missed within the window", time.Date(2016, time.December, 4, 19, 0, 0, 0, time.UTC), 2 * time.Hour, true},
+		{"missed several days", time.Date(2016, time.December, 1, 19, 0, 0, 0, time.UTC), 2 * time.Hour, true},
+		{"missed outside the window", time.Date(2016, time.December, 4, 19, 0, 0, 0, time.UTC), 30 * time.Minute, false},
+		{"skip", time.Date(2016, time.December, 4, 19, 0, 0, 0, time.UTC), 0, false},
+		{"nothing missed", time.Date(2016, time.December, 5, 19, 0, 0, 0, time.UTC), 2 * time.Hour, false},
+		{"no record", time.Time{}, 2 * time.Hour, false},
+	}
+
+	for _, test := range tests {
+		trigger, fired := catchUpTrigger(now, test.last, test.window)
+		select {
+		case at := <-fired:
+			require.True(t, test.fires, test.name)
+			require.Equal(t, now, at, test.name)
+		case <-time.After(100 * time.Millisecond):
+			require.False(t, test.fires, test.name)
+		}
+		trigger.StopConsuming()
+
+		// The time the trigger started is recorded so the same runs aren't caught up again
+		last, ok := trigger.Runs.Last("Lights/trigger")
+		require.True(t, ok, test.name)
+		require.Equal(t, now, last, test.name)
+	}
+}
+
+func TestScheduledRunsPersisted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gohome")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "scheduled_runs.json")
+	runs, err := gohome.LoadScheduledRuns(path)
+	require.Nil(t, err)
+	_, ok := runs.Last("Lights/trigger")
+	require.False(t, ok)
+
+	at := time.Date(2016, time.December, 5, 19, 0, 0, 0, time.UTC)
+	runs.Record("Lights/trigger", at)
+
+	runs, err = gohome.LoadScheduledRuns(path)
+	require.Nil(t, err)
+	last, ok := runs.Last("Lights/trigger")
+	require.True(t, ok)
+	require.True(t, at.Equal(last))
+}
+
+func TestCatchUpInvalid(t *testing.T) {
+	config := `
+name: Lights
+trigger:
+  %s
+catch_up: %s
+actions:
+  - switch:
+      aid: fan
+      on_off: 'on'
+`
+	tests := []struct {
+		trigger string
+		catchUp string
+		key     string
+	}{
+		{"time:\n    at: '19:00:00'", "always", "catch_up"},
+		{"time:\n    at: '19:00:00'", "\n  run_once_if_missed_within: soon", "catch_up.run_once_if_missed_within"},
+		{"time:\n    at: '19:00:00'", "\n  run_once_within: 2h", "catch_up.run_once_within"},
+		{"event:\n    type: server_started", "skip", "catch_up"},
+	}
+
+	h := newRunHarness(t)
+	for _, test := range tests {
+		_, err := gohome.NewAutomation(h.sys, fmt.Sprintf(config, test.trigger, test.catchUp))
+		require.NotNil(t, err, test.catchUp)
+		require.Equal(t, test.key, err.(*gohome.AutomationError).Key, test.catchUp)
+	}
+
+	_, err := gohome.NewAutomation(h.sys, fmt.Sprintf(config, "time:\n    at: '19:00:00'", "\n  run_once_if_missed_within: 2h"))
+	require.Nil(t, err)
+}
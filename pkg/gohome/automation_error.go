@@ -0,0 +1,305 @@
+package gohome
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// AutomationError is returned when an automation script is not valid. Key is the location of the
+// invalid value in the script, e.g. trigger.feature.condition.and[1]. Line and Column are the position
+// of the key in the script, starting at 1, they are 0 if the position is not known
+type AutomationError struct {
+	Key    string
+	Msg    string
+	Line   int
+	Column int
+}
+
+// Error returns a friendly error string
+func (e *AutomationError) Error() string {
+	var pos string
+	if e.Line > 0 {
+		pos = fmt.Sprintf("line %d", e.Line)
+		if e.Column > 0 {
+			pos += fmt.Sprintf(", column %d", e.Column)
+		}
+		pos += ": "
+	}
+
+	if e.Key == "" {
+		return pos + e.Msg
+	}
+	return fmt.Sprintf("%s%s: %s", pos, e.Key, e.Msg)
+}
+
+var yamlLineRegexp = regexp.MustCompile(`line (\d+):`)
+
+// newAutomationError converts the error returned when parsing the script in to an AutomationError
+// and sets the position of the error in the script, if it can be found
+func newAutomationError(script string, err error) *AutomationError {
+	autoErr, ok := err.(*AutomationError)
+	if !ok {
+		autoErr = &AutomationError{Msg: err.Error()}
+
+		// Syntax errors from the yaml parser include the line number in the message
+		if m := yamlLineRegexp.FindStringSubmatch(autoErr.Msg); m != nil {
+			autoErr.Line, _ = strconv.Atoi(m[1])
+		}
+		return autoErr
+	}
+
+	if autoErr.Key != "" && autoErr.Line == 0 {
+		if isJSONScript(script) {
+			autoErr.Line, autoErr.Column = locateJSONKey(script, autoErr.Key)
+		} else {
+			autoErr.Line, autoErr.Column = locateYAMLKey(script, autoErr.Key)
+		}
+	}
+	return autoErr
+}
+
+// isJSONScript returns true if the automation script is written in JSON instead of YAML
+func isJSONScript(script string) bool {
+	return strings.HasPrefix(strings.TrimSpace(script), "{")
+}
+
+// keyPathElem is one part of an error key e.g. and[1] is the and key, index 1
+type keyPathElem struct {
+	name  string
+	index int
+}
+
+// parseKeyPath splits a key such as trigger.feature.condition.and[1] in to its parts, index is -1 for
+// parts that are not list items
+func parseKeyPath(key string) []keyPathElem {
+	var path []keyPathElem
+	for _, part := range strings.Split(key, ".") {
+		elem := keyPathElem{name: part, index: -1}
+		if i := strings.Index(part, "["); i != -1 && strings.HasSuffix(part, "]") {
+			if index, err := strconv.Atoi(part[i+1 : len(part)-1]); err == nil {
+				elem.name = part[:i]
+				elem.index = index
+			}
+		}
+		path = append(path, elem)
+	}
+	return path
+}
+
+// yamlToken is a line in a yaml script. List items such as "- attr: onoff" are split in to two tokens,
+// the list item and the content of the item, which is indented by the size of the "- " prefix
+type yamlToken struct {
+	line   int
+	indent int
+	text   string
+	item   bool
+}
+
+func tokenizeYAML(script string) []yamlToken {
+	var tokens []yamlToken
+	for i, line := range strings.Split(script, "\n") {
+		text := strings.TrimLeft(line, " ")
+		indent := len(line) - len(text)
+		if strings.TrimSpace(text) == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		for text == "-" || strings.HasPrefix(text, "- ") {
+			tokens = append(tokens, yamlToken{line: i + 1, indent: indent, item: true})
+			rest := strings.TrimLeft(text[1:], " ")
+			indent += len(text) - len(rest)
+			text = rest
+		}
+		if text != "" {
+			tokens = append(tokens, yamlToken{line: i + 1, indent: indent, text: text})
+		}
+	}
+	return tokens
+}
+
+// yamlBlockEnd returns the index after the last token that is a child of the token at index i
+func yamlBlockEnd(tokens []yamlToken, i int) int {
+	parent := tokens[i]
+	j := i + 1
+	for ; j < len(tokens); j++ {
+		t := tokens[j]
+		if t.indent > parent.indent {
+			continue
+		}
+
+		// A list can have the same indent as the key that contains it
+		if !parent.item && t.item && t.indent == parent.indent {
+			continue
+		}
+		break
+	}
+	return j
+}
+
+// locateYAMLKey returns the line and column of the key in a yaml script. If the full key can't be found,
+// the position of the closest parent that can be found is returned, 0, 0 if nothing was found
+func locateYAMLKey(script, key string) (int, int) {
+	tokens := tokenizeYAML(script)
+	start, end := 0, len(tokens)
+	line, column := 0, 0
+
+	for _, elem := range parseKeyPath(key) {
+		// Find the key, it has to be at the same indent as the first key in the block
+		found := -1
+		childIndent := -1
+		for i := start; i < end; i++ {
+			t := tokens[i]
+			if t.item {
+				continue
+			}
+			if childIndent == -1 {
+				childIndent = t.indent
+			}
+			if t.indent == childIndent && (strings.HasPrefix(t.text, elem.name+":") ||
+				strings.HasPrefix(t.text, "'"+elem.name+"':") || strings.HasPrefix(t.text, `"`+elem.name+`":`)) {
+				found = i
+				break
+			}
+		}
+		if found == -1 {
+			break
+		}
+		line, column = tokens[found].line, tokens[found].indent+1
+		start, end = found+1, yamlBlockEnd(tokens, found)
+
+		if elem.index == -1 {
+			continue
+		}
+
+		// Find the nth list item inside the key
+		found = -1
+		itemIndent := -1
+		count := 0
+		for i := start; i < end; i++ {
+			t := tokens[i]
+			if !t.item {
+				continue
+			}
+			if itemIndent == -1 {
+				itemIndent = t.indent
+			}
+			if t.indent != itemIndent {
+				continue
+			}
+			if count == elem.index {
+				found = i
+				break
+			}
+			count++
+		}
+		if found == -1 {
+			break
+		}
+		line, column = tokens[found].line, tokens[found].indent+1
+		start, end = found+1, yamlBlockEnd(tokens, found)
+	}
+	return line, column
+}
+
+// locateJSONKey returns the line and column of the key in a JSON script. If the full key can't be found,
+// the position of the closest parent that can be found is returned, 0, 0 if nothing was found
+func locateJSONKey(script, key string) (int, int) {
+	// Flatten the key, e.g. actions[1].scene -> [actions 1 scene]
+	var target []string
+	for _, elem := range parseKeyPath(key) {
+		target = append(target, elem.name)
+		if elem.index != -1 {
+			target = append(target, strconv.Itoa(elem.index))
+		}
+	}
+
+	// level is a JSON object or array we are currently inside of
+	type level struct {
+		isArray   bool
+		expectKey bool
+		key       string
+		index     int
+	}
+	var stack []*level
+
+	// matches returns the number of elements in the target the current position matches
+	matches := func() int {
+		for i, l := range stack {
+			current := l.key
+			if l.isArray {
+				current = strconv.Itoa(l.index)
+			}
+			if i >= len(target) || target[i] != current {
+				return i
+			}
+		}
+		return len(stack)
+	}
+
+	dec := json.NewDecoder(strings.NewReader(script))
+	bestDepth := 0
+	bestOffset := -1
+	for {
+		offset := int(dec.InputOffset())
+		tok, err := dec.Token()
+		if err != nil {
+			break
+		}
+
+		var top *level
+		if len(stack) > 0 {
+			top = stack[len(stack)-1]
+		}
+
+		if delim, ok := tok.(json.Delim); ok && (delim == '}' || delim == ']') {
+			stack = stack[:len(stack)-1]
+			if len(stack) > 0 && !stack[len(stack)-1].isArray {
+				stack[len(stack)-1].expectKey = true
+			}
+			continue
+		}
+
+		if top != nil {
+			if top.isArray {
+				top.index++
+			} else if top.expectKey {
+				top.key, _ = tok.(string)
+				top.expectKey = false
+			} else {
+				top.expectKey = true
+			}
+
+			if top.isArray || !top.expectKey {
+				if depth := matches(); depth > bestDepth {
+					bestDepth = depth
+					bestOffset = offset
+				}
+			}
+		}
+
+		if delim, ok := tok.(json.Delim); ok {
+			// Starting a new object or array, if we are in an object the value is the container
+			// so we won't get a token for the value
+			if top != nil && !top.isArray {
+				top.expectKey = false
+			}
+			stack = append(stack, &level{isArray: delim == '[', expectKey: delim == '{', index: -1})
+		}
+	}
+
+	if bestOffset == -1 {
+		return 0, 0
+	}
+
+	// The offset is the end of the previous token, skip past the separators
+	for bestOffset < len(script) && strings.ContainsRune(" \t\r\n,:", rune(script[bestOffset])) {
+		bestOffset++
+	}
+	prefix := script[:bestOffset]
+	line := strings.Count(prefix, "\n") + 1
+	column := bestOffset - strings.LastIndex(prefix, "\n")
+	return line, column
+}
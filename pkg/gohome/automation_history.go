@@ -0,0 +1,249 @@
+package gohome
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// RunStatusRunning - the run has actions that have not executed yet, because of a delay, wait_until
+	// or for action
+	RunStatusRunning string = "running"
+
+	// RunStatusQueued - the automation triggered while it was still running and the retrigger policy
+	// is queue, the run starts once the current run finishes
+	RunStatusQueued string = "queued"
+
+	// RunStatusCompleted - all of the actions have been sent to the command processor
+	RunStatusCompleted string = "completed"
+
+	// RunStatusSkipped - the automation triggered but none of the actions executed, Reason contains why
+	RunStatusSkipped string = "skipped"
+
+	// RunStatusStopped - the run stopped before all of the actions executed, Reason contains why
+	RunStatusStopped string = "stopped"
+)
+
+const (
+	// CommandStatusPending - the command has been sent to the command processor but hasn't executed yet
+	CommandStatusPending string = "pending"
+
+	// CommandStatusSucceeded - the command executed without an error
+	CommandStatusSucceeded string = "succeeded"
+
+	// CommandStatusFailed - the command could not be built or returned an error when it executed
+	CommandStatusFailed string = "failed"
+)
+
+// AutomationRun is the record of a single time a piece of automation triggered
+type AutomationRun struct {
+	ID   int64
+	Name string
+
+	// Trigger describes the trigger that fired, Chain contains the names of the automation that
+	// caused this automation to trigger, if it was triggered by other automation
+	Trigger string
+	Chain   []string
+
+	// Conditions are the condition of the feature trigger that fired, then the only_if and wait_until
+	// conditions that were evaluated, in order
+	Conditions []RunCondition
+
+	Status string
+	Reason string
+
+	Started time.Time
+
+	// Finished is when the last action was sent to the command processor, zero if the run is still running
+	Finished time.Time
+
+	Commands []RunCommand
+}
+
+// RunCondition is the result of evaluating a condition during a run
+type RunCondition struct {
+	// Key is either trigger, only_if or wait_until
+	Key       string
+	Condition string
+	Result    bool
+
+	// Failed is the part of the condition that was false
+	Failed string
+}
+
+// RunCommand is a command that was sent to the command processor during a run
+type RunCommand struct {
+	Desc     string
+	Sent     time.Time
+	Status   string
+	Err      string
+	Duration time.Duration
+}
+
+// AutomationHistory keeps the most recent runs of each piece of automation, keyed by the automation name
+// so that the history is kept when automation is reloaded
+type AutomationHistory struct {
+	// Max is the maximum number of runs kept for each piece of automation
+	Max int
+
+	mutex  sync.Mutex
+	nextID int64
+	runs   map[string][]*AutomationRun
+}
+
+// NewAutomationHistory returns an AutomationHistory that keeps up to max runs for each piece of automation
+func NewAutomationHistory(max int) *AutomationHistory {
+	return &AutomationHistory{
+		Max:  max,
+		runs: make(map[string][]*AutomationRun),
+	}
+}
+
+// Runs returns copies of the runs for the automation, most recent first
+func (h *AutomationHistory) Runs(name string) []AutomationRun {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	runs := h.runs[name]
+	out := make([]AutomationRun, len(runs))
+	for i, run := range runs {
+		c := *run
+		c.Chain = append([]string(nil), run.Chain...)
+		c.Conditions = append([]RunCondition(nil), run.Conditions...)
+		c.Commands = append([]RunCommand(nil), run.Commands...)
+		out[len(runs)-1-i] = c
+	}
+	return out
+}
+
+// Clear removes all of the runs for the automation
+func (h *AutomationHistory) Clear(name string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	delete(h.runs, name)
+}
+
+// add stores the run, dropping the oldest run for the automation if there are more than Max
+func (h *AutomationHistory) add(run *AutomationRun) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.nextID++
+	run.ID = h.nextID
+	runs := append(h.runs[run.Name], run)
+	if h.Max > 0 && len(runs) > h.Max {
+		runs = append([]*AutomationRun(nil), runs[len(runs)-h.Max:]...)
+	}
+	h.runs[run.Name] = runs
+}
+
+// update modifies a stored run, runs are only modified while holding the history lock
+func (h *AutomationHistory) update(run *AutomationRun, fn func(run *AutomationRun)) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	fn(run)
+}
+
+// runRecorder records the progress of a single run, it does nothing if the automation has no history
+type runRecorder struct {
+	history *AutomationHistory
+	run     *AutomationRun
+}
+
+// newRunRecorder creates a record for a run of the automation and adds it to the history
+func (a *Automation) newRunRecorder(trigger string, chain []string) *runRecorder {
+	rec := &runRecorder{history: a.History}
+	if rec.history == nil {
+		return rec
+	}
+
+	rec.run = &AutomationRun{
+		Name:    a.Name,
+		Trigger: trigger,
+		Chain:   append([]string(nil), chain...),
+		Status:  RunStatusRunning,
+		Started: a.now(),
+	}
+	rec.history.add(rec.run)
+	return rec
+}
+
+func (rec *runRecorder) update(fn func(run *AutomationRun)) {
+	if rec == nil || rec.run == nil {
+		return
+	}
+	rec.history.update(rec.run, fn)
+}
+
+// condition records the result of evaluating a condition, failed is the part of the condition that was
+// false, nil if the condition was true
+func (rec *runRecorder) condition(key string, c *condition, failed *condition) {
+	rec.update(func(run *AutomationRun) {
+		rc := RunCondition{Key: key, Condition: c.String(), Result: failed == nil}
+		if failed != nil {
+			rc.Failed = failed.String()
+		}
+		run.Conditions = append(run.Conditions, rc)
+	})
+}
+
+// triggerCondition records the condition of the feature trigger that fired, the trigger only fires when
+// its condition is true. hold is the for value of the trigger, the condition was true for that long, empty
+// if the trigger doesn't have one
+func (rec *runRecorder) triggerCondition(c *condition, hold string) {
+	rec.condition("trigger", c, nil)
+	if hold == "" {
+		return
+	}
+	rec.update(func(run *AutomationRun) {
+		rc := &run.Conditions[len(run.Conditions)-1]
+		rc.Condition += " for " + hold
+	})
+}
+
+// finish records the final status of the run
+func (rec *runRecorder) finish(status, reason string, at time.Time) {
+	rec.update(func(run *AutomationRun) {
+		run.Status = status
+		run.Reason = reason
+		run.Finished = at
+	})
+}
+
+// sent records the commands in the group and sets the Executed function of the group so that the
+// results are recorded once the command processor has executed the commands
+func (rec *runRecorder) sent(group *CommandGroup, at time.Time) {
+	if rec == nil || rec.run == nil || len(group.Cmds) == 0 {
+		return
+	}
+
+	var first int
+	rec.update(func(run *AutomationRun) {
+		first = len(run.Commands)
+		for _, c := range group.Cmds {
+			run.Commands = append(run.Commands, RunCommand{
+				Desc:   c.FriendlyString(),
+				Sent:   at,
+				Status: CommandStatusPending,
+			})
+		}
+	})
+
+	group.Executed = func(results []CommandResult) {
+		rec.update(func(run *AutomationRun) {
+			for i, result := range results {
+				if first+i >= len(run.Commands) {
+					break
+				}
+				command := &run.Commands[first+i]
+				command.Duration = result.Duration
+				if result.Err != nil {
+					command.Status = CommandStatusFailed
+					command.Err = result.Err.Error()
+				} else {
+					command.Status = CommandStatusSucceeded
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,161 @@
+package gohome_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/markdaws/gohome/pkg/attr"
+	"github.com/markdaws/gohome/pkg/gohome"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAutomationHistory(t *testing.T) {
+	config := `
+name: Porch
+trigger:
+  event:
+    type: server_started
+only_if:
+  aid: door
+  attr: openclose
+  op: '=='
+  value: 2
+actions:
+  - light_zone:
+      aid: porch
+      on_off: 'on'
+  - switch:
+      aid: fan
+      on_off: 'on'
+`
+	h := newRunHarness(t)
+	h.report("door", "openclose", attr.OpenCloseClosed)
+
+	auto := h.automation(config)
+	auto.History = gohome.NewAutomationHistory(2)
+
+	// The door is closed so the run is skipped
+	auto.Trigger.Trigger()
+	require.Equal(t, "only_if condition is false: door.openclose == 2", <-h.skipped)
+	runs := auto.History.Runs("Porch")
+	require.Equal(t, 1, len(runs))
+	require.Equal(t, "event: server_started", runs[0].Trigger)
+	require.Equal(t, gohome.RunStatusSkipped, runs[0].Status)
+	require.Equal(t, "only_if condition is false: door.openclose == 2", runs[0].Reason)
+	require.Equal(t, []gohome.RunCondition{{
+		Key:       "only_if",
+		Condition: "door.openclose == 2",
+		Result:    false,
+		Failed:    "door.openclose == 2",
+	}}, runs[0].Conditions)
+	require.Equal(t, 0, len(runs[0].Commands))
+
+	// Door open, the commands are pending until the command processor executes them
+	h.report("door", "openclose", attr.OpenCloseOpen)
+	auto.Trigger.Trigger()
+	group := h.next(h.fired)
+	runs = auto.History.Runs("Porch")
+	require.Equal(t, 2, len(runs))
+	run := runs[0]
+	require.Equal(t, gohome.RunStatusCompleted, run.Status)
+	require.True(t, run.Conditions[0].Result)
+	require.Equal(t, 2, len(run.Commands))
+	for _, c := range run.Commands {
+		require.Equal(t, gohome.CommandStatusPending, c.Status)
+	}
+
+	require.NotNil(t, group.Executed)
+	group.Executed([]gohome.CommandResult{
+		{Duration: 5 * time.Millisecond},
+		{Err: errors.New("connection refused"), Duration: time.Second},
+	})
+	run = auto.History.Runs("Porch")[0]
+	require.Equal(t, gohome.CommandStatusSucceeded, run.Commands[0].Status)
+	require.Equal(t, 5*time.Millisecond, run.Commands[0].Duration)
+	require.Equal(t, gohome.CommandStatusFailed, run.Commands[1].Status)
+	require.Equal(t, "connection refused", run.Commands[1].Err)
+
+	// Only the last two runs are kept
+	auto.Trigger.Trigger()
+	h.next(h.fired)
+	runs = auto.History.Runs("Porch")
+	require.Equal(t, 2, len(runs))
+	require.True(t, runs[0].ID > runs[1].ID)
+	require.Equal(t, run.ID, runs[1].ID)
+
+	auto.History.Clear("Porch")
+	require.Equal(t, 0, len(auto.History.Runs("Porch")))
+}
+
+func TestAutomationHistoryWaitUntil(t *testing.T) {
+	config := `
+name: Door
+trigger:
+  event:
+    type: server_started
+actions:
+  - wait_until:
+      condition:
+        aid: door
+        attr: openclose
+        op: '=='
+        value: 2
+      timeout: 5m
+  - switch:
+      aid: fan
+      on_off: 'on'
+`
+	h := newRunHarness(t)
+	h.report("door", "openclose", attr.OpenCloseClosed)
+	auto := h.automation(config)
+	auto.History = gohome.NewAutomationHistory(10)
+
+	auto.Trigger.Trigger()
+	h.next(h.fired)
+	require.Equal(t, gohome.RunStatusRunning, auto.History.Runs("Door")[0].Status)
+
+	h.expire(h.nextTimer())
+	require.Equal(t, "wait_until timed out after 5m, remaining actions skipped", <-h.skipped)
+
+	run := auto.History.Runs("Door")[0]
+	require.Equal(t, gohome.RunStatusStopped, run.Status)
+	require.Equal(t, "wait_until timed out after 5m, remaining actions skipped", run.Reason)
+	require.Equal(t, []gohome.RunCondition{{
+		Key:       "wait_until",
+		Condition: "door.openclose == 2",
+		Result:    false,
+		Failed:    "door.openclose == 2",
+	}}, run.Conditions)
+	require.Equal(t, 0, len(run.Commands))
+}
+
+func TestAutomationHistoryTriggerCondition(t *testing.T) {
+	config := `
+name: Door
+trigger:
+  feature:
+    aid: door
+    for: 10m
+    condition:
+      attr: openclose
+      op: '=='
+      value: 2
+actions:
+  - switch:
+      aid: fan
+      on_off: 'on'
+`
+	h := newRunHarness(t)
+	auto := h.automation(config)
+	auto.History = gohome.NewAutomationHistory(10)
+
+	auto.Trigger.Trigger()
+	h.next(h.fired)
+	run := auto.History.Runs("Door")[0]
+	require.Equal(t, []gohome.RunCondition{{
+		Key:       "trigger",
+		Condition: "openclose == 2 for 10m",
+		Result:    true,
+	}}, run.Conditions)
+}
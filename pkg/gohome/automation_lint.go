@@ -0,0 +1,363 @@
+package gohome
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/go-yaml/yaml"
+	"github.com/markdaws/gohome/pkg/attr"
+	"github.com/markdaws/gohome/pkg/feature"
+)
+
+// lintDays are the values allowed in a days key
+var lintDays = []string{"sun", "mon", "tues", "wed", "thurs", "fri", "sat"}
+
+// LintAutomation checks an automation script much more strictly than NewAutomation. As well as the
+// errors returned by NewAutomation it reports unknown keys, which are otherwise ignored, invalid
+// on_off, open_closed and days values, unknown feature ids and aids and values outside of the min and
+// max of the attribute they are applied to. Returns all of the problems found, ordered by their
+// position in the script, nil if the script is valid
+func LintAutomation(sys automationSys, script string) []*AutomationError {
+	var tree interface{}
+	if err := yaml.Unmarshal([]byte(script), &tree); err != nil {
+		return []*AutomationError{newAutomationError(script, err)}
+	}
+
+	l := &linter{sys: sys}
+	l.keys(reflect.TypeOf(automationIntermediate{}), tree, "")
+
+	var auto automationIntermediate
+	if err := yaml.Unmarshal([]byte(script), &auto); err == nil {
+		l.automation(auto)
+	}
+
+	// Anything else NewAutomation rejects, unless it has already been reported more precisely
+	if _, err := NewAutomation(sys, script); err != nil {
+		autoErr := err.(*AutomationError)
+		if !l.reported(autoErr.Key) {
+			l.errs = append(l.errs, autoErr)
+		}
+	}
+
+	for i, err := range l.errs {
+		l.errs[i] = newAutomationError(script, err)
+	}
+	sort.Stable(automationErrorsByPosition(l.errs))
+	return l.errs
+}
+
+// linter collects the problems found in a script
+type linter struct {
+	sys  automationSys
+	errs []*AutomationError
+}
+
+func (l *linter) add(key, format string, args ...interface{}) {
+	l.errs = append(l.errs, &AutomationError{Key: key, Msg: fmt.Sprintf(format, args...)})
+}
+
+// reported returns true if a problem has already been found at the key, or inside of it
+func (l *linter) reported(key string) bool {
+	for _, err := range l.errs {
+		if err.Key == key || strings.HasPrefix(err.Key, key+".") || strings.HasPrefix(err.Key, key+"[") {
+			return true
+		}
+	}
+	return false
+}
+
+// keys reports the keys in the value that are not fields of the type t, the yaml tags of the fields
+// are the allowed keys. Values stored in interface{} fields are not checked
+func (l *linter) keys(t reflect.Type, value interface{}, key string) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		m, ok := value.(map[interface{}]interface{})
+		if !ok {
+			return
+		}
+
+		names := make([]string, 0, len(m))
+		for name := range m {
+			names = append(names, fmt.Sprintf("%v", name))
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			childKey := joinKey(key, name)
+			field, ok := yamlField(t, name)
+			if !ok {
+				l.add(childKey, "unknown key: %s", name)
+				continue
+			}
+			l.keys(field.Type, m[name], childKey)
+		}
+	case reflect.Slice:
+		items, ok := value.([]interface{})
+		if !ok {
+			return
+		}
+		for i, item := range items {
+			l.keys(t.Elem(), item, fmt.Sprintf("%s[%d]", key, i))
+		}
+	}
+}
+
+// yamlField returns the field of the struct type t with the yaml key name
+func yamlField(t reflect.Type, name string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := strings.Split(field.Tag.Get("yaml"), ",")[0]
+		if tag != "" && tag != "-" && tag == name {
+			return field, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+func joinKey(key, name string) string {
+	if key == "" {
+		return name
+	}
+	return key + "." + name
+}
+
+// automation checks the values of the script
+func (l *linter) automation(auto automationIntermediate) {
+	if auto.Trigger != nil {
+		l.trigger(auto.Trigger, "trigger")
+	}
+	for i, trigger := range auto.Triggers {
+		if trigger != nil {
+			l.trigger(trigger, fmt.Sprintf("triggers[%d]", i))
+		}
+	}
+	if auto.OnlyIf != nil {
+		l.condition(auto.OnlyIf, nil, "only_if")
+	}
+
+	for i, action := range auto.Actions {
+		key := fmt.Sprintf("actions[%d]", i)
+		switch {
+		case action.LightZone != nil:
+			lz := action.LightZone
+			key += ".light_zone"
+			features := l.features(key, feature.FTLightZone, lz.ID, lz.AID)
+			l.enum(key+".on_off", lz.OnOff, "on", "off")
+			l.number(key+".brightness", lz.Brightness, features, func(f *feature.Feature) *attr.Attribute {
+				_, brightness, _ := feature.LightZoneCloneAttrs(f)
+				return brightness
+			})
+		case action.Outlet != nil:
+			o := action.Outlet
+			key += ".outlet"
+			l.features(key, feature.FTOutlet, o.ID, o.AID)
+			l.required(key, "on_off", o.OnOff)
+			l.enum(key+".on_off", o.OnOff, "on", "off")
+		case action.Switch != nil:
+			sw := action.Switch
+			key += ".switch"
+			l.features(key, feature.FTSwitch, sw.ID, sw.AID)
+			l.required(key, "on_off", sw.OnOff)
+			l.enum(key+".on_off", sw.OnOff, "on", "off")
+		case action.WindowTreatment != nil:
+			wt := action.WindowTreatment
+			key += ".window_treatment"
+			features := l.features(key, feature.FTWindowTreatment, wt.ID, wt.AID)
+			l.enum(key+".open_closed", wt.OpenClosed, "open", "closed")
+			l.number(key+".offset", wt.Offset, features, func(f *feature.Feature) *attr.Attribute {
+				_, offset := feature.WindowTreatmentCloneAttrs(f)
+				return offset
+			})
+		case action.HeatZone != nil:
+			hz := action.HeatZone
+			key += ".heat_zone"
+			features := l.features(key, feature.FTHeatZone, hz.ID, hz.AID)
+			l.number(key+".target_temp", hz.TargetTemp, features, func(f *feature.Feature) *attr.Attribute {
+				_, targetTemp := feature.HeatZoneCloneAttrs(f)
+				return targetTemp
+			})
+		case action.WaitUntil != nil && action.WaitUntil.Condition != nil:
+			l.condition(action.WaitUntil.Condition, nil, key+".wait_until.condition")
+		}
+	}
+}
+
+func (l *linter) trigger(ti *triggerIntermediate, key string) {
+	switch {
+	case ti.Time != nil:
+		if ti.Time.Days != "" {
+			l.days(key+".time.days", ti.Time.Days)
+		}
+	case ti.Feature != nil:
+		f := l.feature(key+".feature", ti.Feature.ID, ti.Feature.AID)
+		if ti.Feature.Condition != nil {
+			l.condition(ti.Feature.Condition, f, key+".feature.condition")
+		}
+	}
+}
+
+// condition checks the condition tree, f is the feature the condition applies to if it doesn't
+// have an id or aid key
+func (l *linter) condition(c *condition, f *feature.Feature, key string) {
+	if c.FeatureID != nil || c.FeatureAID != nil {
+		f = l.feature(key, c.FeatureID, c.FeatureAID)
+	}
+	if c.Days != nil {
+		l.days(key+".days", *c.Days)
+	}
+	if c.SceneActive != nil && l.sys.SceneByID(*c.SceneActive) == nil {
+		l.add(key+".scene_active", "unknown scene id: %s", *c.SceneActive)
+	}
+
+	if f != nil && c.AttrLocalID != nil {
+		if attribute, ok := f.Attrs[*c.AttrLocalID]; ok {
+			for _, v := range []struct {
+				name  string
+				value interface{}
+			}{{"value", c.Value}, {"from", c.From}, {"to", c.To}} {
+				if v.value == nil {
+					continue
+				}
+				if val := toFloat32(v.value); val != nil {
+					l.inRange(key+"."+v.name, float64(*val), attribute, f)
+				}
+			}
+		}
+	}
+
+	for i, child := range c.And {
+		if child != nil {
+			l.condition(child, f, fmt.Sprintf("%s.and[%d]", key, i))
+		}
+	}
+	for i, child := range c.Or {
+		if child != nil {
+			l.condition(child, f, fmt.Sprintf("%s.or[%d]", key, i))
+		}
+	}
+	if c.Not != nil {
+		l.condition(c.Not, f, key+".not")
+	}
+}
+
+// feature returns the feature with the id or aid, reporting the key if there is no such feature. Returns
+// nil if the id and aid keys are both missing
+func (l *linter) feature(key string, id, aid *string) *feature.Feature {
+	if aid != nil {
+		f := l.sys.FeatureByAID(*aid)
+		if f == nil {
+			l.add(key+".aid", "unknown feature aid: %s", *aid)
+		}
+		return f
+	}
+	if id != nil {
+		f := l.sys.FeatureByID(*id)
+		if f == nil {
+			l.add(key+".id", "unknown feature id: %s", *id)
+		}
+		return f
+	}
+	return nil
+}
+
+// features returns the features an action with the id and aid applies to
+func (l *linter) features(key, featureType string, id, aid *string) []*feature.Feature {
+	if id == nil && aid == nil {
+		return sortedFeatures(l.sys.FeaturesByType(featureType))
+	}
+
+	f := l.feature(key, id, aid)
+	if f == nil {
+		return nil
+	}
+	if f.Type != featureType {
+		l.add(key, "feature %s is a %s, not a %s", f.Name, f.Type, featureType)
+		return nil
+	}
+	return []*feature.Feature{f}
+}
+
+func (l *linter) required(key, name string, value *string) {
+	if value == nil {
+		l.add(key, "missing %s key", name)
+	}
+}
+
+func (l *linter) enum(key string, value *string, allowed ...string) {
+	if value == nil {
+		return
+	}
+	for _, a := range allowed {
+		if *value == a {
+			return
+		}
+	}
+	l.add(key, "invalid value: %s, must be one of [%s]", *value, strings.Join(allowed, "|"))
+}
+
+// days reports any of the | separated values that are not one of the day names
+func (l *linter) days(key, value string) {
+	for _, day := range strings.Split(value, "|") {
+		day = strings.TrimSpace(day)
+		valid := false
+		for _, d := range lintDays {
+			if day == d {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			l.add(key, "invalid day: %s, must be one or more of %s", day, strings.Join(lintDays, "|"))
+		}
+	}
+}
+
+// number checks the value is in the range of the attribute returned by getAttr for each of the features
+func (l *linter) number(key string, value *float64, features []*feature.Feature, getAttr func(*feature.Feature) *attr.Attribute) {
+	if value == nil {
+		return
+	}
+	for _, f := range features {
+		if attribute := getAttr(f); attribute != nil {
+			if !l.inRange(key, *value, attribute, f) {
+				return
+			}
+		}
+	}
+}
+
+// inRange reports the key if the value is outside of the min and max of the attribute. Returns false if
+// the value is out of range
+func (l *linter) inRange(key string, value float64, attribute *attr.Attribute, f *feature.Feature) bool {
+	min, hasMin := attrFloat(&attr.Attribute{Value: attribute.Min})
+	max, hasMax := attrFloat(&attr.Attribute{Value: attribute.Max})
+	switch {
+	case hasMin && value < min:
+		l.add(key, "value %v is out of range for %s.%s, the minimum is %v", value, f.Name, attribute.LocalID, min)
+		return false
+	case hasMax && value > max:
+		l.add(key, "value %v is out of range for %s.%s, the maximum is %v", value, f.Name, attribute.LocalID, max)
+		return false
+	}
+	return true
+}
+
+type automationErrorsByPosition []*AutomationError
+
+func (slice automationErrorsByPosition) Len() int {
+	return len(slice)
+}
+func (slice automationErrorsByPosition) Less(i, j int) bool {
+	if slice[i].Line != slice[j].Line {
+		return slice[i].Line < slice[j].Line
+	}
+	return slice[i].Column < slice[j].Column
+}
+func (slice automationErrorsByPosition) Swap(i, j int) {
+	slice[i], slice[j] = slice[j], slice[i]
+}
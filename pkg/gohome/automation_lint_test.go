@@ -0,0 +1,70 @@
+package gohome_test
+
+import (
+	"testing"
+
+	"github.com/markdaws/gohome/pkg/feature"
+	"github.com/markdaws/gohome/pkg/gohome"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLintAutomation(t *testing.T) {
+	config := `name: Evening
+enabeld: false
+trigger:
+  time:
+    at: sunset
+    days: mon|tue|fri
+only_if:
+  aid: garage
+  attr: openclose
+  op: '=='
+  value: 2
+actions:
+  - light_zone:
+      aid: lounge
+      on_off: 'onn'
+      brightness: 150
+  - switch:
+      aid: fan
+      on_of: 'on'
+`
+	h := newRunHarness(t)
+	lounge := feature.NewLightZone("lounge", feature.LightZoneModeContinuous)
+	lounge.AutomationID = "lounge"
+	lounge.Name = "lounge"
+	h.sys.AddFeature(lounge)
+
+	errs := gohome.LintAutomation(h.sys, config)
+	var got []gohome.AutomationError
+	for _, err := range errs {
+		got = append(got, *err)
+	}
+	require.Equal(t, []gohome.AutomationError{
+		{Key: "enabeld", Msg: "unknown key: enabeld", Line: 2, Column: 1},
+		{Key: "trigger.time.days", Msg: "invalid day: tue, must be one or more of sun|mon|tues|wed|thurs|fri|sat", Line: 6, Column: 5},
+		{Key: "only_if.aid", Msg: "unknown feature aid: garage", Line: 8, Column: 3},
+		{Key: "actions[0].light_zone.on_off", Msg: "invalid value: onn, must be one of [on|off]", Line: 15, Column: 7},
+		{Key: "actions[0].light_zone.brightness", Msg: "value 150 is out of range for lounge.brightness, the maximum is 100", Line: 16, Column: 7},
+		{Key: "actions[1].switch", Msg: "missing on_off key", Line: 17, Column: 5},
+		{Key: "actions[1].switch.on_of", Msg: "unknown key: on_of", Line: 19, Column: 7},
+	}, got)
+
+	// A valid script has no problems
+	errs = gohome.LintAutomation(h.sys, `
+name: Fan
+trigger:
+  event:
+    type: server_started
+actions:
+  - switch:
+      aid: fan
+      on_off: 'on'
+`)
+	require.Equal(t, 0, len(errs))
+
+	// Problems only NewAutomation finds are also reported
+	errs = gohome.LintAutomation(h.sys, "name: Fan\nactions:\n  - switch:\n      aid: fan\n      on_off: 'on'\n")
+	require.Equal(t, 1, len(errs))
+	require.Equal(t, "missing trigger key, trigger must be defined", errs[0].Msg)
+}
@@ -0,0 +1,582 @@
+package gohome
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/markdaws/gohome/pkg/clock"
+	"github.com/markdaws/gohome/pkg/cmd"
+	"github.com/markdaws/gohome/pkg/feature"
+	"github.com/markdaws/gohome/pkg/log"
+)
+
+const (
+	// RetriggerRestart - if the automation triggers while it is still running, the current run is
+	// stopped and the actions start again from the beginning. This is the default
+	RetriggerRestart string = "restart"
+
+	// RetriggerQueue - if the automation triggers while it is still running, the actions run again
+	// once the current run has finished
+	RetriggerQueue string = "queue"
+
+	// RetriggerIgnore - if the automation triggers while it is still running, the trigger is ignored
+	RetriggerIgnore string = "ignore"
+)
+
+// maxQueuedRuns is the maximum number of runs that can be waiting for the current run to finish
+// when the retrigger policy is queue, further triggers are skipped
+const maxQueuedRuns = 10
+
+// waitUntil pauses the execution of the actions until the condition is true, or the timeout expires
+type waitUntil struct {
+	Condition *condition `yaml:"condition"`
+	Timeout   string     `yaml:"timeout"`
+
+	// OnTimeout is either stop, the remaining actions are not executed, or continue
+	OnTimeout string `yaml:"on_timeout"`
+
+	timeout time.Duration
+}
+
+// actionStep is a single action from the actions list, either commands to execute or a pause
+type actionStep struct {
+	cmds []cmd.Command
+
+	// holdFor if non zero is how long until the features changed by cmds are restored to their
+	// previous values
+	holdFor time.Duration
+
+	delay time.Duration
+	wait  *waitUntil
+}
+
+// restore is a pending command that restores the previous values of a feature, once an action with
+// a for value has finished
+type restore struct {
+	at  time.Time
+	cmd *cmd.FeatureSetAttrs
+}
+
+// automationRun is a single execution of the actions of a piece of automation. The commands before
+// the first delay or wait are sent when the automation triggers, the rest are sent from the run's
+// own goroutine so that a pause never holds up the other commands sent to the same hub
+type automationRun struct {
+	auto     *Automation
+	steps    []*actionStep
+	pos      int
+	restores []*restore
+	rec      *runRecorder
+
+	events chan *FeatureAttrsChangedEvt
+
+	// cancel is closed to stop the run, done is closed once the run's goroutine has returned
+	cancel chan struct{}
+	done   chan struct{}
+
+	// release gives up the run's claim on a clock that tracks work, such as the Simulator's clock, see
+	// clock.Tracker. The run is busy from when it starts until it waits, and again each time it wakes
+	release func()
+}
+
+// queuedRun is a trigger waiting for the current run to finish, when the retrigger policy is queue
+type queuedRun struct {
+	steps []*actionStep
+	chain []string
+	rec   *runRecorder
+}
+
+// parseActionTiming validates the delay, wait_until and for keys of the actions and the retrigger
+// policy of the automation
+func parseActionTiming(sys automationSys, auto automationIntermediate) error {
+	switch auto.Retrigger {
+	case "", RetriggerRestart, RetriggerQueue, RetriggerIgnore:
+	default:
+		return &AutomationError{
+			Key: "retrigger",
+			Msg: fmt.Sprintf("invalid retrigger value: %s, must be one of [%s|%s|%s]", auto.Retrigger,
+				RetriggerRestart, RetriggerQueue, RetriggerIgnore),
+		}
+	}
+
+	for i := range auto.Actions {
+		action := &auto.Actions[i]
+		key := fmt.Sprintf("actions[%d]", i)
+
+		if action.Delay != "" || action.WaitUntil != nil {
+			if action.Scene != nil || action.SceneUndo != nil || action.LightZone != nil || action.Outlet != nil || action.Switch != nil ||
+				action.WindowTreatment != nil || action.HeatZone != nil {
+				return &AutomationError{Key: key, Msg: "delay and wait_until must be separate actions"}
+			}
+			if action.Delay != "" && action.WaitUntil != nil {
+				return &AutomationError{Key: key, Msg: "an action can have a delay or wait_until key, not both"}
+			}
+			if action.For != "" {
+				return &AutomationError{Key: key + ".for", Msg: "for can not be used with delay or wait_until"}
+			}
+		}
+
+		if action.Delay != "" {
+			delay, err := time.ParseDuration(action.Delay)
+			if err != nil || delay <= 0 {
+				return &AutomationError{
+					Key: key + ".delay",
+					Msg: fmt.Sprintf("invalid delay value: %s, must be a duration such as 30s, 10m or 1h30m", action.Delay),
+				}
+			}
+			action.delay = delay
+		}
+
+		if wait := action.WaitUntil; wait != nil {
+			key += ".wait_until"
+			if wait.Condition == nil {
+				return &AutomationError{Key: key, Msg: "missing condition key"}
+			}
+			if err := parseCondition(sys, nil, wait.Condition, key+".condition"); err != nil {
+				return err
+			}
+
+			if wait.Timeout == "" {
+				return &AutomationError{Key: key, Msg: "missing timeout key"}
+			}
+			timeout, err := time.ParseDuration(wait.Timeout)
+			if err != nil || timeout <= 0 {
+				return &AutomationError{
+					Key: key + ".timeout",
+					Msg: fmt.Sprintf("invalid timeout value: %s, must be a duration such as 30s, 10m or 1h30m", wait.Timeout),
+				}
+			}
+			wait.timeout = timeout
+
+			switch wait.OnTimeout {
+			case "", "stop", "continue":
+			default:
+				return &AutomationError{
+					Key: key + ".on_timeout",
+					Msg: fmt.Sprintf("invalid on_timeout value: %s, must be one of [stop|continue]", wait.OnTimeout),
+				}
+			}
+		}
+
+		if action.For != "" {
+			if action.Scene != nil || action.SceneUndo != nil {
+				return &AutomationError{Key: key + ".for", Msg: "for is not supported with scene actions"}
+			}
+			holdFor, err := time.ParseDuration(action.For)
+			if err != nil || holdFor <= 0 {
+				return &AutomationError{
+					Key: key + ".for",
+					Msg: fmt.Sprintf("invalid for value: %s, must be a duration such as 30s, 10m or 1h30m", action.For),
+				}
+			}
+			action.holdFor = holdFor
+		}
+	}
+	return nil
+}
+
+// run executes the steps, applying the retrigger policy if the automation is already running. rec
+// records the progress of the run
+func (a *Automation) run(steps []*actionStep, chain []string, rec *runRecorder) {
+	a.starting.Lock()
+	defer a.starting.Unlock()
+
+	a.runMutex.Lock()
+	prev := a.current
+	if prev != nil {
+		switch a.Retrigger {
+		case RetriggerIgnore:
+			a.runMutex.Unlock()
+			a.skip(rec, "already running, retrigger is "+RetriggerIgnore)
+			return
+
+		case RetriggerQueue:
+			if len(a.queued) >= maxQueuedRuns {
+				a.runMutex.Unlock()
+				a.skip(rec, "already running and the queue is full")
+				return
+			}
+			a.queued = append(a.queued, queuedRun{steps: steps, chain: chain, rec: rec})
+			a.runMutex.Unlock()
+			rec.update(func(run *AutomationRun) {
+				run.Status = RunStatusQueued
+			})
+			log.V("automation[%s] - already running, queued", a.Name)
+			return
+		}
+		a.current = nil
+	}
+	a.runMutex.Unlock()
+
+	// Restart, the new run takes over restoring any features the previous run changed, so they go back
+	// to the values they had before the first run, not the values set by the previous run
+	var inherited []*restore
+	if prev != nil {
+		log.V("automation[%s] - already running, restarting", a.Name)
+		inherited = prev.stop("restarted, the automation triggered again")
+	}
+	a.start(steps, chain, inherited, rec)
+}
+
+// start creates a new run and sends the commands up to the first pause, the remaining steps are
+// executed in the background
+func (a *Automation) start(steps []*actionStep, chain []string, inherited []*restore, rec *runRecorder) {
+	rec.update(func(run *AutomationRun) {
+		run.Status = RunStatusRunning
+	})
+
+	r := &automationRun{
+		rec:      rec,
+		auto:     a,
+		steps:    steps,
+		restores: inherited,
+		events:   make(chan *FeatureAttrsChangedEvt, 100),
+		cancel:   make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	group := r.nextBatch()
+	rec.sent(group, a.now())
+	a.fire(group, chain)
+	if r.pos == len(r.steps) && len(r.restores) == 0 {
+		close(r.done)
+		rec.finish(RunStatusCompleted, "", a.now())
+		return
+	}
+
+	a.runMutex.Lock()
+	a.current = r
+	a.runMutex.Unlock()
+
+	clk := a.clock()
+	clock.Add(clk)
+	r.release = func() { clock.Done(clk) }
+	go r.execute()
+}
+
+// finished is called when a run has executed all of its steps, the next queued run is started
+func (a *Automation) finished(r *automationRun) {
+	a.runMutex.Lock()
+	if a.current != r {
+		a.runMutex.Unlock()
+		return
+	}
+	a.current = nil
+
+	var next *queuedRun
+	if len(a.queued) > 0 {
+		next = &a.queued[0]
+		a.queued = a.queued[1:]
+	}
+	a.runMutex.Unlock()
+
+	if next != nil {
+		a.run(next.steps, next.chain, next.rec)
+	}
+}
+
+// stopRuns stops the current run and discards any queued runs. Features changed by actions with a
+// for value are restored straight away, rather than being left in their temporary state
+func (a *Automation) stopRuns() {
+	a.runMutex.Lock()
+	r := a.current
+	a.current = nil
+	queued := a.queued
+	a.queued = nil
+	a.runMutex.Unlock()
+
+	for _, q := range queued {
+		q.rec.finish(RunStatusSkipped, "automation stopped while queued", a.now())
+	}
+	if r == nil {
+		return
+	}
+
+	restores := r.stop("automation stopped")
+	if len(restores) == 0 {
+		return
+	}
+	group := &CommandGroup{Desc: a.Name + " - restore"}
+	for _, rs := range restores {
+		group.Cmds = append(group.Cmds, rs.cmd)
+	}
+	r.rec.sent(group, a.now())
+	a.resume(group)
+}
+
+// resume sends commands that are executed after the automation was triggered
+func (a *Automation) resume(actions *CommandGroup) {
+	if a.Resumed != nil {
+		a.Resumed(actions)
+	}
+}
+
+// notify passes feature changes to the current run, so it can evaluate its wait_until condition
+func (a *Automation) notify(e *FeatureAttrsChangedEvt) {
+	a.runMutex.Lock()
+	defer a.runMutex.Unlock()
+
+	r := a.current
+	if r == nil {
+		return
+	}
+
+	// The event is counted until the run has handled it. Sent while holding the lock, so once the run
+	// is no longer the current run it knows no more events will be sent to it
+	clk := a.clock()
+	clock.Add(clk)
+	select {
+	case r.events <- e:
+	default:
+		// The wait_until condition falls back to the last known values, so a missed event only
+		// delays noticing the change until the next one
+		clock.Done(clk)
+	}
+}
+
+// stop cancels the run, waits for it to return and returns the restores it had not applied yet. reason
+// is recorded as the reason the run stopped
+func (r *automationRun) stop(reason string) []*restore {
+	close(r.cancel)
+	<-r.done
+	r.rec.update(func(run *AutomationRun) {
+		// The run may have sent all of its actions and only be waiting to restore values
+		if run.Status == RunStatusRunning {
+			run.Status = RunStatusStopped
+			run.Reason = reason
+			run.Finished = r.auto.now()
+		}
+	})
+	return r.restores
+}
+
+// nextBatch returns the commands from the current position up to the next pause, recording the
+// current values of features changed by actions with a for value so they can be restored
+func (r *automationRun) nextBatch() *CommandGroup {
+	group := &CommandGroup{Desc: r.auto.Name}
+	for ; r.pos < len(r.steps); r.pos++ {
+		step := r.steps[r.pos]
+		if step.delay > 0 || step.wait != nil {
+			break
+		}
+
+		if step.holdFor > 0 {
+			at := r.auto.now().Add(step.holdFor)
+			for _, c := range step.cmds {
+				if setAttrs, ok := c.(*cmd.FeatureSetAttrs); ok {
+					r.hold(setAttrs, at)
+				}
+			}
+		}
+		group.Cmds = append(group.Cmds, step.cmds...)
+	}
+	return group
+}
+
+// hold records the current values of the attributes set by the command, to be restored at the specified
+// time. If the feature already has a pending restore, it is moved to the later time but keeps the
+// original values
+func (r *automationRun) hold(c *cmd.FeatureSetAttrs, at time.Time) {
+	var existing *restore
+	for _, rs := range r.restores {
+		if rs.cmd.FeatureID == c.FeatureID {
+			existing = rs
+			break
+		}
+	}
+
+	if existing == nil {
+		existing = &restore{cmd: &cmd.FeatureSetAttrs{
+			FeatureID:   c.FeatureID,
+			FeatureType: c.FeatureType,
+			FeatureName: c.FeatureName,
+			Attrs:       feature.NewAttrs(),
+		}}
+	}
+
+	values, _ := r.auto.sys.FeatureValues(c.FeatureID)
+	for localID := range c.Attrs {
+		if _, ok := existing.cmd.Attrs[localID]; ok {
+			continue
+		}
+		value, ok := values[localID]
+		if !ok || value == nil {
+			log.V("automation[%s] - unable to restore %s.%s after for, current value is not known",
+				r.auto.Name, c.FeatureName, localID)
+			continue
+		}
+		existing.cmd.Attrs[localID] = value.Clone()
+	}
+
+	if len(existing.cmd.Attrs) == 0 {
+		return
+	}
+	if existing.at.Before(at) {
+		existing.at = at
+	}
+	for _, rs := range r.restores {
+		if rs == existing {
+			return
+		}
+	}
+	r.restores = append(r.restores, existing)
+}
+
+// execute runs the remaining steps, then waits for the pending restores
+func (r *automationRun) execute() {
+	defer r.idle()
+	defer r.auto.finished(r)
+	defer close(r.done)
+
+	for r.pos < len(r.steps) {
+		step := r.steps[r.pos]
+		if step.delay > 0 {
+			if !r.pause(r.auto.now().Add(step.delay), nil) {
+				return
+			}
+		} else {
+			wait := step.wait
+			deadline := r.auto.now().Add(wait.timeout)
+			if wait.Condition.Evaluate(nil, r.auto.now()) {
+				log.V("automation[%s] - wait_until condition is already true", r.auto.Name)
+				r.rec.condition("wait_until", wait.Condition, nil)
+			} else if r.pause(deadline, wait.Condition) {
+				r.rec.condition("wait_until", wait.Condition, nil)
+			} else {
+				select {
+				case <-r.cancel:
+					return
+				default:
+				}
+
+				failed := wait.Condition.failed(nil, r.auto.now())
+				if failed == nil {
+					failed = wait.Condition
+				}
+				r.rec.condition("wait_until", wait.Condition, failed)
+
+				if wait.OnTimeout != "continue" {
+					reason := "wait_until timed out after " + wait.Timeout + ", remaining actions skipped"
+					r.rec.finish(RunStatusStopped, reason, r.auto.now())
+					r.auto.skip(nil, reason)
+					r.pos = len(r.steps)
+					break
+				}
+				log.V("automation[%s] - wait_until timed out after %s, continuing", r.auto.Name, wait.Timeout)
+			}
+		}
+
+		r.pos++
+		if group := r.nextBatch(); len(group.Cmds) > 0 {
+			r.rec.sent(group, r.auto.now())
+			r.auto.resume(group)
+		}
+	}
+	if r.pos == len(r.steps) {
+		// Still has to wait for restores, but all of the actions have been sent
+		r.rec.update(func(run *AutomationRun) {
+			if run.Status == RunStatusRunning {
+				run.Status = RunStatusCompleted
+				run.Finished = r.auto.now()
+			}
+		})
+	}
+
+	for len(r.restores) > 0 {
+		var last time.Time
+		for _, rs := range r.restores {
+			if rs.at.After(last) {
+				last = rs.at
+			}
+		}
+		if !r.pause(last, nil) {
+			return
+		}
+	}
+}
+
+// pause waits until the deadline, or until the condition is true if cond is not nil, applying any
+// restores that become due while waiting. Returns true if the deadline was reached or the condition
+// became true, false if the run was cancelled or the condition did not become true before the deadline
+func (r *automationRun) pause(deadline time.Time, cond *condition) bool {
+	for {
+		// Wake up for whichever is first, the deadline or the next restore
+		target := deadline
+		for _, rs := range r.restores {
+			if rs.at.Before(target) {
+				target = rs.at
+			}
+		}
+
+		clk := r.auto.clock()
+		timer := clk.After(target.Sub(r.auto.now()))
+		for waiting := true; waiting; {
+			r.wait()
+			select {
+			case <-r.cancel:
+				clock.Release(clk, timer)
+				return false
+
+			case e := <-r.events:
+				r.release = func() { clock.Done(clk) }
+				if cond != nil && cond.watches(e) && cond.Evaluate(e, r.auto.now()) {
+					clock.Release(clk, timer)
+					return true
+				}
+
+			case <-timer:
+				r.release = func() { clock.Release(clk, timer) }
+				waiting = false
+			}
+		}
+
+		// Use the time we were waiting for rather than the current time, so restores scheduled for
+		// the same time are applied together
+		r.applyRestores(target)
+		if !target.Before(deadline) {
+			return cond == nil
+		}
+	}
+}
+
+// wait gives up the run's claim on the clock before the run waits
+func (r *automationRun) wait() {
+	if r.release != nil {
+		r.release()
+		r.release = nil
+	}
+}
+
+// idle is called when the run's goroutine returns. Events sent to the run after it stopped waiting for
+// them are discarded, then the run gives up its claim on the clock
+func (r *automationRun) idle() {
+	clk := r.auto.clock()
+	for {
+		select {
+		case <-r.events:
+			clock.Done(clk)
+		default:
+			r.wait()
+			return
+		}
+	}
+}
+
+// applyRestores sends the restores that are due at the specified time
+func (r *automationRun) applyRestores(now time.Time) {
+	group := &CommandGroup{Desc: r.auto.Name + " - restore"}
+	var pending []*restore
+	for _, rs := range r.restores {
+		if rs.at.After(now) {
+			pending = append(pending, rs)
+			continue
+		}
+		group.Cmds = append(group.Cmds, rs.cmd)
+	}
+	r.restores = pending
+
+	if len(group.Cmds) > 0 {
+		log.V("automation[%s] - for expired, restoring previous values", r.auto.Name)
+		r.rec.sent(group, now)
+		r.auto.resume(group)
+	}
+}
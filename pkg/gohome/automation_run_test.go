@@ -0,0 +1,370 @@
+package gohome_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/go-home-iot/event-bus"
+	"github.com/markdaws/gohome/pkg/attr"
+	"github.com/markdaws/gohome/pkg/cmd"
+	"github.com/markdaws/gohome/pkg/feature"
+	"github.com/markdaws/gohome/pkg/gohome"
+	"github.com/stretchr/testify/require"
+)
+
+// runHarness lets the test decide when each of the timers started by running automation expire, and
+// collects the commands the automation executes
+type runHarness struct {
+	t        *testing.T
+	sys      *gohome.System
+	evtBus   *evtbus.Bus
+	mt       *MockTime
+	timers   chan runTimer
+	fired    chan *gohome.CommandGroup
+	resumed  chan *gohome.CommandGroup
+	skipped  chan string
+	features map[string]*feature.Feature
+}
+
+type runTimer struct {
+	d  time.Duration
+	ch chan time.Time
+}
+
+func newRunHarness(t *testing.T) *runHarness {
+	h := &runHarness{
+		t:        t,
+		sys:      gohome.NewSystem("test system"),
+		evtBus:   evtbus.NewBus(100, 100),
+		timers:   make(chan runTimer, 10),
+		fired:    make(chan *gohome.CommandGroup, 10),
+		resumed:  make(chan *gohome.CommandGroup, 10),
+		skipped:  make(chan string, 10),
+		features: make(map[string]*feature.Feature),
+	}
+	h.mt = &MockTime{
+		now: time.Date(2016, time.December, 5, 10, 0, 0, 0, time.UTC),
+		after: func(mt *MockTime, d time.Duration) <-chan time.Time {
+			c := make(chan time.Time, 1)
+			h.timers <- runTimer{d: d, ch: c}
+			return c
+		},
+	}
+	h.sys.Services.EvtBus = h.evtBus
+	h.sys.Services.Monitor = gohome.NewMonitor(h.sys, h.evtBus)
+
+	porch := feature.NewLightZone("porch", feature.LightZoneModeBinary)
+	fan := feature.NewSwitch("fan")
+	door := feature.NewSensor("door", attr.NewOpenClose("openclose", nil))
+	for _, f := range []*feature.Feature{porch, fan, door} {
+		f.AutomationID = f.ID
+		f.Name = f.ID
+		h.sys.AddFeature(f)
+		h.features[f.ID] = f
+	}
+	return h
+}
+
+func (h *runHarness) automation(config string) *gohome.Automation {
+	auto, err := gohome.NewAutomation(h.sys, config)
+	require.Nil(h.t, err)
+	auto.Time = h.mt
+	auto.Triggered = func(actions *gohome.CommandGroup) { h.fired <- actions }
+	auto.Resumed = func(actions *gohome.CommandGroup) { h.resumed <- actions }
+	auto.Skipped = func(reason string) { h.skipped <- reason }
+	return auto
+}
+
+// report sets the value the monitor has for the attribute
+func (h *runHarness) report(featureID, localID string, val int32) {
+	a := h.features[featureID].Attrs[localID].Clone()
+	a.Value = val
+	h.evtBus.Enqueue(&gohome.FeatureReportingEvt{FeatureID: featureID, Attrs: feature.NewAttrs(a)})
+	time.Sleep(100 * time.Millisecond)
+}
+
+func (h *runHarness) changed(featureID, localID string, val int32) *gohome.FeatureAttrsChangedEvt {
+	a := h.features[featureID].Attrs[localID].Clone()
+	a.Value = val
+	return &gohome.FeatureAttrsChangedEvt{FeatureID: featureID, Attrs: feature.NewAttrs(a)}
+}
+
+func (h *runHarness) nextTimer() runTimer {
+	select {
+	case tm := <-h.timers:
+		return tm
+	case <-time.After(time.Second):
+		require.FailNow(h.t, "timer not started")
+	}
+	return runTimer{}
+}
+
+// expire moves the time forward by the duration of the timer then fires it
+func (h *runHarness) expire(tm runTimer) {
+	h.mt.mutex.Lock()
+	h.mt.now = h.mt.now.Add(tm.d)
+	h.mt.mutex.Unlock()
+	tm.ch <- h.mt.Now()
+}
+
+func (h *runHarness) next(ch chan *gohome.CommandGroup) *gohome.CommandGroup {
+	select {
+	case group := <-ch:
+		return group
+	case <-time.After(time.Second):
+		require.FailNow(h.t, "commands not executed")
+	}
+	return nil
+}
+
+func (h *runHarness) nothing(ch chan *gohome.CommandGroup) {
+	select {
+	case group := <-ch:
+		require.FailNow(h.t, "unexpected commands", "%v", group.Cmds)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// requireSet checks the group contains a single command setting the attribute to the value
+func requireSet(t *testing.T, group *gohome.CommandGroup, featureID, localID string, val int32) {
+	require.Equal(t, 1, len(group.Cmds))
+	setAttrs, ok := group.Cmds[0].(*cmd.FeatureSetAttrs)
+	require.True(t, ok)
+	require.Equal(t, featureID, setAttrs.FeatureID)
+	require.Equal(t, val, setAttrs.Attrs[localID].Value)
+}
+
+func TestAutomationDelayWaitUntilFor(t *testing.T) {
+	config := `
+name: Porch
+trigger:
+  event:
+    type: server_started
+actions:
+  - light_zone:
+      aid: porch
+      on_off: 'on'
+    for: 10m
+  - delay: 1m
+  - switch:
+      aid: fan
+      on_off: 'on'
+  - wait_until:
+      condition:
+        aid: door
+        attr: openclose
+        op: '=='
+        value: 2
+      timeout: 5m
+  - switch:
+      aid: fan
+      on_off: 'off'
+`
+	h := newRunHarness(t)
+	h.report("porch", "onoff", attr.OnOffOff)
+
+	auto := h.automation(config)
+	require.Equal(t, []string{
+		"light_zone: porch, on_off: on, for: 10m",
+		"delay: 1m",
+		"switch: fan, on_off: on",
+		"wait_until: door.openclose == 2, timeout: 5m",
+		"switch: fan, on_off: off",
+	}, auto.ActionSummary())
+
+	// The dry run contains all of the commands, ignoring the pauses
+	group, err := auto.DryRun()
+	require.Nil(t, err)
+	require.Equal(t, 3, len(group.Cmds))
+
+	ch := make(chan evtbus.Event)
+	auto.StartConsuming(ch)
+	defer auto.StopConsuming()
+
+	// Only the commands before the delay execute when triggered
+	auto.Trigger.Trigger()
+	requireSet(t, h.next(h.fired), "porch", "onoff", attr.OnOffOn)
+
+	tm := h.nextTimer()
+	require.Equal(t, time.Minute, tm.d)
+	h.nothing(h.resumed)
+	h.expire(tm)
+	requireSet(t, h.next(h.resumed), "fan", "onoff", attr.OnOffOn)
+
+	// Waiting for the door to open, other features changing don't matter
+	tm = h.nextTimer()
+	require.Equal(t, 5*time.Minute, tm.d)
+	ch <- h.changed("porch", "onoff", attr.OnOffOn)
+	h.nothing(h.resumed)
+	ch <- h.changed("door", "openclose", attr.OpenCloseOpen)
+	requireSet(t, h.next(h.resumed), "fan", "onoff", attr.OnOffOff)
+
+	// The porch light goes back to its previous value 10 minutes after it was turned on
+	tm = h.nextTimer()
+	require.Equal(t, 9*time.Minute, tm.d)
+	h.expire(tm)
+	requireSet(t, h.next(h.resumed), "porch", "onoff", attr.OnOffOff)
+	h.nothing(h.resumed)
+}
+
+func TestAutomationWaitUntilTimeout(t *testing.T) {
+	config := `
+name: Door
+trigger:
+  event:
+    type: server_started
+actions:
+  - wait_until:
+      condition:
+        aid: door
+        attr: openclose
+        op: '=='
+        value: 2
+      timeout: 5m
+      on_timeout: %s
+  - switch:
+      aid: fan
+      on_off: 'on'
+`
+	for _, onTimeout := range []string{"stop", "continue"} {
+		h := newRunHarness(t)
+		auto := h.automation(fmt.Sprintf(config, onTimeout))
+		auto.Trigger.Trigger()
+		require.Equal(t, 0, len(h.next(h.fired).Cmds))
+
+		h.expire(h.nextTimer())
+		if onTimeout == "stop" {
+			h.nothing(h.resumed)
+			require.Equal(t, "wait_until timed out after 5m, remaining actions skipped", <-h.skipped)
+		} else {
+			requireSet(t, h.next(h.resumed), "fan", "onoff", attr.OnOffOn)
+		}
+	}
+}
+
+func TestAutomationRetrigger(t *testing.T) {
+	config := `
+name: Fan
+retrigger: %s
+trigger:
+  event:
+    type: server_started
+actions:
+  - switch:
+      aid: fan
+      on_off: 'on'
+  - delay: 1m
+  - light_zone:
+      aid: porch
+      on_off: 'on'
+`
+	// ignore, the second trigger is skipped
+	h := newRunHarness(t)
+	auto := h.automation(fmt.Sprintf(config, gohome.RetriggerIgnore))
+	auto.Trigger.Trigger()
+	h.next(h.fired)
+	tm := h.nextTimer()
+	auto.Trigger.Trigger()
+	require.Equal(t, "already running, retrigger is ignore", <-h.skipped)
+	h.nothing(h.fired)
+	h.expire(tm)
+	requireSet(t, h.next(h.resumed), "porch", "onoff", attr.OnOffOn)
+
+	// queue, the second run starts after the first finishes
+	h = newRunHarness(t)
+	auto = h.automation(fmt.Sprintf(config, gohome.RetriggerQueue))
+	auto.Trigger.Trigger()
+	h.next(h.fired)
+	tm = h.nextTimer()
+	auto.Trigger.Trigger()
+	h.nothing(h.fired)
+	h.expire(tm)
+	requireSet(t, h.next(h.resumed), "porch", "onoff", attr.OnOffOn)
+	requireSet(t, h.next(h.fired), "fan", "onoff", attr.OnOffOn)
+	h.expire(h.nextTimer())
+	requireSet(t, h.next(h.resumed), "porch", "onoff", attr.OnOffOn)
+
+	// restart, the first run stops and the actions start again
+	h = newRunHarness(t)
+	auto = h.automation(fmt.Sprintf(config, gohome.RetriggerRestart))
+	auto.Trigger.Trigger()
+	h.next(h.fired)
+	tm = h.nextTimer()
+	auto.Trigger.Trigger()
+	requireSet(t, h.next(h.fired), "fan", "onoff", attr.OnOffOn)
+	tm2 := h.nextTimer()
+	h.expire(tm)
+	h.nothing(h.resumed)
+	h.expire(tm2)
+	requireSet(t, h.next(h.resumed), "porch", "onoff", attr.OnOffOn)
+	h.nothing(h.resumed)
+}
+
+func TestAutomationForRestart(t *testing.T) {
+	config := `
+name: Porch
+trigger:
+  event:
+    type: server_started
+actions:
+  - light_zone:
+      aid: porch
+      on_off: 'on'
+    for: 10m
+`
+	h := newRunHarness(t)
+	h.report("porch", "onoff", attr.OnOffOff)
+	auto := h.automation(config)
+	ch := make(chan evtbus.Event)
+	auto.StartConsuming(ch)
+
+	auto.Trigger.Trigger()
+	h.next(h.fired)
+	tm := h.nextTimer()
+	require.Equal(t, 10*time.Minute, tm.d)
+
+	// The light is now on, triggering again extends the time the light stays on, but it still goes
+	// back to the value it had before the first trigger
+	h.report("porch", "onoff", attr.OnOffOn)
+	h.mt.mutex.Lock()
+	h.mt.now = h.mt.now.Add(5 * time.Minute)
+	h.mt.mutex.Unlock()
+	auto.Trigger.Trigger()
+	h.next(h.fired)
+	tm = h.nextTimer()
+	require.Equal(t, 10*time.Minute, tm.d)
+
+	// Stopping the automation restores the light straight away
+	auto.StopConsuming()
+	requireSet(t, h.next(h.resumed), "porch", "onoff", attr.OnOffOff)
+}
+
+func TestAutomationActionTimingInvalid(t *testing.T) {
+	tests := []struct {
+		actions string
+		key     string
+	}{
+		{"  - delay: soon", "actions[0].delay"},
+		{"  - wait_until:\n      condition:\n        aid: door\n        attr: openclose\n        op: '=='\n        value: 2",
+			"actions[0].wait_until"},
+		{"  - wait_until:\n      condition:\n        aid: nope\n        attr: openclose\n        op: '=='\n        value: 2\n      timeout: 1m",
+			"actions[0].wait_until.condition"},
+		{"  - switch:\n      aid: fan\n      on_off: 'on'\n    for: -1m", "actions[0].for"},
+		{"  - switch:\n      aid: fan\n      on_off: 'on'\n    delay: 1m", "actions[0]"},
+	}
+
+	h := newRunHarness(t)
+	for _, test := range tests {
+		config := "name: Test\ntrigger:\n  event:\n    type: server_started\nactions:\n" + test.actions + "\n"
+		_, err := gohome.NewAutomation(h.sys, config)
+		require.NotNil(t, err, test.actions)
+		require.Equal(t, test.key, err.(*gohome.AutomationError).Key, test.actions)
+	}
+
+	config := "name: Test\nretrigger: sometimes\ntrigger:\n  event:\n    type: server_started\n" +
+		"actions:\n  - delay: 1m\n"
+	_, err := gohome.NewAutomation(h.sys, config)
+	require.NotNil(t, err)
+	require.Equal(t, "retrigger", err.(*gohome.AutomationError).Key)
+}
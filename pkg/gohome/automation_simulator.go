@@ -0,0 +1,557 @@
+package gohome
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-home-iot/event-bus"
+	"github.com/go-yaml/yaml"
+	"github.com/markdaws/gohome/pkg/attr"
+	"github.com/markdaws/gohome/pkg/clock"
+	"github.com/markdaws/gohome/pkg/cmd"
+	"github.com/markdaws/gohome/pkg/feature"
+)
+
+// The kinds of SimulatedRun
+const (
+	SimulatedTriggered  = "triggered"
+	SimulatedResumed    = "resumed"
+	SimulatedSkipped    = "skipped"
+	SimulatedSuppressed = "suppressed"
+)
+
+// Timeline is a list of steps replayed by the Simulator, starting at Start
+type Timeline struct {
+	Start time.Time
+	Steps []TimelineStep
+}
+
+// TimelineStep is a single step of a timeline. Only one of the fields is set. Advance moves the time
+// forward by a duration, At moves it forward to a time, Sunrise and Sunset move it forward to the next
+// sunrise or sunset and Feature reports new attribute values for a feature
+type TimelineStep struct {
+	Advance time.Duration
+	At      time.Time
+	Sunrise bool
+	Sunset  bool
+	Feature *FeatureAttrsChangedEvt
+}
+
+// SimulatedRun records one time a piece of automation fired, or didn't, during a simulation
+type SimulatedRun struct {
+	Time time.Time
+	Name string
+
+	// Kind is one of the Simulated values
+	Kind string
+
+	// Reason is set when the automation was skipped or suppressed
+	Reason string
+
+	// Chain is the names of the automation that caused this automation to trigger
+	Chain []string
+
+	// Cmds are the commands the automation would have sent to the command processor
+	Cmds []cmd.Command
+}
+
+// helper types to deserialize the timeline yaml
+type timelineIntermediate struct {
+	Start string                     `yaml:"start"`
+	Steps []timelineStepIntermediate `yaml:"steps"`
+}
+
+type timelineStepIntermediate struct {
+	Advance string `yaml:"advance"`
+	At      string `yaml:"at"`
+	Sunrise bool   `yaml:"sunrise"`
+	Sunset  bool   `yaml:"sunset"`
+	Feature *struct {
+		ID    string                 `yaml:"id"`
+		AID   string                 `yaml:"aid"`
+		Attrs map[string]interface{} `yaml:"attrs"`
+	} `yaml:"feature"`
+}
+
+// timelineTimeFormats are the supported formats of the start and at values, times are in the local
+// timezone unless the value includes an offset
+var timelineTimeFormats = []string{
+	time.RFC3339,
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+}
+
+// ParseTimeline parses a timeline written in YAML or JSON, e.g.
+//
+//	start: 2016-12-05 16:00
+//	steps:
+//	  - feature:
+//	      aid: front_door
+//	      attrs:
+//	        openclose: 2
+//	  - advance: 10m
+//	  - sunset: true
+//	  - at: '22:00'
+//
+// Features are found using sys. An invalid timeline returns an *AutomationError with the position of
+// the invalid value
+func ParseTimeline(sys automationSys, script string) (*Timeline, error) {
+	timeline, err := parseTimeline(sys, script)
+	if err != nil {
+		return nil, newAutomationError(script, err)
+	}
+	return timeline, nil
+}
+
+func parseTimeline(sys automationSys, script string) (*Timeline, error) {
+	var ti timelineIntermediate
+	if err := yaml.Unmarshal([]byte(script), &ti); err != nil {
+		return nil, err
+	}
+
+	if ti.Start == "" {
+		return nil, &AutomationError{Key: "start", Msg: "missing start key"}
+	}
+	start, ok := parseTimelineTime(ti.Start)
+	if !ok {
+		return nil, &AutomationError{
+			Key: "start",
+			Msg: fmt.Sprintf("invalid start value: %s, must be a time such as 2016-12-05 16:00", ti.Start),
+		}
+	}
+
+	timeline := &Timeline{Start: start}
+	now := start
+	for i, si := range ti.Steps {
+		key := fmt.Sprintf("steps[%d]", i)
+
+		set := 0
+		for _, isSet := range []bool{si.Advance != "", si.At != "", si.Sunrise, si.Sunset, si.Feature != nil} {
+			if isSet {
+				set++
+			}
+		}
+		if set != 1 {
+			return nil, &AutomationError{
+				Key: key,
+				Msg: "a step must have exactly one of the advance, at, sunrise, sunset or feature keys",
+			}
+		}
+
+		var step TimelineStep
+		switch {
+		case si.Advance != "":
+			d, err := parsePositiveDuration(key+".advance", si.Advance)
+			if err != nil {
+				return nil, err
+			}
+			step.Advance = d
+			now = now.Add(d)
+
+		case si.At != "":
+			at, ok := parseTimelineTime(si.At)
+			if !ok {
+				// Just a time of day, the next time it occurs
+				tod, err := time.Parse("15:04", si.At)
+				if err != nil {
+					return nil, &AutomationError{
+						Key: key + ".at",
+						Msg: fmt.Sprintf("invalid at value: %s, must be a time such as 22:00 or 2016-12-05 22:00", si.At),
+					}
+				}
+				at = time.Date(now.Year(), now.Month(), now.Day(), tod.Hour(), tod.Minute(), 0, 0, now.Location())
+				if !at.After(now) {
+					at = at.AddDate(0, 0, 1)
+				}
+			}
+			if at.Before(now) {
+				return nil, &AutomationError{
+					Key: key + ".at",
+					Msg: fmt.Sprintf("invalid at value: %s, time can not move backwards", si.At),
+				}
+			}
+			step.At = at
+			now = at
+
+		case si.Sunrise || si.Sunset:
+			mode := TimeTriggerModeSunrise
+			if si.Sunset {
+				mode = TimeTriggerModeSunset
+			}
+			latitude, longitude := sys.Coordinates()
+			if latitude == 0 && longitude == 0 {
+				return nil, &AutomationError{Key: key + "." + mode, Msg: "the location of the system is not set"}
+			}
+			at, ok := NextSolarTime(mode, now, latitude, longitude)
+			if !ok {
+				return nil, &AutomationError{Key: key + "." + mode, Msg: fmt.Sprintf("there is no %s in the next year", mode)}
+			}
+			step.Sunrise = si.Sunrise
+			step.Sunset = si.Sunset
+			now = at
+
+		default:
+			evt, err := parseTimelineFeature(sys, key+".feature", si)
+			if err != nil {
+				return nil, err
+			}
+			step.Feature = evt
+		}
+		timeline.Steps = append(timeline.Steps, step)
+	}
+	return timeline, nil
+}
+
+// parseTimelineFeature returns the event reporting the attribute values of the feature step
+func parseTimelineFeature(sys automationSys, key string, si timelineStepIntermediate) (*FeatureAttrsChangedEvt, error) {
+	fi := si.Feature
+
+	var f *feature.Feature
+	switch {
+	case fi.ID != "":
+		f = sys.FeatureByID(fi.ID)
+	case fi.AID != "":
+		f = sys.FeatureByAID(fi.AID)
+	default:
+		return nil, &AutomationError{Key: key, Msg: "missing id or aid key"}
+	}
+	if f == nil {
+		return nil, &AutomationError{Key: key, Msg: fmt.Sprintf("unknown feature: %s%s", fi.ID, fi.AID)}
+	}
+	if len(fi.Attrs) == 0 {
+		return nil, &AutomationError{Key: key + ".attrs", Msg: "missing attrs key"}
+	}
+
+	attrs := make(map[string]*attr.Attribute)
+	for localID, value := range fi.Attrs {
+		attrKey := key + ".attrs." + localID
+		a, ok := f.Attrs[localID]
+		if !ok {
+			return nil, &AutomationError{Key: attrKey, Msg: fmt.Sprintf("unknown attribute: %s", localID)}
+		}
+		if err := validateValue(a, value); err != nil {
+			return nil, &AutomationError{Key: attrKey, Msg: err.Error()}
+		}
+
+		a = a.Clone()
+		switch a.DataType {
+		case attr.DTInt32:
+			a.Value = *toInt32(value)
+		case attr.DTFloat32:
+			a.Value = *toFloat32(value)
+		default:
+			a.Value = value
+		}
+		attrs[localID] = a
+	}
+	return &FeatureAttrsChangedEvt{FeatureID: f.ID, Attrs: attrs}, nil
+}
+
+func parseTimelineTime(value string) (time.Time, bool) {
+	for _, format := range timelineTimeFormats {
+		if t, err := time.ParseInLocation(format, value, time.Local); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// Simulator replays a timeline against a set of automation, using a virtual clock so that hours or days
+// of events can be replayed in seconds. The simulator runs copies of the automation, built from their
+// scripts, against its own record of the feature values, the commands the automation would execute are
+// recorded instead of being sent to the command processor, so nothing is sent to any of the devices.
+// Neither the system nor the automation are changed by the simulator
+type Simulator struct {
+	// System is the system the automation was loaded from
+	System *System
+
+	// Automation is the automation to simulate
+	Automation []*Automation
+
+	clock     *clock.Virtual
+	scheduler *Scheduler
+	autos     []*Automation
+
+	mutex  sync.Mutex
+	runs   []*SimulatedRun
+	queue  []evtbus.Event
+	values map[string]map[string]*attr.Attribute
+}
+
+// simulatedSys is the system seen by the automation during a simulation, feature values and active
+// scenes come from the values reported by the timeline rather than the monitor
+type simulatedSys struct {
+	*System
+	sim *Simulator
+}
+
+func (s simulatedSys) FeatureValues(ID string) (map[string]*attr.Attribute, bool) {
+	return s.sim.featureValues(ID)
+}
+
+func (s simulatedSys) SceneActive(ID string) bool {
+	scene := s.SceneByID(ID)
+	if scene == nil {
+		return false
+	}
+	return sceneMatches(scene, s.sim.featureValues)
+}
+
+// Run replays the timeline and returns the runs of the automation, ordered by time. A
+// ServerStartedEvt is raised at the start of the timeline. An error is returned if the script of
+// any of the automation is invalid
+func (s *Simulator) Run(timeline *Timeline) ([]*SimulatedRun, error) {
+	s.mutex.Lock()
+	s.runs = nil
+	s.queue = nil
+	s.values = make(map[string]map[string]*attr.Attribute)
+	s.mutex.Unlock()
+
+	s.clock = clock.NewVirtual(timeline.Start)
+	s.scheduler = NewScheduler(s.clock)
+	s.autos = nil
+
+	sys := simulatedSys{System: s.System, sim: s}
+	for _, auto := range s.Automation {
+		a, err := NewAutomation(sys, auto.Script)
+		if err != nil {
+			return nil, err
+		}
+		s.simulate(a)
+		s.autos = append(s.autos, a)
+	}
+
+	// Events are passed to the automation by the simulator, the channels are never sent to
+	for _, a := range s.autos {
+		ch := make(chan evtbus.Event)
+		a.StartConsuming(ch)
+		defer func(a *Automation) {
+			a.StopConsuming()
+			close(ch)
+		}(a)
+	}
+
+	s.settle()
+	s.raise(&ServerStartedEvt{})
+	s.settle()
+
+	now := timeline.Start
+	for _, step := range timeline.Steps {
+		switch {
+		case step.Feature != nil:
+			s.report(step.Feature)
+			s.settle()
+			continue
+		case step.Advance > 0:
+			now = now.Add(step.Advance)
+		case !step.At.IsZero():
+			now = step.At
+		case step.Sunrise:
+			now, _ = NextSolarTime(TimeTriggerModeSunrise, now, s.System.Latitude, s.System.Longitude)
+		case step.Sunset:
+			now, _ = NextSolarTime(TimeTriggerModeSunset, now, s.System.Latitude, s.System.Longitude)
+		}
+		s.advance(now)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	runs := append([]*SimulatedRun(nil), s.runs...)
+	sort.Stable(simulatedRunsByTime(runs))
+	return runs, nil
+}
+
+// simulate sets the automation to run on the simulator's clock and scheduler and to record its runs
+func (s *Simulator) simulate(a *Automation) {
+	vclock := s.clock
+	a.SetTime(vclock)
+	walkTriggers(a.Trigger, func(trigger Trigger) {
+		if t, ok := trigger.(*TimeTrigger); ok {
+			t.Scheduler = s.scheduler
+		}
+	})
+
+	a.Triggered = func(actions *CommandGroup) {
+		s.record(&SimulatedRun{
+			Time:  vclock.Now(),
+			Name:  a.Name,
+			Kind:  SimulatedTriggered,
+			Chain: a.chain,
+			Cmds:  actions.Cmds,
+		})
+		s.raise(&AutomationTriggeredEvt{Name: a.Name, Chain: a.chain})
+	}
+	a.Resumed = func(actions *CommandGroup) {
+		s.record(&SimulatedRun{Time: vclock.Now(), Name: a.Name, Kind: SimulatedResumed, Cmds: actions.Cmds})
+	}
+	a.Skipped = func(reason string) {
+		s.record(&SimulatedRun{Time: vclock.Now(), Name: a.Name, Kind: SimulatedSkipped, Reason: reason})
+	}
+	a.Suppressed = func(reason string) {
+		s.record(&SimulatedRun{Time: vclock.Now(), Name: a.Name, Kind: SimulatedSuppressed, Reason: reason})
+	}
+}
+
+type simulatedRunsByTime []*SimulatedRun
+
+func (slice simulatedRunsByTime) Len() int {
+	return len(slice)
+}
+
+func (slice simulatedRunsByTime) Less(i, j int) bool {
+	if !slice[i].Time.Equal(slice[j].Time) {
+		return slice[i].Time.Before(slice[j].Time)
+	}
+	return slice[i].Name < slice[j].Name
+}
+
+func (slice simulatedRunsByTime) Swap(i, j int) {
+	slice[i], slice[j] = slice[j], slice[i]
+}
+
+// advance moves the clock forward to until, firing the timers, running the scheduled items and raising
+// the sunrise and sunset events that occur on the way in the order they occur
+func (s *Simulator) advance(until time.Time) {
+	sys := s.System
+	for {
+		now := s.clock.Now()
+		solar, evt := until, evtbus.Event(nil)
+		if sys.Latitude != 0 || sys.Longitude != 0 {
+			if at, ok := NextSolarTime(TimeTriggerModeSunrise, now, sys.Latitude, sys.Longitude); ok && !at.After(solar) {
+				solar, evt = at, &SunriseEvt{}
+			}
+			if at, ok := NextSolarTime(TimeTriggerModeSunset, now, sys.Latitude, sys.Longitude); ok && !at.After(solar) {
+				solar, evt = at, &SunsetEvt{}
+			}
+		}
+
+		// Timers expiring at the same time as a scheduled item fire first, then the scheduled items,
+		// then the solar event
+		due, scheduled := s.scheduler.next()
+		scheduled = scheduled && !due.After(solar)
+		next := solar
+		if scheduled {
+			next = due
+		}
+
+		if s.clock.Fire(next) {
+			s.settle()
+			continue
+		}
+		if scheduled {
+			s.clock.Set(due)
+			s.scheduler.fireDue(due)
+			s.settle()
+			continue
+		}
+		if evt == nil {
+			break
+		}
+		s.clock.Set(solar)
+		s.raise(evt)
+		s.settle()
+	}
+	s.clock.Set(until)
+}
+
+// settle passes the queued events to the automation one at a time. Before each event, and before
+// returning, it waits for the automation to finish the work started by the previous event or timer,
+// including the work done on the automation's own goroutines
+func (s *Simulator) settle() {
+	for {
+		s.clock.Wait()
+
+		s.mutex.Lock()
+		if len(s.queue) == 0 {
+			s.mutex.Unlock()
+			return
+		}
+		evt := s.queue[0]
+		s.queue = s.queue[1:]
+		s.mutex.Unlock()
+
+		for _, a := range s.autos {
+			a.handleEvent(evt)
+		}
+	}
+}
+
+// raise queues an event to be passed to the automation
+func (s *Simulator) raise(evt evtbus.Event) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.queue = append(s.queue, evt)
+}
+
+// report merges the values of the timeline step with the values already reported for the feature and
+// raises a FeatureAttrsChangedEvt for the values that changed, the same way the monitor does
+func (s *Simulator) report(step *FeatureAttrsChangedEvt) {
+	s.mutex.Lock()
+	current, ok := s.values[step.FeatureID]
+	if !ok {
+		current = make(map[string]*attr.Attribute)
+		s.values[step.FeatureID] = current
+	}
+
+	changed := make(map[string]*attr.Attribute)
+	previous := make(map[string]*attr.Attribute)
+	for localID, attribute := range step.Attrs {
+		prev, known := current[localID]
+		if known && prev.Value == attribute.Value {
+			continue
+		}
+		if known {
+			previous[localID] = prev
+		}
+		changed[localID] = attribute
+		current[localID] = attribute
+	}
+	s.mutex.Unlock()
+
+	if len(changed) == 0 {
+		return
+	}
+	s.raise(&FeatureAttrsChangedEvt{
+		FeatureID: step.FeatureID,
+		Context:   MonitorContext,
+		Attrs:     changed,
+		Previous:  previous,
+	})
+}
+
+// featureValues returns the values reported for the feature so far, see Monitor.FeatureValues
+func (s *Simulator) featureValues(featureID string) (map[string]*attr.Attribute, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	values, ok := s.values[featureID]
+	if !ok {
+		return nil, false
+	}
+	out := make(map[string]*attr.Attribute)
+	for localID, attribute := range values {
+		out[localID] = attribute
+	}
+	return out, true
+}
+
+func (s *Simulator) record(run *SimulatedRun) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.runs = append(s.runs, run)
+}
+
+// String returns a short description of the run, without the commands
+func (r *SimulatedRun) String() string {
+	str := fmt.Sprintf("%s %s %s", r.Time.Format("2006-01-02 15:04:05"), r.Name, r.Kind)
+	if len(r.Chain) > 0 {
+		str += " (chain: " + strings.Join(r.Chain, " > ") + ")"
+	}
+	if r.Reason != "" {
+		str += ": " + r.Reason
+	}
+	return str
+}
@@ -0,0 +1,136 @@
+package gohome_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/markdaws/gohome/pkg/cmd"
+	"github.com/markdaws/gohome/pkg/gohome"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSimulator(t *testing.T) {
+	scripts := []string{`
+name: Door Fan
+trigger:
+  feature:
+    aid: door
+    condition:
+      attr: openclose
+      op: '=='
+      value: 2
+actions:
+  - switch:
+      aid: fan
+      on_off: 'on'
+  - delay: 5m
+  - switch:
+      aid: fan
+      on_off: 'off'
+`, `
+name: Porch
+trigger:
+  time:
+    at: sunset
+actions:
+  - light_zone:
+      aid: porch
+      on_off: 'on'
+`, `
+name: Porch Fan
+trigger:
+  event:
+    type: automation_triggered
+    automation: Porch
+only_if:
+  aid: door
+  attr: openclose
+  op: '=='
+  value: 1
+actions:
+  - switch:
+      aid: fan
+      on_off: 'on'
+`}
+
+	h := newRunHarness(t)
+	h.sys.Latitude, h.sys.Longitude = 37.7749, 122.4194
+
+	var autos []*gohome.Automation
+	for _, script := range scripts {
+		auto, err := gohome.NewAutomation(h.sys, script)
+		require.Nil(t, err)
+		autos = append(autos, auto)
+	}
+
+	timeline, err := gohome.ParseTimeline(h.sys, `
+start: 2016-12-05T12:00:00-08:00
+steps:
+  - feature:
+      aid: door
+      attrs:
+        openclose: 2
+  - advance: 10m
+  - sunset: true
+`)
+	require.Nil(t, err)
+
+	sim := &gohome.Simulator{System: h.sys, Automation: autos}
+	services := h.sys.Services
+	runs, err := sim.Run(timeline)
+	require.Nil(t, err)
+
+	// The simulator runs copies of the automation, the system and the automation are left alone
+	require.Equal(t, services, h.sys.Services)
+	for _, auto := range autos {
+		require.Nil(t, auto.Time)
+		require.Nil(t, auto.Triggered)
+	}
+
+	start := timeline.Start
+	sunset, _ := gohome.NextSolarTime(gohome.TimeTriggerModeSunset, start, h.sys.Latitude, h.sys.Longitude)
+	require.Equal(t, 4, len(runs))
+
+	require.Equal(t, "Door Fan", runs[0].Name)
+	require.Equal(t, gohome.SimulatedTriggered, runs[0].Kind)
+	require.True(t, start.Equal(runs[0].Time))
+	require.Equal(t, "fan", runs[0].Cmds[0].(*cmd.FeatureSetAttrs).FeatureID)
+
+	require.Equal(t, "Door Fan", runs[1].Name)
+	require.Equal(t, gohome.SimulatedResumed, runs[1].Kind)
+	require.True(t, start.Add(5*time.Minute).Equal(runs[1].Time))
+
+	require.Equal(t, "Porch", runs[2].Name)
+	require.Equal(t, gohome.SimulatedTriggered, runs[2].Kind)
+	require.True(t, sunset.Equal(runs[2].Time))
+
+	require.Equal(t, "Porch Fan", runs[3].Name)
+	require.Equal(t, gohome.SimulatedSkipped, runs[3].Kind)
+	require.Equal(t, "only_if condition is false: door.openclose == 1", runs[3].Reason)
+	require.True(t, sunset.Equal(runs[3].Time))
+}
+
+func TestParseTimelineInvalid(t *testing.T) {
+	tests := []struct {
+		timeline string
+		key      string
+		line     int
+	}{
+		{"steps:\n  - advance: 10m", "start", 0},
+		{"start: tomorrow", "start", 1},
+		{"start: 2016-12-05 12:00\nsteps:\n  - advance: soon", "steps[0].advance", 3},
+		{"start: 2016-12-05 12:00\nsteps:\n  - advance: 10m\n    at: '13:00'", "steps[0]", 3},
+		{"start: 2016-12-05 12:00\nsteps:\n  - at: 2016-12-04 12:00", "steps[0].at", 3},
+		{"start: 2016-12-05 12:00\nsteps:\n  - sunset: true", "steps[0].sunset", 3},
+		{"start: 2016-12-05 12:00\nsteps:\n  - feature:\n      aid: garage\n      attrs:\n        openclose: 2", "steps[0].feature", 3},
+		{"start: 2016-12-05 12:00\nsteps:\n  - feature:\n      aid: door\n      attrs:\n        openclose: open", "steps[0].feature.attrs.openclose", 6},
+	}
+
+	h := newRunHarness(t)
+	for _, test := range tests {
+		_, err := gohome.ParseTimeline(h.sys, test.timeline)
+		require.NotNil(t, err, test.timeline)
+		require.Equal(t, test.key, err.(*gohome.AutomationError).Key, test.timeline)
+		require.Equal(t, test.line, err.(*gohome.AutomationError).Line, test.timeline)
+	}
+}
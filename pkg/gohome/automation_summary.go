@@ -0,0 +1,235 @@
+package gohome
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/markdaws/gohome/pkg/feature"
+)
+
+// TriggerSummary returns a short human readable description of the automation trigger, if the
+// automation has multiple triggers the summaries are separated by " or "
+func (a *Automation) TriggerSummary() string {
+	if a.config.Trigger != nil {
+		return triggerSummary(a.config.Trigger)
+	}
+
+	var summary []string
+	for _, trigger := range a.config.Triggers {
+		summary = append(summary, triggerSummary(trigger))
+	}
+	return strings.Join(summary, " or ")
+}
+
+func triggerSummary(trigger *triggerIntermediate) string {
+	switch {
+	case trigger == nil:
+		return ""
+
+	case trigger.Time != nil:
+		summary := "time: " + trigger.Time.At
+		if trigger.Time.Cron != "" {
+			summary = "time: cron " + trigger.Time.Cron
+		}
+		if trigger.Time.Days != "" {
+			summary += ", days: " + trigger.Time.Days
+		}
+		return summary
+
+	case trigger.Feature != nil:
+		ft := trigger.Feature
+		summary := "feature: " + featureRef(ft.ID, ft.AID)
+		if ft.Condition != nil {
+			summary += ", condition: " + ft.Condition.String()
+		}
+		if ft.Count > 0 {
+			summary += fmt.Sprintf(", count: %d in %dms", ft.Count, ft.Duration)
+		}
+		if ft.For != "" {
+			summary += ", for: " + ft.For
+		}
+		return summary
+
+	case trigger.Event != nil:
+		evt := trigger.Event
+		summary := "event: " + evt.Type
+		summary += valueSummary("login", evt.Login)
+		if evt.Success != nil {
+			summary += fmt.Sprintf(", success: %t", *evt.Success)
+		}
+		summary += valueSummary("device", evt.Device)
+		summary += valueSummary("automation", evt.Automation)
+		if evt.LastClient {
+			summary += ", last_client: true"
+		}
+		return summary
+	}
+	return ""
+}
+
+// OnlyIfSummary returns a short human readable description of the only_if condition, empty if the
+// automation doesn't have one
+func (a *Automation) OnlyIfSummary() string {
+	if a.config.OnlyIf == nil {
+		return ""
+	}
+	return a.config.OnlyIf.String()
+}
+
+// ActionSummary returns a short human readable description of each of the automation actions
+func (a *Automation) ActionSummary() []string {
+	var summary []string
+	for _, action := range a.config.Actions {
+		switch {
+		case action.Delay != "":
+			summary = append(summary, "delay: "+action.Delay)
+			continue
+		case action.WaitUntil != nil:
+			wait := action.WaitUntil
+			text := "wait_until: "
+			if wait.Condition != nil {
+				text += wait.Condition.String()
+			}
+			summary = append(summary, text+valueSummary("timeout", &wait.Timeout))
+			continue
+		case action.Scene != nil:
+			summary = append(summary, "scene: "+action.Scene.ID)
+		case action.SceneUndo != nil:
+			summary = append(summary, "scene_undo")
+		case action.LightZone != nil:
+			lz := action.LightZone
+			summary = append(summary, "light_zone: "+targetRef(lz.ID, lz.AID, lz.Selector)+
+				valueSummary("on_off", lz.OnOff)+floatSummary("brightness", lz.Brightness))
+		case action.Outlet != nil:
+			o := action.Outlet
+			summary = append(summary, "outlet: "+targetRef(o.ID, o.AID, o.Selector)+valueSummary("on_off", o.OnOff))
+		case action.Switch != nil:
+			sw := action.Switch
+			summary = append(summary, "switch: "+targetRef(sw.ID, sw.AID, sw.Selector)+valueSummary("on_off", sw.OnOff))
+		case action.WindowTreatment != nil:
+			wt := action.WindowTreatment
+			summary = append(summary, "window_treatment: "+targetRef(wt.ID, wt.AID, wt.Selector)+
+				valueSummary("open_closed", wt.OpenClosed)+floatSummary("offset", wt.Offset))
+		case action.HeatZone != nil:
+			hz := action.HeatZone
+			summary = append(summary, "heat_zone: "+targetRef(hz.ID, hz.AID, hz.Selector)+
+				floatSummary("target_temp", hz.TargetTemp))
+		}
+		if action.For != "" && len(summary) > 0 {
+			summary[len(summary)-1] += valueSummary("for", &action.For)
+		}
+	}
+	return summary
+}
+
+// String returns a human readable version of the condition, e.g. openclose == 2 and (a == 1 or b == 2)
+func (c *condition) String() string {
+	var parts []string
+	if c.AttrLocalID != nil {
+		attrName := *c.AttrLocalID
+		if c.FeatureID != nil || c.FeatureAID != nil {
+			attrName = featureRef(c.FeatureID, c.FeatureAID) + "." + attrName
+		}
+
+		op := ""
+		if c.Op != nil {
+			op = *c.Op
+		}
+
+		switch {
+		case c.From != nil || c.To != nil:
+			summary := attrName + " changed"
+			if c.From != nil {
+				summary += fmt.Sprintf(" from %v", c.From)
+			}
+			if c.To != nil {
+				summary += fmt.Sprintf(" to %v", c.To)
+			}
+			parts = append(parts, summary)
+		case op == OpChanged:
+			parts = append(parts, attrName+" changed")
+		case c.Hysteresis != nil:
+			parts = append(parts, fmt.Sprintf("%s %s %v, hysteresis %v", attrName, op, c.Value, c.Hysteresis))
+		default:
+			parts = append(parts, fmt.Sprintf("%s %s %v", attrName, op, c.Value))
+		}
+	}
+
+	if c.Time != nil {
+		switch {
+		case c.Time.After != nil && c.Time.Before != nil:
+			parts = append(parts, fmt.Sprintf("time between %s and %s", *c.Time.After, *c.Time.Before))
+		case c.Time.After != nil:
+			parts = append(parts, "time after "+*c.Time.After)
+		case c.Time.Before != nil:
+			parts = append(parts, "time before "+*c.Time.Before)
+		}
+	}
+
+	if c.Days != nil {
+		parts = append(parts, "days "+*c.Days)
+	}
+
+	if c.SceneActive != nil {
+		parts = append(parts, fmt.Sprintf("scene %s is active", *c.SceneActive))
+	}
+
+	for _, child := range c.And {
+		childStr := child.String()
+		if len(child.And)+len(child.Or) > 0 {
+			childStr = "(" + childStr + ")"
+		}
+		parts = append(parts, childStr)
+	}
+
+	if len(c.Or) > 0 {
+		var ors []string
+		for _, child := range c.Or {
+			ors = append(ors, child.String())
+		}
+
+		orStr := strings.Join(ors, " or ")
+		if len(parts) > 0 && len(ors) > 1 {
+			orStr = "(" + orStr + ")"
+		}
+		parts = append(parts, orStr)
+	}
+
+	if c.Not != nil {
+		parts = append(parts, "not ("+c.Not.String()+")")
+	}
+	return strings.Join(parts, " and ")
+}
+
+// featureRef returns the aid or id of a feature referenced in a script, or "all" if neither is set
+func featureRef(id, aid *string) string {
+	if aid != nil {
+		return *aid
+	}
+	if id != nil {
+		return *id
+	}
+	return "all"
+}
+
+// targetRef returns the features an action applies to, either the feature reference or the selector
+func targetRef(id, aid *string, sel *feature.Selector) string {
+	if sel != nil {
+		return "(" + sel.String() + ")"
+	}
+	return featureRef(id, aid)
+}
+
+func valueSummary(key string, val *string) string {
+	if val == nil {
+		return ""
+	}
+	return fmt.Sprintf(", %s: %s", key, *val)
+}
+
+func floatSummary(key string, val *float64) string {
+	if val == nil {
+		return ""
+	}
+	return fmt.Sprintf(", %s: %g", key, *val)
+}
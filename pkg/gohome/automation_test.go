@@ -1,11 +1,14 @@
 package gohome_test
 
 import (
+	"fmt"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/go-home-iot/event-bus"
 	"github.com/markdaws/gohome/pkg/attr"
+	"github.com/markdaws/gohome/pkg/cmd"
 	"github.com/markdaws/gohome/pkg/feature"
 	"github.com/markdaws/gohome/pkg/gohome"
 	"github.com/stretchr/testify/require"
@@ -70,6 +73,46 @@ actions:
 	require.True(t, wasTriggered)
 }
 
+func TestFeatureTriggerCountRestart(t *testing.T) {
+	t.Parallel()
+
+	config := `
+name: Test
+trigger:
+  feature:
+    count: 3
+    duration: 3000
+    id: 12345
+    condition:
+      attr: 'openclose'
+      op: '=='
+      value: 2
+actions:
+  - light_zone:
+      on_off: 'on'
+`
+
+	sys := gohome.NewSystem("test system")
+	sensor := feature.NewSensor("12345", attr.NewOpenClose("openclose", nil))
+	sys.AddFeature(sensor)
+	auto, err := gohome.NewAutomation(sys, config)
+	require.Nil(t, err)
+	trigger := auto.Trigger.(*gohome.FeatureTrigger)
+
+	openclosed := sensor.Attrs["openclose"].Clone()
+	openclosed.Value = attr.OpenCloseOpen
+
+	// Restart the trigger, as reloading the automation does, while it is still handling events
+	ch := make(chan evtbus.Event, 100)
+	trigger.StartConsuming(ch)
+	for i := 0; i < 50; i++ {
+		ch <- &gohome.FeatureAttrsChangedEvt{FeatureID: "12345", Attrs: feature.NewAttrs(openclosed)}
+		trigger.StopConsuming()
+		trigger.StartConsuming(ch)
+	}
+	trigger.StopConsuming()
+}
+
 func TestFeatureTriggerCountExpiredDuration(t *testing.T) {
 	// Make sure that if we trigger events but not within the desired time the trigger doesn't fire
 	t.Parallel()
@@ -296,6 +339,80 @@ actions:
 	require.Equal(t, gohome.TimeTriggerDaysMon|gohome.TimeTriggerDaysFri, trigger.Days)
 }
 
+func TestTimeTriggerSunsetOffset(t *testing.T) {
+	t.Parallel()
+
+	config := `
+name: Test
+trigger:
+  time:
+    at: sunset-30m
+actions:
+  - scene:
+      id: 12345
+`
+	sys := gohome.NewSystem("test system")
+	sys.Latitude = 47.6
+	sys.Longitude = 122.3
+	s1 := &gohome.Scene{ID: "12345"}
+	sys.AddScene(s1)
+
+	auto, err := gohome.NewAutomation(sys, config)
+	require.Nil(t, err)
+
+	trigger := auto.Trigger.(*gohome.TimeTrigger)
+	require.Equal(t, gohome.TimeTriggerModeSunset, trigger.Mode)
+	require.Equal(t, -30*time.Minute, trigger.Offset)
+	require.Equal(t, 47.6, trigger.Latitude)
+	require.Equal(t, 122.3, trigger.Longitude)
+}
+
+func TestTimeTriggerTwilightOffset(t *testing.T) {
+	t.Parallel()
+
+	config := `
+name: Test
+trigger:
+  time:
+    at: civil_dawn + 1h15m
+    days: sat|sun
+actions:
+  - scene:
+      id: 12345
+`
+	sys := gohome.NewSystem("test system")
+	s1 := &gohome.Scene{ID: "12345"}
+	sys.AddScene(s1)
+
+	auto, err := gohome.NewAutomation(sys, config)
+	require.Nil(t, err)
+
+	trigger := auto.Trigger.(*gohome.TimeTrigger)
+	require.Equal(t, gohome.TimeTriggerModeCivilDawn, trigger.Mode)
+	require.Equal(t, time.Hour+15*time.Minute, trigger.Offset)
+	require.Equal(t, gohome.TimeTriggerDaysSat|gohome.TimeTriggerDaysSun, trigger.Days)
+}
+
+func TestTimeTriggerInvalidOffset(t *testing.T) {
+	t.Parallel()
+
+	config := `
+name: Test
+trigger:
+  time:
+    at: sunrise+30 minutes
+actions:
+  - scene:
+      id: 12345
+`
+	sys := gohome.NewSystem("test system")
+	s1 := &gohome.Scene{ID: "12345"}
+	sys.AddScene(s1)
+
+	_, err := gohome.NewAutomation(sys, config)
+	require.NotNil(t, err)
+}
+
 func TestMissingNameField(t *testing.T) {
 	t.Parallel()
 
@@ -423,3 +540,1092 @@ actions:
 	require.Nil(t, err)
 	require.True(t, auto.Enabled)
 }
+
+func TestFeatureTriggerCompoundCondition(t *testing.T) {
+	t.Parallel()
+
+	config := `
+name: Test
+trigger:
+  feature:
+    id: door
+    condition:
+      and:
+        - attr: 'openclose'
+          op: '=='
+          value: 2
+        - aid: 'hallway'
+          attr: 'onoff'
+          op: '=='
+          value: 1
+        - or:
+          - aid: 'alarm'
+            attr: 'onoff'
+            op: '=='
+            value: 2
+          - aid: 'porch'
+            attr: 'onoff'
+            op: '=='
+            value: 2
+actions:
+  - light_zone:
+      aid: 'hallway'
+      on_off: 'on'
+`
+
+	sys := gohome.NewSystem("test system")
+	evtBus := evtbus.NewBus(100, 100)
+	sys.Services.EvtBus = evtBus
+	sys.Services.Monitor = gohome.NewMonitor(sys, evtBus)
+
+	door := feature.NewSensor("door", attr.NewOpenClose("openclose", nil))
+	hallway := feature.NewLightZone("hallway", feature.LightZoneModeBinary)
+	hallway.AutomationID = "hallway"
+	alarm := feature.NewSwitch("alarm")
+	alarm.AutomationID = "alarm"
+	porch := feature.NewSwitch("porch")
+	porch.AutomationID = "porch"
+	for _, f := range []*feature.Feature{door, hallway, alarm, porch} {
+		sys.AddFeature(f)
+	}
+
+	auto, err := gohome.NewAutomation(sys, config)
+	require.Nil(t, err)
+
+	ch := make(chan evtbus.Event)
+	auto.StartConsuming(ch)
+
+	var triggerCount int32
+	auto.Triggered = func(actions *gohome.CommandGroup) {
+		atomic.AddInt32(&triggerCount, 1)
+	}
+
+	report := func(f *feature.Feature, localID string, val int32) {
+		a := f.Attrs[localID].Clone()
+		a.Value = val
+		evtBus.Enqueue(&gohome.FeatureReportingEvt{FeatureID: f.ID, Attrs: feature.NewAttrs(a)})
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	openclosed := door.Attrs["openclose"].Clone()
+	openclosed.Value = attr.OpenCloseOpen
+	doorOpened := &gohome.FeatureAttrsChangedEvt{
+		FeatureID: door.ID,
+		Attrs:     feature.NewAttrs(openclosed),
+	}
+
+	// Nothing known about the other features, condition can't be true
+	ch <- doorOpened
+	time.Sleep(100 * time.Millisecond)
+	require.Equal(t, int32(0), atomic.LoadInt32(&triggerCount))
+
+	// Hallway light is on, should not trigger
+	report(hallway, "onoff", attr.OnOffOn)
+	report(alarm, "onoff", attr.OnOffOn)
+	ch <- doorOpened
+	time.Sleep(100 * time.Millisecond)
+	require.Equal(t, int32(0), atomic.LoadInt32(&triggerCount))
+
+	// Hallway light off and alarm armed, should trigger
+	report(hallway, "onoff", attr.OnOffOff)
+	ch <- doorOpened
+	time.Sleep(100 * time.Millisecond)
+	require.Equal(t, int32(1), atomic.LoadInt32(&triggerCount))
+
+	// Neither of the or conditions are true
+	report(alarm, "onoff", attr.OnOffOff)
+	report(porch, "onoff", attr.OnOffOff)
+	ch <- doorOpened
+	time.Sleep(100 * time.Millisecond)
+	require.Equal(t, int32(1), atomic.LoadInt32(&triggerCount))
+
+	// Only the porch is on, or is satisfied
+	report(porch, "onoff", attr.OnOffOn)
+	ch <- doorOpened
+	time.Sleep(100 * time.Millisecond)
+	require.Equal(t, int32(2), atomic.LoadInt32(&triggerCount))
+
+	// Other feature changes should not evaluate the trigger
+	ch <- &gohome.FeatureAttrsChangedEvt{FeatureID: hallway.ID, Attrs: hallway.Attrs}
+	time.Sleep(100 * time.Millisecond)
+	require.Equal(t, int32(2), atomic.LoadInt32(&triggerCount))
+}
+
+func TestFeatureTriggerConditionErrorKey(t *testing.T) {
+	t.Parallel()
+
+	config := `
+name: Test
+trigger:
+  feature:
+    id: door
+    condition:
+      and:
+        - attr: 'openclose'
+          op: '=='
+          value: 2
+        - or:
+          - aid: 'hallway'
+            attr: 'brightness'
+            op: '=='
+            value: 1
+actions:
+  - light_zone:
+      on_off: 'on'
+`
+
+	sys := gohome.NewSystem("test system")
+	sys.AddFeature(feature.NewSensor("door", attr.NewOpenClose("openclose", nil)))
+	hallway := feature.NewLightZone("hallway", feature.LightZoneModeBinary)
+	hallway.AutomationID = "hallway"
+	sys.AddFeature(hallway)
+
+	_, err := gohome.NewAutomation(sys, config)
+	require.NotNil(t, err)
+	autoErr, ok := err.(*gohome.AutomationError)
+	require.True(t, ok)
+	require.Equal(t, "trigger.feature.condition.and[1].or[0]", autoErr.Key)
+}
+
+func TestFeatureTriggerConditionInvalidOp(t *testing.T) {
+	t.Parallel()
+
+	config := `
+name: Test
+trigger:
+  feature:
+    id: door
+    condition:
+      or:
+        - attr: 'openclose'
+          op: 'eq'
+          value: 2
+actions:
+  - light_zone:
+      on_off: 'on'
+`
+
+	sys := gohome.NewSystem("test system")
+	sys.AddFeature(feature.NewSensor("door", attr.NewOpenClose("openclose", nil)))
+
+	_, err := gohome.NewAutomation(sys, config)
+	require.NotNil(t, err)
+	require.Equal(t, "trigger.feature.condition.or[0]", err.(*gohome.AutomationError).Key)
+}
+
+func TestAutomationErrorPosition(t *testing.T) {
+	t.Parallel()
+
+	config := `
+name: Test
+trigger:
+  feature:
+    id: door
+    condition:
+      and:
+        - attr: 'openclose'
+          op: '=='
+          value: 2
+        - or:
+          - attr: 'openclose'
+            op: '=='
+            value: 1
+          - aid: 'hallway'
+            attr: 'onoff'
+            op: 'eq'
+            value: 1
+actions:
+  - light_zone:
+      on_off: 'on'
+`
+
+	sys := gohome.NewSystem("test system")
+	sys.AddFeature(feature.NewSensor("door", attr.NewOpenClose("openclose", nil)))
+	hallway := feature.NewLightZone("hallway", feature.LightZoneModeBinary)
+	hallway.AutomationID = "hallway"
+	sys.AddFeature(hallway)
+
+	_, err := gohome.NewAutomation(sys, config)
+	require.NotNil(t, err)
+	autoErr := err.(*gohome.AutomationError)
+	require.Equal(t, "trigger.feature.condition.and[1].or[1]", autoErr.Key)
+	require.Equal(t, 15, autoErr.Line)
+	require.Equal(t, 11, autoErr.Column)
+}
+
+func TestAutomationErrorPositionAction(t *testing.T) {
+	t.Parallel()
+
+	config := `
+name: Test
+trigger:
+  time:
+    at: sunset
+actions:
+- light_zone:
+    on_off: 'on'
+- scene:
+    id: 'invalid'
+`
+
+	sys := gohome.NewSystem("test system")
+	_, err := gohome.NewAutomation(sys, config)
+	require.NotNil(t, err)
+	autoErr := err.(*gohome.AutomationError)
+	require.Equal(t, "actions[1].scene", autoErr.Key)
+	require.Equal(t, 9, autoErr.Line)
+	require.Equal(t, 3, autoErr.Column)
+}
+
+func TestAutomationErrorPositionJSON(t *testing.T) {
+	t.Parallel()
+
+	config := `{
+  "name": "Test",
+  "trigger": {"time": {"at": "sunset"}},
+  "actions": [
+    {"light_zone": {"on_off": "on"}},
+    {"scene": {"id": "invalid"}}
+  ]
+}`
+
+	sys := gohome.NewSystem("test system")
+	_, err := gohome.NewAutomation(sys, config)
+	require.NotNil(t, err)
+	autoErr := err.(*gohome.AutomationError)
+	require.Equal(t, "actions[1].scene", autoErr.Key)
+	require.Equal(t, 6, autoErr.Line)
+	require.Equal(t, 6, autoErr.Column)
+}
+
+func TestAutomationErrorSyntax(t *testing.T) {
+	t.Parallel()
+
+	config := `
+name: Test
+trigger:
+  time:
+    at: sunset
+   days: mon
+actions:
+  - scene:
+      id: 12345
+`
+
+	sys := gohome.NewSystem("test system")
+	_, err := gohome.NewAutomation(sys, config)
+	require.NotNil(t, err)
+	require.True(t, err.(*gohome.AutomationError).Line > 0)
+}
+
+func TestAutomationSummary(t *testing.T) {
+	t.Parallel()
+
+	config := `
+name: Test
+enabled: false
+trigger:
+  feature:
+    aid: door
+    condition:
+      and:
+        - attr: 'openclose'
+          op: '=='
+          value: 2
+        - or:
+          - aid: 'hallway'
+            attr: 'onoff'
+            op: '=='
+            value: 1
+          - aid: 'hallway'
+            attr: 'onoff'
+            op: '=='
+            value: 2
+actions:
+  - light_zone:
+      aid: hallway
+      on_off: 'on'
+      brightness: 50
+  - switch:
+      on_off: 'off'
+`
+
+	sys := gohome.NewSystem("test system")
+	door := feature.NewSensor("door", attr.NewOpenClose("openclose", nil))
+	door.AutomationID = "door"
+	sys.AddFeature(door)
+	hallway := feature.NewLightZone("hallway", feature.LightZoneModeContinuous)
+	hallway.AutomationID = "hallway"
+	sys.AddFeature(hallway)
+
+	auto, err := gohome.NewAutomation(sys, config)
+	require.Nil(t, err)
+	require.False(t, auto.Enabled)
+	require.Equal(t, config, auto.Script)
+	require.Equal(t,
+		"feature: door, condition: openclose == 2 and (hallway.onoff == 1 or hallway.onoff == 2)",
+		auto.TriggerSummary())
+	require.Equal(t, []string{
+		"light_zone: hallway, on_off: on, brightness: 50",
+		"switch: all, on_off: off",
+	}, auto.ActionSummary())
+}
+
+func TestAutomationDryRun(t *testing.T) {
+	t.Parallel()
+
+	config := `
+name: Test
+trigger:
+  time:
+    at: '10:00:00'
+actions:
+  - light_zone:
+      on_off: 'on'
+      brightness: 40
+  - switch:
+      aid: fan
+      on_off: 'off'
+`
+
+	sys := gohome.NewSystem("test system")
+	kitchen := feature.NewLightZone("2", feature.LightZoneModeContinuous)
+	kitchen.Name = "kitchen"
+	sys.AddFeature(kitchen)
+	bedroom := feature.NewLightZone("1", feature.LightZoneModeContinuous)
+	bedroom.Name = "bedroom"
+	sys.AddFeature(bedroom)
+	fan := feature.NewSwitch("3")
+	fan.Name = "fan"
+	fan.AutomationID = "fan"
+	sys.AddFeature(fan)
+
+	auto, err := gohome.NewAutomation(sys, config)
+	require.Nil(t, err)
+
+	triggered := false
+	auto.Triggered = func(actions *gohome.CommandGroup) {
+		triggered = true
+	}
+
+	group, err := auto.DryRun()
+	require.Nil(t, err)
+	require.False(t, triggered)
+	require.Equal(t, "Test", group.Desc)
+	require.Equal(t, 3, len(group.Cmds))
+
+	// The wildcard light zone action is expanded in name order
+	var names []string
+	for _, command := range group.Cmds {
+		setAttrs, ok := command.(*cmd.FeatureSetAttrs)
+		require.True(t, ok)
+		names = append(names, setAttrs.FeatureName)
+	}
+	require.Equal(t, []string{"bedroom", "kitchen", "fan"}, names)
+
+	lz := group.Cmds[0].(*cmd.FeatureSetAttrs)
+	require.Equal(t, feature.FTLightZone, lz.FeatureType)
+	require.Equal(t, int32(attr.OnOffOn), lz.Attrs[feature.LightZoneOnOffLocalID].Value)
+	require.Equal(t, float32(40), lz.Attrs[feature.LightZoneBrightnessLocalID].Value)
+
+	sw := group.Cmds[2].(*cmd.FeatureSetAttrs)
+	require.Equal(t, int32(attr.OnOffOff), sw.Attrs[feature.SwitchOnOffLocalID].Value)
+
+	// Features added after the automation was loaded are picked up by the dry run
+	porch := feature.NewLightZone("4", feature.LightZoneModeContinuous)
+	porch.Name = "porch"
+	sys.AddFeature(porch)
+	group, err = auto.DryRun()
+	require.Nil(t, err)
+	require.Equal(t, 4, len(group.Cmds))
+}
+
+func TestTimeTriggerCron(t *testing.T) {
+	t.Parallel()
+
+	config := `
+name: Test
+trigger:
+  time:
+    cron: '*/15 8-17 * * mon-fri'
+actions:
+  - light_zone:
+      on_off: 'on'
+`
+
+	sys := gohome.NewSystem("test system")
+	auto, err := gohome.NewAutomation(sys, config)
+	require.Nil(t, err)
+
+	trigger := auto.Trigger.(*gohome.TimeTrigger)
+	require.Equal(t, gohome.TimeTriggerModeCron, trigger.Mode)
+	require.Equal(t, "*/15 8-17 * * mon-fri", trigger.Cron.Expr)
+	require.Equal(t, "time: cron */15 8-17 * * mon-fri", auto.TriggerSummary())
+
+	config = `
+name: Test
+trigger:
+  time:
+    cron: '*/15 8-17 * * mon-fri'
+    days: 'sat'
+actions:
+  - light_zone:
+      on_off: 'on'
+`
+	_, err = gohome.NewAutomation(sys, config)
+	require.NotNil(t, err)
+	require.Equal(t, "trigger.time.days", err.(*gohome.AutomationError).Key)
+
+	config = `
+name: Test
+trigger:
+  time:
+    cron: '*/15 25 * * *'
+actions:
+  - light_zone:
+      on_off: 'on'
+`
+	_, err = gohome.NewAutomation(sys, config)
+	require.NotNil(t, err)
+	require.Equal(t, "trigger.time.cron", err.(*gohome.AutomationError).Key)
+	require.Equal(t, 5, err.(*gohome.AutomationError).Line)
+}
+
+func TestFeatureTriggerFor(t *testing.T) {
+	t.Parallel()
+
+	config := `
+name: Test
+trigger:
+  feature:
+    id: garage
+    for: 10m
+    condition:
+      attr: 'openclose'
+      op: '=='
+      value: 2
+actions:
+  - light_zone:
+      on_off: 'on'
+`
+
+	sys := gohome.NewSystem("test system")
+	sensor := feature.NewSensor("garage", attr.NewOpenClose("openclose", nil))
+	sys.AddFeature(sensor)
+	auto, err := gohome.NewAutomation(sys, config)
+	require.Nil(t, err)
+	require.Equal(t, "feature: garage, condition: openclose == 2, for: 10m", auto.TriggerSummary())
+
+	// The test decides when each of the timers started by the trigger expire
+	type timer struct {
+		d  time.Duration
+		ch chan time.Time
+	}
+	timers := make(chan timer, 10)
+	mt := &MockTime{
+		now: time.Date(2016, time.December, 5, 10, 0, 0, 0, time.UTC),
+		after: func(mt *MockTime, d time.Duration) <-chan time.Time {
+			c := make(chan time.Time, 1)
+			timers <- timer{d: d, ch: c}
+			return c
+		},
+	}
+	trigger := auto.Trigger.(*gohome.FeatureTrigger)
+	require.Equal(t, 10*time.Minute, trigger.For)
+	trigger.Time = mt
+
+	fired := make(chan bool, 10)
+	auto.Triggered = func(actions *gohome.CommandGroup) {
+		fired <- true
+	}
+
+	ch := make(chan evtbus.Event)
+	auto.StartConsuming(ch)
+	defer auto.StopConsuming()
+
+	evt := func(value int32) *gohome.FeatureAttrsChangedEvt {
+		openclose := sensor.Attrs["openclose"].Clone()
+		openclose.Value = value
+		return &gohome.FeatureAttrsChangedEvt{FeatureID: "garage", Attrs: feature.NewAttrs(openclose)}
+	}
+	nextTimer := func() timer {
+		select {
+		case tm := <-timers:
+			return tm
+		case <-time.After(time.Second):
+			require.FailNow(t, "timer not started")
+		}
+		return timer{}
+	}
+	noTimer := func() {
+		select {
+		case <-timers:
+			require.FailNow(t, "unexpected timer started")
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	requireFired := func(expected bool) {
+		select {
+		case <-fired:
+			require.True(t, expected, "trigger should not have fired")
+		case <-time.After(100 * time.Millisecond):
+			require.False(t, expected, "trigger did not fire")
+		}
+	}
+
+	// Door opens then closes before the duration expires, should not fire
+	ch <- evt(attr.OpenCloseOpen)
+	tm := nextTimer()
+	require.Equal(t, 10*time.Minute, tm.d)
+	ch <- evt(attr.OpenCloseClosed)
+	time.Sleep(50 * time.Millisecond)
+	tm.ch <- mt.Now()
+	requireFired(false)
+
+	// Door stays open for the whole duration, another open event while timing doesn't restart the timer
+	ch <- evt(attr.OpenCloseOpen)
+	tm = nextTimer()
+	ch <- evt(attr.OpenCloseOpen)
+	noTimer()
+	tm.ch <- mt.Now()
+	requireFired(true)
+
+	// Still open, already fired so should not fire again
+	ch <- evt(attr.OpenCloseOpen)
+	noTimer()
+	requireFired(false)
+
+	// Closed then opened again starts a new timer
+	ch <- evt(attr.OpenCloseClosed)
+	ch <- evt(attr.OpenCloseOpen)
+	tm = nextTimer()
+	tm.ch <- mt.Now()
+	requireFired(true)
+}
+
+func TestFeatureTriggerForInvalid(t *testing.T) {
+	t.Parallel()
+
+	sys := gohome.NewSystem("test system")
+	sys.AddFeature(feature.NewSensor("garage", attr.NewOpenClose("openclose", nil)))
+
+	for _, value := range []string{"for: 10", "for: -5m", "for: 10m\n    count: 2"} {
+		config := `
+name: Test
+trigger:
+  feature:
+    id: garage
+    ` + value + `
+    condition:
+      attr: 'openclose'
+      op: '=='
+      value: 2
+actions:
+  - light_zone:
+      on_off: 'on'
+`
+		_, err := gohome.NewAutomation(sys, config)
+		require.NotNil(t, err, value)
+		require.Equal(t, "trigger.feature.for", err.(*gohome.AutomationError).Key, value)
+	}
+}
+
+func TestMultipleTriggers(t *testing.T) {
+	t.Parallel()
+
+	config := `
+name: Test
+triggers:
+  - time:
+      at: '22:00:00'
+  - event:
+      type: client_disconnected
+      last_client: true
+  - event:
+      type: server_started
+actions:
+  - light_zone:
+      on_off: 'off'
+`
+
+	sys := gohome.NewSystem("test system")
+	auto, err := gohome.NewAutomation(sys, config)
+	require.Nil(t, err)
+	require.Equal(t,
+		"time: 22:00:00 or event: client_disconnected, last_client: true or event: server_started",
+		auto.TriggerSummary())
+
+	multi, ok := auto.Trigger.(*gohome.MultiTrigger)
+	require.True(t, ok)
+	require.Equal(t, 3, len(multi.Triggers))
+
+	fired := make(chan bool, 10)
+	auto.Triggered = func(actions *gohome.CommandGroup) {
+		fired <- true
+	}
+
+	ch := make(chan evtbus.Event)
+	auto.StartConsuming(ch)
+	ch <- &gohome.ClientConnectedEvt{ConnectionID: "1"}
+	ch <- &gohome.ClientDisconnectedEvt{ConnectionID: "1"}
+	ch <- &gohome.ServerStartedEvt{}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-fired:
+		case <-time.After(time.Second):
+			require.FailNow(t, "trigger did not fire")
+		}
+	}
+	auto.StopConsuming()
+	close(ch)
+
+	config = `
+name: Test
+trigger:
+  event:
+    type: server_started
+triggers:
+  - event:
+      type: server_started
+actions:
+  - light_zone:
+      on_off: 'off'
+`
+	_, err = gohome.NewAutomation(sys, config)
+	require.NotNil(t, err)
+	require.Equal(t, "triggers", err.(*gohome.AutomationError).Key)
+}
+
+func TestAutomationOnlyIf(t *testing.T) {
+	t.Parallel()
+
+	config := `
+name: Test
+trigger:
+  event:
+    type: server_started
+only_if:
+  and:
+    - time:
+        after: sunset
+        before: '23:00'
+    - days: 'mon|tues|wed|thurs|fri'
+    - aid: away
+      attr: onoff
+      op: '=='
+      value: 2
+    - not:
+        aid: living
+        attr: onoff
+        op: '=='
+        value: 2
+actions:
+  - light_zone:
+      aid: living
+      on_off: 'on'
+`
+
+	sys := gohome.NewSystem("test system")
+	sys.Latitude = testLatitude
+	sys.Longitude = testLongitude
+	evtBus := evtbus.NewBus(100, 100)
+	sys.Services.EvtBus = evtBus
+	sys.Services.Monitor = gohome.NewMonitor(sys, evtBus)
+
+	away := feature.NewSwitch("away")
+	away.AutomationID = "away"
+	living := feature.NewLightZone("living", feature.LightZoneModeBinary)
+	living.AutomationID = "living"
+	sys.AddFeature(away)
+	sys.AddFeature(living)
+
+	report := func(f *feature.Feature, localID string, val int32) {
+		a := f.Attrs[localID].Clone()
+		a.Value = val
+		evtBus.Enqueue(&gohome.FeatureReportingEvt{FeatureID: f.ID, Attrs: feature.NewAttrs(a)})
+		time.Sleep(100 * time.Millisecond)
+	}
+	report(away, "onoff", attr.OnOffOn)
+	report(living, "onoff", attr.OnOffOff)
+
+	auto, err := gohome.NewAutomation(sys, config)
+	require.Nil(t, err)
+	require.Equal(t,
+		"time between sunset and 23:00 and days mon|tues|wed|thurs|fri and away.onoff == 2 and "+
+			"not (living.onoff == 2)",
+		auto.OnlyIfSummary())
+
+	loc := seattle(t)
+	mt := &MockTime{}
+	auto.Time = mt
+
+	triggered := 0
+	var skipped []string
+	auto.Triggered = func(actions *gohome.CommandGroup) {
+		triggered++
+	}
+	auto.Skipped = func(reason string) {
+		skipped = append(skipped, reason)
+	}
+
+	// Monday evening after sunset, everything is true
+	mt.now = time.Date(2016, time.December, 5, 20, 0, 0, 0, loc)
+	auto.Trigger.Trigger()
+	require.Equal(t, 1, triggered)
+	require.Equal(t, 0, len(skipped))
+
+	// Before sunset
+	mt.now = time.Date(2016, time.December, 5, 15, 0, 0, 0, loc)
+	auto.Trigger.Trigger()
+	require.Equal(t, 1, triggered)
+	require.Equal(t, "only_if condition is false: time between sunset and 23:00", skipped[0])
+
+	// Saturday
+	mt.now = time.Date(2016, time.December, 10, 20, 0, 0, 0, loc)
+	auto.Trigger.Trigger()
+	require.Equal(t, "only_if condition is false: days mon|tues|wed|thurs|fri", skipped[1])
+
+	// Living room light is already on
+	mt.now = time.Date(2016, time.December, 5, 20, 0, 0, 0, loc)
+	report(living, "onoff", attr.OnOffOn)
+	auto.Trigger.Trigger()
+	require.Equal(t, "only_if condition is false: not (living.onoff == 2)", skipped[2])
+
+	// Not away
+	report(living, "onoff", attr.OnOffOff)
+	report(away, "onoff", attr.OnOffOff)
+	auto.Trigger.Trigger()
+	require.Equal(t, "only_if condition is false: away.onoff == 2", skipped[3])
+	require.Equal(t, 1, triggered)
+}
+
+func TestAutomationOnlyIfTimeWindow(t *testing.T) {
+	t.Parallel()
+
+	loc := seattle(t)
+	tests := []struct {
+		window string
+		at     time.Time
+		ok     bool
+	}{
+		// Wraps around midnight
+		{"after: '22:00'\n      before: '06:00'", time.Date(2016, time.December, 5, 23, 0, 0, 0, loc), true},
+		{"after: '22:00'\n      before: '06:00'", time.Date(2016, time.December, 5, 5, 59, 59, 0, loc), true},
+		{"after: '22:00'\n      before: '06:00'", time.Date(2016, time.December, 5, 6, 0, 0, 0, loc), false},
+		{"after: '22:00'\n      before: '06:00'", time.Date(2016, time.December, 5, 12, 0, 0, 0, loc), false},
+		{"after: '07:30'", time.Date(2016, time.December, 5, 7, 30, 0, 0, loc), true},
+		{"after: '07:30'", time.Date(2016, time.December, 5, 7, 29, 0, 0, loc), false},
+		{"before: 'sunrise+1h'", time.Date(2016, time.December, 5, 8, 30, 0, 0, loc), true},
+		{"before: 'sunrise+1h'", time.Date(2016, time.December, 5, 9, 0, 0, 0, loc), false},
+	}
+
+	sys := gohome.NewSystem("test system")
+	sys.Latitude = testLatitude
+	sys.Longitude = testLongitude
+	for _, test := range tests {
+		config := `
+name: Test
+trigger:
+  event:
+    type: server_started
+only_if:
+  time:
+      ` + test.window + `
+actions:
+  - light_zone:
+      on_off: 'on'
+`
+		auto, err := gohome.NewAutomation(sys, config)
+		require.Nil(t, err, test.window)
+		auto.Time = &MockTime{now: test.at}
+
+		triggered := false
+		auto.Triggered = func(actions *gohome.CommandGroup) {
+			triggered = true
+		}
+		auto.Skipped = func(reason string) {}
+		auto.Trigger.Trigger()
+		require.Equal(t, test.ok, triggered, "%s at %s", test.window, test.at)
+	}
+
+	config := `
+name: Test
+trigger:
+  event:
+    type: server_started
+only_if:
+  time:
+    after: '25:00'
+actions:
+  - light_zone:
+      on_off: 'on'
+`
+	_, err := gohome.NewAutomation(sys, config)
+	require.NotNil(t, err)
+	require.Equal(t, "only_if.time.after", err.(*gohome.AutomationError).Key)
+}
+
+func TestAutomationSelector(t *testing.T) {
+	t.Parallel()
+
+	sys := gohome.NewSystem("test system")
+	sys.AddDevice(&gohome.Device{ID: "dev1", Name: "Lutron Main Repeater"})
+	sys.AddDevice(&gohome.Device{ID: "dev2", Name: "Hue Bridge"})
+
+	addZone := func(id, name, deviceID string) {
+		lz := feature.NewLightZone(id, feature.LightZoneModeBinary)
+		lz.Name = name
+		lz.AutomationID = id
+		lz.DeviceID = deviceID
+		sys.AddFeature(lz)
+	}
+	addZone("front", "Outside Front", "dev1")
+	addZone("back", "outside back", "dev1")
+	addZone("garage", "Outside Garage", "dev2")
+	addZone("kitchen", "Kitchen", "dev2")
+	sw := feature.NewSwitch("outside_fan")
+	sw.Name = "Outside Fan"
+	sys.AddFeature(sw)
+
+	tests := []struct {
+		selector string
+		expected []string
+	}{
+		// Globs ignore case, only light zones are selected by a light_zone action. The features are
+		// sorted by name, upper case first
+		{"name: '*outside*'\n        exclude: ['garage']", []string{"front", "back"}},
+		{"name: '/^Outside/'", []string{"front", "garage"}},
+		{"device: 'Lutron*'", []string{"front", "back"}},
+		{"device: 'dev2'", []string{"kitchen", "garage"}},
+		{"aids: ['kitchen', 'garage', 'outside_fan']", []string{"kitchen", "garage"}},
+		{"name: '*'\n        exclude: ['Outside*', '/Kitchen/']", []string{}},
+		{"type: LightZone\n        exclude: ['/Kitchen/']", []string{"front", "garage", "back"}},
+	}
+
+	for _, test := range tests {
+		config := `
+name: Test
+trigger:
+  event:
+    type: server_started
+actions:
+  - light_zone:
+      selector:
+        ` + test.selector + `
+      on_off: 'on'
+`
+		auto, err := gohome.NewAutomation(sys, config)
+		require.Nil(t, err, test.selector)
+
+		group, err := auto.DryRun()
+		require.Nil(t, err)
+		ids := []string{}
+		for _, c := range group.Cmds {
+			ids = append(ids, c.(*cmd.FeatureSetAttrs).FeatureID)
+		}
+		require.Equal(t, test.expected, ids, test.selector)
+	}
+
+	config := `
+name: Test
+trigger:
+  event:
+    type: server_started
+actions:
+  - light_zone:
+      selector:
+        name: '*Outside*'
+        exclude: ['garage']
+      on_off: 'on'
+`
+	auto, err := gohome.NewAutomation(sys, config)
+	require.Nil(t, err)
+	require.Equal(t, []string{"light_zone: (name: *Outside*, exclude: garage), on_off: on"}, auto.ActionSummary())
+
+	invalid := []struct {
+		action string
+		key    string
+	}{
+		{"light_zone:\n      selector:\n        name: '/[/'\n      on_off: 'on'", "actions[0].light_zone.selector"},
+		{"light_zone:\n      selector:\n        type: Switch\n      on_off: 'on'", "actions[0].light_zone.selector.type"},
+		{"light_zone:\n      aid: front\n      selector:\n        name: '*'\n      on_off: 'on'",
+			"actions[0].light_zone.selector"},
+	}
+	for _, test := range invalid {
+		config := "name: Test\ntrigger:\n  event:\n    type: server_started\nactions:\n  - " + test.action + "\n"
+		_, err := gohome.NewAutomation(sys, config)
+		require.NotNil(t, err, test.action)
+		require.Equal(t, test.key, err.(*gohome.AutomationError).Key, test.action)
+	}
+}
+
+func TestFeatureTriggerTransitions(t *testing.T) {
+	t.Parallel()
+
+	config := `
+name: Test
+trigger:
+  feature:
+    id: temp
+    condition:
+      %s
+actions:
+  - light_zone:
+      on_off: 'on'
+`
+
+	tests := []struct {
+		condition string
+		summary   string
+
+		// previous is the value before the first value, -1 if it is not known
+		previous int32
+		values   []int32
+		fired    []bool
+	}{
+		{
+			condition: "attr: temp\n      op: changed",
+			summary:   "temp changed",
+			previous:  -1,
+			values:    []int32{70, 72, 72, 75},
+			fired:     []bool{false, true, false, true},
+		},
+		{
+			condition: "attr: temp\n      from: 70\n      to: 72",
+			summary:   "temp changed from 70 to 72",
+			previous:  68,
+			values:    []int32{72, 70, 71, 70, 72},
+			fired:     []bool{false, false, false, false, true},
+		},
+		{
+			condition: "attr: temp\n      to: 72",
+			summary:   "temp changed to 72",
+			previous:  68,
+			values:    []int32{72, 72, 70, 72},
+			fired:     []bool{true, false, false, true},
+		},
+		{
+			condition: "attr: temp\n      op: crosses_above\n      value: 75",
+			summary:   "temp crosses_above 75",
+			previous:  -1,
+			values:    []int32{74, 75, 76, 77, 74, 76},
+			fired:     []bool{false, false, true, false, false, true},
+		},
+		{
+			condition: "attr: temp\n      op: crosses_above\n      value: 75\n      hysteresis: 2",
+			summary:   "temp crosses_above 75, hysteresis 2",
+			previous:  -1,
+			values:    []int32{74, 76, 74, 76, 73, 76},
+			fired:     []bool{false, true, false, false, false, true},
+		},
+		{
+			condition: "attr: temp\n      op: crosses_below\n      value: 60\n      hysteresis: 1",
+			summary:   "temp crosses_below 60, hysteresis 1",
+			previous:  -1,
+			values:    []int32{61, 59, 60, 59, 61, 58},
+			fired:     []bool{false, true, false, false, false, true},
+		},
+	}
+
+	for _, test := range tests {
+		sys := gohome.NewSystem("test system")
+		sensor := feature.NewSensor("temp", attr.NewTemp("temp", nil))
+		sys.AddFeature(sensor)
+
+		value := func(v int32) *attr.Attribute {
+			a := sensor.Attrs["temp"].Clone()
+			a.Value = v
+			return a
+		}
+
+		// The previous value of the first change comes from the monitor
+		if test.previous != -1 {
+			evtBus := evtbus.NewBus(100, 100)
+			sys.Services.EvtBus = evtBus
+			sys.Services.Monitor = gohome.NewMonitor(sys, evtBus)
+			evtBus.AddConsumer(sys.Services.Monitor)
+			evtBus.Enqueue(&gohome.FeatureReportingEvt{FeatureID: "temp", Attrs: feature.NewAttrs(value(test.previous))})
+			time.Sleep(100 * time.Millisecond)
+		}
+
+		auto, err := gohome.NewAutomation(sys, fmt.Sprintf(config, test.condition))
+		require.Nil(t, err, test.condition)
+		require.Equal(t, "feature: temp, condition: "+test.summary, auto.TriggerSummary())
+
+		fired := make(chan bool, 10)
+		auto.Triggered = func(actions *gohome.CommandGroup) {
+			fired <- true
+		}
+		ch := make(chan evtbus.Event)
+		auto.StartConsuming(ch)
+
+		previous := test.previous
+		for i, v := range test.values {
+			// Each change is reported by the extension, then by the Monitor with the previous value, but
+			// the transition should only match once
+			ch <- &gohome.FeatureAttrsChangedEvt{FeatureID: "temp", Attrs: feature.NewAttrs(value(v))}
+			monitorEvt := &gohome.FeatureAttrsChangedEvt{
+				FeatureID: "temp",
+				Context:   gohome.MonitorContext,
+				Attrs:     feature.NewAttrs(value(v)),
+				Previous:  map[string]*attr.Attribute{},
+			}
+			if previous != -1 {
+				monitorEvt.Previous["temp"] = value(previous)
+			}
+			ch <- monitorEvt
+			previous = v
+
+			count := 0
+			for done := false; !done; {
+				select {
+				case <-fired:
+					count++
+				case <-time.After(50 * time.Millisecond):
+					done = true
+				}
+			}
+			if test.fired[i] {
+				require.Equal(t, 1, count, "%s, value %d", test.summary, i)
+			} else {
+				require.Equal(t, 0, count, "%s, value %d", test.summary, i)
+			}
+		}
+		auto.StopConsuming()
+	}
+}
+
+func TestFeatureTriggerTransitionsInvalid(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		script string
+		key    string
+	}{
+		{"trigger:\n  feature:\n    id: temp\n    condition:\n      attr: temp\n      op: changed\n      value: 2",
+			"trigger.feature.condition"},
+		{"trigger:\n  feature:\n    id: temp\n    condition:\n      attr: temp\n      from: 1\n      op: '=='",
+			"trigger.feature.condition"},
+		{"trigger:\n  feature:\n    id: temp\n    condition:\n      attr: temp\n      op: '>'\n      value: 2\n      hysteresis: 1",
+			"trigger.feature.condition"},
+		{"trigger:\n  feature:\n    id: door\n    condition:\n      attr: openclose\n      op: crosses_above\n      value: 1",
+			"trigger.feature.condition"},
+		{"trigger:\n  feature:\n    id: temp\n    condition:\n      attr: temp\n      op: crosses_below\n      value: 1\n      hysteresis: -1",
+			"trigger.feature.condition"},
+		{"trigger:\n  feature:\n    id: temp\n    for: 1m\n    condition:\n      attr: temp\n      op: changed",
+			"trigger.feature.for"},
+		{"trigger:\n  event:\n    type: server_started\nonly_if:\n  id: temp\n  attr: temp\n  to: 1",
+			"only_if"},
+	}
+
+	sys := gohome.NewSystem("test system")
+	sys.AddFeature(feature.NewSensor("temp", attr.NewTemp("temp", nil)))
+	sys.AddFeature(feature.NewSensor("door", attr.NewString("openclose", "", nil)))
+	for _, test := range tests {
+		config := "name: Test\n" + test.script + "\nactions:\n  - light_zone:\n      on_off: 'on'\n"
+		_, err := gohome.NewAutomation(sys, config)
+		require.NotNil(t, err, test.script)
+		require.Equal(t, test.key, err.(*gohome.AutomationError).Key, test.script)
+	}
+}
@@ -0,0 +1,203 @@
+package gohome
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-home-iot/event-bus"
+	"github.com/markdaws/gohome/pkg/clock"
+)
+
+// maxRunsPer limits the automation to running count times in the window
+type maxRunsPer struct {
+	Count  int    `yaml:"count"`
+	Window string `yaml:"window"`
+
+	window time.Duration
+}
+
+// throttledTrigger wraps the trigger of a piece of automation, limiting how often the automation runs.
+// The wrapped trigger calls fire each time it fires, which either runs the automation or suppresses
+// the firing. It works the same way for every type of trigger
+type throttledTrigger struct {
+	trigger Trigger
+	auto    *Automation
+
+	// cooldown is how long after running the automation can't run again
+	cooldown    time.Duration
+	cooldownStr string
+
+	// debounce is how long the trigger must be quiet before the automation runs, each time the trigger
+	// fires within the debounce period the previous firing is suppressed
+	debounce    time.Duration
+	debounceStr string
+
+	maxRunsPer *maxRunsPer
+
+	mutex   sync.Mutex
+	last    time.Time
+	runs    []time.Time
+	pending int
+	waiting bool
+	done    chan struct{}
+}
+
+// parseThrottle returns the throttle for the automation, nil if the automation does not have a
+// cooldown, debounce or max_runs_per key
+func parseThrottle(auto automationIntermediate) (*throttledTrigger, error) {
+	if auto.Cooldown == "" && auto.Debounce == "" && auto.MaxRunsPer == nil {
+		return nil, nil
+	}
+
+	t := &throttledTrigger{
+		cooldownStr: auto.Cooldown,
+		debounceStr: auto.Debounce,
+		maxRunsPer:  auto.MaxRunsPer,
+	}
+
+	var err error
+	if auto.Cooldown != "" {
+		if t.cooldown, err = parsePositiveDuration("cooldown", auto.Cooldown); err != nil {
+			return nil, err
+		}
+	}
+	if auto.Debounce != "" {
+		if t.debounce, err = parsePositiveDuration("debounce", auto.Debounce); err != nil {
+			return nil, err
+		}
+	}
+	if runsPer := auto.MaxRunsPer; runsPer != nil {
+		if runsPer.Count <= 0 {
+			return nil, &AutomationError{
+				Key: "max_runs_per.count",
+				Msg: fmt.Sprintf("invalid count value: %d, must be greater than 0", runsPer.Count),
+			}
+		}
+		if runsPer.Window == "" {
+			return nil, &AutomationError{Key: "max_runs_per", Msg: "missing window key"}
+		}
+		if runsPer.window, err = parsePositiveDuration("max_runs_per.window", runsPer.Window); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// parsePositiveDuration parses a duration value such as 30s, key is the key of the value in the script
+func parsePositiveDuration(key, value string) (time.Duration, error) {
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		return 0, &AutomationError{
+			Key: key,
+			Msg: fmt.Sprintf("invalid %s value: %s, must be a duration such as 30s, 10m or 1h30m", key, value),
+		}
+	}
+	return d, nil
+}
+
+func (t *throttledTrigger) ConsumerName() string {
+	return "ThrottledTrigger - " + t.trigger.ConsumerName()
+}
+
+// Trigger fires the wrapped trigger, the firing is throttled the same as when the trigger fires by itself
+func (t *throttledTrigger) Trigger() {
+	t.trigger.Trigger()
+}
+
+// StartConsuming starts the wrapped trigger
+func (t *throttledTrigger) StartConsuming(ch chan evtbus.Event) {
+	t.mutex.Lock()
+	t.done = make(chan struct{})
+	t.mutex.Unlock()
+
+	t.trigger.StartConsuming(ch)
+}
+
+// StopConsuming stops the wrapped trigger, a firing waiting for the debounce period to end is dropped
+func (t *throttledTrigger) StopConsuming() {
+	t.mutex.Lock()
+	if t.done != nil {
+		close(t.done)
+		t.done = nil
+	}
+	t.waiting = false
+	t.mutex.Unlock()
+
+	t.trigger.StopConsuming()
+}
+
+// fire is called each time the wrapped trigger fires, run runs the automation
+func (t *throttledTrigger) fire(run func()) {
+	if t.debounce == 0 {
+		t.limit(run)
+		return
+	}
+
+	t.mutex.Lock()
+	t.pending++
+	id := t.pending
+	superseded := t.waiting
+	t.waiting = true
+	done := t.done
+	t.mutex.Unlock()
+
+	if superseded {
+		t.auto.suppress(fmt.Sprintf("debounce %s, triggered again before the debounce period ended", t.debounceStr))
+	}
+
+	clk := t.auto.clock()
+	timer := clk.After(t.debounce)
+	go func() {
+		defer clock.Release(clk, timer)
+
+		select {
+		case <-timer:
+		case <-done:
+			return
+		}
+
+		t.mutex.Lock()
+		latest := id == t.pending && t.waiting
+		if latest {
+			t.waiting = false
+		}
+		t.mutex.Unlock()
+
+		if latest {
+			t.limit(run)
+		}
+	}()
+}
+
+// limit runs the automation unless it is in its cooldown period or has already run max_runs_per times
+// in the window
+func (t *throttledTrigger) limit(run func()) {
+	now := t.auto.now()
+
+	t.mutex.Lock()
+	if t.cooldown > 0 && !t.last.IsZero() && now.Sub(t.last) < t.cooldown {
+		remaining := t.cooldown - now.Sub(t.last)
+		t.mutex.Unlock()
+		t.auto.suppress(fmt.Sprintf("cooldown %s, %s remaining", t.cooldownStr, remaining))
+		return
+	}
+
+	if runsPer := t.maxRunsPer; runsPer != nil {
+		i := 0
+		for i < len(t.runs) && now.Sub(t.runs[i]) >= runsPer.window {
+			i++
+		}
+		t.runs = t.runs[i:]
+		if len(t.runs) >= runsPer.Count {
+			t.mutex.Unlock()
+			t.auto.suppress(fmt.Sprintf("max_runs_per %d in %s reached", runsPer.Count, runsPer.Window))
+			return
+		}
+		t.runs = append(t.runs, now)
+	}
+	t.last = now
+	t.mutex.Unlock()
+
+	run()
+}
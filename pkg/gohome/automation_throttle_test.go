@@ -0,0 +1,117 @@
+package gohome_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/markdaws/gohome/pkg/attr"
+	"github.com/markdaws/gohome/pkg/gohome"
+	"github.com/stretchr/testify/require"
+)
+
+const throttleConfig = `
+name: Fan
+trigger:
+  event:
+    type: server_started
+%s
+actions:
+  - switch:
+      aid: fan
+      on_off: 'on'
+`
+
+// throttled returns the automation with the throttle settings and a channel that receives the reason
+// each time the automation is suppressed
+func (h *runHarness) throttled(settings string) (*gohome.Automation, chan string) {
+	auto := h.automation(fmt.Sprintf(throttleConfig, settings))
+	suppressed := make(chan string, 10)
+	auto.Suppressed = func(reason string) { suppressed <- reason }
+	return auto, suppressed
+}
+
+// advance moves the mock time forward
+func (h *runHarness) advance(d time.Duration) {
+	h.mt.mutex.Lock()
+	h.mt.now = h.mt.now.Add(d)
+	h.mt.mutex.Unlock()
+}
+
+func TestAutomationCooldown(t *testing.T) {
+	h := newRunHarness(t)
+	auto, suppressed := h.throttled("cooldown: 5m")
+
+	auto.Trigger.Trigger()
+	requireSet(t, h.next(h.fired), "fan", "onoff", attr.OnOffOn)
+
+	h.advance(time.Minute)
+	auto.Trigger.Trigger()
+	h.nothing(h.fired)
+	require.Equal(t, "cooldown 5m, 4m0s remaining", <-suppressed)
+
+	h.advance(4 * time.Minute)
+	auto.Trigger.Trigger()
+	h.next(h.fired)
+}
+
+func TestAutomationMaxRunsPer(t *testing.T) {
+	h := newRunHarness(t)
+	auto, suppressed := h.throttled("max_runs_per:\n  count: 2\n  window: 1h")
+
+	auto.Trigger.Trigger()
+	h.next(h.fired)
+	h.advance(40 * time.Minute)
+	auto.Trigger.Trigger()
+	h.next(h.fired)
+
+	h.advance(10 * time.Minute)
+	auto.Trigger.Trigger()
+	h.nothing(h.fired)
+	require.Equal(t, "max_runs_per 2 in 1h reached", <-suppressed)
+
+	// The first run is now outside of the window
+	h.advance(10 * time.Minute)
+	auto.Trigger.Trigger()
+	h.next(h.fired)
+}
+
+func TestAutomationDebounce(t *testing.T) {
+	h := newRunHarness(t)
+	auto, suppressed := h.throttled("debounce: 10s")
+
+	auto.Trigger.Trigger()
+	first := h.nextTimer()
+	require.Equal(t, 10*time.Second, first.d)
+	auto.Trigger.Trigger()
+	second := h.nextTimer()
+	require.Equal(t, "debounce 10s, triggered again before the debounce period ended", <-suppressed)
+
+	// Only runs once the trigger has been quiet for the debounce period
+	h.expire(first)
+	h.nothing(h.fired)
+	h.expire(second)
+	h.next(h.fired)
+	h.nothing(h.fired)
+	require.Equal(t, 0, len(suppressed))
+}
+
+func TestAutomationThrottleInvalid(t *testing.T) {
+	tests := []struct {
+		settings string
+		key      string
+	}{
+		{"cooldown: soon", "cooldown"},
+		{"debounce: -5s", "debounce"},
+		{"max_runs_per:\n  count: 0\n  window: 1h", "max_runs_per.count"},
+		{"max_runs_per:\n  count: 3", "max_runs_per"},
+		{"max_runs_per:\n  count: 3\n  window: 1d", "max_runs_per.window"},
+	}
+
+	h := newRunHarness(t)
+	for _, test := range tests {
+		_, err := gohome.NewAutomation(h.sys, fmt.Sprintf(throttleConfig, test.settings))
+		require.NotNil(t, err, test.settings)
+		require.Equal(t, test.key, err.(*gohome.AutomationError).Key, test.settings)
+	}
+}
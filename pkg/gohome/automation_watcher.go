@@ -0,0 +1,205 @@
+package gohome
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-home-iot/event-bus"
+	"github.com/markdaws/gohome/pkg/clock"
+	"github.com/markdaws/gohome/pkg/log"
+)
+
+// AutomationWatcher loads all of the automation scripts in a directory, then watches the directory
+// for scripts that are added, changed or removed, so the automation can be updated without restarting
+// the server. If a changed script fails to load, the previous version keeps running and an
+// AutomationErrorEvt is fired
+type AutomationWatcher struct {
+	// Path is the directory containing the automation scripts
+	Path   string
+	System *System
+	Time   clock.Time
+
+	// Interval is how often the directory is checked for changes, defaults to 2 seconds
+	Interval time.Duration
+
+	mutex sync.Mutex
+	done  chan struct{}
+	files map[string]watchedFile
+}
+
+// watchedFile contains the state of an automation script the last time it was loaded
+type watchedFile struct {
+	modTime time.Time
+	size    int64
+
+	// auto is the running automation loaded from the file, nil if the file has never loaded successfully
+	auto *Automation
+}
+
+func (w *AutomationWatcher) ProducerName() string {
+	return "AutomationWatcher"
+}
+
+func (w *AutomationWatcher) StartProducing(b *evtbus.Bus) {
+	log.V("AutomationWatcher - watching: %s", w.Path)
+
+	w.mutex.Lock()
+	w.done = make(chan struct{})
+	done := w.done
+	if w.files == nil {
+		w.files = make(map[string]watchedFile)
+	}
+	w.mutex.Unlock()
+
+	// Load all of the scripts before returning, so that all the automation is running
+	// by the time the server has started
+	w.Scan()
+
+	interval := w.Interval
+	if interval == 0 {
+		interval = time.Second * 2
+	}
+
+	go func() {
+		for {
+			select {
+			case <-w.Time.After(interval):
+				w.Scan()
+			case <-done:
+				return
+			}
+		}
+	}()
+}
+
+func (w *AutomationWatcher) StopProducing() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.done != nil {
+		close(w.done)
+		w.done = nil
+	}
+}
+
+// Scan checks the automation directory for changes. New and modified scripts are loaded and started, and
+// automation whose scripts have been removed is stopped
+func (w *AutomationWatcher) Scan() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.files == nil {
+		w.files = make(map[string]watchedFile)
+	}
+
+	infos, err := ioutil.ReadDir(w.Path)
+	if err != nil {
+		log.E("AutomationWatcher - failed to enumerate automation files: %s", err)
+		return
+	}
+
+	seen := make(map[string]bool)
+	for _, info := range infos {
+		if info.IsDir() || !strings.HasSuffix(info.Name(), ".yaml") {
+			continue
+		}
+
+		path := filepath.Join(w.Path, info.Name())
+		seen[path] = true
+
+		prev, ok := w.files[path]
+		if ok && prev.modTime.Equal(info.ModTime()) && prev.size == info.Size() {
+			continue
+		}
+		w.load(path, info)
+	}
+
+	for path, file := range w.files {
+		if seen[path] {
+			continue
+		}
+
+		delete(w.files, path)
+		if file.auto != nil {
+			log.V("automation - script removed: %s", path)
+			w.System.StopAutomation(file.auto)
+		}
+	}
+}
+
+// Load loads the automation script at path and starts it, even if the file does not appear to have
+// changed since the last time it was loaded
+func (w *AutomationWatcher) Load(path string) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.files == nil {
+		w.files = make(map[string]watchedFile)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		w.loadFailed(path, w.files[path].auto, err)
+		return
+	}
+	w.load(path, info)
+}
+
+// load parses the automation script and starts it, replacing any automation previously loaded
+// from the same file
+func (w *AutomationWatcher) load(path string, info os.FileInfo) {
+	prev := w.files[path]
+
+	// Record the file state even if we fail to load, so we don't try to load the
+	// same broken script each time we scan
+	w.files[path] = watchedFile{modTime: info.ModTime(), size: info.Size(), auto: prev.auto}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		w.loadFailed(path, prev.auto, fmt.Errorf("failed to read file: %s", err))
+		return
+	}
+
+	auto, err := NewAutomation(w.System, string(b))
+	if err != nil {
+		w.loadFailed(path, prev.auto, err)
+		return
+	}
+	auto.Path = path
+
+	// Automation that wasn't loaded from a file can be replaced, otherwise names must be unique
+	existing := w.System.AutomationByName(auto.Name)
+	if existing != nil && existing.Path != "" && existing.Path != path {
+		w.loadFailed(path, prev.auto, fmt.Errorf("duplicate automation name: %s, already used by %s",
+			auto.Name, existing.Path))
+		return
+	}
+
+	// If the name changed, the old automation won't be replaced by name so we have to stop it
+	if prev.auto != nil && prev.auto.Name != auto.Name {
+		w.System.StopAutomation(prev.auto)
+	}
+
+	log.V("automation - loaded: %s", path)
+	w.System.StartAutomation(auto)
+	w.files[path] = watchedFile{modTime: info.ModTime(), size: info.Size(), auto: auto}
+}
+
+// loadFailed logs the error and fires an AutomationErrorEvt, running is the automation that is still
+// running from a previous version of the script, if any
+func (w *AutomationWatcher) loadFailed(path string, running *Automation, err error) {
+	log.E("automation - failed to load automation: %s, %s", path, err)
+
+	evt := &AutomationErrorEvt{Path: path, Err: err.Error()}
+	if running != nil {
+		evt.Name = running.Name
+	}
+	if w.System.Services.EvtBus != nil {
+		w.System.Services.EvtBus.Enqueue(evt)
+	}
+}
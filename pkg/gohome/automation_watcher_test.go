@@ -0,0 +1,149 @@
+package gohome_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-home-iot/event-bus"
+	"github.com/markdaws/gohome/pkg/gohome"
+	"github.com/stretchr/testify/require"
+)
+
+// errorRecorder records all of the AutomationErrorEvt events on the bus
+type errorRecorder struct {
+	mutex  sync.Mutex
+	errors []*gohome.AutomationErrorEvt
+}
+
+func (r *errorRecorder) ConsumerName() string {
+	return "errorRecorder"
+}
+
+func (r *errorRecorder) StartConsuming(ch chan evtbus.Event) {
+	go func() {
+		for e := range ch {
+			if evt, ok := e.(*gohome.AutomationErrorEvt); ok {
+				r.mutex.Lock()
+				r.errors = append(r.errors, evt)
+				r.mutex.Unlock()
+			}
+		}
+	}()
+}
+
+func (r *errorRecorder) StopConsuming() {}
+
+func (r *errorRecorder) Errors() []*gohome.AutomationErrorEvt {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.errors
+}
+
+func writeScript(t *testing.T, path, name, sceneID string) {
+	script := `
+name: ` + name + `
+trigger:
+  time:
+    at: '10:00:00'
+actions:
+  - scene:
+      id: ` + sceneID + `
+`
+	require.Nil(t, ioutil.WriteFile(path, []byte(script), 0644))
+
+	// Make sure the mod time changes even on file systems with a coarse resolution
+	modTime := time.Now().Add(time.Duration(len(script)) * time.Second)
+	require.Nil(t, os.Chtimes(path, modTime, modTime))
+}
+
+func TestAutomationWatcher(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "automation")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	sys := gohome.NewSystem("test system")
+	sys.AddScene(&gohome.Scene{ID: "12345"})
+	sys.AddScene(&gohome.Scene{ID: "67890"})
+
+	evtBus := evtbus.NewBus(100, 100)
+	sys.Services.EvtBus = evtBus
+	recorder := &errorRecorder{}
+	evtBus.AddConsumer(recorder)
+
+	lightsPath := filepath.Join(dir, "lights.yaml")
+	writeScript(t, lightsPath, "Lights", "12345")
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "readme.txt"), []byte("ignored"), 0644))
+
+	watcher := &gohome.AutomationWatcher{
+		Path:   dir,
+		System: sys,
+		Time: &MockTime{
+			after: func(mt *MockTime, d time.Duration) <-chan time.Time { return make(chan time.Time) },
+		},
+	}
+	evtBus.AddProducer(watcher)
+	defer evtBus.RemoveProducer(watcher)
+
+	// Loaded on start
+	lights := sys.AutomationByName("Lights")
+	require.NotNil(t, lights)
+	require.Equal(t, lightsPath, lights.Path)
+	require.Equal(t, 1, len(sys.Automations()))
+
+	// Nothing changed, should not reload
+	watcher.Scan()
+	require.True(t, lights == sys.AutomationByName("Lights"))
+
+	// New file
+	shadesPath := filepath.Join(dir, "shades.yaml")
+	writeScript(t, shadesPath, "Shades", "67890")
+	watcher.Scan()
+	require.Equal(t, 2, len(sys.Automations()))
+	require.NotNil(t, sys.AutomationByName("Shades"))
+
+	// Modified file is reloaded
+	writeScript(t, lightsPath, "Lights", "67890")
+	watcher.Scan()
+	reloaded := sys.AutomationByName("Lights")
+	require.NotNil(t, reloaded)
+	require.False(t, lights == reloaded)
+
+	// Invalid script, previous version keeps running and an error event is fired
+	writeScript(t, lightsPath, "Lights", "bad_scene_id")
+	watcher.Scan()
+	require.True(t, reloaded == sys.AutomationByName("Lights"))
+	time.Sleep(time.Millisecond * 100)
+	errors := recorder.Errors()
+	require.Equal(t, 1, len(errors))
+	require.Equal(t, lightsPath, errors[0].Path)
+	require.Equal(t, "Lights", errors[0].Name)
+
+	// Error is not repeated if the file didn't change
+	watcher.Scan()
+	time.Sleep(time.Millisecond * 100)
+	require.Equal(t, 1, len(recorder.Errors()))
+
+	// Renaming the automation replaces the old one
+	writeScript(t, lightsPath, "Porch Lights", "12345")
+	watcher.Scan()
+	require.Nil(t, sys.AutomationByName("Lights"))
+	require.NotNil(t, sys.AutomationByName("Porch Lights"))
+
+	// Duplicate names are not allowed
+	writeScript(t, filepath.Join(dir, "dupe.yaml"), "Shades", "12345")
+	watcher.Scan()
+	require.Equal(t, shadesPath, sys.AutomationByName("Shades").Path)
+	time.Sleep(time.Millisecond * 100)
+	require.Equal(t, 2, len(recorder.Errors()))
+
+	// Removed file stops the automation
+	require.Nil(t, os.Remove(shadesPath))
+	watcher.Scan()
+	require.Nil(t, sys.AutomationByName("Shades"))
+}
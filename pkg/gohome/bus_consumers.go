@@ -0,0 +1,120 @@
+package gohome
+
+import (
+	"sync"
+
+	"github.com/go-home-iot/event-bus"
+	"github.com/markdaws/gohome/pkg/log"
+)
+
+// busConsumers is added to the event bus once and passes the events on to consumers that are added and
+// removed while the system is running, such as automation that is reloaded or devices that are stopped.
+// The event bus closes the channel of a removed consumer without stopping events being sent to it, so
+// consumers that come and go are added here, where delivering events and removing consumers share a lock
+type busConsumers struct {
+	bus       *evtbus.Bus
+	mutex     sync.RWMutex
+	consumers map[evtbus.Consumer]chan evtbus.Event
+}
+
+func newBusConsumers(bus *evtbus.Bus) *busConsumers {
+	return &busConsumers{
+		bus:       bus,
+		consumers: make(map[evtbus.Consumer]chan evtbus.Event),
+	}
+}
+
+func (b *busConsumers) ConsumerName() string {
+	return "BusConsumers"
+}
+
+func (b *busConsumers) StartConsuming(ch chan evtbus.Event) {
+	go func() {
+		for e := range ch {
+			b.mutex.RLock()
+			for _, q := range b.consumers {
+				select {
+				case q <- e:
+				default:
+					// Consumer queue was full, drop the event like the bus does
+				}
+			}
+			b.mutex.RUnlock()
+		}
+	}()
+}
+
+// StopConsuming is called when the event bus stops, all of the consumers are removed
+func (b *busConsumers) StopConsuming() {
+	b.mutex.RLock()
+	var consumers []evtbus.Consumer
+	for c := range b.consumers {
+		consumers = append(consumers, c)
+	}
+	b.mutex.RUnlock()
+
+	for _, c := range consumers {
+		b.remove(c)
+	}
+}
+
+// add starts sending events to the consumer, it is ignored if the consumer has already been added
+func (b *busConsumers) add(c evtbus.Consumer) {
+	b.mutex.Lock()
+	if _, ok := b.consumers[c]; ok {
+		b.mutex.Unlock()
+		return
+	}
+	q := make(chan evtbus.Event, b.bus.ConsumerCapacity)
+	b.consumers[c] = q
+	b.mutex.Unlock()
+
+	c.StartConsuming(q)
+}
+
+// remove stops sending events to the consumer, then stops the consumer
+func (b *busConsumers) remove(c evtbus.Consumer) {
+	b.mutex.Lock()
+	q, ok := b.consumers[c]
+	if !ok {
+		b.mutex.Unlock()
+		return
+	}
+	delete(b.consumers, c)
+	close(q)
+	b.mutex.Unlock()
+
+	c.StopConsuming()
+}
+
+// addConsumer adds a consumer that may later be removed with removeConsumer, see busConsumers
+func (s *System) addConsumer(c evtbus.Consumer) {
+	if consumers := s.busConsumers(); consumers != nil {
+		consumers.add(c)
+	}
+}
+
+// removeConsumer removes a consumer added with addConsumer
+func (s *System) removeConsumer(c evtbus.Consumer) {
+	if consumers := s.busConsumers(); consumers != nil {
+		consumers.remove(c)
+	}
+}
+
+// busConsumers returns the busConsumers for the event bus of the system, adding it to the bus the
+// first time it is needed. Returns nil if the system doesn't have an event bus
+func (s *System) busConsumers() *busConsumers {
+	s.consumersMutex.Lock()
+	defer s.consumersMutex.Unlock()
+
+	bus := s.Services.EvtBus
+	if bus == nil {
+		return nil
+	}
+	if s.consumers == nil || s.consumers.bus != bus {
+		log.V("System - adding consumers to the event bus")
+		s.consumers = newBusConsumers(bus)
+		bus.AddConsumer(s.consumers)
+	}
+	return s.consumers
+}
@@ -0,0 +1,253 @@
+package gohome
+
+import (
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/markdaws/gohome/pkg/cmd"
+	"github.com/markdaws/gohome/pkg/log"
+)
+
+// hubCmd is a built command along with the hub that executes it and the index of the command in the
+// group that it was built from
+type hubCmd struct {
+	hub   *Device
+	fn    *cmd.Func
+	owner int
+
+	// capture is set on the commands that snapshot the features of a scene before it is set, they are
+	// not sent to the hub so they don't count towards its rate limit
+	capture *sceneCapture
+
+	// failed if not nil is called if the command returns an error
+	failed func()
+
+	// featureID is the feature the command sets, if any, setting a feature cancels its ramp
+	featureID string
+
+	// ramp is set instead of fn for a transition done in software, see ramp
+	ramp *ramp
+}
+
+// groupRun tracks the execution of a command group whose commands are spread across the lanes of
+// one or more hubs, the group is finished once every lane has executed its part of the group
+type groupRun struct {
+	cg      CommandGroup
+	started sync.Once
+
+	mutex   sync.Mutex
+	results []CommandResult
+	pending int
+}
+
+// record adds the outcome of executing one of the built commands to the result of the command it was
+// built from, only the first error is kept
+func (r *groupRun) record(owner int, duration time.Duration, err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	result := &r.results[owner]
+	result.Duration += duration
+	if err != nil && result.Err == nil {
+		result.Err = err
+	}
+}
+
+// addPending is called when part of the group is going to finish later, such as a ramp that is started
+func (r *groupRun) addPending() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.pending++
+}
+
+// laneDone is called when a lane has executed its part of the group, it returns true if that was the
+// last lane the group was waiting on
+func (r *groupRun) laneDone() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.pending--
+	return r.pending == 0
+}
+
+// laneBatch is the part of a command group that is executed by a single hub
+type laneBatch struct {
+	run  *groupRun
+	cmds []hubCmd
+
+	// ramp is set instead of cmds when the batch is the next step of a ramp
+	ramp *ramp
+}
+
+// hubLane executes the commands for a single hub one at a time in the order they were enqueued, so
+// commands sent to a hub never overtake each other. Each hub has its own lane so a slow or rate
+// limited hub doesn't hold up commands for other hubs
+type hubLane struct {
+	hubID   string
+	batches chan laneBatch
+	limit   *tokenBucket
+
+	// Ramps send their steps to the lane from their own timers, closed stops them sending once the
+	// command processor has stopped
+	mutex  sync.RWMutex
+	closed bool
+}
+
+func newHubLane(hub *Device, queueSize int) *hubLane {
+	lane := &hubLane{
+		hubID:   hub.ID,
+		batches: make(chan laneBatch, queueSize),
+	}
+
+	if builder, ok := hub.CmdBuilder.(cmd.RateLimitedBuilder); ok {
+		limit := builder.RateLimit()
+		if limit.PerSecond > 0 {
+			log.V("CommandProcessor - hub %s is limited to %.2f commands per second, burst %d",
+				hub.ID, limit.PerSecond, limit.Burst)
+			lane.limit = newTokenBucket(limit)
+		}
+	}
+	return lane
+}
+
+// start executes the batches sent to the lane until the batches channel is closed
+func (l *hubLane) start(cp *commandProcessor) {
+	go func() {
+		for batch := range l.batches {
+			cp.executeBatch(l, batch)
+		}
+		log.V("CommandProcessor - lane stopped: %s", l.hubID)
+	}()
+}
+
+// send sends the batch to the lane, returns false if the lane has been closed
+func (l *hubLane) send(batch laneBatch) bool {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	if l.closed {
+		return false
+	}
+	l.batches <- batch
+	return true
+}
+
+// close stops the lane once it has executed the batches it has already been sent
+func (l *hubLane) close() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.closed = true
+	close(l.batches)
+}
+
+// wait blocks until the rate limit of the hub allows another command to be sent
+func (l *hubLane) wait() {
+	if l.limit == nil {
+		return
+	}
+	if delay := l.limit.take(time.Now()); delay > 0 {
+		log.V("CommandProcessor - hub %s rate limited, waiting %s", l.hubID, delay)
+		time.Sleep(delay)
+	}
+}
+
+// executeBatch executes the commands of the batch in order, once all of the lanes the group was sent to
+// have executed their commands the group is finished
+func (cp *commandProcessor) executeBatch(lane *hubLane, batch laneBatch) {
+	if batch.ramp != nil {
+		cp.executeRampStep(lane, batch.ramp)
+		return
+	}
+
+	run := batch.run
+	run.started.Do(func() {
+		cp.statuses.running(run.cg.ID)
+	})
+
+	for _, c := range batch.cmds {
+		if c.featureID != "" {
+			cp.cancelRamp(c.featureID)
+		}
+		if c.ramp != nil {
+			cp.startRamp(lane, run, c.owner, c.ramp)
+			continue
+		}
+		if c.capture == nil {
+			lane.wait()
+		}
+
+		duration, err := cp.executeFunc(c.fn)
+		if err != nil && c.failed != nil {
+			c.failed()
+		}
+
+		// keep going, try to complete as many of the commands as possible
+		run.record(c.owner, duration, err)
+	}
+
+	if run.laneDone() {
+		cp.finished(run.cg, run.results)
+	}
+}
+
+// executeFunc executes the func, returning how long it took
+func (cp *commandProcessor) executeFunc(c *cmd.Func) (time.Duration, error) {
+	log.V("CommandProcessor - executing command: %s", c)
+	start := time.Now()
+	err := callFunc(c)
+	if err != nil {
+		log.V("CommandProcessor - execute error: %s", err)
+	}
+	log.V("CommandProcessor - executed command: %s", c)
+	return time.Since(start), err
+}
+
+// callFunc executes the func, if it panics the panic is returned as an error so that the lane keeps
+// going and the group still finishes
+func callFunc(c *cmd.Func) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.E("CommandProcessor - command panic: %s, %s, %s", c, r, debug.Stack())
+			err = fmt.Errorf("command processor panic: %s", r)
+		}
+	}()
+	return c.Func()
+}
+
+// tokenBucket implements a cmd.RateLimit, it is only used from the goroutine of its lane
+type tokenBucket struct {
+	perSecond float64
+	burst     float64
+	tokens    float64
+	last      time.Time
+}
+
+func newTokenBucket(limit cmd.RateLimit) *tokenBucket {
+	burst := float64(limit.Burst)
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{perSecond: limit.PerSecond, burst: burst, tokens: burst}
+}
+
+// take takes a token from the bucket, returning how long to wait before sending the command. The token
+// is taken even if there isn't one yet, the bucket goes in to debt that is paid back by the wait
+func (b *tokenBucket) take(now time.Time) time.Duration {
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * b.perSecond
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.perSecond * float64(time.Second))
+}
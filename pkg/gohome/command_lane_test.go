@@ -0,0 +1,169 @@
+package gohome_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-home-iot/event-bus"
+	"github.com/markdaws/gohome/pkg/attr"
+	"github.com/markdaws/gohome/pkg/cmd"
+	"github.com/markdaws/gohome/pkg/feature"
+	"github.com/markdaws/gohome/pkg/gohome"
+	"github.com/stretchr/testify/require"
+)
+
+// blockingBuilder doesn't execute any commands until it is released
+type blockingBuilder struct {
+	recordingBuilder
+	release chan bool
+}
+
+func (b *blockingBuilder) Build(c cmd.Command) (*cmd.Func, error) {
+	built, _ := b.recordingBuilder.Build(c)
+	return &cmd.Func{Func: func() error {
+		<-b.release
+		return built.Func()
+	}}, nil
+}
+
+// rateLimitedBuilder is a builder for hardware that can only receive a few commands at a time
+type rateLimitedBuilder struct {
+	recordingBuilder
+	limit cmd.RateLimit
+}
+
+func (b *rateLimitedBuilder) RateLimit() cmd.RateLimit {
+	return b.limit
+}
+
+// hubSystem returns a system with a light zone for each builder, each on its own hub
+func hubSystem(builders ...cmd.Builder) (*gohome.System, []*feature.Feature) {
+	sys := gohome.NewSystem("test system")
+	sys.Services.EvtBus = evtbus.NewBus(100, 100)
+
+	var zones []*feature.Feature
+	for _, builder := range builders {
+		d := gohome.NewDevice(sys.NewID(), "bulbs", "", "", "", "", "", nil, builder, nil, nil)
+		sys.AddDevice(d)
+
+		zone := feature.NewLightZone(sys.NewID(), feature.LightZoneModeContinuous)
+		zone.DeviceID = d.ID
+		zone.Name = "zone"
+		sys.AddFeature(zone)
+		zones = append(zones, zone)
+	}
+	return sys, zones
+}
+
+// enqueueBrightness sets the brightness of the zone, the returned channel receives the results once
+// the command has executed
+func enqueueBrightness(
+	t *testing.T, cp gohome.CommandProcessor, zone *feature.Feature, values ...float32,
+) chan []gohome.CommandResult {
+	var cmds []cmd.Command
+	for _, value := range values {
+		cmds = append(cmds, &cmd.FeatureSetAttrs{FeatureID: zone.ID, Attrs: feature.NewAttrs(brightnessAttr(zone, value))})
+	}
+
+	done := make(chan []gohome.CommandResult, 1)
+	group := gohome.NewCommandGroup("brightness", cmds...)
+	group.Executed = func(results []gohome.CommandResult) { done <- results }
+	require.Nil(t, cp.Enqueue(group))
+	return done
+}
+
+// brightnessAttr returns a brightness attribute for the zone set to value
+func brightnessAttr(zone *feature.Feature, value float32) *attr.Attribute {
+	_, brightness, _ := feature.LightZoneCloneAttrs(zone)
+	brightness.Value = value
+	return brightness
+}
+
+func brightnessValues(b *recordingBuilder) []float32 {
+	var values []float32
+	for _, c := range b.executed() {
+		values = append(values, c.Attrs[feature.LightZoneBrightnessLocalID].Value.(float32))
+	}
+	return values
+}
+
+func TestCommandLanes(t *testing.T) {
+	blocked := &blockingBuilder{release: make(chan bool)}
+	other := &recordingBuilder{}
+	sys, zones := hubSystem(blocked, other)
+
+	cp := gohome.NewCommandProcessor(sys, 10)
+	cp.Start()
+	defer cp.Stop()
+
+	// A hub that isn't responding doesn't hold up the commands for another hub
+	var waiting []chan []gohome.CommandResult
+	for _, value := range []float32{10, 20, 30} {
+		waiting = append(waiting, enqueueBrightness(t, cp, zones[0], value))
+	}
+	select {
+	case <-enqueueBrightness(t, cp, zones[1], 50):
+	case <-time.After(time.Second):
+		require.FailNow(t, "commands for the other hub not executed")
+	}
+	require.Equal(t, []float32{50}, brightnessValues(other))
+	require.Equal(t, 0, len(blocked.executed()))
+
+	// The commands for a hub are executed in the order they were enqueued
+	close(blocked.release)
+	for _, done := range waiting {
+		select {
+		case results := <-done:
+			require.Nil(t, results[0].Err)
+		case <-time.After(time.Second):
+			require.FailNow(t, "commands not executed")
+		}
+	}
+	require.Equal(t, []float32{10, 20, 30}, brightnessValues(&blocked.recordingBuilder))
+}
+
+func TestCommandLanesGroupAcrossHubs(t *testing.T) {
+	first := &recordingBuilder{}
+	second := &recordingBuilder{}
+	sys, zones := hubSystem(first, second)
+	sys.AddScene(&gohome.Scene{ID: "both", Name: "Both", Commands: []cmd.Command{
+		&cmd.FeatureSetAttrs{FeatureID: zones[0].ID, Attrs: feature.NewAttrs(brightnessAttr(zones[0], 10))},
+		&cmd.FeatureSetAttrs{FeatureID: zones[1].ID, Attrs: feature.NewAttrs(brightnessAttr(zones[1], 20))},
+	}})
+
+	// The group only finishes once both hubs have executed their commands
+	results := execute(t, sys, &cmd.SceneSet{SceneID: "both"})
+	require.Nil(t, results[0].Err)
+	require.Equal(t, []float32{10}, brightnessValues(first))
+	require.Equal(t, []float32{20}, brightnessValues(second))
+}
+
+func TestCommandLanesRateLimit(t *testing.T) {
+	limited := &rateLimitedBuilder{limit: cmd.RateLimit{PerSecond: 20, Burst: 2}}
+	unlimited := &rateLimitedBuilder{}
+	sys, zones := hubSystem(limited, unlimited)
+
+	cp := gohome.NewCommandProcessor(sys, 10)
+	cp.Start()
+	defer cp.Stop()
+
+	// The first 2 commands are sent straight away, the other 3 at 20 a second
+	start := time.Now()
+	limitedDone := enqueueBrightness(t, cp, zones[0], 1, 2, 3, 4, 5)
+	unlimitedDone := enqueueBrightness(t, cp, zones[1], 1, 2, 3, 4, 5)
+
+	select {
+	case <-unlimitedDone:
+		require.True(t, time.Since(start) < 100*time.Millisecond)
+	case <-time.After(time.Second):
+		require.FailNow(t, "commands not executed")
+	}
+
+	select {
+	case <-limitedDone:
+		require.True(t, time.Since(start) >= 140*time.Millisecond)
+	case <-time.After(time.Second):
+		require.FailNow(t, "commands not executed")
+	}
+	require.Equal(t, []float32{1, 2, 3, 4, 5}, brightnessValues(&limited.recordingBuilder))
+}
@@ -4,15 +4,35 @@ import (
 	"errors"
 	"fmt"
 	"runtime/debug"
+	"sync"
+	"time"
 
+	"github.com/markdaws/gohome/pkg/attr"
 	"github.com/markdaws/gohome/pkg/cmd"
 	"github.com/markdaws/gohome/pkg/log"
 )
 
-// CommandGroup contains a collection of commands that need to be run sequentially
+// CommandGroup contains a collection of commands, the commands for each hub are run sequentially in
+// the order they are in the group, commands for different hubs may run in parallel
 type CommandGroup struct {
+	// ID identifies the group when querying its status, if it is empty when the group is enqueued the
+	// command processor assigns one
+	ID   string
 	Desc string
 	Cmds []cmd.Command
+
+	// Executed if not nil is called once the commands have been executed, with the result of each
+	// command in the same order as Cmds
+	Executed func(results []CommandResult)
+}
+
+// CommandResult is the outcome of executing a single command from a CommandGroup
+type CommandResult struct {
+	// Err is non nil if the command could not be built or failed to execute
+	Err error
+
+	// Duration is how long the command took to execute
+	Duration time.Duration
 }
 
 // NewCommandGroup returns a CommandGroup instance with the Desc and Cmds field set
@@ -25,6 +45,10 @@ type CommandProcessor interface {
 	Start()
 	Stop()
 	Enqueue(CommandGroup) error
+
+	// Status returns the status of an enqueued command group, only the most recent groups are kept,
+	// the bool return value is false if the ID is unknown
+	Status(ID string) (CommandGroupStatus, bool)
 }
 
 // CommandBuilder know how to take an abstract command like ZoneSetLevel and turn it
@@ -33,118 +57,211 @@ type CommandBuilder interface {
 	Build(cmd.Command) (*cmd.Func, error)
 }
 
-// NewCommandProcessor returns an initialized type that implements the CommandProcessor interface
-func NewCommandProcessor(system *System, maxWorkers, queueSize int) CommandProcessor {
+// maxSceneDepth is the deepest scenes can be nested, when a scene sets another scene which sets
+// another scene and so on
+const maxSceneDepth = 32
+
+// NewCommandProcessor returns an initialized type that implements the CommandProcessor interface.
+// queueSize is how many command groups can be waiting to be built, and how many groups each hub can
+// have waiting to be executed
+func NewCommandProcessor(system *System, queueSize int) CommandProcessor {
 	return &commandProcessor{
-		system:     system,
-		queueSize:  queueSize,
-		maxWorkers: maxWorkers,
+		system:    system,
+		queueSize: queueSize,
+		statuses:  newCommandStatuses(),
 	}
 }
 
+// commandProcessor builds the command groups one at a time in the order they were enqueued, then sends
+// the commands to the lane of the hub that executes them, see hubLane
 type commandProcessor struct {
-	maxWorkers int
-	queueSize  int
-	requests   chan CommandGroup
-	system     *System
+	queueSize int
+	requests  chan CommandGroup
+	system    *System
+	statuses  *commandStatuses
+
+	// lanes is keyed by hub ID, it is only accessed from the dispatch goroutine
+	lanes map[string]*hubLane
+
+	// ramps are the transitions in progress keyed by feature ID, accessed from the lanes
+	rampsMutex sync.Mutex
+	ramps      map[string]*ramp
+
+	// captures counts the scenes that have been dispatched but haven't finished taking their snapshot
+	captures sync.WaitGroup
+
+	// undone are the snapshots removed from the scene history while building the current group, they
+	// are put back if the group can't be built. Only accessed from the dispatch goroutine
+	undone []*SceneSnapshot
 }
 
 func (cp *commandProcessor) Enqueue(cg CommandGroup) error {
+	if cg.ID == "" {
+		cg.ID = cp.system.NewID()
+	}
+
+	// The status has to exist before the group can be dispatched
+	cp.statuses.queued(cg)
 	select {
 	case cp.requests <- cg:
-		log.V("CommandProcessor - enqueued: %s", cg.Desc)
+		log.V("CommandProcessor - enqueued: %s [%s]", cg.Desc, cg.ID)
 		return nil
 	default:
+		cp.statuses.remove(cg.ID)
 		err := errors.New("CommandProcessor - CommandGroup enqueue failed, CommandProcessor queue is full")
 		log.E(err.Error())
 		return err
 	}
 }
 
+func (cp *commandProcessor) Status(ID string) (CommandGroupStatus, bool) {
+	return cp.statuses.get(ID)
+}
+
 func (cp *commandProcessor) Start() {
 	log.V("CommandProcessor - starting")
 
 	cp.requests = make(chan CommandGroup, cp.queueSize)
+	cp.lanes = make(map[string]*hubLane)
+	cp.ramps = make(map[string]*ramp)
 
-	for i := 0; i < cp.maxWorkers; i++ {
-		i := i
-		go func() {
-			for {
-				err := cp.startWorker(i)
-				if err != nil {
-					log.E("CommandProcessor - worker[%d] panic: %s", i, err)
-
-					// restart the failed worker
-				} else {
-					//worker quit gracefully, allow shutdown, break out of the loop
-					break
-				}
-			}
-		}()
-	}
-}
+	go func() {
+		for cg := range cp.requests {
+			cp.dispatch(cg)
+		}
 
-func (cp *commandProcessor) startWorker(index int) (errRet error) {
+		// Let the lanes finish what they have already been sent
+		for _, lane := range cp.lanes {
+			lane.close()
+		}
+		log.V("CommandProcessor - stopped")
+	}()
+}
 
-	log.V("CommandProcessor - starting worker %d", index)
+func (cp *commandProcessor) Stop() {
+	log.V("CommandProcessor - stopping")
+	close(cp.requests)
+}
 
-	// If there is a panic for any reason trying to execute the commands
-	// recover and log the error
-	defer func() {
-		if r := recover(); r != nil {
-			errRet = fmt.Errorf("%s, %s", r, debug.Stack())
+// dispatch builds the commands in the group and sends them to the lanes of the hubs that execute them
+func (cp *commandProcessor) dispatch(cg CommandGroup) {
+	log.V("CommandProcessor - dispatch group: %s", cg.Desc)
+
+	run := &groupRun{cg: cg, results: make([]CommandResult, len(cg.Cmds))}
+	cp.undone = nil
+	cmds, err := cp.buildCommands(cg)
+	if err != nil {
+		log.E("CommandProcessor - unable to generate commands: %s, %s", cg.Desc, err)
+		for i := range run.results {
+			run.results[i].Err = err
 		}
-	}()
 
-	for cg := range cp.requests {
-		log.V("CommandProcessor - execute group: %s", cg.Desc)
+		// Nothing was undone, the scenes can still be undone later
+		for _, snapshot := range cp.undone {
+			cp.system.Services.SceneHistory.Add(snapshot)
+		}
+	}
+	cp.undone = nil
+
+	// The scenes are now going to take their snapshots, scene undos wait for them
+	captures := make(map[*sceneCapture]bool)
+	for _, c := range cmds {
+		if c.capture != nil && !captures[c.capture] {
+			captures[c.capture] = true
+			cp.captures.Add(1)
+		}
+	}
 
-		cmds, err := cp.buildCommands(cg)
-		if err != nil {
-			log.E("CommandProcessor - unable to generate commands: %s, %s", cg.Desc, err)
-			continue
+	var hubIDs []string
+	batches := make(map[string][]hubCmd)
+	for _, c := range cmds {
+		if _, ok := batches[c.hub.ID]; !ok {
+			hubIDs = append(hubIDs, c.hub.ID)
 		}
+		batches[c.hub.ID] = append(batches[c.hub.ID], c)
+	}
 
-		for _, c := range cmds {
-			log.V("CommandProcessor - executing command: %s", c)
-			err := c.Func()
-			if err != nil {
-				log.V("CommandProcessor - execute error: %s", err)
+	// Nothing to execute e.g. a selector that doesn't match any features
+	if len(hubIDs) == 0 {
+		cp.statuses.running(cg.ID)
+		cp.finished(cg, run.results)
+		return
+	}
 
-				// keep going, try to complete as many of the commands as possible
-			}
-			log.V("CommandProcessor - executed command: %s", c)
+	run.pending = len(hubIDs)
+	for _, hubID := range hubIDs {
+		lane, ok := cp.lanes[hubID]
+		if !ok {
+			lane = newHubLane(batches[hubID][0].hub, cp.queueSize)
+			lane.start(cp)
+			cp.lanes[hubID] = lane
 		}
+		lane.send(laneBatch{run: run, cmds: batches[hubID]})
 	}
+}
 
-	errRet = nil
-	return
+// finished records the final status of the command group, raising a CommandCompletedEvt or
+// CommandFailedEvt, then passes the results to the Executed function of the group
+func (cp *commandProcessor) finished(cg CommandGroup, results []CommandResult) {
+	status, ok := cp.statuses.finished(cg.ID, results)
+	if ok && cp.system.Services.EvtBus != nil {
+		if status.Status == CommandGroupFailed {
+			cp.system.Services.EvtBus.Enqueue(&CommandFailedEvt{ID: status.ID, Desc: status.Desc, Commands: status.Commands})
+		} else {
+			cp.system.Services.EvtBus.Enqueue(&CommandCompletedEvt{ID: status.ID, Desc: status.Desc, Commands: status.Commands})
+		}
+	}
+	cp.executed(cg, results)
 }
 
-func (cp *commandProcessor) Stop() {
-	log.V("CommandProcessor - stopping")
-	close(cp.requests)
+// executed passes the results to the Executed function of the command group, if it has one
+func (cp *commandProcessor) executed(cg CommandGroup, results []CommandResult) {
+	if cg.Executed == nil {
+		return
+	}
 
-	//TODO: Wait until all workers return?
+	// If the callback panics we don't want to take the worker down with it
+	defer func() {
+		if r := recover(); r != nil {
+			log.E("CommandProcessor - executed callback panic: %s, %s", cg.Desc, r)
+		}
+	}()
+	cg.Executed(results)
 }
 
-func (cp *commandProcessor) buildCommands(cg CommandGroup) ([]*cmd.Func, error) {
-	var cmds []*cmd.Func
+// buildCommands builds all of the commands in the group, a command can build to many funcs e.g. a scene,
+// each hubCmd contains the index of the command in the group that built it. A panic while building is
+// returned as an error so that the group still finishes
+func (cp *commandProcessor) buildCommands(cg CommandGroup) (cmds []hubCmd, errRet error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.E("CommandProcessor - build panic: %s, %s, %s", cg.Desc, r, debug.Stack())
+			cmds = nil
+			errRet = fmt.Errorf("command processor panic: %s", r)
+		}
+	}()
 
-	for _, c := range cg.Cmds {
-		finalCmd, err := cp.buildCommand(c)
+	for i, c := range cg.Cmds {
+		finalCmd, err := cp.buildCommand(c, 0)
 		if err != nil {
 			return nil, err
 		}
-		cmds = append(cmds, finalCmd...)
+		for _, built := range finalCmd {
+			built.owner = i
+			cmds = append(cmds, built)
+		}
 	}
 	return cmds, nil
 }
 
-func (cp *commandProcessor) buildCommand(c cmd.Command) ([]*cmd.Func, error) {
+// buildCommand builds the funcs that execute the command and the hubs that execute them, depth is how
+// many scenes deep the command is
+func (cp *commandProcessor) buildCommand(c cmd.Command, depth int) ([]hubCmd, error) {
 
-	var cmds []*cmd.Func
+	var cmds []hubCmd
 	var finalCmd *cmd.Func
+	var finalHub *Device
+	var featureID string
 	switch command := c.(type) {
 	case *cmd.FeatureSetAttrs:
 		f := cp.system.FeatureByID(command.FeatureID)
@@ -161,6 +278,21 @@ func (cp *commandProcessor) buildCommand(c cmd.Command) ([]*cmd.Func, error) {
 			hub = d
 		}
 
+		if hub.CmdBuilder != nil && command.Transition > 0 && !canTransition(hub.CmdBuilder, command) {
+			r, err := cp.rampCommand(f, hub.CmdBuilder, command)
+			if err != nil {
+				return nil, err
+			}
+			switch len(r.steps) {
+			case 0:
+			case 1:
+				cmds = append(cmds, hubCmd{hub: hub, fn: r.steps[0], featureID: f.ID})
+			default:
+				cmds = append(cmds, hubCmd{hub: hub, ramp: r, featureID: f.ID})
+			}
+			return cmds, nil
+		}
+
 		var zCmd *cmd.Func
 		var err error
 		if hub.CmdBuilder != nil {
@@ -172,22 +304,105 @@ func (cp *commandProcessor) buildCommand(c cmd.Command) ([]*cmd.Func, error) {
 			return nil, fmt.Errorf("no command builder for device id:%s", f.DeviceID)
 		}
 		finalCmd = zCmd
+		finalHub = hub
+		featureID = f.ID
 
 	case *cmd.SceneSet:
 		s := cp.system.SceneByID(command.SceneID)
 		if s == nil {
 			return nil, fmt.Errorf("unknown scene ID %s", command.SceneID)
 		}
+
+		// Cycles are rejected when scenes are loaded or changed, this stops us recursing forever if one
+		// gets through
+		if depth >= maxSceneDepth {
+			return nil, fmt.Errorf("scene %s is nested more than %d scenes deep, check for scenes that set "+
+				"each other in a loop", s.Name, maxSceneDepth)
+		}
+
 		for _, sceneCmd := range s.Commands {
 			// Scenes are a list of commands, so we may get multiple commands
 			// that we need to execute, also scenes can execute other scenes
-			sceneCmds, err := cp.buildCommand(sceneCmd)
+			sceneCmds, err := cp.buildCommand(sceneCmd, depth+1)
 			if err != nil {
 				return nil, err
 			}
 			cmds = append(cmds, sceneCmds...)
 		}
 
+		// Only the scene being set is snapshotted, the scenes it sets are part of its snapshot. The
+		// snapshot is taken by the hubs just before they execute the commands of the scene
+		if depth == 0 && cp.system.Services.SceneHistory != nil {
+			capture := cp.system.newSceneCapture(s, cp.system.Services.SceneHistory, cp.captures.Done)
+			cmds = append(capture.hubCmds(cmds), cmds...)
+		}
+
+	case *cmd.SceneUndo:
+		history := cp.system.Services.SceneHistory
+		if history == nil {
+			return nil, fmt.Errorf("scene history is not enabled, unable to undo")
+		}
+
+		// Scenes that have already been dispatched may not have taken their snapshot yet
+		cp.captures.Wait()
+		snapshot := history.Last()
+		if snapshot == nil {
+			return nil, fmt.Errorf("there are no scenes to undo")
+		}
+
+		log.V("CommandProcessor - undoing scene %s, set at %s", snapshot.SceneName, snapshot.Time)
+		var restoreCmds []hubCmd
+		for _, restore := range snapshot.Commands {
+			built, err := cp.buildCommand(restore, depth)
+			if err != nil {
+				return nil, err
+			}
+			restoreCmds = append(restoreCmds, built...)
+		}
+
+		// The snapshot is only removed once it can be restored, if restoring any of the features fails
+		// it is put back so the scene can be undone again
+		history.Remove(snapshot)
+		cp.undone = append(cp.undone, snapshot)
+		var once sync.Once
+		failed := func() {
+			once.Do(func() {
+				log.V("CommandProcessor - undoing scene %s failed, keeping its snapshot", snapshot.SceneName)
+				history.Add(snapshot)
+			})
+		}
+		for i := range restoreCmds {
+			restoreCmds[i].failed = failed
+		}
+		cmds = append(cmds, restoreCmds...)
+
+	case *cmd.SelectorSetAttrs:
+		for _, f := range cp.system.SelectFeatures(&command.Selector) {
+			attrs := make(map[string]*attr.Attribute)
+			for localID, attribute := range command.Attrs {
+				if _, ok := f.Attrs[localID]; ok {
+					attrs[localID] = attribute.Clone()
+				}
+			}
+			if len(attrs) == 0 {
+				continue
+			}
+
+			// One bad feature shouldn't stop the rest of the selected features from being set
+			featureCmds, err := cp.buildCommand(&cmd.FeatureSetAttrs{
+				FeatureID:   f.ID,
+				FeatureType: f.Type,
+				FeatureName: f.Name,
+				Attrs:       attrs,
+				Transition:  command.Transition,
+			}, depth)
+			if err != nil {
+				log.E("CommandProcessor - unable to set attributes on selected feature: %s, %s", f.ID, err)
+				continue
+			}
+			cmds = append(cmds, featureCmds...)
+		}
+
 	default:
 		return nil, fmt.Errorf("unknown command, cannot process")
 	}
@@ -196,7 +411,7 @@ func (cp *commandProcessor) buildCommand(c cmd.Command) ([]*cmd.Func, error) {
 		if finalCmd.Friendly == "" {
 			finalCmd.Friendly = c.FriendlyString()
 		}
-		cmds = append(cmds, finalCmd)
+		cmds = append(cmds, hubCmd{hub: finalHub, fn: finalCmd, featureID: featureID})
 	}
 
 	return cmds, nil
@@ -0,0 +1,164 @@
+package gohome
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// CommandGroupQueued - the group is waiting for a command processor worker
+	CommandGroupQueued string = "queued"
+
+	// CommandGroupRunning - a worker is executing the commands in the group
+	CommandGroupRunning string = "running"
+
+	// CommandGroupDone - all of the commands in the group executed without an error
+	CommandGroupDone string = "done"
+
+	// CommandGroupFailed - at least one command in the group could not be built or returned an error,
+	// the status of each command says which
+	CommandGroupFailed string = "failed"
+)
+
+// maxCommandStatuses is how many command groups the command processor keeps the status of, once there
+// are more the oldest are dropped
+const maxCommandStatuses = 200
+
+// CommandGroupStatus is the progress of a CommandGroup through the command processor
+type CommandGroupStatus struct {
+	ID     string
+	Desc   string
+	Status string
+
+	Queued time.Time
+
+	// Started and Finished are zero until the group starts and finishes executing
+	Started  time.Time
+	Finished time.Time
+
+	// Commands has the status of each command, in the same order as the commands in the group
+	Commands []CommandStatus
+}
+
+// CommandStatus is the status of a single command in a CommandGroup, Status is one of CommandStatusPending,
+// CommandStatusSucceeded or CommandStatusFailed
+type CommandStatus struct {
+	Desc     string
+	Status   string
+	Err      string
+	Duration time.Duration
+}
+
+// commandStatuses keeps the status of the most recently enqueued command groups
+type commandStatuses struct {
+	mutex    sync.Mutex
+	statuses map[string]*CommandGroupStatus
+	order    []string
+}
+
+func newCommandStatuses() *commandStatuses {
+	return &commandStatuses{statuses: make(map[string]*CommandGroupStatus)}
+}
+
+// queued adds a status for the group, dropping the oldest status if there are too many
+func (s *commandStatuses) queued(cg CommandGroup) {
+	status := &CommandGroupStatus{
+		ID:       cg.ID,
+		Desc:     cg.Desc,
+		Status:   CommandGroupQueued,
+		Queued:   time.Now(),
+		Commands: make([]CommandStatus, len(cg.Cmds)),
+	}
+	for i, c := range cg.Cmds {
+		status.Commands[i] = CommandStatus{Desc: c.FriendlyString(), Status: CommandStatusPending}
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.statuses[cg.ID]; !ok {
+		s.order = append(s.order, cg.ID)
+	}
+	s.statuses[cg.ID] = status
+	for len(s.order) > maxCommandStatuses {
+		delete(s.statuses, s.order[0])
+		s.order = s.order[1:]
+	}
+}
+
+// remove removes the status of a group, used when the group could not be queued
+func (s *commandStatuses) remove(ID string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.statuses, ID)
+	for i, orderID := range s.order {
+		if orderID == ID {
+			s.order = append(s.order[:i], s.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// running records that a worker has started executing the group
+func (s *commandStatuses) running(ID string) {
+	s.update(ID, func(status *CommandGroupStatus) {
+		status.Status = CommandGroupRunning
+		status.Started = time.Now()
+	})
+}
+
+// finished records the results of executing the group and returns a copy of the final status, the bool
+// return value is false if the status is no longer kept
+func (s *commandStatuses) finished(ID string, results []CommandResult) (CommandGroupStatus, bool) {
+	var final CommandGroupStatus
+	ok := s.update(ID, func(status *CommandGroupStatus) {
+		status.Status = CommandGroupDone
+		status.Finished = time.Now()
+		for i, result := range results {
+			if i >= len(status.Commands) {
+				break
+			}
+			command := &status.Commands[i]
+			command.Duration = result.Duration
+			if result.Err != nil {
+				command.Status = CommandStatusFailed
+				command.Err = result.Err.Error()
+				status.Status = CommandGroupFailed
+			} else {
+				command.Status = CommandStatusSucceeded
+			}
+		}
+		final = status.clone()
+	})
+	return final, ok
+}
+
+// get returns a copy of the status of the group
+func (s *commandStatuses) get(ID string) (CommandGroupStatus, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	status, ok := s.statuses[ID]
+	if !ok {
+		return CommandGroupStatus{}, false
+	}
+	return status.clone(), true
+}
+
+func (s *commandStatuses) update(ID string, fn func(status *CommandGroupStatus)) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	status, ok := s.statuses[ID]
+	if ok {
+		fn(status)
+	}
+	return ok
+}
+
+func (s *CommandGroupStatus) clone() CommandGroupStatus {
+	c := *s
+	c.Commands = append([]CommandStatus(nil), s.Commands...)
+	return c
+}
@@ -0,0 +1,112 @@
+package gohome_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-home-iot/event-bus"
+	"github.com/markdaws/gohome/pkg/cmd"
+	"github.com/markdaws/gohome/pkg/feature"
+	"github.com/markdaws/gohome/pkg/gohome"
+	"github.com/stretchr/testify/require"
+)
+
+// failingBuilder fails to set the brightness to 99
+type failingBuilder struct {
+	recordingBuilder
+}
+
+func (b *failingBuilder) Build(c cmd.Command) (*cmd.Func, error) {
+	command := c.(*cmd.FeatureSetAttrs)
+	if brightness, ok := command.Attrs[feature.LightZoneBrightnessLocalID]; ok && brightness.Value == float32(99) {
+		return &cmd.Func{Func: func() error { return errors.New("no response from the dimmer") }}, nil
+	}
+	return b.recordingBuilder.Build(c)
+}
+
+// commandEvents records the command completed and failed events
+type commandEvents struct {
+	evts chan evtbus.Event
+}
+
+func (c *commandEvents) ConsumerName() string {
+	return "commandEvents"
+}
+
+func (c *commandEvents) StartConsuming(ch chan evtbus.Event) {
+	go func() {
+		for e := range ch {
+			switch e.(type) {
+			case *gohome.CommandCompletedEvt, *gohome.CommandFailedEvt:
+				c.evts <- e
+			}
+		}
+	}()
+}
+
+func (c *commandEvents) StopConsuming() {}
+
+func TestCommandStatus(t *testing.T) {
+	sys, lounge := transitionSystem(t, &failingBuilder{})
+	evts := &commandEvents{evts: make(chan evtbus.Event, 10)}
+	sys.Services.EvtBus.AddConsumer(evts)
+
+	cp := gohome.NewCommandProcessor(sys, 10)
+	cp.Start()
+	defer cp.Stop()
+
+	setBrightness := func(value float32) cmd.Command {
+		_, brightness, _ := feature.LightZoneCloneAttrs(lounge)
+		brightness.Value = value
+		return &cmd.FeatureSetAttrs{FeatureID: lounge.ID, FeatureName: lounge.Name, Attrs: feature.NewAttrs(brightness)}
+	}
+
+	// The second command fails, the others still execute
+	done := make(chan bool, 1)
+	group := gohome.NewCommandGroup("dim", setBrightness(10), setBrightness(99), setBrightness(30))
+	group.ID = "group1"
+	group.Executed = func(results []gohome.CommandResult) { done <- true }
+	require.Nil(t, cp.Enqueue(group))
+	<-done
+
+	status, ok := cp.Status("group1")
+	require.True(t, ok)
+	require.Equal(t, gohome.CommandGroupFailed, status.Status)
+	require.Equal(t, "dim", status.Desc)
+	require.False(t, status.Queued.IsZero())
+	require.False(t, status.Finished.Before(status.Started))
+	require.Equal(t, 3, len(status.Commands))
+	require.Equal(t, gohome.CommandStatusSucceeded, status.Commands[0].Status)
+	require.Equal(t, gohome.CommandStatusFailed, status.Commands[1].Status)
+	require.Equal(t, "no response from the dimmer", status.Commands[1].Err)
+	require.Equal(t, gohome.CommandStatusSucceeded, status.Commands[2].Status)
+
+	select {
+	case e := <-evts.evts:
+		failed, ok := e.(*gohome.CommandFailedEvt)
+		require.True(t, ok)
+		require.Equal(t, "group1", failed.ID)
+		require.Equal(t, status.Commands, failed.Commands)
+	case <-time.After(time.Second):
+		require.FailNow(t, "no command event")
+	}
+
+	// IDs are assigned to groups that don't have one
+	require.Nil(t, cp.Enqueue(gohome.NewCommandGroup("bright", setBrightness(80))))
+	select {
+	case e := <-evts.evts:
+		completed, ok := e.(*gohome.CommandCompletedEvt)
+		require.True(t, ok)
+		require.NotEqual(t, "", completed.ID)
+
+		status, ok = cp.Status(completed.ID)
+		require.True(t, ok)
+		require.Equal(t, gohome.CommandGroupDone, status.Status)
+	case <-time.After(time.Second):
+		require.FailNow(t, "no command event")
+	}
+
+	_, ok = cp.Status("unknown")
+	require.False(t, ok)
+}
@@ -0,0 +1,677 @@
+package gohome
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/markdaws/gohome/pkg/attr"
+	"github.com/markdaws/gohome/pkg/feature"
+)
+
+// Transition ops, unlike the other ops which compare the current value of an attribute, these are only
+// true for the event that changed the attribute
+const (
+	OpChanged      string = "changed"
+	OpCrossesAbove string = "crosses_above"
+	OpCrossesBelow string = "crosses_below"
+)
+
+// condition is a node in a condition tree. A node can compare a single attribute of a feature
+// against a value, check the current time is inside a time window or on certain days of the week,
+// check a scene is active, and/or contain child conditions in the And, Or and Not fields. If a node specifies more than one
+// of these, all of them have to be true for the node to be true.
+//
+// A node can also match a transition of an attribute, using the changed, crosses_above or crosses_below
+// ops or the From and To values. Transitions are only true when evaluated with the event that changed
+// the attribute, and the previous value of the attribute was known. The previous value starts as the
+// value in the Monitor when the condition is parsed, then is updated from each event for the attribute
+type condition struct {
+	FeatureID   *string      `yaml:"id"`
+	FeatureAID  *string      `yaml:"aid"`
+	AttrLocalID *string      `yaml:"attr"`
+	Op          *string      `yaml:"op"`
+	Value       interface{}  `yaml:"value"`
+	From        interface{}  `yaml:"from"`
+	To          interface{}  `yaml:"to"`
+	Hysteresis  interface{}  `yaml:"hysteresis"`
+	Time        *timeWindow  `yaml:"time"`
+	Days        *string      `yaml:"days"`
+	SceneActive *string      `yaml:"scene_active"`
+	And         []*condition `yaml:"and"`
+	Or          []*condition `yaml:"or"`
+	Not         *condition   `yaml:"not"`
+
+	feature *feature.Feature
+	scene   *Scene
+	days    uint32
+	sys     automationSys
+	state   *transitionState
+}
+
+// transitionState tracks the value of the attribute referenced by a transition condition
+type transitionState struct {
+	// crossing is true for the crosses_above and crosses_below ops
+	crossing   bool
+	above      bool
+	threshold  float64
+	hysteresis float64
+
+	mutex sync.Mutex
+
+	// last is the last value of the attribute that was seen, nil if it is not known
+	last *attr.Attribute
+
+	// evt is the last event observed, result is true if evt matched the transition
+	evt    *FeatureAttrsChangedEvt
+	result bool
+
+	// latched is true if the value crossed the threshold and hasn't moved back past the hysteresis band
+	latched bool
+}
+
+// timeWindow is true between the After and Before times of the day, either can be omitted. If After
+// is later in the day than Before, the window wraps around midnight. The times can either be HH:MM,
+// HH:MM:SS or relative to a solar event e.g. sunset-30m
+type timeWindow struct {
+	After  *string `yaml:"after"`
+	Before *string `yaml:"before"`
+
+	after, before *timeOfDay
+}
+
+// timeOfDay is a time on any day, either a fixed time or relative to a solar event
+type timeOfDay struct {
+	// mode is either TimeTriggerModeExact or one of the solar modes
+	mode string
+
+	// offset is the time after midnight for exact times, or the offset from the solar event
+	offset time.Duration
+}
+
+// Evaluate returns true if the condition tree is true at the time now. Attribute values are taken from
+// the event if the event is for the feature the condition references, otherwise the last known value of
+// the feature is used. A nil event can be passed, in which case only the last known values are used.
+// Conditions referencing attributes with unknown values evaluate to false
+func (c *condition) Evaluate(e *FeatureAttrsChangedEvt, now time.Time) bool {
+	return c.failed(e, now) == nil
+}
+
+// failed returns the first part of the condition tree that is false at the time now, nil if the
+// condition is true
+func (c *condition) failed(e *FeatureAttrsChangedEvt, now time.Time) *condition {
+	if e != nil {
+		// Transitions have to see every change, even if they aren't evaluated because an earlier part
+		// of the condition is false
+		c.observe(e)
+	}
+
+	if c.AttrLocalID != nil && !c.attrTrue(e) {
+		return &condition{FeatureID: c.FeatureID, FeatureAID: c.FeatureAID, AttrLocalID: c.AttrLocalID,
+			Op: c.Op, Value: c.Value, From: c.From, To: c.To, Hysteresis: c.Hysteresis}
+	}
+
+	if c.Time != nil && !c.Time.contains(now, c.sys) {
+		return &condition{Time: c.Time}
+	}
+
+	if c.Days != nil && !dayInMask(c.days, now) {
+		return &condition{Days: c.Days}
+	}
+
+	if c.SceneActive != nil && !c.sys.SceneActive(c.scene.ID) {
+		return &condition{SceneActive: c.SceneActive}
+	}
+
+	for _, child := range c.And {
+		if failed := child.failed(e, now); failed != nil {
+			return failed
+		}
+	}
+
+	if len(c.Or) > 0 {
+		anyTrue := false
+		for _, child := range c.Or {
+			if child.Evaluate(e, now) {
+				anyTrue = true
+				break
+			}
+		}
+		if !anyTrue {
+			return &condition{Or: c.Or}
+		}
+	}
+
+	if c.Not != nil && c.Not.Evaluate(e, now) {
+		return &condition{Not: c.Not}
+	}
+
+	return nil
+}
+
+// attrTrue returns true if the attribute referenced by the condition matches the op and value, or for a
+// transition, if the event changed the attribute in the way the condition describes
+func (c *condition) attrTrue(e *FeatureAttrsChangedEvt) bool {
+	if c.state != nil {
+		return c.state.matched(e)
+	}
+
+	attribute := c.attrValue(e)
+	return attribute != nil && compareAttr(attribute, *c.Op, c.Value)
+}
+
+// observe updates the state of all of the transitions in the tree with the event
+func (c *condition) observe(e *FeatureAttrsChangedEvt) {
+	if c.state != nil {
+		c.state.observe(c, e)
+	}
+	for _, child := range c.And {
+		child.observe(e)
+	}
+	for _, child := range c.Or {
+		child.observe(e)
+	}
+	if c.Not != nil {
+		c.Not.observe(e)
+	}
+}
+
+// observe checks if the event changed the attribute in the way the condition describes. Each event is
+// only observed once, so the same event can be evaluated many times
+func (x *transitionState) observe(c *condition, e *FeatureAttrsChangedEvt) {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	if x.evt == e {
+		return
+	}
+	x.evt = e
+	x.result = false
+
+	if e.FeatureID != c.feature.ID {
+		return
+	}
+	cur, ok := e.Attrs[*c.AttrLocalID]
+	if !ok {
+		return
+	}
+
+	// The same change can be reported more than once, by the extension and again by the Monitor, so the
+	// previous value is the last value we saw, only using the value in the event if we haven't seen one
+	prev := x.last
+	if prev == nil {
+		prev = e.Previous[*c.AttrLocalID]
+	}
+	x.last = cur
+
+	if x.crossing {
+		x.result = x.crossed(prev, cur)
+		return
+	}
+
+	x.result = prev != nil && prev.Value != cur.Value &&
+		(c.From == nil || compareAttr(prev, "==", c.From)) &&
+		(c.To == nil || compareAttr(cur, "==", c.To))
+}
+
+// crossed returns true if the value moved across the threshold. Once the value has crossed, it has to
+// move back past the threshold by the hysteresis amount before it can cross again
+func (x *transitionState) crossed(prevAttr, curAttr *attr.Attribute) bool {
+	cur, ok := attrFloat(curAttr)
+	if !ok {
+		return false
+	}
+
+	if x.above {
+		if x.latched && cur <= x.threshold-x.hysteresis {
+			x.latched = false
+		}
+	} else if x.latched && cur >= x.threshold+x.hysteresis {
+		x.latched = false
+	}
+
+	prev, ok := attrFloat(prevAttr)
+	if !ok || x.latched {
+		return false
+	}
+
+	if x.above {
+		x.latched = prev <= x.threshold && cur > x.threshold
+	} else {
+		x.latched = prev >= x.threshold && cur < x.threshold
+	}
+	return x.latched
+}
+
+// matched returns true if the event is the last event observed and it matched the transition
+func (x *transitionState) matched(e *FeatureAttrsChangedEvt) bool {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	return e != nil && x.evt == e && x.result
+}
+
+// attrFloat returns the value of a numeric attribute
+func attrFloat(attribute *attr.Attribute) (float64, bool) {
+	if attribute == nil {
+		return 0, false
+	}
+	switch v := attribute.Value.(type) {
+	case int32:
+		return float64(v), true
+	case float32:
+		return float64(v), true
+	}
+	return 0, false
+}
+
+// transition returns the first node in the tree that matches a transition, nil if there are none
+func (c *condition) transition() *condition {
+	if c.AttrLocalID != nil && (c.From != nil || c.To != nil ||
+		(c.Op != nil && (*c.Op == OpChanged || *c.Op == OpCrossesAbove || *c.Op == OpCrossesBelow))) {
+		return c
+	}
+
+	children := append(append([]*condition{}, c.And...), c.Or...)
+	if c.Not != nil {
+		children = append(children, c.Not)
+	}
+	for _, child := range children {
+		if t := child.transition(); t != nil {
+			return t
+		}
+	}
+	return nil
+}
+
+// contains returns true if the time is inside the time window
+func (w *timeWindow) contains(now time.Time, sys automationSys) bool {
+	var after, before time.Time
+	if w.after != nil {
+		var ok bool
+		if after, ok = w.after.on(now, sys); !ok {
+			return false
+		}
+	}
+	if w.before != nil {
+		var ok bool
+		if before, ok = w.before.on(now, sys); !ok {
+			return false
+		}
+	}
+
+	switch {
+	case w.after == nil:
+		return now.Before(before)
+	case w.before == nil:
+		return !now.Before(after)
+	case after.Before(before):
+		return !now.Before(after) && now.Before(before)
+	default:
+		// Wraps around midnight e.g. 22:00 to 06:00
+		return !now.Before(after) || now.Before(before)
+	}
+}
+
+// on returns the time on the same day as t. The bool return value is false if the time does not exist
+// on that day, for a solar event that doesn't happen on that day or if the location is not set
+func (d *timeOfDay) on(t time.Time, sys automationSys) (time.Time, bool) {
+	if d.mode == TimeTriggerModeExact {
+		// Use the wall clock time so the time is correct on days the clocks change
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, int(d.offset/time.Second), 0, t.Location()), true
+	}
+
+	latitude, longitude := sys.Coordinates()
+	if latitude == 0 && longitude == 0 {
+		return time.Time{}, false
+	}
+
+	noon := time.Date(t.Year(), t.Month(), t.Day(), 12, 0, 0, 0, t.Location())
+	solar, ok := SolarTime(d.mode, noon, latitude, longitude)
+	if !ok {
+		return time.Time{}, false
+	}
+	return solar.Add(d.offset), true
+}
+
+// parseTimeOfDay parses a time such as 23:00, 06:30:15 or sunset-30m
+func parseTimeOfDay(val string) (*timeOfDay, error) {
+	if mode, offset, ok, err := parseSolarTime(val); ok {
+		if err != nil {
+			return nil, err
+		}
+		return &timeOfDay{mode: mode, offset: offset}, nil
+	}
+
+	for _, layout := range []string{"15:04:05", "15:04"} {
+		if t, err := time.Parse(layout, strings.TrimSpace(val)); err == nil {
+			offset := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute +
+				time.Duration(t.Second())*time.Second
+			return &timeOfDay{mode: TimeTriggerModeExact, offset: offset}, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid time: %s, must be HH:MM, HH:MM:SS or relative to a solar event e.g. sunset-30m", val)
+}
+
+// watches returns true if the event contains a value for any attribute referenced by the condition tree,
+// or is for a feature set by a scene the condition checks is active
+func (c *condition) watches(e *FeatureAttrsChangedEvt) bool {
+	if c.AttrLocalID != nil && c.feature.ID == e.FeatureID {
+		if _, ok := e.Attrs[*c.AttrLocalID]; ok {
+			return true
+		}
+	}
+	if c.scene != nil && sceneSetsFeature(c.scene, e.FeatureID) {
+		return true
+	}
+
+	for _, child := range c.And {
+		if child.watches(e) {
+			return true
+		}
+	}
+	for _, child := range c.Or {
+		if child.watches(e) {
+			return true
+		}
+	}
+	return c.Not != nil && c.Not.watches(e)
+}
+
+// attrValue returns the current value of the attribute referenced by the condition, nil if the value
+// is not known
+func (c *condition) attrValue(e *FeatureAttrsChangedEvt) *attr.Attribute {
+	if e != nil && e.FeatureID == c.feature.ID {
+		if attribute, ok := e.Attrs[*c.AttrLocalID]; ok {
+			return attribute
+		}
+	}
+
+	values, ok := c.sys.FeatureValues(c.feature.ID)
+	if !ok {
+		return nil
+	}
+	return values[*c.AttrLocalID]
+}
+
+// compareAttr compares the attribute value against the value using the specified operator
+func compareAttr(attribute *attr.Attribute, op string, value interface{}) bool {
+	switch attribute.DataType {
+	case attr.DTInt32:
+		a, ok := attribute.Value.(int32)
+		b := toInt32(value)
+		if !ok || b == nil {
+			return false
+		}
+		switch op {
+		case "<":
+			return a < *b
+		case ">":
+			return a > *b
+		case "==":
+			return a == *b
+		case "!=":
+			return a != *b
+		case "<=":
+			return a <= *b
+		case ">=":
+			return a >= *b
+		}
+
+	case attr.DTFloat32:
+		a, ok := attribute.Value.(float32)
+		b := toFloat32(value)
+		if !ok || b == nil {
+			return false
+		}
+		switch op {
+		case "<":
+			return a < *b
+		case ">":
+			return a > *b
+		case "==":
+			return a == *b
+		case "!=":
+			return a != *b
+		case "<=":
+			return a <= *b
+		case ">=":
+			return a >= *b
+		}
+
+	case attr.DTString:
+		a, ok := attribute.Value.(string)
+		b, okB := value.(string)
+		if !ok || !okB {
+			return false
+		}
+		switch op {
+		case "<":
+			return a < b
+		case ">":
+			return a > b
+		case "==":
+			return a == b
+		case "!=":
+			return a != b
+		case "<=":
+			return a <= b
+		case ">=":
+			return a >= b
+		}
+
+	case attr.DTBool:
+		switch op {
+		case "==":
+			return attribute.Value == value
+		case "!=":
+			return attribute.Value != value
+		}
+	}
+
+	return false
+}
+
+// parseCondition validates the condition tree, resolving any features referenced by the conditions.
+// f is the feature used by conditions that don't specify an id or aid key, it can be nil in which case
+// all conditions that compare attributes must specify the feature. key is the location of the condition
+// in the script, used to report errors
+func parseCondition(sys automationSys, f *feature.Feature, c *condition, key string) error {
+	if c == nil {
+		return &AutomationError{Key: key, Msg: "condition is empty"}
+	}
+
+	c.sys = sys
+	if c.FeatureID != nil || c.FeatureAID != nil {
+		var err error
+		f, err = getFeature(sys, c.FeatureID, c.FeatureAID)
+		if err != nil {
+			return &AutomationError{Key: key, Msg: err.Error()}
+		}
+	}
+
+	if c.AttrLocalID == nil && c.Time == nil && c.Days == nil && c.SceneActive == nil &&
+		len(c.And) == 0 && len(c.Or) == 0 && c.Not == nil {
+		return &AutomationError{
+			Key: key,
+			Msg: "condition must have an 'attr', 'time', 'days', 'scene_active', 'and', 'or' or 'not' key",
+		}
+	}
+
+	if c.SceneActive != nil {
+		c.scene = sys.SceneByID(*c.SceneActive)
+		if c.scene == nil {
+			return &AutomationError{Key: key + ".scene_active", Msg: fmt.Sprintf("invalid scene ID: %s", *c.SceneActive)}
+		}
+	}
+
+	if c.Time != nil {
+		if c.Time.After == nil && c.Time.Before == nil {
+			return &AutomationError{Key: key + ".time", Msg: "time must have an after or before key"}
+		}
+		if c.Time.After != nil {
+			after, err := parseTimeOfDay(*c.Time.After)
+			if err != nil {
+				return &AutomationError{Key: key + ".time.after", Msg: err.Error()}
+			}
+			c.Time.after = after
+		}
+		if c.Time.Before != nil {
+			before, err := parseTimeOfDay(*c.Time.Before)
+			if err != nil {
+				return &AutomationError{Key: key + ".time.before", Msg: err.Error()}
+			}
+			c.Time.before = before
+		}
+	}
+
+	if c.Days != nil {
+		c.days = parseDays(*c.Days)
+		if c.days == 0 {
+			return &AutomationError{
+				Key: key + ".days",
+				Msg: fmt.Sprintf("invalid days: %s, must be one or more of sun|mon|tues|wed|thurs|fri|sat", *c.Days),
+			}
+		}
+	}
+
+	if c.AttrLocalID != nil {
+		if f == nil {
+			return &AutomationError{Key: key, Msg: "missing id and aid key, one must be present"}
+		}
+		c.feature = f
+
+		attribute, ok := f.Attrs[*c.AttrLocalID]
+		if !ok {
+			return &AutomationError{Key: key, Msg: fmt.Sprintf("invalid attr key: %s", *c.AttrLocalID)}
+		}
+
+		if err := parseAttrCondition(c, attribute); err != nil {
+			return &AutomationError{Key: key, Msg: err.Error()}
+		}
+		if c.state != nil {
+			if values, ok := sys.FeatureValues(f.ID); ok {
+				c.state.last = values[*c.AttrLocalID]
+			}
+		}
+	}
+
+	for i, child := range c.And {
+		if err := parseCondition(sys, f, child, fmt.Sprintf("%s.and[%d]", key, i)); err != nil {
+			return err
+		}
+	}
+	for i, child := range c.Or {
+		if err := parseCondition(sys, f, child, fmt.Sprintf("%s.or[%d]", key, i)); err != nil {
+			return err
+		}
+	}
+	if c.Not != nil {
+		if err := parseCondition(sys, f, c.Not, key+".not"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseAttrCondition validates a condition that compares an attribute, or matches a transition of the
+// attribute
+func parseAttrCondition(c *condition, attribute *attr.Attribute) error {
+	if c.Hysteresis != nil && (c.Op == nil || (*c.Op != OpCrossesAbove && *c.Op != OpCrossesBelow)) {
+		return fmt.Errorf("hysteresis can only be used with the %s and %s ops", OpCrossesAbove, OpCrossesBelow)
+	}
+
+	if c.From != nil || c.To != nil {
+		if c.Op != nil || c.Value != nil {
+			return fmt.Errorf("from and to can not be used with the op and value keys")
+		}
+		for _, value := range []interface{}{c.From, c.To} {
+			if value == nil {
+				continue
+			}
+			if err := validateValue(attribute, value); err != nil {
+				return err
+			}
+		}
+		c.state = &transitionState{}
+		return nil
+	}
+
+	if c.Op == nil {
+		return fmt.Errorf("missing op key")
+	}
+
+	switch *c.Op {
+	case OpChanged:
+		if c.Value != nil {
+			return fmt.Errorf("value can not be used with the %s op", OpChanged)
+		}
+		c.state = &transitionState{}
+		return nil
+
+	case OpCrossesAbove, OpCrossesBelow:
+		if attribute.DataType != attr.DTInt32 && attribute.DataType != attr.DTFloat32 {
+			return fmt.Errorf("%s can only be used with numeric attributes", *c.Op)
+		}
+		if c.Value == nil {
+			return fmt.Errorf("missing value key")
+		}
+		threshold := toFloat32(c.Value)
+		if threshold == nil {
+			return fmt.Errorf("value must be a number")
+		}
+
+		c.state = &transitionState{crossing: true, threshold: float64(*threshold), above: *c.Op == OpCrossesAbove}
+		if c.Hysteresis != nil {
+			hysteresis := toFloat32(c.Hysteresis)
+			if hysteresis == nil || *hysteresis < 0 {
+				return fmt.Errorf("hysteresis must be a number greater than or equal to 0")
+			}
+			c.state.hysteresis = float64(*hysteresis)
+		}
+		return nil
+	}
+
+	if c.Value == nil {
+		return fmt.Errorf("missing value key")
+	}
+	return validateOp(attribute, *c.Op, c.Value)
+}
+
+// validateOp checks the operator and value are supported for the data type of the attribute
+func validateOp(attribute *attr.Attribute, op string, value interface{}) error {
+	switch op {
+	case "==", "!=":
+	case "<", ">", "<=", ">=":
+		if attribute.DataType == attr.DTBool {
+			return fmt.Errorf("unsupported op for a bool attribute: %s, must be one of [==|!=|changed]", op)
+		}
+	default:
+		return fmt.Errorf("unsupported op: %s, must be one of [==|!=|<|>|<=|>=|changed|crosses_above|crosses_below]", op)
+	}
+	return validateValue(attribute, value)
+}
+
+// validateValue checks the value can be compared to the attribute
+func validateValue(attribute *attr.Attribute, value interface{}) error {
+
+	switch attribute.DataType {
+	case attr.DTInt32:
+		if toInt32(value) == nil {
+			return fmt.Errorf("value must be a number")
+		}
+	case attr.DTFloat32:
+		if toFloat32(value) == nil {
+			return fmt.Errorf("value must be a number")
+		}
+	case attr.DTString:
+		if _, ok := value.(string); !ok {
+			return fmt.Errorf("value must be a string")
+		}
+	case attr.DTBool:
+		if _, ok := value.(bool); !ok {
+			return fmt.Errorf("value must be true or false")
+		}
+	}
+	return nil
+}
@@ -22,6 +22,10 @@ type Config struct {
 	// AutomationPath is the path where all the automation files live
 	AutomationPath string `json:"automationPath"`
 
+	// ScheduledRunsPath is the path of the file recording the last time each time trigger was scheduled
+	// to run, used to find runs that were missed while the server was not running
+	ScheduledRunsPath string `json:"scheduledRunsPath"`
+
 	// WebUIPath is the path to the dist folder in the goHOME source code, where the web UI lives
 	WebUIPath string `json:"webUIPath"`
 
@@ -52,6 +56,9 @@ func (c *Config) Merge(cfg Config) {
 	if c.AutomationPath == "" {
 		c.AutomationPath = cfg.AutomationPath
 	}
+	if c.ScheduledRunsPath == "" {
+		c.ScheduledRunsPath = cfg.ScheduledRunsPath
+	}
 	if c.WebUIPath == "" {
 		c.WebUIPath = cfg.WebUIPath
 	}
@@ -88,15 +95,16 @@ func NewDefaultConfig(systemPath, webUIPath string) *Config {
 	}
 
 	cfg := Config{
-		SystemPath:     path.Join(systemPath, "gohome.json"),
-		EventLogPath:   path.Join(systemPath, "events.json"),
-		AutomationPath: path.Join(systemPath, "automation"),
-		WebUIPath:      webUIPath,
-		WWWAddr:        addr,
-		WWWPort:        "8000",
-		UPNPNotifyAddr: addr,
-		UPNPNotifyPort: "8001",
-		Location:       location{},
+		SystemPath:        path.Join(systemPath, "gohome.json"),
+		EventLogPath:      path.Join(systemPath, "events.json"),
+		AutomationPath:    path.Join(systemPath, "automation"),
+		ScheduledRunsPath: path.Join(systemPath, "scheduled_runs.json"),
+		WebUIPath:         webUIPath,
+		WWWAddr:           addr,
+		WWWPort:           "8000",
+		UPNPNotifyAddr:    addr,
+		UPNPNotifyPort:    "8001",
+		Location:          location{},
 	}
 
 	return &cfg
@@ -0,0 +1,360 @@
+package gohome
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CronSchedule is a parsed cron expression. The expression has five fields, minute, hour, day of
+// the month, month and day of the week, with an optional seconds field before the minute field.
+// Each field supports *, lists (1,15), ranges (8-17) and steps (*/15 or 8-17/2). Months and days of
+// the week can be specified by name e.g. jan or mon, and a day of the week can be restricted to
+// the nth occurrence in the month e.g. mon#1 is the first Monday of the month.
+//
+// Like cron, if both the day of the month and day of the week fields are restricted, the schedule
+// matches days that match either field.
+//
+// The schedule is evaluated against the wall clock in the location of the time passed to Next. When
+// the clocks go forward, times that are skipped fire once at the time of the transition. When the
+// clocks go back, times that happen twice only fire the first time, unless the hour field is a
+// wildcard, in which case they fire both times
+type CronSchedule struct {
+	Expr string
+
+	second, minute, hour, dom, month, dow uint64
+
+	// nth contains a bitmask of the occurrences in the month of each day of the week
+	// specified using the day#n syntax, bit 1 is the first occurrence
+	nth [7]uint8
+
+	domStar, dowStar bool
+}
+
+type cronField struct {
+	name     string
+	min, max int
+	names    map[string]int
+}
+
+var (
+	cronSecond = cronField{name: "second", min: 0, max: 59}
+	cronMinute = cronField{name: "minute", min: 0, max: 59}
+	cronHour   = cronField{name: "hour", min: 0, max: 23}
+	cronDom    = cronField{name: "day of month", min: 1, max: 31}
+	cronMonth  = cronField{name: "month", min: 1, max: 12, names: map[string]int{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}}
+
+	// 7 is also accepted as Sunday
+	cronDow = cronField{name: "day of week", min: 0, max: 7, names: map[string]int{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}}
+)
+
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// cronMaxYears is how far ahead Next searches, long enough to find the next Feb 29th
+const cronMaxYears = 8
+
+// ParseCron parses a cron expression, see CronSchedule for the supported syntax
+func ParseCron(expr string) (*CronSchedule, error) {
+	expr = strings.TrimSpace(expr)
+	spec := expr
+	if macro, ok := cronMacros[strings.ToLower(spec)]; ok {
+		spec = macro
+	}
+
+	fields := strings.Fields(spec)
+	switch len(fields) {
+	case 5:
+		fields = append([]string{"0"}, fields...)
+	case 6:
+	default:
+		return nil, fmt.Errorf("invalid cron expression: %s, expected 5 or 6 fields, found %d", expr, len(fields))
+	}
+
+	c := &CronSchedule{Expr: expr}
+	var err error
+	if c.second, _, err = parseCronField(fields[0], cronSecond); err != nil {
+		return nil, err
+	}
+	if c.minute, _, err = parseCronField(fields[1], cronMinute); err != nil {
+		return nil, err
+	}
+	if c.hour, _, err = parseCronField(fields[2], cronHour); err != nil {
+		return nil, err
+	}
+	if c.dom, c.domStar, err = parseCronField(fields[3], cronDom); err != nil {
+		return nil, err
+	}
+	if c.month, _, err = parseCronField(fields[4], cronMonth); err != nil {
+		return nil, err
+	}
+	if c.dow, c.dowStar, err = c.parseDow(fields[5]); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// parseDow parses the day of week field, which also supports the day#n syntax
+func (c *CronSchedule) parseDow(field string) (uint64, bool, error) {
+	var plain []string
+	for _, part := range strings.Split(field, ",") {
+		i := strings.Index(part, "#")
+		if i == -1 {
+			plain = append(plain, part)
+			continue
+		}
+
+		day, err := parseCronValue(part[:i], cronDow)
+		if err != nil {
+			return 0, false, err
+		}
+		n, err := strconv.Atoi(part[i+1:])
+		if err != nil || n < 1 || n > 5 {
+			return 0, false, fmt.Errorf("invalid day of week occurrence: %s, must be between 1 and 5", part)
+		}
+		c.nth[day%7] |= 1 << uint(n)
+	}
+
+	if len(plain) == 0 {
+		return 0, false, nil
+	}
+
+	bits, star, err := parseCronField(strings.Join(plain, ","), cronDow)
+	if err != nil {
+		return 0, false, err
+	}
+
+	// Sunday can be 0 or 7
+	if bits&(1<<7) != 0 {
+		bits = (bits | 1) &^ (1 << 7)
+	}
+	return bits, star && len(plain) == len(strings.Split(field, ",")), nil
+}
+
+// parseCronField parses a field of the expression in to a bitmask of the values it matches. The bool
+// return value is true if the field is a wildcard
+func parseCronField(field string, f cronField) (uint64, bool, error) {
+	if field == "" {
+		return 0, false, fmt.Errorf("invalid %s field, empty value", f.name)
+	}
+
+	var bits uint64
+	star := false
+	for _, part := range strings.Split(field, ",") {
+		rng := part
+		step := 1
+		if i := strings.Index(part, "/"); i != -1 {
+			rng = part[:i]
+			var err error
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step < 1 {
+				return 0, false, fmt.Errorf("invalid step in %s field: %s", f.name, part)
+			}
+		}
+
+		var start, end int
+		switch {
+		case rng == "*":
+			start, end = f.min, f.max
+			if f.max == cronDow.max {
+				// Don't include Sunday twice
+				end = 6
+			}
+			if step == 1 {
+				star = true
+			}
+
+		case strings.Contains(rng, "-"):
+			i := strings.Index(rng, "-")
+			var err error
+			if start, err = parseCronValue(rng[:i], f); err != nil {
+				return 0, false, err
+			}
+			if end, err = parseCronValue(rng[i+1:], f); err != nil {
+				return 0, false, err
+			}
+			if end < start {
+				return 0, false, fmt.Errorf("invalid range in %s field: %s, start is after the end", f.name, part)
+			}
+
+		default:
+			var err error
+			if start, err = parseCronValue(rng, f); err != nil {
+				return 0, false, err
+			}
+			end = start
+			if step > 1 {
+				// a/n means every n starting at a
+				end = f.max
+			}
+		}
+
+		for v := start; v <= end; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, star, nil
+}
+
+// parseCronValue parses a single number or name
+func parseCronValue(val string, f cronField) (int, error) {
+	if n, ok := f.names[strings.ToLower(val)]; ok {
+		return n, nil
+	}
+
+	n, err := strconv.Atoi(val)
+	if err != nil || n < f.min || n > f.max {
+		return 0, fmt.Errorf("invalid value in %s field: %s, must be between %d and %d", f.name, val, f.min, f.max)
+	}
+	return n, nil
+}
+
+// Next returns the first time after from that matches the schedule, in the location of from. The
+// bool return value is false if the schedule never matches e.g. 30th of February
+func (c *CronSchedule) Next(from time.Time) (time.Time, bool) {
+	loc := from.Location()
+
+	// The schedule is matched against the wall clock, which we represent as a UTC time so that there are
+	// no DST changes. When the clocks go back, wall clock times before from can happen after from, so
+	// start the search a little earlier than the wall clock time of from
+	const maxShift = 2 * time.Hour
+	wall := time.Date(from.Year(), from.Month(), from.Day(), from.Hour(), from.Minute(), from.Second(), 0, time.UTC)
+	end := time.Date(wall.Year()+cronMaxYears, wall.Month(), wall.Day(), 0, 0, 0, 0, time.UTC)
+
+	var next time.Time
+	var stop time.Time
+	found := false
+	w := wall.Add(-maxShift)
+	for {
+		var ok bool
+		w, ok = c.nextWall(w, end)
+		if !ok || (found && w.After(stop)) {
+			break
+		}
+
+		for _, at := range c.instants(w, loc) {
+			if at.After(from) && (!found || at.Before(next)) {
+				next = at
+				if !found {
+					stop = w.Add(maxShift)
+				}
+				found = true
+			}
+		}
+	}
+	return next, found
+}
+
+// nextWall returns the first wall clock time after w that matches the schedule, w must be in UTC
+func (c *CronSchedule) nextWall(w, end time.Time) (time.Time, bool) {
+	t := w.Truncate(time.Second).Add(time.Second)
+	for t.Before(end) {
+		if c.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+		if !c.matchesDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+		if c.hour&(1<<uint(t.Hour())) == 0 {
+			t = t.Truncate(time.Hour).Add(time.Hour)
+			continue
+		}
+		if c.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Truncate(time.Minute).Add(time.Minute)
+			continue
+		}
+		if c.second&(1<<uint(t.Second())) == 0 {
+			t = t.Add(time.Second)
+			continue
+		}
+		return t, true
+	}
+	return time.Time{}, false
+}
+
+// matchesDay returns true if the day of the month and day of the week fields match the day of t
+func (c *CronSchedule) matchesDay(t time.Time) bool {
+	domMatch := c.dom&(1<<uint(t.Day())) != 0
+
+	wd := t.Weekday()
+	dowMatch := c.dow&(1<<uint(wd)) != 0 || c.nth[wd]&(1<<uint((t.Day()-1)/7+1)) != 0
+
+	if c.domStar || c.dowStar {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
+
+// instants returns the times in loc that have the wall clock time w. If the wall clock time is
+// skipped because the clocks go forward, the time of the transition is returned
+func (c *CronSchedule) instants(w time.Time, loc *time.Location) []time.Time {
+	u := w.Unix()
+	_, before := time.Unix(u-86400, 0).In(loc).Zone()
+	_, after := time.Unix(u+86400, 0).In(loc).Zone()
+
+	var times []time.Time
+	for _, offset := range []int{before, after} {
+		at := time.Unix(u-int64(offset), 0).In(loc)
+		if sameWallClock(at, w) && (len(times) == 0 || !times[0].Equal(at)) {
+			times = append(times, at)
+		}
+	}
+	sort.Sort(timesAsc(times))
+
+	if len(times) == 0 {
+		// Skipped by the clocks going forward, find the transition between the two offsets
+		lo := u - int64(after)
+		hi := u - int64(before)
+		if lo > hi {
+			lo, hi = hi, lo
+		}
+		for lo < hi {
+			mid := lo + (hi-lo)/2
+			if _, offset := time.Unix(mid, 0).In(loc).Zone(); offset == before {
+				lo = mid + 1
+			} else {
+				hi = mid
+			}
+		}
+		return []time.Time{time.Unix(lo, 0).In(loc)}
+	}
+
+	// The wall clock time happens twice, only fire once unless the schedule runs every hour
+	if len(times) > 1 && c.hour != 1<<24-1 {
+		times = times[:1]
+	}
+	return times
+}
+
+func sameWallClock(at, w time.Time) bool {
+	return at.Year() == w.Year() && at.Month() == w.Month() && at.Day() == w.Day() &&
+		at.Hour() == w.Hour() && at.Minute() == w.Minute() && at.Second() == w.Second()
+}
+
+type timesAsc []time.Time
+
+func (slice timesAsc) Len() int {
+	return len(slice)
+}
+func (slice timesAsc) Less(i, j int) bool {
+	return slice[i].Before(slice[j])
+}
+func (slice timesAsc) Swap(i, j int) {
+	slice[i], slice[j] = slice[j], slice[i]
+}
@@ -66,9 +66,33 @@ func (c *EventLogger) StartConsuming(ch chan evtbus.Event) {
 			case *ServerStartedEvt:
 				eventType = "ServerStartedEvt"
 				data = evt
+			case *DeviceLostEvt:
+				eventType = "DeviceLostEvt"
+				data = evt
 			case *AutomationTriggeredEvt:
 				eventType = "AutomationTriggeredEvt"
 				data = evt
+			case *AutomationSkippedEvt:
+				eventType = "AutomationSkippedEvt"
+				data = evt
+			case *AutomationSuppressedEvt:
+				eventType = "AutomationSuppressedEvt"
+				data = evt
+			case *AutomationErrorEvt:
+				eventType = "AutomationErrorEvt"
+				data = evt
+			case *CommandCompletedEvt:
+				eventType = "CommandCompletedEvt"
+				data = evt
+			case *CommandFailedEvt:
+				eventType = "CommandFailedEvt"
+				data = evt
+			case *SceneActivatedEvt:
+				eventType = "SceneActivatedEvt"
+				data = evt
+			case *SceneDeactivatedEvt:
+				eventType = "SceneDeactivatedEvt"
+				data = evt
 			}
 
 			// In verbose mode we log more information, useful for debugging
@@ -0,0 +1,241 @@
+package gohome
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/go-home-iot/event-bus"
+	"github.com/markdaws/gohome/pkg/log"
+)
+
+const (
+	// EventTriggerTypeServerStarted - fires when the server starts
+	EventTriggerTypeServerStarted string = "server_started"
+
+	// EventTriggerTypeUserLogin - fires when a user logs in
+	EventTriggerTypeUserLogin string = "user_login"
+
+	// EventTriggerTypeClientConnected - fires when a client connects to get updates from the server
+	EventTriggerTypeClientConnected string = "client_connected"
+
+	// EventTriggerTypeClientDisconnected - fires when a client disconnects from the server
+	EventTriggerTypeClientDisconnected string = "client_disconnected"
+
+	// EventTriggerTypeDeviceLost - fires when the connection to a device is lost
+	EventTriggerTypeDeviceLost string = "device_lost"
+
+	// EventTriggerTypeAutomationTriggered - fires when another piece of automation is triggered
+	EventTriggerTypeAutomationTriggered string = "automation_triggered"
+)
+
+// EventTrigger is a trigger that fires when a system event is raised, such as the server starting or
+// a user logging in. The optional fields filter which of the events cause the trigger to fire
+type EventTrigger struct {
+	// Name is the name of the automation the trigger belongs to
+	Name string
+
+	// Type is one of the EventTriggerType values
+	Type string
+
+	// Login and Success filter UserLoginEvt events, nil matches any value
+	Login   *string
+	Success *bool
+
+	// Device filters DeviceLostEvt events by the name or ID of the device, empty matches any device
+	Device string
+
+	// Automation filters AutomationTriggeredEvt events by the name of the automation, empty
+	// matches any automation
+	Automation string
+
+	// LastClient if true only fires a client_disconnected trigger when there are no other clients
+	// connected
+	LastClient bool
+
+	// ConnectedClients if not nil returns the IDs of the clients that are connected when the trigger
+	// starts, so that clients that connected before the automation was loaded are counted
+	ConnectedClients func() []string
+
+	Triggered func()
+
+	// chained is called instead of Triggered when an AutomationTriggeredEvt fires the trigger, with the
+	// names of all of the automation that caused this trigger to fire
+	chained func(chain []string)
+
+	mutex   sync.Mutex
+	done    chan struct{}
+	clients map[string]bool
+}
+
+func (t *EventTrigger) ConsumerName() string {
+	return fmt.Sprintf("EventTrigger - %s", t.Type)
+}
+
+func (t *EventTrigger) StartConsuming(ch chan evtbus.Event) {
+	t.mutex.Lock()
+	t.done = make(chan struct{})
+	done := t.done
+	t.clients = make(map[string]bool)
+	if t.ConnectedClients != nil {
+		for _, ID := range t.ConnectedClients() {
+			t.clients[ID] = true
+		}
+	}
+	t.mutex.Unlock()
+
+	go func() {
+		for {
+			select {
+			case evt, more := <-ch:
+				if !more {
+					return
+				}
+				t.handleEvent(evt)
+			case <-done:
+				return
+			}
+		}
+	}()
+}
+
+// StopConsuming stops the trigger, it will not fire again until StartConsuming is called
+func (t *EventTrigger) StopConsuming() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.done != nil {
+		close(t.done)
+		t.done = nil
+	}
+}
+
+func (t *EventTrigger) Trigger() {
+	t.Triggered()
+}
+
+func (t *EventTrigger) handleEvent(evt evtbus.Event) {
+	switch e := evt.(type) {
+	case *ServerStartedEvt:
+		if t.Type == EventTriggerTypeServerStarted {
+			t.Triggered()
+		}
+
+	case *UserLoginEvt:
+		if t.Type != EventTriggerTypeUserLogin {
+			return
+		}
+		if (t.Login == nil || *t.Login == e.Login) && (t.Success == nil || *t.Success == e.Success) {
+			t.Triggered()
+		}
+
+	case *ClientConnectedEvt:
+		t.mutex.Lock()
+		t.clients[e.ConnectionID] = true
+		t.mutex.Unlock()
+
+		if t.Type == EventTriggerTypeClientConnected {
+			t.Triggered()
+		}
+
+	case *ClientDisconnectedEvt:
+		t.mutex.Lock()
+		delete(t.clients, e.ConnectionID)
+		remaining := len(t.clients)
+		t.mutex.Unlock()
+
+		if t.Type != EventTriggerTypeClientDisconnected {
+			return
+		}
+		if !t.LastClient || remaining == 0 {
+			t.Triggered()
+		}
+
+	case *DeviceLostEvt:
+		if t.Type != EventTriggerTypeDeviceLost {
+			return
+		}
+		if t.Device == "" || t.Device == e.DeviceName || t.Device == e.DeviceID {
+			t.Triggered()
+		}
+
+	case *AutomationTriggeredEvt:
+		if t.Type != EventTriggerTypeAutomationTriggered {
+			return
+		}
+		if t.Automation != "" && t.Automation != e.Name {
+			return
+		}
+
+		// Automation can't trigger itself, either directly or through a chain of other automation,
+		// otherwise it would never stop
+		chain := append(append([]string{}, e.Chain...), e.Name)
+		for _, name := range chain {
+			if name == t.Name {
+				log.E("automation[%s] - ignoring trigger, automation is triggering itself: %v", t.Name, chain)
+				return
+			}
+		}
+
+		if t.chained != nil {
+			t.chained(chain)
+		} else {
+			t.Triggered()
+		}
+	}
+}
+
+// parseEventTrigger creates an EventTrigger from the event key of the trigger
+func parseEventTrigger(name string, ti *triggerIntermediate, key string, fire func(chain []string)) (Trigger, error) {
+	e := ti.Event
+	key += ".event"
+
+	trigger := &EventTrigger{
+		Name:      name,
+		Type:      e.Type,
+		Login:     e.Login,
+		Success:   e.Success,
+		Triggered: func() { fire(nil) },
+	}
+
+	switch e.Type {
+	case EventTriggerTypeServerStarted, EventTriggerTypeClientConnected, EventTriggerTypeUserLogin:
+	case EventTriggerTypeClientDisconnected:
+		trigger.LastClient = e.LastClient
+	case EventTriggerTypeDeviceLost:
+		if e.Device != nil {
+			trigger.Device = *e.Device
+		}
+	case EventTriggerTypeAutomationTriggered:
+		if e.Automation != nil {
+			if *e.Automation == name {
+				return nil, &AutomationError{Key: key + ".automation", Msg: "automation can not be triggered by itself"}
+			}
+			trigger.Automation = *e.Automation
+		}
+		trigger.chained = fire
+	case "":
+		return nil, &AutomationError{Key: key, Msg: "missing type key"}
+	default:
+		return nil, &AutomationError{
+			Key: key + ".type",
+			Msg: fmt.Sprintf("unsupported event type: %s, must be one of [%s|%s|%s|%s|%s|%s]", e.Type,
+				EventTriggerTypeServerStarted, EventTriggerTypeUserLogin, EventTriggerTypeClientConnected,
+				EventTriggerTypeClientDisconnected, EventTriggerTypeDeviceLost, EventTriggerTypeAutomationTriggered),
+		}
+	}
+
+	// Make sure the filters are only used with the events they apply to
+	if (e.Login != nil || e.Success != nil) && e.Type != EventTriggerTypeUserLogin {
+		return nil, &AutomationError{Key: key, Msg: "login and success can only be used with the user_login type"}
+	}
+	if e.Device != nil && e.Type != EventTriggerTypeDeviceLost {
+		return nil, &AutomationError{Key: key, Msg: "device can only be used with the device_lost type"}
+	}
+	if e.Automation != nil && e.Type != EventTriggerTypeAutomationTriggered {
+		return nil, &AutomationError{Key: key, Msg: "automation can only be used with the automation_triggered type"}
+	}
+	if e.LastClient && e.Type != EventTriggerTypeClientDisconnected {
+		return nil, &AutomationError{Key: key, Msg: "last_client can only be used with the client_disconnected type"}
+	}
+	return trigger, nil
+}
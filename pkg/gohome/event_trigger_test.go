@@ -0,0 +1,210 @@
+package gohome_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-home-iot/event-bus"
+	"github.com/markdaws/gohome/pkg/gohome"
+	"github.com/stretchr/testify/require"
+)
+
+// sendEvents starts the trigger, sends it the events and returns the number of times it fired
+func sendEvents(trigger evtbus.Consumer, fired chan bool, evts ...evtbus.Event) int {
+	ch := make(chan evtbus.Event)
+	trigger.StartConsuming(ch)
+	defer trigger.StopConsuming()
+	defer close(ch)
+
+	for _, evt := range evts {
+		ch <- evt
+	}
+
+	count := 0
+	for {
+		select {
+		case <-fired:
+			count++
+		case <-time.After(100 * time.Millisecond):
+			return count
+		}
+	}
+}
+
+func TestEventTriggerServerStarted(t *testing.T) {
+	t.Parallel()
+
+	fired := make(chan bool, 10)
+	trigger := &gohome.EventTrigger{
+		Type:      gohome.EventTriggerTypeServerStarted,
+		Triggered: func() { fired <- true },
+	}
+
+	count := sendEvents(trigger, fired,
+		&gohome.UserLoginEvt{Login: "bob", Success: true},
+		&gohome.ServerStartedEvt{},
+	)
+	require.Equal(t, 1, count)
+}
+
+func TestEventTriggerUserLogin(t *testing.T) {
+	t.Parallel()
+
+	fired := make(chan bool, 10)
+	login := "bob"
+	success := false
+	trigger := &gohome.EventTrigger{
+		Type:      gohome.EventTriggerTypeUserLogin,
+		Login:     &login,
+		Success:   &success,
+		Triggered: func() { fired <- true },
+	}
+
+	count := sendEvents(trigger, fired,
+		&gohome.UserLoginEvt{Login: "bob", Success: true},
+		&gohome.UserLoginEvt{Login: "alice", Success: false},
+		&gohome.UserLoginEvt{Login: "bob", Success: false},
+	)
+	require.Equal(t, 1, count)
+}
+
+func TestEventTriggerLastClientDisconnected(t *testing.T) {
+	t.Parallel()
+
+	fired := make(chan bool, 10)
+	trigger := &gohome.EventTrigger{
+		Type:       gohome.EventTriggerTypeClientDisconnected,
+		LastClient: true,
+		Triggered:  func() { fired <- true },
+
+		// Connected before the trigger started e.g. the automation was reloaded
+		ConnectedClients: func() []string { return []string{"3"} },
+	}
+
+	count := sendEvents(trigger, fired,
+		&gohome.ClientConnectedEvt{ConnectionID: "1"},
+		&gohome.ClientConnectedEvt{ConnectionID: "2"},
+		&gohome.ClientDisconnectedEvt{ConnectionID: "1"},
+		&gohome.ClientDisconnectedEvt{ConnectionID: "2"},
+		&gohome.ClientDisconnectedEvt{ConnectionID: "3"},
+	)
+	require.Equal(t, 1, count)
+}
+
+func TestEventTriggerLastClientReloaded(t *testing.T) {
+	t.Parallel()
+
+	config := `
+name: Lights off
+trigger:
+  event:
+    type: client_disconnected
+    last_client: true
+actions:
+  - light_zone:
+      on_off: 'off'
+`
+
+	sys := gohome.NewSystem("test system")
+	sys.Services.EvtBus = evtbus.NewBus(100, 100)
+
+	// The client connects before the automation is loaded
+	sys.ClientConnected(&gohome.ClientConnectedEvt{ConnectionID: "1"})
+
+	auto, err := gohome.NewAutomation(sys, config)
+	require.Nil(t, err)
+	fired := make(chan bool, 10)
+	auto.Triggered = func(actions *gohome.CommandGroup) {
+		fired <- true
+	}
+	sys.StartAutomation(auto)
+	defer sys.StopAutomation(auto)
+
+	sys.ClientDisconnected("1")
+	select {
+	case <-fired:
+	case <-time.After(time.Second):
+		require.FailNow(t, "last client disconnected did not fire")
+	}
+	require.Equal(t, 0, len(sys.ConnectedClients()))
+}
+
+func TestEventTriggerDeviceLost(t *testing.T) {
+	t.Parallel()
+
+	fired := make(chan bool, 10)
+	trigger := &gohome.EventTrigger{
+		Type:      gohome.EventTriggerTypeDeviceLost,
+		Device:    "bridge",
+		Triggered: func() { fired <- true },
+	}
+
+	count := sendEvents(trigger, fired,
+		&gohome.DeviceLostEvt{DeviceName: "hub", DeviceID: "1"},
+		&gohome.DeviceLostEvt{DeviceName: "bridge", DeviceID: "2"},
+	)
+	require.Equal(t, 1, count)
+}
+
+func TestEventTriggerAutomationChain(t *testing.T) {
+	t.Parallel()
+
+	config := `
+name: Porch
+trigger:
+  event:
+    type: automation_triggered
+    automation: 'Sunset'
+actions:
+  - light_zone:
+      on_off: 'on'
+`
+
+	sys := gohome.NewSystem("test system")
+	auto, err := gohome.NewAutomation(sys, config)
+	require.Nil(t, err)
+	require.Equal(t, "event: automation_triggered, automation: Sunset", auto.TriggerSummary())
+
+	fired := make(chan bool, 10)
+	auto.Triggered = func(actions *gohome.CommandGroup) {
+		fired <- true
+	}
+
+	count := sendEvents(auto, fired,
+		&gohome.AutomationTriggeredEvt{Name: "Sunrise"},
+		&gohome.AutomationTriggeredEvt{Name: "Sunset"},
+
+		// Porch triggered Sunset which triggered Porch, ignored to stop an infinite loop
+		&gohome.AutomationTriggeredEvt{Name: "Sunset", Chain: []string{"Porch"}},
+	)
+	require.Equal(t, 1, count)
+}
+
+func TestEventTriggerInvalid(t *testing.T) {
+	t.Parallel()
+
+	sys := gohome.NewSystem("test system")
+	tests := map[string]string{
+		"type: sunrise":                                      "triggers[1].event.type",
+		"type: server_started\n      login: bob":             "triggers[1].event",
+		"type: automation_triggered\n      automation: Test": "triggers[1].event.automation",
+		"login: bob": "triggers[1].event",
+	}
+
+	for event, key := range tests {
+		config := `
+name: Test
+triggers:
+  - time:
+      at: '22:00:00'
+  - event:
+      ` + event + `
+actions:
+  - light_zone:
+      on_off: 'on'
+`
+		_, err := gohome.NewAutomation(sys, config)
+		require.NotNil(t, err, event)
+		require.Equal(t, key, err.(*gohome.AutomationError).Key, event)
+	}
+}
@@ -11,11 +11,116 @@ import (
 // AutomationTriggeredEvt is fired when a piece of automation is triggered
 type AutomationTriggeredEvt struct {
 	Name string
+
+	// Chain contains the names of the automation that caused this automation to trigger, if it was
+	// triggered by other automation triggering, in the order they were triggered
+	Chain []string
 }
 
 // String returns a debug string
 func (e *AutomationTriggeredEvt) String() string {
-	return fmt.Sprintf("AutomationTriggeredEvt[Name: %s]", e.Name)
+	return fmt.Sprintf("AutomationTriggeredEvt[Name: %s, Chain: %v]", e.Name, e.Chain)
+}
+
+// AutomationSkippedEvt is fired when a piece of automation is triggered, but the actions are not
+// executed, for example because the only_if condition of the automation is false
+type AutomationSkippedEvt struct {
+	Name string
+
+	// Reason describes why the actions were not executed
+	Reason string
+}
+
+// String returns a debug string
+func (e *AutomationSkippedEvt) String() string {
+	return fmt.Sprintf("AutomationSkippedEvt[Name: %s, Reason: %s]", e.Name, e.Reason)
+}
+
+// AutomationSuppressedEvt is fired when the trigger of a piece of automation fires, but the automation
+// doesn't run because of its cooldown, debounce or max_runs_per settings
+type AutomationSuppressedEvt struct {
+	Name string
+
+	// Reason describes which setting suppressed the automation
+	Reason string
+}
+
+// String returns a debug string
+func (e *AutomationSuppressedEvt) String() string {
+	return fmt.Sprintf("AutomationSuppressedEvt[Name: %s, Reason: %s]", e.Name, e.Reason)
+}
+
+// AutomationErrorEvt is fired when an automation script fails to load. If there was a previous version
+// of the script that loaded successfully, it continues to run
+type AutomationErrorEvt struct {
+	// Path is the path of the automation script
+	Path string
+
+	// Name is the name of the automation that is still running, empty if there is no previous version
+	Name string
+
+	// Err describes why the automation failed to load
+	Err string
+}
+
+// String returns a debug string
+func (e *AutomationErrorEvt) String() string {
+	return fmt.Sprintf("AutomationErrorEvt[Path: %s, Name: %s, Err: %s]", e.Path, e.Name, e.Err)
+}
+
+// CommandCompletedEvt is fired when all of the commands in a CommandGroup have executed without an error
+type CommandCompletedEvt struct {
+	// ID is the ID of the CommandGroup
+	ID   string
+	Desc string
+
+	// Commands has the status of each command in the group
+	Commands []CommandStatus
+}
+
+// String returns a debug string
+func (e *CommandCompletedEvt) String() string {
+	return fmt.Sprintf("CommandCompletedEvt[ID: %s, Desc: %s]", e.ID, e.Desc)
+}
+
+// CommandFailedEvt is fired when at least one of the commands in a CommandGroup could not be built or
+// returned an error, the status of each command contains the errors
+type CommandFailedEvt struct {
+	// ID is the ID of the CommandGroup
+	ID   string
+	Desc string
+
+	// Commands has the status of each command in the group
+	Commands []CommandStatus
+}
+
+// String returns a debug string
+func (e *CommandFailedEvt) String() string {
+	return fmt.Sprintf("CommandFailedEvt[ID: %s, Desc: %s]", e.ID, e.Desc)
+}
+
+// SceneActivatedEvt is fired when the current values of the features a scene sets all match the values
+// in the scene, whether or not the scene was the reason they changed
+type SceneActivatedEvt struct {
+	SceneID   string
+	SceneName string
+}
+
+// String returns a debug string
+func (e *SceneActivatedEvt) String() string {
+	return fmt.Sprintf("SceneActivatedEvt[ID: %s, Name: %s]", e.SceneID, e.SceneName)
+}
+
+// SceneDeactivatedEvt is fired when a scene was active but one of the features it sets no longer
+// matches the value in the scene
+type SceneDeactivatedEvt struct {
+	SceneID   string
+	SceneName string
+}
+
+// String returns a debug string
+func (e *SceneDeactivatedEvt) String() string {
+	return fmt.Sprintf("SceneDeactivatedEvt[ID: %s, Name: %s]", e.SceneID, e.SceneName)
 }
 
 // SunriseEvt is fired when it is sunrise
@@ -72,6 +177,11 @@ type FeatureAttrsChangedEvt struct {
 	FeatureID string
 	Context   string
 	Attrs     map[string]*attr.Attribute
+
+	// Previous contains the values the attributes had before they changed, keyed by the attribute local
+	// ID. An attribute is missing if its previous value was not known. It is only set by the Monitor,
+	// it is nil for events raised by extensions
+	Previous map[string]*attr.Attribute
 }
 
 // String returns a debug string
@@ -97,7 +207,7 @@ type DeviceLostEvt struct {
 
 // String returns a debug string
 func (dl *DeviceLostEvt) String() string {
-	return fmt.Sprintf("DeviceLostEvt[ID: %s, Name: %s]", dl.DeviceName, dl.DeviceID)
+	return fmt.Sprintf("DeviceLostEvt[ID: %s, Name: %s]", dl.DeviceID, dl.DeviceName)
 }
 
 // ClientConnectedEvt is raised when a client registers to get updates for zone and sensor values
@@ -1,13 +1,21 @@
 package gohome
 
 import (
+	"sync"
 	"time"
 
 	"github.com/go-home-iot/event-bus"
+	"github.com/markdaws/gohome/pkg/clock"
+	"github.com/markdaws/gohome/pkg/log"
 )
 
 // FeatureTrigger is a trigger that can be used to fire based on a features attributes changing
 type FeatureTrigger struct {
+	// FeatureID is the ID of the feature whose attribute changes cause the condition to be evaluated
+	FeatureID string
+
+	// Condition is evaluated each time the feature reports changes to attributes referenced by the condition,
+	// the condition may also reference the current values of other features in the system
 	Condition *condition
 	Triggered func()
 
@@ -19,8 +27,25 @@ type FeatureTrigger struct {
 	// 3000 milliseconds
 	Duration time.Duration
 
+	// For is how long the condition must be continuously true before the trigger fires, if zero the
+	// trigger fires as soon as the condition is true. Once the trigger has fired, the condition has to
+	// become false before the trigger can fire again
+	For time.Duration
+
+	// Time is used to time the Duration and For values, defaults to the system time if nil
+	Time clock.Time
+
 	trueCount int
 	startTime time.Time
+	mutex     sync.Mutex
+	done      chan struct{}
+
+	// pending is closed to cancel the timer waiting for the For duration to expire, nil if there
+	// is no timer running
+	pending chan struct{}
+
+	// held is true if the trigger has fired since the condition last became true
+	held bool
 }
 
 func (e *FeatureTrigger) ConsumerName() string {
@@ -28,36 +53,171 @@ func (e *FeatureTrigger) ConsumerName() string {
 }
 
 func (e *FeatureTrigger) StartConsuming(ch chan evtbus.Event) {
-	go func() {
-		for evt := range ch {
-			attrEvt, ok := evt.(*FeatureAttrsChangedEvt)
-			if !ok {
-				continue
-			}
+	e.mutex.Lock()
+	e.done = make(chan struct{})
+	done := e.done
+	e.trueCount = 0
+	e.startTime = time.Time{}
+	e.held = false
 
-			isTrue := e.Condition.Evaluate(attrEvt)
-			if isTrue {
-				if time.Now().After(e.startTime.Add(e.Duration)) {
-					e.trueCount = 1
-					e.startTime = time.Now()
-				} else {
-					e.trueCount++
-				}
+	// If the condition is already true when we start, it has been true for at least as long as we
+	// have been running, so start timing it
+	if e.For > 0 && e.Condition != nil && e.Condition.Evaluate(nil, e.now()) {
+		e.startHoldTimer(done)
+	}
+	e.mutex.Unlock()
 
-				if e.Count == 0 {
-					// User has not set a count, just trigger
-					e.Triggered()
-				} else if e.trueCount == e.Count {
-					// Reached the trigger amount
-					e.Triggered()
+	go func() {
+		for {
+			select {
+			case evt, more := <-ch:
+				if !more {
+					return
 				}
+				e.handleEvent(evt)
+			case <-done:
+				return
 			}
 		}
 	}()
 }
 
+// StopConsuming stops the trigger, it will not fire again until StartConsuming is called
 func (e *FeatureTrigger) StopConsuming() {
-	//TODO:
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if e.done != nil {
+		close(e.done)
+		e.done = nil
+	}
+	e.cancelHoldTimer()
+}
+
+func (e *FeatureTrigger) handleEvent(evt evtbus.Event) {
+	attrEvt, ok := evt.(*FeatureAttrsChangedEvt)
+	if !ok {
+		return
+	}
+
+	if e.For > 0 {
+		e.handleHoldEvent(attrEvt)
+		return
+	}
+
+	if attrEvt.FeatureID != e.FeatureID || !e.Condition.watches(attrEvt) {
+		return
+	}
+
+	isTrue := e.Condition.Evaluate(attrEvt, e.now())
+	if !isTrue {
+		return
+	}
+
+	e.mutex.Lock()
+	if e.done == nil {
+		e.mutex.Unlock()
+		return
+	}
+	now := e.now()
+	if now.After(e.startTime.Add(e.Duration)) {
+		e.trueCount = 1
+		e.startTime = now
+	} else {
+		e.trueCount++
+	}
+
+	// If the user has not set a count just trigger, otherwise trigger once the count is reached
+	fire := e.Count == 0 || e.trueCount == e.Count
+	e.mutex.Unlock()
+
+	if fire {
+		e.Triggered()
+	}
+}
+
+// handleHoldEvent starts timing the condition when it becomes true, and cancels the timer if a change
+// to any of the attributes referenced by the condition makes it false
+func (e *FeatureTrigger) handleHoldEvent(evt *FeatureAttrsChangedEvt) {
+	if !e.Condition.watches(evt) {
+		return
+	}
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if e.done == nil {
+		return
+	}
+
+	if !e.Condition.Evaluate(evt, e.now()) {
+		if e.pending != nil {
+			log.V("FeatureTrigger - condition no longer true, cancelling timer, feature ID: %s", e.FeatureID)
+		}
+		e.cancelHoldTimer()
+		e.held = false
+		return
+	}
+
+	if e.pending != nil || e.held {
+		// Already timing, or already fired for this period of the condition being true
+		return
+	}
+	e.startHoldTimer(e.done)
+}
+
+// startHoldTimer starts a timer which fires the trigger once the For duration has expired, unless it
+// is cancelled first. The caller must hold the mutex
+func (e *FeatureTrigger) startHoldTimer(done chan struct{}) {
+	pending := make(chan struct{})
+	e.pending = pending
+	clk := e.clock()
+	after := clk.After(e.For)
+
+	go func() {
+		// Released once the trigger has fired, so a clock tracking the timer knows the work is done
+		defer clock.Release(clk, after)
+
+		select {
+		case <-after:
+		case <-pending:
+			return
+		case <-done:
+			return
+		}
+
+		e.mutex.Lock()
+		if e.pending != pending {
+			// Cancelled while we were waiting for the lock
+			e.mutex.Unlock()
+			return
+		}
+		e.pending = nil
+		e.held = true
+		e.mutex.Unlock()
+
+		e.Triggered()
+	}()
+}
+
+// cancelHoldTimer stops the timer started by startHoldTimer, if there is one. The caller must hold
+// the mutex
+func (e *FeatureTrigger) cancelHoldTimer() {
+	if e.pending != nil {
+		close(e.pending)
+		e.pending = nil
+	}
+}
+
+func (e *FeatureTrigger) clock() clock.Time {
+	if e.Time == nil {
+		return clock.SystemTime{}
+	}
+	return e.Time
+}
+
+func (e *FeatureTrigger) now() time.Time {
+	return e.clock().Now()
 }
 
 func (e *FeatureTrigger) Trigger() {
@@ -21,8 +21,16 @@ type MonitorDelegate interface {
 // MonitorGroup represents a group of features a client wished to receive updates for.
 type MonitorGroup struct {
 	//TODO: change name to FeatureIDs
-	Features        map[string]bool
-	Handler         MonitorDelegate
+	Features map[string]bool
+	Handler  MonitorDelegate
+
+	// Scenes is true if the group is also updated when scenes become active or inactive
+	Scenes bool
+
+	// Commands is true if the clients of the group also want the results of command groups, the monitor
+	// doesn't send these, they come from the CommandCompletedEvt and CommandFailedEvt events
+	Commands bool
+
 	Timeout         time.Duration
 	timeoutAbsolute time.Time
 	id              string
@@ -32,14 +40,17 @@ func (mg *MonitorGroup) String() string {
 	return fmt.Sprintf("MonitorGroup[ID:%s, %d features]", mg.id, len(mg.Features))
 }
 
-// ChangeBatch contains a list of features whos values have changed
+// ChangeBatch contains a list of features whos values have changed, and for groups that monitor scenes
+// the scenes that have become active or inactive, keyed by the scene ID
 type ChangeBatch struct {
 	MonitorID string
 	Features  map[string]map[string]*attr.Attribute
+	Scenes    map[string]bool
 }
 
 func (cb *ChangeBatch) String() string {
-	return fmt.Sprintf("ChangeBatch[monitorID: %s, #features:%d]", cb.MonitorID, len(cb.Features))
+	return fmt.Sprintf("ChangeBatch[monitorID: %s, #features:%d, #scenes:%d]",
+		cb.MonitorID, len(cb.Features), len(cb.Scenes))
 }
 
 const MonitorContext = "__MONITOR__"
@@ -53,7 +64,9 @@ type Monitor struct {
 	evtBus          *evtbus.Bus
 	featureToGroups map[string]map[string]bool
 	featureValues   map[string]map[string]*attr.Attribute
+	activeScenes    map[string]bool
 	mutex           sync.RWMutex
+	sceneMutex      sync.Mutex
 }
 
 // NewMonitor returns an initialzed Monitor instance
@@ -65,6 +78,7 @@ func NewMonitor(sys *System, evtBus *evtbus.Bus) *Monitor {
 		groups:          make(map[string]*MonitorGroup),
 		featureToGroups: make(map[string]map[string]bool),
 		featureValues:   make(map[string]map[string]*attr.Attribute),
+		activeScenes:    make(map[string]bool),
 		evtBus:          evtBus,
 	}
 
@@ -103,13 +117,19 @@ func (m *Monitor) Refresh(monitorID string, force bool) {
 			featuresReport.Add(featureID)
 		}
 	}
+	if group.Scenes {
+		changeBatch.Scenes = make(map[string]bool)
+		for sceneID, active := range m.activeScenes {
+			changeBatch.Scenes[sceneID] = active
+		}
+	}
 
 	log.V("Monitor - refreshing: %s, force:%t", group, force)
 	log.V("Monitor - refreshing: cached values: [%s], uncached features: %s", changeBatch, featuresReport)
 
 	m.mutex.RUnlock()
 
-	if len(changeBatch.Features) > 0 {
+	if len(changeBatch.Features) > 0 || len(changeBatch.Scenes) > 0 {
 		// We have some values already cached for certain items, return
 		group.Handler.Update(changeBatch)
 	}
@@ -172,8 +192,8 @@ func (m *Monitor) SubscribeRenew(monitorID string) error {
 // that can be passed into other functions, such as Unsubscribe and Refresh.
 func (m *Monitor) Subscribe(g *MonitorGroup, refresh bool) (string, error) {
 
-	if len(g.Features) == 0 {
-		return "", errors.New("no features listed in the monitor group")
+	if len(g.Features) == 0 && !g.Scenes && !g.Commands {
+		return "", errors.New("no features, scenes or commands listed in the monitor group")
 	}
 
 	m.mutex.Lock()
@@ -216,6 +236,9 @@ func (m *Monitor) Unsubscribe(monitorID string) {
 
 	emptyFeatureToGroupCount := 0
 
+	// NOTE: we don't remove the cached values for features that are no longer being
+	// monitored, automation conditions rely on the last known value of features even
+	// if no client is currently watching them
 	m.mutex.Lock()
 	delete(m.groups, monitorID)
 	for featureID, groups := range m.featureToGroups {
@@ -224,7 +247,6 @@ func (m *Monitor) Unsubscribe(monitorID string) {
 			if len(groups) == 0 {
 				emptyFeatureToGroupCount++
 				delete(m.featureToGroups, featureID)
-				delete(m.featureValues, featureID)
 			}
 		}
 	}
@@ -238,16 +260,66 @@ func (m *Monitor) featureAttrsChanged(featureID string, attrs map[string]*attr.A
 	m.featureReporting(featureID, attrs)
 }
 
-func (m *Monitor) featureReporting(featureID string, attrs map[string]*attr.Attribute) {
+// FeatureValues returns the last known attribute values for the feature, keyed by the attribute
+// local ID. The bool return value is false if the monitor has not received any values for the feature
+func (m *Monitor) FeatureValues(featureID string) (map[string]*attr.Attribute, bool) {
 	m.mutex.RLock()
-	groups, ok := m.featureToGroups[featureID]
-	m.mutex.RUnlock()
+	defer m.mutex.RUnlock()
 
+	values, ok := m.featureValues[featureID]
 	if !ok {
-		// Not a feature we are monitoring, ignore
-		return
+		return nil, false
+	}
+
+	out := make(map[string]*attr.Attribute)
+	for localID, attribute := range values {
+		out[localID] = attribute
+	}
+	return out, true
+}
+
+// ReportValues returns the current attribute values of the features, keyed by feature ID. Features
+// the monitor doesn't have values for are asked to report them, waiting up to timeout for the values
+// to arrive. Features that still have no values after the timeout are not in the returned map
+func (m *Monitor) ReportValues(featureIDs []string, timeout time.Duration) map[string]map[string]*attr.Attribute {
+	values := make(map[string]map[string]*attr.Attribute)
+	featuresReport := &FeaturesReportEvt{}
+	for _, featureID := range featureIDs {
+		if attrs, ok := m.FeatureValues(featureID); ok {
+			values[featureID] = attrs
+		} else {
+			featuresReport.Add(featureID)
+		}
+	}
+	if len(featuresReport.FeatureIDs) == 0 {
+		return values
 	}
 
+	log.V("Monitor - requesting values: %s", featuresReport)
+	m.evtBus.Enqueue(featuresReport)
+
+	// The event is shared with the consumers, so keep track of the features still to report separately
+	pending := make(map[string]bool)
+	for featureID := range featuresReport.FeatureIDs {
+		pending[featureID] = true
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		for featureID := range pending {
+			if attrs, ok := m.FeatureValues(featureID); ok {
+				values[featureID] = attrs
+				delete(pending, featureID)
+			}
+		}
+		if len(pending) == 0 || time.Now().After(deadline) {
+			return values
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func (m *Monitor) featureReporting(featureID string, attrs map[string]*attr.Attribute) {
 	// If not a valid featureID in the system, ignore
 	f := m.system.FeatureByID(featureID)
 	if f == nil {
@@ -289,13 +361,28 @@ func (m *Monitor) featureReporting(featureID string, attrs map[string]*attr.Attr
 
 	m.mutex.Lock()
 
-	// Merge new attribute values with the ones we already know about
+	// Merge new attribute values with the ones we already know about, keeping the previous values so
+	// that consumers can see how the values changed
+	previousAttrs := make(map[string]*attr.Attribute)
 	for localID, attr := range updatedAttrs {
+		if previous, ok := currentAttrs[localID]; ok {
+			previousAttrs[localID] = previous
+		}
 		currentAttrs[localID] = attr
 	}
 	m.featureValues[featureID] = currentAttrs
+	groups, ok := m.featureToGroups[featureID]
 	m.mutex.Unlock()
 
+	// Check the scenes before the change is reported, so anything handling the change sees which scenes
+	// are active now
+	m.updateActiveScenes(featureID)
+
+	if !ok {
+		// Not a feature we are monitoring, the value is cached but there is no one to notify
+		return
+	}
+
 	for groupID := range groups {
 		m.mutex.RLock()
 		group := m.groups[groupID]
@@ -312,6 +399,7 @@ func (m *Monitor) featureReporting(featureID string, attrs map[string]*attr.Attr
 		FeatureID: featureID,
 		Context:   MonitorContext,
 		Attrs:     updatedAttrs,
+		Previous:  previousAttrs,
 	})
 }
 
@@ -0,0 +1,81 @@
+package gohome
+
+import (
+	"sync"
+
+	"github.com/go-home-iot/event-bus"
+)
+
+// MultiTrigger contains a list of triggers, the automation executes when any one of the triggers fires
+type MultiTrigger struct {
+	Triggers []Trigger
+
+	mutex sync.Mutex
+	done  chan struct{}
+}
+
+func (t *MultiTrigger) ConsumerName() string {
+	return "MultiTrigger"
+}
+
+// StartConsuming starts all of the triggers, each event is passed to every trigger
+func (t *MultiTrigger) StartConsuming(ch chan evtbus.Event) {
+	t.mutex.Lock()
+	t.done = make(chan struct{})
+	done := t.done
+	t.mutex.Unlock()
+
+	chans := make([]chan evtbus.Event, len(t.Triggers))
+	for i, trigger := range t.Triggers {
+		chans[i] = make(chan evtbus.Event, 100)
+		trigger.StartConsuming(chans[i])
+	}
+
+	go func() {
+		defer func() {
+			for _, c := range chans {
+				close(c)
+			}
+		}()
+
+		for {
+			select {
+			case evt, more := <-ch:
+				if !more {
+					return
+				}
+				for _, c := range chans {
+					select {
+					case c <- evt:
+					case <-done:
+						return
+					}
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+}
+
+// StopConsuming stops all of the triggers
+func (t *MultiTrigger) StopConsuming() {
+	t.mutex.Lock()
+	if t.done != nil {
+		close(t.done)
+		t.done = nil
+	}
+	t.mutex.Unlock()
+
+	for _, trigger := range t.Triggers {
+		trigger.StopConsuming()
+	}
+}
+
+// Trigger fires the automation, the actions are the same whichever trigger fires so we
+// just use the first one
+func (t *MultiTrigger) Trigger() {
+	if len(t.Triggers) > 0 {
+		t.Triggers[0].Trigger()
+	}
+}
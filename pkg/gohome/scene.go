@@ -46,11 +46,9 @@ func (s *Scene) AddCommand(c cmd.Command) error {
 	return nil
 }
 
-// Validate verfies the scene is in a good state
+// Validate verfies the scene is in a good state. Scenes that set each other in a loop are checked
+// by System.ValidateSceneGraph, since that needs the other scenes in the system
 func (s *Scene) Validate() *validation.Errors {
-	//TODO: Verify that there isn't an infinite loop where scene A -> B -> C -> A otherwise
-	//app will crash
-
 	errors := &validation.Errors{}
 
 	if s.Name == "" {
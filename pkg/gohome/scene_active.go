@@ -0,0 +1,159 @@
+package gohome
+
+import (
+	"math"
+
+	"github.com/markdaws/gohome/pkg/attr"
+	"github.com/markdaws/gohome/pkg/cmd"
+	"github.com/markdaws/gohome/pkg/log"
+)
+
+const (
+	// sceneBrightnessTolerance is how far, in percent, the brightness of a light can be from the value in a
+	// scene and still match, dimmers often report a slightly different level to the one they were set to
+	sceneBrightnessTolerance = 2
+
+	// sceneOffsetTolerance is how far, in percent, the offset of a window treatment can be from the value
+	// in a scene and still match
+	sceneOffsetTolerance = 2
+)
+
+// sceneMatches returns true if the current values of all of the attributes set by the FeatureSetAttrs
+// commands in the scene match the values in the scene. Other commands are ignored. A scene without any
+// FeatureSetAttrs commands, or where any of the values are not known, doesn't match
+func sceneMatches(scene *Scene, values func(featureID string) (map[string]*attr.Attribute, bool)) bool {
+	matched := false
+	for _, c := range scene.Commands {
+		command, ok := c.(*cmd.FeatureSetAttrs)
+		if !ok {
+			continue
+		}
+
+		current, ok := values(command.FeatureID)
+		if !ok {
+			return false
+		}
+		for localID, target := range command.Attrs {
+			if !attrMatches(target, current[localID]) {
+				return false
+			}
+		}
+		matched = true
+	}
+	return matched
+}
+
+// attrMatches returns true if the current value of an attribute matches the target value, brightness
+// and offset values only have to be within a tolerance of the target
+func attrMatches(target, current *attr.Attribute) bool {
+	if current == nil {
+		return false
+	}
+
+	var tolerance float64
+	switch target.Type {
+	case attr.ATBrightness:
+		tolerance = sceneBrightnessTolerance
+	case attr.ATOffset:
+		tolerance = sceneOffsetTolerance
+	}
+	if tolerance > 0 {
+		a, ok1 := attrFloat(target)
+		b, ok2 := attrFloat(current)
+		return ok1 && ok2 && math.Abs(a-b) <= tolerance
+	}
+	return target.Value == current.Value
+}
+
+// SceneActive returns true if the scene is active, the current values of the features it sets match the
+// values in the scene
+func (m *Monitor) SceneActive(sceneID string) bool {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.activeScenes[sceneID]
+}
+
+// ActiveScenes returns whether each managed scene is active, keyed by the scene ID
+func (m *Monitor) ActiveScenes() map[string]bool {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	out := make(map[string]bool)
+	for sceneID, active := range m.activeScenes {
+		out[sceneID] = active
+	}
+	return out
+}
+
+// UpdateActiveScenes checks which scenes are active. This happens automatically when feature values
+// change, it needs to be called when scenes are added, changed or deleted
+func (m *Monitor) UpdateActiveScenes() {
+	m.updateActiveScenes("")
+}
+
+// updateActiveScenes checks which of the managed scenes that set the feature are active, if featureID is
+// empty all of the managed scenes are checked. When a scene becomes active or inactive an event is fired
+// and groups that monitor scenes are updated
+func (m *Monitor) updateActiveScenes(featureID string) {
+	m.sceneMutex.Lock()
+	defer m.sceneMutex.Unlock()
+
+	scenes := m.system.Scenes()
+	states := make(map[string]bool)
+	for _, scene := range scenes {
+		if !scene.Managed || (featureID != "" && !sceneSetsFeature(scene, featureID)) {
+			continue
+		}
+		states[scene.ID] = sceneMatches(scene, m.FeatureValues)
+	}
+
+	changed := make(map[string]bool)
+	var groups []*MonitorGroup
+	m.mutex.Lock()
+	if featureID == "" {
+		// Forget scenes that have been deleted or are no longer managed
+		for sceneID := range m.activeScenes {
+			if _, ok := states[sceneID]; !ok {
+				delete(m.activeScenes, sceneID)
+			}
+		}
+	}
+	for sceneID, active := range states {
+		if m.activeScenes[sceneID] != active {
+			changed[sceneID] = active
+		}
+		m.activeScenes[sceneID] = active
+	}
+	if len(changed) > 0 {
+		for _, group := range m.groups {
+			if group.Scenes {
+				groups = append(groups, group)
+			}
+		}
+	}
+	m.mutex.Unlock()
+
+	for sceneID, active := range changed {
+		scene := scenes[sceneID]
+		log.V("Monitor - scene active: %t, %s", active, scene.Name)
+		if active {
+			m.evtBus.Enqueue(&SceneActivatedEvt{SceneID: scene.ID, SceneName: scene.Name})
+		} else {
+			m.evtBus.Enqueue(&SceneDeactivatedEvt{SceneID: scene.ID, SceneName: scene.Name})
+		}
+	}
+
+	for _, group := range groups {
+		group.Handler.Update(&ChangeBatch{MonitorID: group.id, Scenes: changed})
+	}
+}
+
+// sceneSetsFeature returns true if the scene has a FeatureSetAttrs command for the feature
+func sceneSetsFeature(scene *Scene, featureID string) bool {
+	for _, c := range scene.Commands {
+		if command, ok := c.(*cmd.FeatureSetAttrs); ok && command.FeatureID == featureID {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,163 @@
+package gohome_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/go-home-iot/event-bus"
+	"github.com/markdaws/gohome/pkg/attr"
+	"github.com/markdaws/gohome/pkg/cmd"
+	"github.com/markdaws/gohome/pkg/feature"
+	"github.com/markdaws/gohome/pkg/gohome"
+	"github.com/stretchr/testify/require"
+)
+
+// sceneEvents records scene activation events, as "+ID" when a scene is activated and "-ID" when it is
+// deactivated
+type sceneEvents struct {
+	evts chan string
+}
+
+func (c *sceneEvents) ConsumerName() string {
+	return "sceneEvents"
+}
+
+func (c *sceneEvents) StartConsuming(ch chan evtbus.Event) {
+	go func() {
+		for e := range ch {
+			switch evt := e.(type) {
+			case *gohome.SceneActivatedEvt:
+				c.evts <- "+" + evt.SceneID
+			case *gohome.SceneDeactivatedEvt:
+				c.evts <- "-" + evt.SceneID
+			}
+		}
+	}()
+}
+
+func (c *sceneEvents) StopConsuming() {}
+
+func (c *sceneEvents) next(t *testing.T) string {
+	select {
+	case evt := <-c.evts:
+		return evt
+	case <-time.After(time.Second):
+		require.FailNow(t, "no scene event")
+	}
+	return ""
+}
+
+// sceneBatches records the scene changes reported to a monitor group
+type sceneBatches struct {
+	batches chan map[string]bool
+}
+
+func (d *sceneBatches) Update(b *gohome.ChangeBatch) {
+	if b.Scenes != nil {
+		d.batches <- b.Scenes
+	}
+}
+
+func (d *sceneBatches) Expired(monitorID string) {}
+
+// setLounge reports the on/off and brightness of the lounge light zone
+func setLounge(h *runHarness, lounge *feature.Feature, onoff int32, brightness float32) {
+	onoffAttr, brightnessAttr, _ := feature.LightZoneCloneAttrs(lounge)
+	onoffAttr.Value = onoff
+	brightnessAttr.Value = brightness
+	h.evtBus.Enqueue(&gohome.FeatureReportingEvt{
+		FeatureID: lounge.ID,
+		Attrs:     feature.NewAttrs(onoffAttr, brightnessAttr),
+	})
+	time.Sleep(100 * time.Millisecond)
+}
+
+// activeSceneHarness returns a harness with a lounge light zone and a managed "reading" scene that sets
+// it to 50% brightness
+func activeSceneHarness(t *testing.T) (*runHarness, *feature.Feature) {
+	h := newRunHarness(t)
+	lounge := feature.NewLightZone("lounge", feature.LightZoneModeContinuous)
+	lounge.Name = "lounge"
+	h.sys.AddFeature(lounge)
+
+	onoff, brightness, _ := feature.LightZoneCloneAttrs(lounge)
+	onoff.Value = attr.OnOffOn
+	brightness.Value = float32(50)
+	h.sys.AddScene(&gohome.Scene{
+		ID:      "reading",
+		Name:    "Reading",
+		Managed: true,
+		Commands: []cmd.Command{
+			&cmd.FeatureSetAttrs{FeatureID: lounge.ID, Attrs: feature.NewAttrs(onoff, brightness)},
+		},
+	})
+	return h, lounge
+}
+
+func TestSceneActive(t *testing.T) {
+	h, lounge := activeSceneHarness(t)
+	evts := &sceneEvents{evts: make(chan string, 10)}
+	h.evtBus.AddConsumer(evts)
+
+	batches := &sceneBatches{batches: make(chan map[string]bool, 10)}
+	monitor := h.sys.Services.Monitor
+	_, err := monitor.Subscribe(&gohome.MonitorGroup{Scenes: true, Handler: batches, Timeout: time.Minute}, false)
+	require.Nil(t, err)
+
+	// Close enough to the brightness in the scene
+	setLounge(h, lounge, attr.OnOffOn, 49)
+	require.Equal(t, "+reading", evts.next(t))
+	require.Equal(t, map[string]bool{"reading": true}, <-batches.batches)
+	require.True(t, h.sys.SceneActive("reading"))
+
+	// Still active, no event
+	setLounge(h, lounge, attr.OnOffOn, 51)
+	require.True(t, h.sys.SceneActive("reading"))
+
+	setLounge(h, lounge, attr.OnOffOn, 30)
+	require.Equal(t, "-reading", evts.next(t))
+	require.Equal(t, map[string]bool{"reading": false}, <-batches.batches)
+	require.False(t, h.sys.SceneActive("reading"))
+
+	// Changing the scene so it matches the current values
+	_, brightness, _ := feature.LightZoneCloneAttrs(lounge)
+	brightness.Value = float32(30)
+	h.sys.SceneByID("reading").Commands[0].(*cmd.FeatureSetAttrs).Attrs[brightness.LocalID] = brightness
+	monitor.UpdateActiveScenes()
+	require.Equal(t, "+reading", evts.next(t))
+	require.Equal(t, map[string]bool{"reading": true}, monitor.ActiveScenes())
+
+	// Deleting the scene forgets it
+	h.sys.DeleteScene(h.sys.SceneByID("reading"))
+	monitor.UpdateActiveScenes()
+	require.Equal(t, map[string]bool{}, monitor.ActiveScenes())
+}
+
+func TestSceneActiveCondition(t *testing.T) {
+	config := `
+name: Reading
+trigger:
+  event:
+    type: server_started
+only_if:
+  scene_active: %s
+actions:
+  - switch:
+      aid: fan
+      on_off: 'on'
+`
+	h, lounge := activeSceneHarness(t)
+
+	auto := h.automation(fmt.Sprintf(config, "reading"))
+	auto.Trigger.Trigger()
+	require.Equal(t, "only_if condition is false: scene reading is active", <-h.skipped)
+
+	setLounge(h, lounge, attr.OnOffOn, 50)
+	auto.Trigger.Trigger()
+	requireSet(t, h.next(h.fired), "fan", "onoff", attr.OnOffOn)
+
+	_, err := gohome.NewAutomation(h.sys, fmt.Sprintf(config, "missing"))
+	require.NotNil(t, err)
+	require.Equal(t, "only_if.scene_active", err.(*gohome.AutomationError).Key)
+}
@@ -0,0 +1,76 @@
+package gohome
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/markdaws/gohome/pkg/attr"
+	"github.com/markdaws/gohome/pkg/cmd"
+	"github.com/markdaws/gohome/pkg/feature"
+)
+
+// CaptureScene returns a new scene that sets the features back to the values they have right now, with
+// a command for each feature. Read only attributes, and sensors and buttons which can't be set, are not
+// included. Features the monitor doesn't have values for are asked to report them, waiting up to timeout.
+// The second return value is the IDs of the features that were not captured because their values are
+// not known
+func CaptureScene(sys *System, name string, features []*feature.Feature, timeout time.Duration) (*Scene, []string, error) {
+	if sys.Services.Monitor == nil {
+		return nil, nil, errors.New("the monitor is not running, the current values are not known")
+	}
+
+	var settable []*feature.Feature
+	var featureIDs []string
+	for _, f := range features {
+		if f.Type == feature.FTSensor || f.Type == feature.FTButton {
+			continue
+		}
+		settable = append(settable, f)
+		featureIDs = append(featureIDs, f.ID)
+	}
+	sort.Sort(featuresByName(settable))
+
+	values := sys.Services.Monitor.ReportValues(featureIDs, timeout)
+	scene := &Scene{
+		ID:      sys.NewID(),
+		Name:    name,
+		Managed: true,
+	}
+	var missing []string
+	for _, f := range settable {
+		current, ok := values[f.ID]
+		if !ok {
+			missing = append(missing, f.ID)
+			continue
+		}
+
+		attrs := make(map[string]*attr.Attribute)
+		for localID, attribute := range f.Attrs {
+			value, ok := current[localID]
+			if !ok || attribute.Perms == attr.PermsReadOnly {
+				continue
+			}
+			captured := attribute.Clone()
+			captured.Value = value.Value
+			attrs[localID] = captured
+		}
+		if len(attrs) == 0 {
+			missing = append(missing, f.ID)
+			continue
+		}
+
+		scene.AddCommand(&cmd.FeatureSetAttrs{
+			ID:          sys.NewID(),
+			FeatureID:   f.ID,
+			FeatureType: f.Type,
+			FeatureName: f.Name,
+			Attrs:       attrs,
+		})
+	}
+
+	if len(scene.Commands) == 0 {
+		return nil, missing, errors.New("none of the features have values that can be captured")
+	}
+	return scene, missing, nil
+}
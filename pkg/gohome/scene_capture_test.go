@@ -0,0 +1,96 @@
+package gohome_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-home-iot/event-bus"
+	"github.com/markdaws/gohome/pkg/attr"
+	"github.com/markdaws/gohome/pkg/cmd"
+	"github.com/markdaws/gohome/pkg/feature"
+	"github.com/markdaws/gohome/pkg/gohome"
+	"github.com/stretchr/testify/require"
+)
+
+// reportingDevice answers FeaturesReportEvt requests for its features with the values in attrs
+type reportingDevice struct {
+	bus   *evtbus.Bus
+	attrs map[string]map[string]*attr.Attribute
+}
+
+func (d *reportingDevice) ConsumerName() string {
+	return "reportingDevice"
+}
+
+func (d *reportingDevice) StartConsuming(ch chan evtbus.Event) {
+	go func() {
+		for e := range ch {
+			evt, ok := e.(*gohome.FeaturesReportEvt)
+			if !ok {
+				continue
+			}
+			for featureID := range evt.FeatureIDs {
+				if attrs, ok := d.attrs[featureID]; ok {
+					d.bus.Enqueue(&gohome.FeatureReportingEvt{FeatureID: featureID, Attrs: attrs})
+				}
+			}
+		}
+	}()
+}
+
+func (d *reportingDevice) StopConsuming() {}
+
+func TestCaptureScene(t *testing.T) {
+	h := newRunHarness(t)
+
+	lounge := feature.NewLightZone("lounge", feature.LightZoneModeContinuous)
+	heat := feature.NewHeatZone("heat")
+	outlet := feature.NewOutlet("outlet")
+	for _, f := range []*feature.Feature{lounge, heat, outlet} {
+		f.Name = f.ID
+		h.sys.AddFeature(f)
+	}
+
+	// The lounge and heat zone values are cached, the fan reports when asked, the outlet never reports
+	onoff, brightness, _ := feature.LightZoneCloneAttrs(lounge)
+	onoff.Value = attr.OnOffOn
+	brightness.Value = float32(40)
+	h.evtBus.Enqueue(&gohome.FeatureReportingEvt{FeatureID: lounge.ID, Attrs: feature.NewAttrs(onoff, brightness)})
+	current, target := feature.HeatZoneCloneAttrs(heat)
+	current.Value = int32(18)
+	target.Value = int32(21)
+	h.evtBus.Enqueue(&gohome.FeatureReportingEvt{FeatureID: heat.ID, Attrs: feature.NewAttrs(current, target)})
+	h.report("door", "openclose", attr.OpenCloseOpen)
+
+	fanOnOff := feature.SwitchCloneAttrs(h.features["fan"])
+	fanOnOff.Value = attr.OnOffOff
+	h.evtBus.AddConsumer(&reportingDevice{
+		bus:   h.evtBus,
+		attrs: map[string]map[string]*attr.Attribute{"fan": feature.NewAttrs(fanOnOff)},
+	})
+
+	features := []*feature.Feature{lounge, heat, outlet, h.features["fan"], h.features["door"]}
+	scene, missing, err := gohome.CaptureScene(h.sys, "Evening", features, 500*time.Millisecond)
+	require.Nil(t, err)
+	require.Equal(t, []string{"outlet"}, missing)
+	require.Equal(t, "Evening", scene.Name)
+
+	captured := make(map[string]map[string]interface{})
+	for _, c := range scene.Commands {
+		setAttrs := c.(*cmd.FeatureSetAttrs)
+		values := make(map[string]interface{})
+		for localID, attribute := range setAttrs.Attrs {
+			values[localID] = attribute.Value
+		}
+		captured[setAttrs.FeatureID] = values
+	}
+	require.Equal(t, map[string]map[string]interface{}{
+		"fan":    {"onoff": attr.OnOffOff},
+		"heat":   {"targettemp": int32(21)},
+		"lounge": {"onoff": attr.OnOffOn, "brightness": float32(40)},
+	}, captured)
+
+	// Nothing to capture is an error
+	_, _, err = gohome.CaptureScene(h.sys, "Nothing", []*feature.Feature{h.features["door"]}, 0)
+	require.NotNil(t, err)
+}
@@ -0,0 +1,196 @@
+package gohome
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/markdaws/gohome/pkg/cmd"
+	"github.com/markdaws/gohome/pkg/feature"
+)
+
+// The types of SceneGraphEdge
+const (
+	// SceneGraphEdgeScene - the scene sets another scene
+	SceneGraphEdgeScene = "scene"
+
+	// SceneGraphEdgeFeature - the scene sets the attributes of a feature
+	SceneGraphEdgeFeature = "feature"
+)
+
+// SceneCycleError is returned when scenes set each other in a loop, setting any of them would never finish
+type SceneCycleError struct {
+	// Names are the names of the scenes in the loop, the first scene is repeated at the end
+	Names []string
+}
+
+func (e *SceneCycleError) Error() string {
+	return fmt.Sprintf("scenes set each other in a loop: %s", strings.Join(e.Names, " -> "))
+}
+
+// SceneGraph is everything a scene ultimately touches when it is set
+type SceneGraph struct {
+	// Scenes are the scenes that are set, starting with the scene itself, in the order they are reached
+	Scenes []*Scene
+
+	// Features are the features the scenes set, ordered by name. Selector commands are expanded to the
+	// features that match them right now
+	Features []*feature.Feature
+
+	// Edges link each scene to the scenes and features its commands set
+	Edges []SceneGraphEdge
+}
+
+// SceneGraphEdge is a scene setting another scene or a feature, From is the ID of the scene and To is the
+// ID of the scene or feature, depending on the Type
+type SceneGraphEdge struct {
+	From string
+	To   string
+	Type string
+}
+
+// ValidateSceneGraph returns a *SceneCycleError if setting the scene would set itself again, either
+// directly or through the scenes it sets. The scene doesn't have to be in the system, so changes can be
+// checked before they are made, if it is in the system this version of the scene is used
+func (s *System) ValidateSceneGraph(scene *Scene) error {
+	lookup := func(ID string) *Scene {
+		if ID == scene.ID {
+			return scene
+		}
+		return s.SceneByID(ID)
+	}
+
+	if cycle := sceneCycle(scene, lookup, nil, make(map[string]bool)); cycle != nil {
+		names := make([]string, len(cycle))
+		for i, scn := range cycle {
+			names[i] = scn.Name
+		}
+		return &SceneCycleError{Names: names}
+	}
+	return nil
+}
+
+// ValidateScenes checks none of the scenes in the system set each other in a loop, returning a
+// *SceneCycleError for the first loop found
+func (s *System) ValidateScenes() error {
+	var sorted scenesByName
+	for _, scene := range s.Scenes() {
+		sorted = append(sorted, scene)
+	}
+	sort.Sort(sorted)
+
+	for _, scene := range sorted {
+		if err := s.ValidateSceneGraph(scene); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sceneCycle returns the scenes in a loop reachable from the scene, nil if there isn't one. path is the
+// scenes being set that led to this scene and checked are the IDs of scenes already known not to loop
+func sceneCycle(scene *Scene, lookup func(string) *Scene, path []*Scene, checked map[string]bool) []*Scene {
+	for i, p := range path {
+		if p.ID == scene.ID {
+			cycle := append([]*Scene{}, path[i:]...)
+			return append(cycle, scene)
+		}
+	}
+	if checked[scene.ID] {
+		return nil
+	}
+
+	path = append(path, scene)
+	for _, c := range scene.Commands {
+		set, ok := c.(*cmd.SceneSet)
+		if !ok {
+			continue
+		}
+		next := lookup(set.SceneID)
+		if next == nil {
+			continue
+		}
+		if cycle := sceneCycle(next, lookup, path, checked); cycle != nil {
+			return cycle
+		}
+	}
+	checked[scene.ID] = true
+	return nil
+}
+
+// SceneGraph returns the scenes and features the scene sets, including those set by the scenes it sets.
+// Returns a *SceneCycleError if the scenes set each other in a loop
+func (s *System) SceneGraph(scene *Scene) (*SceneGraph, error) {
+	if err := s.ValidateSceneGraph(scene); err != nil {
+		return nil, err
+	}
+
+	graph := &SceneGraph{}
+	seenScenes := make(map[string]bool)
+	seenFeatures := make(map[string]bool)
+	queue := []*Scene{scene}
+	seenScenes[scene.ID] = true
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		graph.Scenes = append(graph.Scenes, current)
+
+		edges := make(map[SceneGraphEdge]bool)
+		addEdge := func(edge SceneGraphEdge) {
+			if !edges[edge] {
+				edges[edge] = true
+				graph.Edges = append(graph.Edges, edge)
+			}
+		}
+		addFeature := func(f *feature.Feature) {
+			addEdge(SceneGraphEdge{From: current.ID, To: f.ID, Type: SceneGraphEdgeFeature})
+			if !seenFeatures[f.ID] {
+				seenFeatures[f.ID] = true
+				graph.Features = append(graph.Features, f)
+			}
+		}
+
+		for _, c := range current.Commands {
+			switch command := c.(type) {
+			case *cmd.SceneSet:
+				next := s.SceneByID(command.SceneID)
+				if next == nil {
+					continue
+				}
+				addEdge(SceneGraphEdge{From: current.ID, To: next.ID, Type: SceneGraphEdgeScene})
+				if !seenScenes[next.ID] {
+					seenScenes[next.ID] = true
+					queue = append(queue, next)
+				}
+
+			case *cmd.FeatureSetAttrs:
+				if f := s.FeatureByID(command.FeatureID); f != nil {
+					addFeature(f)
+				}
+
+			case *cmd.SelectorSetAttrs:
+				for _, f := range s.SelectFeatures(&command.Selector) {
+					addFeature(f)
+				}
+			}
+		}
+	}
+
+	sort.Sort(featuresByName(graph.Features))
+	return graph, nil
+}
+
+type scenesByName []*Scene
+
+func (slice scenesByName) Len() int {
+	return len(slice)
+}
+func (slice scenesByName) Less(i, j int) bool {
+	if slice[i].Name == slice[j].Name {
+		return slice[i].ID < slice[j].ID
+	}
+	return slice[i].Name < slice[j].Name
+}
+func (slice scenesByName) Swap(i, j int) {
+	slice[i], slice[j] = slice[j], slice[i]
+}
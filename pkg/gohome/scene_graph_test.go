@@ -0,0 +1,104 @@
+package gohome_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/markdaws/gohome/pkg/attr"
+	"github.com/markdaws/gohome/pkg/cmd"
+	"github.com/markdaws/gohome/pkg/feature"
+	"github.com/markdaws/gohome/pkg/gohome"
+	"github.com/stretchr/testify/require"
+)
+
+func addTestScene(sys *gohome.System, ID string, cmds ...cmd.Command) *gohome.Scene {
+	scene := &gohome.Scene{ID: ID, Name: ID, Commands: cmds}
+	sys.AddScene(scene)
+	return scene
+}
+
+func TestValidateSceneGraph(t *testing.T) {
+	sys := gohome.NewSystem("test system")
+	evening := addTestScene(sys, "evening", &cmd.SceneSet{SceneID: "lounge"})
+	lounge := addTestScene(sys, "lounge", &cmd.SceneSet{SceneID: "lamps"})
+	addTestScene(sys, "lamps")
+	require.Nil(t, sys.ValidateScenes())
+
+	// Lamps setting evening would loop, checked before the change is made
+	candidate := *sys.SceneByID("lamps")
+	candidate.Commands = []cmd.Command{&cmd.SceneSet{SceneID: "evening"}}
+	err := sys.ValidateSceneGraph(&candidate)
+	require.NotNil(t, err)
+	require.Equal(t, []string{"lamps", "evening", "lounge", "lamps"}, err.(*gohome.SceneCycleError).Names)
+	require.Equal(t, "scenes set each other in a loop: lamps -> evening -> lounge -> lamps", err.Error())
+	require.Nil(t, sys.ValidateSceneGraph(evening))
+
+	// A scene setting itself
+	lounge.Commands = append(lounge.Commands, &cmd.SceneSet{SceneID: "lounge"})
+	err = sys.ValidateScenes()
+	require.NotNil(t, err)
+	require.Equal(t, []string{"lounge", "lounge"}, err.(*gohome.SceneCycleError).Names)
+}
+
+func TestSceneGraph(t *testing.T) {
+	sys := gohome.NewSystem("test system")
+	var features []*feature.Feature
+	for _, ID := range []string{"porch", "garden", "hall"} {
+		f := feature.NewLightZone(ID, feature.LightZoneModeBinary)
+		f.Name = ID
+		sys.AddFeature(f)
+		features = append(features, f)
+	}
+	onoff, _, _ := feature.LightZoneCloneAttrs(features[0])
+	onoff.Value = attr.OnOffOn
+
+	outside := addTestScene(sys, "outside",
+		&cmd.FeatureSetAttrs{FeatureID: "porch", Attrs: feature.NewAttrs(onoff)},
+		&cmd.SelectorSetAttrs{Selector: feature.Selector{Name: "g*"}, Attrs: feature.NewAttrs(onoff)},
+	)
+	evening := addTestScene(sys, "evening",
+		&cmd.SceneSet{SceneID: "outside"},
+		&cmd.FeatureSetAttrs{FeatureID: "hall", Attrs: feature.NewAttrs(onoff)},
+		&cmd.FeatureSetAttrs{FeatureID: "porch", Attrs: feature.NewAttrs(onoff)},
+	)
+
+	graph, err := sys.SceneGraph(evening)
+	require.Nil(t, err)
+	require.Equal(t, []*gohome.Scene{evening, outside}, graph.Scenes)
+
+	var featureIDs []string
+	for _, f := range graph.Features {
+		featureIDs = append(featureIDs, f.ID)
+	}
+	require.Equal(t, []string{"garden", "hall", "porch"}, featureIDs)
+	require.Equal(t, []gohome.SceneGraphEdge{
+		{From: "evening", To: "outside", Type: gohome.SceneGraphEdgeScene},
+		{From: "evening", To: "hall", Type: gohome.SceneGraphEdgeFeature},
+		{From: "evening", To: "porch", Type: gohome.SceneGraphEdgeFeature},
+		{From: "outside", To: "porch", Type: gohome.SceneGraphEdgeFeature},
+		{From: "outside", To: "garden", Type: gohome.SceneGraphEdgeFeature},
+	}, graph.Edges)
+}
+
+func TestCommandProcessorSceneLoop(t *testing.T) {
+	// A loop that got past validation fails to build instead of recursing forever
+	sys := gohome.NewSystem("test system")
+	addTestScene(sys, "ping", &cmd.SceneSet{SceneID: "pong"})
+	addTestScene(sys, "pong", &cmd.SceneSet{SceneID: "ping"})
+
+	cp := gohome.NewCommandProcessor(sys, 10)
+	cp.Start()
+	defer cp.Stop()
+
+	done := make(chan []gohome.CommandResult, 1)
+	group := gohome.NewCommandGroup("loop", &cmd.SceneSet{SceneID: "ping"})
+	group.Executed = func(results []gohome.CommandResult) { done <- results }
+	require.Nil(t, cp.Enqueue(group))
+
+	select {
+	case results := <-done:
+		require.NotNil(t, results[0].Err)
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "commands not executed")
+	}
+}
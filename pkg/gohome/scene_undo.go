@@ -0,0 +1,288 @@
+package gohome
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/markdaws/gohome/pkg/cmd"
+	"github.com/markdaws/gohome/pkg/feature"
+	"github.com/markdaws/gohome/pkg/log"
+)
+
+// SceneSnapshot contains the values features had before a scene was set, so they can be restored
+type SceneSnapshot struct {
+	SceneID   string
+	SceneName string
+
+	// Time is when the scene was set
+	Time time.Time
+
+	// Commands set each feature the scene changed back to its previous values, only the attributes the
+	// scene set are included
+	Commands []*cmd.FeatureSetAttrs
+
+	// Missing are the IDs of features the scene set whose previous values were not known, so they
+	// can't be restored
+	Missing []string
+}
+
+// SceneHistory keeps snapshots of the features set by the most recent scenes, so the scenes can be
+// undone. Once the history is full the oldest snapshot is dropped
+type SceneHistory struct {
+	max       int
+	mutex     sync.Mutex
+	snapshots []*SceneSnapshot
+}
+
+// NewSceneHistory returns a history that keeps up to max snapshots
+func NewSceneHistory(max int) *SceneHistory {
+	return &SceneHistory{max: max}
+}
+
+// Add adds a snapshot to the history, dropping the oldest snapshot if the history is full
+func (h *SceneHistory) Add(snapshot *SceneSnapshot) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.snapshots = append(h.snapshots, snapshot)
+	if len(h.snapshots) > h.max {
+		h.snapshots = h.snapshots[len(h.snapshots)-h.max:]
+	}
+}
+
+// Last returns the most recent snapshot, nil if the history is empty
+func (h *SceneHistory) Last() *SceneSnapshot {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if len(h.snapshots) == 0 {
+		return nil
+	}
+	return h.snapshots[len(h.snapshots)-1]
+}
+
+// Pop removes and returns the most recent snapshot, nil if the history is empty
+func (h *SceneHistory) Pop() *SceneSnapshot {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if len(h.snapshots) == 0 {
+		return nil
+	}
+	snapshot := h.snapshots[len(h.snapshots)-1]
+	h.snapshots = h.snapshots[:len(h.snapshots)-1]
+	return snapshot
+}
+
+// Remove removes the snapshot from the history, returns false if it is not in the history
+func (h *SceneHistory) Remove(snapshot *SceneSnapshot) bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	for i, existing := range h.snapshots {
+		if existing == snapshot {
+			h.snapshots = append(h.snapshots[:i], h.snapshots[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Snapshots returns the snapshots in the history, most recent first
+func (h *SceneHistory) Snapshots() []*SceneSnapshot {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	out := make([]*SceneSnapshot, len(h.snapshots))
+	for i, snapshot := range h.snapshots {
+		out[len(h.snapshots)-1-i] = snapshot
+	}
+	return out
+}
+
+// sceneCapture takes the snapshot of a scene while it is being set. Each hub the scene sets features on
+// captures the current values of its features in its command lane, just before it executes the commands
+// of the scene, so the snapshot has the values left by any commands sent before the scene. Once every
+// hub has captured its features the snapshot is added to the history
+type sceneCapture struct {
+	system   *System
+	history  *SceneHistory
+	scene    *Scene
+	targets  map[string]map[string]bool
+	snapshot *SceneSnapshot
+
+	// done is called once the snapshot has been added to the history
+	done func()
+
+	mutex   sync.Mutex
+	pending int
+}
+
+func (s *System) newSceneCapture(scene *Scene, history *SceneHistory, done func()) *sceneCapture {
+	targets := make(map[string]map[string]bool)
+	s.sceneTargets(scene, targets, 0)
+	return &sceneCapture{
+		system:   s,
+		history:  history,
+		scene:    scene,
+		targets:  targets,
+		snapshot: &SceneSnapshot{SceneID: scene.ID, SceneName: scene.Name},
+		done:     done,
+	}
+}
+
+// hubCmds returns the commands that capture the features of the scene, one for each hub that cmds, the
+// commands that set the scene, are sent to. They have to be sent to the hubs before cmds
+func (c *sceneCapture) hubCmds(cmds []hubCmd) []hubCmd {
+	featureIDs := make(map[string][]string)
+	for featureID := range c.targets {
+		f := c.system.FeatureByID(featureID)
+		if f == nil {
+			continue
+		}
+		d := c.system.DeviceByID(f.DeviceID)
+		if d == nil {
+			continue
+		}
+		hub := d.Hub
+		if hub == nil {
+			hub = d
+		}
+		featureIDs[hub.ID] = append(featureIDs[hub.ID], featureID)
+	}
+
+	var captures []hubCmd
+	seen := make(map[string]bool)
+	for _, built := range cmds {
+		hubID := built.hub.ID
+		if seen[hubID] || len(featureIDs[hubID]) == 0 {
+			continue
+		}
+		seen[hubID] = true
+		captures = append(captures, hubCmd{
+			hub:     built.hub,
+			capture: c,
+			fn: &cmd.Func{
+				Friendly: fmt.Sprintf("Snapshot features before setting scene: %s", c.scene.Name),
+				Func:     c.captureFunc(featureIDs[hubID]),
+			},
+		})
+	}
+	c.pending = len(captures)
+	return captures
+}
+
+// captureFunc returns a func that adds the current values of the features to the snapshot
+func (c *sceneCapture) captureFunc(featureIDs []string) func() error {
+	return func() error {
+		defer c.captured()
+
+		for _, featureID := range featureIDs {
+			f := c.system.FeatureByID(featureID)
+			if f == nil {
+				continue
+			}
+
+			values, _ := c.system.FeatureValues(f.ID)
+			restore := &cmd.FeatureSetAttrs{
+				ID:          c.system.NewID(),
+				FeatureID:   f.ID,
+				FeatureType: f.Type,
+				FeatureName: f.Name,
+				Attrs:       feature.NewAttrs(),
+			}
+			for localID := range c.targets[f.ID] {
+				if value, ok := values[localID]; ok && value != nil {
+					restore.Attrs[localID] = value.Clone()
+				}
+			}
+
+			c.mutex.Lock()
+			if len(restore.Attrs) < len(c.targets[f.ID]) {
+				log.V("Scene - unable to snapshot all of %s before setting %s, current values are not known",
+					f.Name, c.scene.Name)
+				c.snapshot.Missing = append(c.snapshot.Missing, f.ID)
+			}
+			if len(restore.Attrs) > 0 {
+				c.snapshot.Commands = append(c.snapshot.Commands, restore)
+			}
+			c.mutex.Unlock()
+		}
+		return nil
+	}
+}
+
+// captured is called when a hub has captured its features, once they all have the snapshot is added
+// to the history
+func (c *sceneCapture) captured() {
+	c.mutex.Lock()
+	c.pending--
+	if c.pending > 0 {
+		c.mutex.Unlock()
+		return
+	}
+
+	// The hubs capture in any order, keep the snapshot in a predictable order
+	snapshot := c.snapshot
+	sort.Sort(restoresByName(snapshot.Commands))
+	sort.Strings(snapshot.Missing)
+	snapshot.Time = time.Now()
+	c.mutex.Unlock()
+
+	c.history.Add(snapshot)
+	if c.done != nil {
+		c.done()
+	}
+}
+
+type restoresByName []*cmd.FeatureSetAttrs
+
+func (slice restoresByName) Len() int {
+	return len(slice)
+}
+func (slice restoresByName) Less(i, j int) bool {
+	return slice[i].FeatureName < slice[j].FeatureName
+}
+func (slice restoresByName) Swap(i, j int) {
+	slice[i], slice[j] = slice[j], slice[i]
+}
+
+// sceneTargets adds the attributes set by the scene to targets, keyed by feature ID then attribute local
+// ID. depth is how many scenes deep the scene is
+func (s *System) sceneTargets(scene *Scene, targets map[string]map[string]bool, depth int) {
+	if depth >= maxSceneDepth {
+		return
+	}
+
+	add := func(featureID string, localID string) {
+		if targets[featureID] == nil {
+			targets[featureID] = make(map[string]bool)
+		}
+		targets[featureID][localID] = true
+	}
+
+	for _, c := range scene.Commands {
+		switch command := c.(type) {
+		case *cmd.FeatureSetAttrs:
+			for localID := range command.Attrs {
+				add(command.FeatureID, localID)
+			}
+
+		case *cmd.SelectorSetAttrs:
+			for _, f := range s.SelectFeatures(&command.Selector) {
+				for localID := range command.Attrs {
+					if _, ok := f.Attrs[localID]; ok {
+						add(f.ID, localID)
+					}
+				}
+			}
+
+		case *cmd.SceneSet:
+			if next := s.SceneByID(command.SceneID); next != nil {
+				s.sceneTargets(next, targets, depth+1)
+			}
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package gohome_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/markdaws/gohome/pkg/cmd"
+	"github.com/markdaws/gohome/pkg/feature"
+	"github.com/markdaws/gohome/pkg/gohome"
+	"github.com/stretchr/testify/require"
+)
+
+// execute runs the commands through a command processor, waiting for them to execute
+func execute(t *testing.T, sys *gohome.System, commands ...cmd.Command) []gohome.CommandResult {
+	cp := gohome.NewCommandProcessor(sys, 10)
+	cp.Start()
+	defer cp.Stop()
+
+	done := make(chan []gohome.CommandResult, 1)
+	group := gohome.NewCommandGroup("test", commands...)
+	group.Executed = func(results []gohome.CommandResult) { done <- results }
+	require.Nil(t, cp.Enqueue(group))
+
+	select {
+	case results := <-done:
+		return results
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "commands not executed")
+	}
+	return nil
+}
+
+// reportBrightness reports the brightness of the light zone to the monitor, waiting for the monitor to
+// update its value
+func reportBrightness(sys *gohome.System, lounge *feature.Feature, value float32) {
+	_, brightness, _ := feature.LightZoneCloneAttrs(lounge)
+	brightness.Value = value
+	sys.Services.EvtBus.Enqueue(&gohome.FeatureReportingEvt{FeatureID: lounge.ID, Attrs: feature.NewAttrs(brightness)})
+	for i := 0; i < 100; i++ {
+		values, _ := sys.Services.Monitor.FeatureValues(lounge.ID)
+		if values[feature.LightZoneBrightnessLocalID].Value == value {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// reportingBuilder reports the new brightness once it is set, like hardware that reports its values
+type reportingBuilder struct {
+	recordingBuilder
+	sys *gohome.System
+}
+
+func (b *reportingBuilder) Build(c cmd.Command) (*cmd.Func, error) {
+	built, _ := b.recordingBuilder.Build(c)
+	command := c.(*cmd.FeatureSetAttrs)
+	return &cmd.Func{Func: func() error {
+		built.Func()
+		f := b.sys.FeatureByID(command.FeatureID)
+		reportBrightness(b.sys, f, command.Attrs[feature.LightZoneBrightnessLocalID].Value.(float32))
+		return nil
+	}}, nil
+}
+
+func TestSceneUndo(t *testing.T) {
+	builder := &recordingBuilder{}
+	sys, lounge := transitionSystem(t, builder)
+	sys.Services.SceneHistory = gohome.NewSceneHistory(5)
+
+	// Movie sets another scene, both of their changes are part of the snapshot
+	_, brightness, _ := feature.LightZoneCloneAttrs(lounge)
+	brightness.Value = float32(5)
+	sys.AddScene(&gohome.Scene{ID: "dim", Name: "Dim", Commands: []cmd.Command{
+		&cmd.FeatureSetAttrs{FeatureID: lounge.ID, Attrs: feature.NewAttrs(brightness)},
+	}})
+	sys.AddScene(&gohome.Scene{ID: "movie", Name: "Movie", Commands: []cmd.Command{
+		&cmd.SceneSet{SceneID: "dim"},
+	}})
+
+	results := execute(t, sys, &cmd.SceneSet{SceneID: "movie"})
+	require.Nil(t, results[0].Err)
+
+	snapshots := sys.Services.SceneHistory.Snapshots()
+	require.Equal(t, 1, len(snapshots))
+	require.Equal(t, "Movie", snapshots[0].SceneName)
+	require.Equal(t, 1, len(snapshots[0].Commands))
+	require.Equal(t, 1, len(snapshots[0].Commands[0].Attrs))
+	require.Equal(t, float32(20), snapshots[0].Commands[0].Attrs[feature.LightZoneBrightnessLocalID].Value)
+
+	results = execute(t, sys, &cmd.SceneUndo{})
+	require.Nil(t, results[0].Err)
+
+	cmds := builder.executed()
+	require.Equal(t, 2, len(cmds))
+	require.Equal(t, float32(5), cmds[0].Attrs[feature.LightZoneBrightnessLocalID].Value)
+	require.Equal(t, float32(20), cmds[1].Attrs[feature.LightZoneBrightnessLocalID].Value)
+
+	// Nothing left to undo
+	results = execute(t, sys, &cmd.SceneUndo{})
+	require.NotNil(t, results[0].Err)
+}
+
+func TestSceneHistory(t *testing.T) {
+	history := gohome.NewSceneHistory(2)
+	require.Nil(t, history.Last())
+	require.Nil(t, history.Pop())
+
+	for _, name := range []string{"a", "b", "c"} {
+		history.Add(&gohome.SceneSnapshot{SceneName: name})
+	}
+
+	var names []string
+	for _, snapshot := range history.Snapshots() {
+		names = append(names, snapshot.SceneName)
+	}
+	require.Equal(t, []string{"c", "b"}, names)
+	require.Equal(t, "c", history.Last().SceneName)
+	require.Equal(t, "c", history.Pop().SceneName)
+	require.Equal(t, "b", history.Pop().SceneName)
+	require.Nil(t, history.Pop())
+}
+
+func TestSceneUndoAction(t *testing.T) {
+	config := `
+name: Movie over
+trigger:
+  event:
+    type: server_started
+actions:
+  - scene_undo: %t
+`
+	h := newRunHarness(t)
+	auto, err := gohome.NewAutomation(h.sys, fmt.Sprintf(config, true))
+	require.Nil(t, err)
+	group, err := auto.DryRun()
+	require.Nil(t, err)
+	require.Equal(t, 1, len(group.Cmds))
+	_, ok := group.Cmds[0].(*cmd.SceneUndo)
+	require.True(t, ok)
+
+	_, err = gohome.NewAutomation(h.sys, fmt.Sprintf(config, false))
+	require.NotNil(t, err)
+	require.Equal(t, "actions[0].scene_undo", err.(*gohome.AutomationError).Key)
+}
+
+func TestSceneUndoBackToBack(t *testing.T) {
+	builder := &reportingBuilder{}
+	sys, lounge := transitionSystem(t, builder)
+	builder.sys = sys
+	sys.Services.SceneHistory = gohome.NewSceneHistory(5)
+
+	for _, value := range []float32{5, 50} {
+		sys.AddScene(&gohome.Scene{ID: fmt.Sprintf("%v", value), Name: fmt.Sprintf("%v", value), Commands: []cmd.Command{
+			&cmd.FeatureSetAttrs{FeatureID: lounge.ID, FeatureName: lounge.Name, Attrs: feature.NewAttrs(brightnessAttr(lounge, value))},
+		}})
+	}
+
+	// The second scene is enqueued before the first has executed, its snapshot still has the values
+	// the first scene set
+	cp := gohome.NewCommandProcessor(sys, 10)
+	cp.Start()
+	defer cp.Stop()
+	done := make(chan bool, 2)
+	for _, sceneID := range []string{"5", "50"} {
+		group := gohome.NewCommandGroup("scene", &cmd.SceneSet{SceneID: sceneID})
+		group.Executed = func(results []gohome.CommandResult) { done <- true }
+		require.Nil(t, cp.Enqueue(group))
+	}
+	<-done
+	<-done
+
+	snapshots := sys.Services.SceneHistory.Snapshots()
+	require.Equal(t, 2, len(snapshots))
+	require.Equal(t, float32(5), snapshots[0].Commands[0].Attrs[feature.LightZoneBrightnessLocalID].Value)
+	require.Equal(t, float32(20), snapshots[1].Commands[0].Attrs[feature.LightZoneBrightnessLocalID].Value)
+
+	// Undo waits for scenes that are still being set
+	group := gohome.NewCommandGroup("scene", &cmd.SceneSet{SceneID: "5"})
+	require.Nil(t, cp.Enqueue(group))
+	group = gohome.NewCommandGroup("undo", &cmd.SceneUndo{})
+	group.Executed = func(results []gohome.CommandResult) { done <- true }
+	require.Nil(t, cp.Enqueue(group))
+	<-done
+	require.Equal(t, []float32{5, 50, 5, 50}, brightnessValues(&builder.recordingBuilder))
+	require.Equal(t, 2, len(sys.Services.SceneHistory.Snapshots()))
+}
+
+func TestSceneUndoFailureKeepsSnapshot(t *testing.T) {
+	sys, lounge := transitionSystem(t, &failingBuilder{})
+	sys.Services.SceneHistory = gohome.NewSceneHistory(5)
+	sys.AddScene(&gohome.Scene{ID: "dim", Name: "Dim", Commands: []cmd.Command{
+		&cmd.FeatureSetAttrs{FeatureID: lounge.ID, Attrs: feature.NewAttrs(brightnessAttr(lounge, 5))},
+	}})
+
+	// Restoring the brightness to 99 fails, the scene can still be undone
+	reportBrightness(sys, lounge, 99)
+	results := execute(t, sys, &cmd.SceneSet{SceneID: "dim"})
+	require.Nil(t, results[0].Err)
+	require.Equal(t, 1, len(sys.Services.SceneHistory.Snapshots()))
+
+	results = execute(t, sys, &cmd.SceneUndo{})
+	require.NotNil(t, results[0].Err)
+	require.Equal(t, 1, len(sys.Services.SceneHistory.Snapshots()))
+
+	// The restore commands can't be built once the device has gone, the snapshot is kept
+	sys.DeleteDevice(sys.DeviceByID(lounge.DeviceID))
+	results = execute(t, sys, &cmd.SceneUndo{})
+	require.NotNil(t, results[0].Err)
+	require.Equal(t, 1, len(sys.Services.SceneHistory.Snapshots()))
+}
@@ -0,0 +1,285 @@
+package gohome
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+
+	"github.com/markdaws/gohome/pkg/clock"
+	"github.com/markdaws/gohome/pkg/log"
+)
+
+// ScheduleItem is something the Scheduler runs at a point in time
+type ScheduleItem struct {
+	// Key uniquely identifies the item, scheduling an item with the same key replaces the existing item
+	Key string
+
+	// Automation is the name of the automation the item belongs to, empty if the item is not part of any
+	// automation, in which case it is not included in the upcoming runs
+	Automation string
+
+	// Trigger describes what is scheduled, e.g. the summary of the time trigger
+	Trigger string
+
+	// At is the time the item runs
+	At time.Time
+
+	// Next returns the time the item should run again after from, if it is nil or the bool return value
+	// is false the item only runs once
+	Next func(from time.Time) (time.Time, bool)
+
+	// Fire is called when the item runs, at is the time it was scheduled for. It is called from the
+	// scheduler goroutine so it should not block
+	Fire func(at time.Time)
+
+	index int
+}
+
+// UpcomingRun is a scheduled run of a piece of automation
+type UpcomingRun struct {
+	At         time.Time
+	Automation string
+	Trigger    string
+}
+
+// Scheduler owns the times all of the time based items in the system next run. A single goroutine
+// sleeps until the earliest item is due, rather than every trigger having its own goroutine and timer
+type Scheduler struct {
+	Time clock.Time
+
+	mutex sync.Mutex
+	items scheduleHeap
+	byKey map[string]*ScheduleItem
+	wake  chan struct{}
+	done  chan struct{}
+}
+
+// NewScheduler returns a scheduler that uses t to tell the time, call Start for items to run
+func NewScheduler(t clock.Time) *Scheduler {
+	return &Scheduler{
+		Time:  t,
+		byKey: make(map[string]*ScheduleItem),
+		wake:  make(chan struct{}, 1),
+	}
+}
+
+// Start starts running the scheduled items
+func (s *Scheduler) Start() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.done != nil {
+		return
+	}
+	s.done = make(chan struct{})
+	go s.run(s.done)
+}
+
+// Stop stops running items, the items are kept and run again if Start is called
+func (s *Scheduler) Stop() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.done != nil {
+		close(s.done)
+		s.done = nil
+	}
+}
+
+// Schedule adds the item, replacing any existing item with the same key
+func (s *Scheduler) Schedule(item ScheduleItem) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.remove(item.Key)
+	s.push(&item)
+	log.V("Scheduler - %s next runs at %s", item.Key, item.At)
+	s.signal()
+}
+
+// Cancel removes the item with the key, it is not an error if there is no such item
+func (s *Scheduler) Cancel(key string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.remove(key) {
+		s.signal()
+	}
+}
+
+// CancelAutomation removes all of the items that belong to the named automation
+func (s *Scheduler) CancelAutomation(name string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	removed := false
+	for key, item := range s.byKey {
+		if item.Automation == name {
+			removed = s.remove(key) || removed
+		}
+	}
+	if removed {
+		s.signal()
+	}
+}
+
+// Upcoming returns the next n runs of automation, in time order. Items that repeat are included once
+// for each time they run. Conditions such as only_if are not evaluated, so a listed run may end up
+// being skipped
+func (s *Scheduler) Upcoming(n int) []UpcomingRun {
+	s.mutex.Lock()
+	var pending scheduleHeap
+	for _, item := range s.items {
+		if item.Automation != "" {
+			copied := *item
+			pending = append(pending, &copied)
+		}
+	}
+	s.mutex.Unlock()
+
+	heap.Init(&pending)
+	var runs []UpcomingRun
+	for len(runs) < n && len(pending) > 0 {
+		item := heap.Pop(&pending).(*ScheduleItem)
+		runs = append(runs, UpcomingRun{At: item.At, Automation: item.Automation, Trigger: item.Trigger})
+		if item.Next == nil {
+			continue
+		}
+		if at, ok := item.Next(item.At); ok {
+			item.At = at
+			heap.Push(&pending, item)
+		}
+	}
+	return runs
+}
+
+// run sleeps until the earliest item is due, or until it is woken because the items changed
+func (s *Scheduler) run(done chan struct{}) {
+	for {
+		s.mutex.Lock()
+
+		// Any pending wake up is handled by looking at the earliest item now
+		select {
+		case <-s.wake:
+		default:
+		}
+
+		var due <-chan time.Time
+		var dueAt time.Time
+		if len(s.items) > 0 {
+			dueAt = s.items[0].At
+			due = s.Time.After(dueAt.Sub(s.Time.Now()))
+		}
+		s.mutex.Unlock()
+
+		select {
+		case <-due:
+			s.fireDue(dueAt)
+		case <-s.wake:
+		case <-done:
+			clock.Release(s.Time, due)
+			return
+		}
+		clock.Release(s.Time, due)
+	}
+}
+
+// next returns the time the earliest item is due, the bool return value is false if there are no items
+func (s *Scheduler) next() (time.Time, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if len(s.items) == 0 {
+		return time.Time{}, false
+	}
+	return s.items[0].At, true
+}
+
+// fireDue runs all of the items that are due, rescheduling items that repeat. dueAt is the time the
+// timer was waiting for, once the timer has expired items up to that time are due even if the clock
+// says otherwise, e.g. a clock that doesn't move forward
+func (s *Scheduler) fireDue(dueAt time.Time) {
+	now := s.Time.Now()
+	if dueAt.After(now) {
+		now = dueAt
+	}
+	for {
+		s.mutex.Lock()
+		if len(s.items) == 0 || s.items[0].At.After(now) {
+			s.mutex.Unlock()
+			return
+		}
+
+		item := s.items[0]
+		at := item.At
+		s.remove(item.Key)
+		if item.Next != nil {
+			// The next time has to be after this one so the item doesn't run twice for the same time
+			if next, ok := item.Next(at); ok {
+				again := *item
+				again.At = next
+				s.push(&again)
+			} else {
+				log.V("Scheduler - %s has no future run time, will not run again", item.Key)
+			}
+		}
+		s.mutex.Unlock()
+
+		item.Fire(at)
+	}
+}
+
+// push adds the item, the mutex must be held
+func (s *Scheduler) push(item *ScheduleItem) {
+	heap.Push(&s.items, item)
+	s.byKey[item.Key] = item
+}
+
+// remove removes the item with the key, the mutex must be held. Returns false if there is no such item
+func (s *Scheduler) remove(key string) bool {
+	item, ok := s.byKey[key]
+	if !ok {
+		return false
+	}
+	heap.Remove(&s.items, item.index)
+	delete(s.byKey, key)
+	return true
+}
+
+// signal wakes the run goroutine so it looks at the earliest item again, the mutex must be held
+func (s *Scheduler) signal() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// scheduleHeap is a min heap of items, ordered by the time they run
+type scheduleHeap []*ScheduleItem
+
+func (h scheduleHeap) Len() int { return len(h) }
+func (h scheduleHeap) Less(i, j int) bool {
+	// Items at the same time are ordered by key so the order they run in is predictable
+	if h[i].At.Equal(h[j].At) {
+		return h[i].Key < h[j].Key
+	}
+	return h[i].At.Before(h[j].At)
+}
+func (h scheduleHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *scheduleHeap) Push(x interface{}) {
+	item := x.(*ScheduleItem)
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *scheduleHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
@@ -0,0 +1,112 @@
+package gohome_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-home-iot/event-bus"
+	"github.com/markdaws/gohome/pkg/clock"
+	"github.com/markdaws/gohome/pkg/gohome"
+	"github.com/stretchr/testify/require"
+)
+
+// waitForTimer waits until the scheduler has a timer for at on the virtual clock
+func waitForTimer(t *testing.T, vclock *clock.Virtual, at time.Time) {
+	for i := 0; i < 200; i++ {
+		if next, ok := vclock.Next(); ok && next.Equal(at) {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	require.FailNow(t, "scheduler did not set a timer", "%s", at)
+}
+
+func TestSchedulerFires(t *testing.T) {
+	start := time.Date(2016, time.December, 5, 10, 0, 0, 0, time.UTC)
+	vclock := clock.NewVirtual(start)
+	scheduler := gohome.NewScheduler(vclock)
+	scheduler.Start()
+	defer scheduler.Stop()
+
+	fired := make(chan string, 10)
+	hourly := func(from time.Time) (time.Time, bool) { return from.Add(time.Hour), true }
+	scheduler.Schedule(gohome.ScheduleItem{
+		Key:  "hourly",
+		At:   start.Add(time.Hour),
+		Next: hourly,
+		Fire: func(at time.Time) { fired <- "hourly " + at.Format("15:04") },
+	})
+	scheduler.Schedule(gohome.ScheduleItem{
+		Key:  "once",
+		At:   start.Add(90 * time.Minute),
+		Fire: func(at time.Time) { fired <- "once " + at.Format("15:04") },
+	})
+
+	var got []string
+	for _, at := range []time.Time{start.Add(time.Hour), start.Add(90 * time.Minute), start.Add(2 * time.Hour)} {
+		waitForTimer(t, vclock, at)
+		require.True(t, vclock.Fire(at))
+		select {
+		case name := <-fired:
+			got = append(got, name)
+		case <-time.After(time.Second):
+			require.FailNow(t, "item did not fire")
+		}
+	}
+	require.Equal(t, []string{"hourly 11:00", "once 11:30", "hourly 12:00"}, got)
+
+	// Once cancelled the item doesn't fire again
+	waitForTimer(t, vclock, start.Add(3*time.Hour))
+	scheduler.Cancel("hourly")
+	vclock.Fire(start.Add(3 * time.Hour))
+	select {
+	case name := <-fired:
+		require.FailNow(t, "cancelled item fired", name)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestSchedulerUpcoming(t *testing.T) {
+	now := time.Date(2016, time.December, 5, 10, 0, 0, 0, time.UTC)
+	vclock := clock.NewVirtual(now)
+	scheduler := gohome.NewScheduler(vclock)
+
+	every := gohome.TimeTriggerDaysSun | gohome.TimeTriggerDaysMon | gohome.TimeTriggerDaysTues |
+		gohome.TimeTriggerDaysWed | gohome.TimeTriggerDaysThurs | gohome.TimeTriggerDaysFri |
+		gohome.TimeTriggerDaysSat
+	newTrigger := func(name string, hour int) *gohome.TimeTrigger {
+		return &gohome.TimeTrigger{
+			Name:        name,
+			Description: "time: " + time.Date(0, 1, 1, hour, 0, 0, 0, time.UTC).Format("15:04:05"),
+			Time:        vclock,
+			Mode:        gohome.TimeTriggerModeExact,
+			At:          time.Date(0, 1, 1, hour, 0, 0, 0, time.UTC),
+			Days:        every,
+			RunKey:      name + "/trigger",
+			Scheduler:   scheduler,
+			Triggered:   func() {},
+		}
+	}
+
+	evening := newTrigger("Evening", 19)
+	morning := newTrigger("Morning", 7)
+	evening.StartConsuming(make(chan evtbus.Event))
+	morning.StartConsuming(make(chan evtbus.Event))
+
+	runs := scheduler.Upcoming(3)
+	require.Equal(t, []gohome.UpcomingRun{
+		{At: time.Date(2016, time.December, 5, 19, 0, 0, 0, time.UTC), Automation: "Evening", Trigger: "time: 19:00:00"},
+		{At: time.Date(2016, time.December, 6, 7, 0, 0, 0, time.UTC), Automation: "Morning", Trigger: "time: 07:00:00"},
+		{At: time.Date(2016, time.December, 6, 19, 0, 0, 0, time.UTC), Automation: "Evening", Trigger: "time: 19:00:00"},
+	}, runs)
+
+	scheduler.CancelAutomation("Evening")
+	runs = scheduler.Upcoming(2)
+	require.Equal(t, 2, len(runs))
+	for _, run := range runs {
+		require.Equal(t, "Morning", run.Automation)
+	}
+
+	morning.StopConsuming()
+	require.Equal(t, 0, len(scheduler.Upcoming(10)))
+}
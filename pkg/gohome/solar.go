@@ -0,0 +1,138 @@
+package gohome
+
+import (
+	"math"
+	"time"
+)
+
+// solarZeniths maps the solar time trigger modes to the zenith of the sun, in degrees, at which
+// the event occurs
+var solarZeniths = map[string]float64{
+	TimeTriggerModeSunrise:          90.833,
+	TimeTriggerModeSunset:           90.833,
+	TimeTriggerModeCivilDawn:        96,
+	TimeTriggerModeCivilDusk:        96,
+	TimeTriggerModeNauticalDawn:     102,
+	TimeTriggerModeNauticalDusk:     102,
+	TimeTriggerModeAstronomicalDawn: 108,
+	TimeTriggerModeAstronomicalDusk: 108,
+}
+
+// isSolarMode returns true if the time trigger mode is relative to the position of the sun
+func isSolarMode(mode string) bool {
+	_, ok := solarZeniths[mode]
+	return ok
+}
+
+// isMorningMode returns true if the solar event happens while the sun is rising
+func isMorningMode(mode string) bool {
+	switch mode {
+	case TimeTriggerModeSunrise, TimeTriggerModeCivilDawn, TimeTriggerModeNauticalDawn,
+		TimeTriggerModeAstronomicalDawn:
+		return true
+	default:
+		return false
+	}
+}
+
+// SolarTime returns the time of the solar event on the day of t, in the location of t. mode must be one
+// of the solar time trigger modes e.g. TimeTriggerModeSunset. The longitude is positive west of Greenwich.
+// The bool return value is false if the event does not happen on that day, for example civil dusk in
+// the summer close to the poles
+func SolarTime(mode string, t time.Time, latitude, longitude float64) (time.Time, bool) {
+	zenith, ok := solarZeniths[mode]
+	if !ok {
+		return time.Time{}, false
+	}
+
+	minutes, ok := calcSolarEventUTC(t.Year(), t.Month(), t.Day(), latitude, longitude, zenith, isMorningMode(mode))
+	if !ok {
+		return time.Time{}, false
+	}
+
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	at := midnight.Add(time.Duration(minutes * float64(time.Minute))).Truncate(time.Second)
+	return at.In(t.Location()), true
+}
+
+// NextSolarTime returns the first time the solar event happens after t. The bool return value is false
+// if the event does not happen within the next year
+func NextSolarTime(mode string, t time.Time, latitude, longitude float64) (time.Time, bool) {
+	// Start one day early, depending on the timezone the solar event for the previous day
+	// can fall on the current day
+	for i := -1; i <= 366; i++ {
+		day := time.Date(t.Year(), t.Month(), t.Day()+i, 12, 0, 0, 0, t.Location())
+		at, ok := SolarTime(mode, day, latitude, longitude)
+		if ok && at.After(t) {
+			return at, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// calcSolarEventUTC returns the number of minutes after midnight UTC that the sun is at the zenith
+// on the specified day, using the NOAA solar calculations. The bool return value is false if the sun
+// does not reach the zenith on that day
+func calcSolarEventUTC(
+	year int, month time.Month, day int,
+	latitude, longitude, zenith float64,
+	rising bool) (float64, bool) {
+
+	const degToRad = math.Pi / 180
+	midnight := time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+	julianDay := float64(midnight.Unix())/86400 + 2440587.5
+	latRad := latitude * degToRad
+
+	// The first pass uses solar noon to approximate the time of the event, the second pass
+	// then uses the approximate time to get a more accurate value
+	minutes := 720 + 4*longitude
+	for i := 0; i < 2; i++ {
+		decl, eqTime := calcSunPosition(julianDay + minutes/1440)
+
+		cosHourAngle := math.Cos(zenith*degToRad)/(math.Cos(latRad)*math.Cos(decl)) -
+			math.Tan(latRad)*math.Tan(decl)
+		if cosHourAngle < -1 || cosHourAngle > 1 {
+			return 0, false
+		}
+
+		hourAngle := math.Acos(cosHourAngle) / degToRad
+		if rising {
+			minutes = 720 + 4*(longitude-hourAngle) - eqTime
+		} else {
+			minutes = 720 + 4*(longitude+hourAngle) - eqTime
+		}
+	}
+	return minutes, true
+}
+
+// calcSunPosition returns the declination of the sun in radians and the equation of time in minutes
+// for the julian day
+func calcSunPosition(julianDay float64) (float64, float64) {
+	const degToRad = math.Pi / 180
+
+	// Julian centuries since J2000.0
+	t := (julianDay - 2451545.0) / 36525.0
+
+	meanLong := math.Mod(280.46646+t*(36000.76983+0.0003032*t), 360) * degToRad
+	meanAnomaly := (357.52911 + t*(35999.05029-0.0001537*t)) * degToRad
+	eccentricity := 0.016708634 - t*(0.000042037+0.0000001267*t)
+
+	eqOfCenter := math.Sin(meanAnomaly)*(1.914602-t*(0.004817+0.000014*t)) +
+		math.Sin(2*meanAnomaly)*(0.019993-0.000101*t) +
+		math.Sin(3*meanAnomaly)*0.000289
+	omega := (125.04 - 1934.136*t) * degToRad
+	apparentLong := meanLong + (eqOfCenter-0.00569-0.00478*math.Sin(omega))*degToRad
+
+	meanObliquity := 23 + (26+(21.448-t*(46.815+t*(0.00059-t*0.001813)))/60)/60
+	obliquity := (meanObliquity + 0.00256*math.Cos(omega)) * degToRad
+
+	decl := math.Asin(math.Sin(obliquity) * math.Sin(apparentLong))
+
+	y := math.Pow(math.Tan(obliquity/2), 2)
+	eqTime := y*math.Sin(2*meanLong) -
+		2*eccentricity*math.Sin(meanAnomaly) +
+		4*eccentricity*y*math.Sin(meanAnomaly)*math.Cos(2*meanLong) -
+		0.5*y*y*math.Sin(4*meanLong) -
+		1.25*eccentricity*eccentricity*math.Sin(2*meanAnomaly)
+	return decl, 4 * eqTime / degToRad
+}
@@ -2,11 +2,13 @@ package gohome
 
 import (
 	"math/rand"
+	"sort"
 	"strconv"
 	"sync"
 
 	"github.com/go-home-iot/event-bus"
 	"github.com/go-home-iot/upnp"
+	"github.com/markdaws/gohome/pkg/attr"
 	"github.com/markdaws/gohome/pkg/feature"
 	"github.com/markdaws/gohome/pkg/log"
 	"github.com/nu7hatch/gouuid"
@@ -15,10 +17,15 @@ import (
 // SystemServices is a collection of services that devices can access
 // such as UPNP notification and discovery
 type SystemServices struct {
-	UPNP         *upnp.SubServer
-	Monitor      *Monitor
-	EvtBus       *evtbus.Bus
-	CmdProcessor CommandProcessor
+	UPNP              *upnp.SubServer
+	Monitor           *Monitor
+	EvtBus            *evtbus.Bus
+	CmdProcessor      CommandProcessor
+	AutomationWatcher *AutomationWatcher
+	AutomationHistory *AutomationHistory
+	ScheduledRuns     *ScheduledRuns
+	Scheduler         *Scheduler
+	SceneHistory      *SceneHistory
 }
 
 // System is a container that holds information such as all the zones and devices
@@ -30,12 +37,22 @@ type System struct {
 	Extensions  *Extensions
 	Services    SystemServices
 
+	// Latitude and Longitude are the location of the home, used to calculate times such as sunrise
+	// and sunset. Longitude is positive west of Greenwich
+	Latitude  float64
+	Longitude float64
+
 	mutex      sync.RWMutex
 	automation map[string]*Automation
 	devices    map[string]*Device
 	features   map[string]*feature.Feature
 	scenes     map[string]*Scene
 	users      map[string]*User
+	clients    map[string]bool
+
+	// consumers passes events to the consumers that can be removed while the system is running
+	consumersMutex sync.Mutex
+	consumers      *busConsumers
 }
 
 // NewSystem returns an initial System instance.  It is still up to the caller
@@ -49,6 +66,7 @@ func NewSystem(name string) *System {
 		scenes:      make(map[string]*Scene),
 		features:    make(map[string]*feature.Feature),
 		users:       make(map[string]*User),
+		clients:     make(map[string]bool),
 	}
 
 	// Area is the root area which all of the devices and features are contained within
@@ -108,7 +126,7 @@ func (s *System) InitDevice(d *Device) error {
 		}
 		if evts.Consumer != nil {
 			log.V("%s - added event consumer", d)
-			s.Services.EvtBus.AddConsumer(evts.Consumer)
+			s.addConsumer(evts.Consumer)
 		}
 	}
 
@@ -130,11 +148,45 @@ func (s *System) StopDevice(d *Device) {
 			s.Services.EvtBus.RemoveProducer(evts.Producer)
 		}
 		if evts.Consumer != nil {
-			s.Services.EvtBus.RemoveConsumer(evts.Consumer)
+			s.removeConsumer(evts.Consumer)
 		}
 	}
 }
 
+// ClientConnected records that a client has connected to get updates, then raises a ClientConnectedEvt
+func (s *System) ClientConnected(evt *ClientConnectedEvt) {
+	s.mutex.Lock()
+	s.clients[evt.ConnectionID] = true
+	s.mutex.Unlock()
+
+	if s.Services.EvtBus != nil {
+		s.Services.EvtBus.Enqueue(evt)
+	}
+}
+
+// ClientDisconnected records that the client has disconnected, then raises a ClientDisconnectedEvt
+func (s *System) ClientDisconnected(connectionID string) {
+	s.mutex.Lock()
+	delete(s.clients, connectionID)
+	s.mutex.Unlock()
+
+	if s.Services.EvtBus != nil {
+		s.Services.EvtBus.Enqueue(&ClientDisconnectedEvt{ConnectionID: connectionID})
+	}
+}
+
+// ConnectedClients returns the connection IDs of the clients that are currently connected
+func (s *System) ConnectedClients() []string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	var IDs []string
+	for ID := range s.clients {
+		IDs = append(IDs, ID)
+	}
+	return IDs
+}
+
 // DeviceByID returns the device with the specified ID, nil if not found
 func (s *System) DeviceByID(ID string) *Device {
 	s.mutex.RLock()
@@ -265,6 +317,48 @@ func (s *System) FeaturesByType(ft string) map[string]*feature.Feature {
 	return features
 }
 
+// SelectFeatures returns all of the features in the system that match the selector, sorted by name
+func (s *System) SelectFeatures(sel *feature.Selector) []*feature.Feature {
+	s.mutex.RLock()
+	var selected []*feature.Feature
+	for _, f := range s.features {
+		deviceName := ""
+		if d, ok := s.devices[f.DeviceID]; ok {
+			deviceName = d.Name
+		}
+		if sel.Match(f, deviceName) {
+			selected = append(selected, f)
+		}
+	}
+	s.mutex.RUnlock()
+
+	sort.Sort(featuresByName(selected))
+	return selected
+}
+
+// FeatureValues returns the last known attribute values for the feature with the specified ID,
+// as cached by the monitor. The bool return value is false if no values are known
+func (s *System) FeatureValues(ID string) (map[string]*attr.Attribute, bool) {
+	if s.Services.Monitor == nil {
+		return nil, false
+	}
+	return s.Services.Monitor.FeatureValues(ID)
+}
+
+// SceneActive returns true if the current values of the features the scene sets match the scene, false
+// if they don't or the monitor is not running
+func (s *System) SceneActive(ID string) bool {
+	if s.Services.Monitor == nil {
+		return false
+	}
+	return s.Services.Monitor.SceneActive(ID)
+}
+
+// Coordinates returns the latitude and longitude of the home
+func (s *System) Coordinates() (float64, float64) {
+	return s.Latitude, s.Longitude
+}
+
 // SceneByID returns the scene with the specified ID, nil if not found
 func (s *System) SceneByID(ID string) *Scene {
 	s.mutex.RLock()
@@ -317,6 +411,107 @@ func (s *System) AddAutomation(a *Automation) {
 	s.mutex.Unlock()
 }
 
+// DeleteAutomation removes the automation from the system
+func (s *System) DeleteAutomation(a *Automation) {
+	s.mutex.Lock()
+	if s.automation[a.Name] == a {
+		delete(s.automation, a.Name)
+	}
+	s.mutex.Unlock()
+}
+
+// AutomationByName returns the automation with the specified name, nil if not found
+func (s *System) AutomationByName(name string) *Automation {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.automation[name]
+}
+
+// StartAutomation adds the automation to the system, replacing and stopping any existing automation
+// with the same name. If the automation is enabled it is added to the event bus so that it starts to
+// execute. If the automation does not have a Triggered or Resumed function, its commands are sent to the
+// command processor when it is triggered or resumes after a pause, if it does not have a Skipped function
+// an AutomationSkippedEvt is fired when it is skipped, and if it does not have a Suppressed function an
+// AutomationSuppressedEvt is fired when it is suppressed
+func (s *System) StartAutomation(a *Automation) {
+	if existing := s.AutomationByName(a.Name); existing != nil {
+		s.StopAutomation(existing)
+	}
+
+	if a.History == nil {
+		a.History = s.Services.AutomationHistory
+	}
+	walkTriggers(a.Trigger, func(trigger Trigger) {
+		switch t := trigger.(type) {
+		case *TimeTrigger:
+			if t.Runs == nil {
+				t.Runs = s.Services.ScheduledRuns
+			}
+			if t.Scheduler == nil {
+				t.Scheduler = s.Services.Scheduler
+			}
+		case *EventTrigger:
+			if t.ConnectedClients == nil {
+				t.ConnectedClients = s.ConnectedClients
+			}
+		}
+	})
+	if a.Triggered == nil {
+		a.Triggered = func(actions *CommandGroup) {
+			s.Services.EvtBus.Enqueue(&AutomationTriggeredEvt{
+				Name:  a.Name,
+				Chain: a.chain,
+			})
+
+			log.V("automation[%s] - trigger fired, enqueuing actions", a.Name)
+			s.Services.CmdProcessor.Enqueue(*actions)
+		}
+	}
+	if a.Resumed == nil {
+		a.Resumed = func(actions *CommandGroup) {
+			log.V("automation[%s] - resuming, enqueuing actions", a.Name)
+			s.Services.CmdProcessor.Enqueue(*actions)
+		}
+	}
+	if a.Skipped == nil {
+		a.Skipped = func(reason string) {
+			s.Services.EvtBus.Enqueue(&AutomationSkippedEvt{
+				Name:   a.Name,
+				Reason: reason,
+			})
+		}
+	}
+
+	if a.Suppressed == nil {
+		a.Suppressed = func(reason string) {
+			s.Services.EvtBus.Enqueue(&AutomationSuppressedEvt{
+				Name:   a.Name,
+				Reason: reason,
+			})
+		}
+	}
+
+	s.AddAutomation(a)
+	if !a.Enabled {
+		log.V("automation - disabled: %s", a.Name)
+		return
+	}
+
+	log.V("automation - starting: %s", a.Name)
+	s.addConsumer(a)
+}
+
+// StopAutomation removes the automation from the event bus, stopping its trigger, then removes it
+// from the system
+func (s *System) StopAutomation(a *Automation) {
+	log.V("automation - stopping: %s", a.Name)
+	s.removeConsumer(a)
+	if s.Services.Scheduler != nil {
+		s.Services.Scheduler.CancelAutomation(a.Name)
+	}
+	s.DeleteAutomation(a)
+}
+
 // AutomationByTempID returns the automation instance with the specified TempID, nil if not found
 func (s *System) AutomationByTempID(ID string) *Automation {
 	s.mutex.RLock()
@@ -3,7 +3,6 @@ package gohome
 import (
 	"time"
 
-	"github.com/cpucycle/astrotime"
 	"github.com/go-home-iot/event-bus"
 	"github.com/markdaws/gohome/pkg/clock"
 	"github.com/markdaws/gohome/pkg/log"
@@ -16,6 +15,12 @@ type TimeHelper struct {
 	Latitude  float64
 	Longitude float64
 	Produce   bool
+
+	// Scheduler fires the events at the sunrise and sunset times, if it is nil the helper creates its
+	// own scheduler when it starts producing
+	Scheduler *Scheduler
+
+	ownScheduler bool
 }
 
 func (th *TimeHelper) ProducerName() string {
@@ -33,43 +38,59 @@ func (th *TimeHelper) StartProducing(b *evtbus.Bus) {
 
 	log.V("TimeHelper - initializing")
 
-	go func() {
-		for {
-			now := th.Time.Now()
-			t := astrotime.NextSunrise(now, th.Latitude, th.Longitude)
-			tzname, _ := t.Zone()
-			log.V("The next sunrise (lat:%f, long:%f) is %d:%02d %s on %d/%d/%d.",
-				th.Latitude, th.Longitude, t.Hour(), t.Minute(), tzname, t.Month(), t.Day(), t.Year())
-
-			<-th.Time.After(t.Sub(now))
+	if th.Scheduler == nil {
+		th.Scheduler = NewScheduler(th.Time)
+		th.ownScheduler = true
+	}
+	if th.ownScheduler {
+		th.Scheduler.Start()
+	}
 
-			if th.Produce {
-				th.System.Services.EvtBus.Enqueue(&SunriseEvt{})
-			}
+	th.schedule(TimeTriggerModeSunrise, func() evtbus.Event { return &SunriseEvt{} })
+	th.schedule(TimeTriggerModeSunset, func() evtbus.Event { return &SunsetEvt{} })
+}
 
-			// Small delay so we don't fire multiple times in the loop for the same event
-			time.Sleep(time.Second)
+// schedule enqueues the event returned by newEvt each time the solar event occurs
+func (th *TimeHelper) schedule(mode string, newEvt func() evtbus.Event) {
+	next := func(from time.Time) (time.Time, bool) {
+		t, ok := NextSolarTime(mode, from, th.Latitude, th.Longitude)
+		if !ok {
+			// Can happen close to the poles
+			log.V("There is no %s (lat:%f, long:%f) in the next year", mode, th.Latitude, th.Longitude)
+			return t, false
 		}
-	}()
-
-	go func() {
-		for {
-			now := th.Time.Now()
-			t := astrotime.NextSunset(now, th.Latitude, th.Longitude)
-			tzname, _ := t.Zone()
-			log.V("The next sunset (lat:%f, long:%f) is %d:%02d %s on %d/%d/%d.",
-				th.Latitude, th.Longitude, t.Hour(), t.Minute(), tzname, t.Month(), t.Day(), t.Year())
 
-			<-th.Time.After(t.Sub(now))
+		tzname, _ := t.Zone()
+		log.V("The next %s (lat:%f, long:%f) is %d:%02d %s on %d/%d/%d.",
+			mode, th.Latitude, th.Longitude, t.Hour(), t.Minute(), tzname, t.Month(), t.Day(), t.Year())
+		return t, true
+	}
 
+	at, ok := next(th.Time.Now())
+	if !ok {
+		return
+	}
+	th.Scheduler.Schedule(ScheduleItem{
+		Key:  th.ProducerName() + "/" + mode,
+		At:   at,
+		Next: next,
+		Fire: func(time.Time) {
 			if th.Produce {
-				th.System.Services.EvtBus.Enqueue(&SunsetEvt{})
+				th.System.Services.EvtBus.Enqueue(newEvt())
 			}
-			time.Sleep(time.Second)
-		}
-	}()
+		},
+	})
 }
 
 func (th *TimeHelper) StopProducing() {
 	th.Produce = false
+	if th.Scheduler == nil {
+		return
+	}
+
+	th.Scheduler.Cancel(th.ProducerName() + "/" + TimeTriggerModeSunrise)
+	th.Scheduler.Cancel(th.ProducerName() + "/" + TimeTriggerModeSunset)
+	if th.ownScheduler {
+		th.Scheduler.Stop()
+	}
 }
@@ -2,7 +2,8 @@ package gohome
 
 import (
 	"fmt"
-	"math"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-home-iot/event-bus"
@@ -17,8 +18,31 @@ const (
 	// TimeTriggerModeSunset - the time trigger is relative to sunset
 	TimeTriggerModeSunset string = "sunset"
 
+	// TimeTriggerModeCivilDawn - the time trigger is relative to civil dawn, the sun is 6 degrees below the horizon
+	TimeTriggerModeCivilDawn string = "civil_dawn"
+
+	// TimeTriggerModeCivilDusk - the time trigger is relative to civil dusk, the sun is 6 degrees below the horizon
+	TimeTriggerModeCivilDusk string = "civil_dusk"
+
+	// TimeTriggerModeNauticalDawn - the time trigger is relative to nautical dawn, the sun is 12 degrees below the horizon
+	TimeTriggerModeNauticalDawn string = "nautical_dawn"
+
+	// TimeTriggerModeNauticalDusk - the time trigger is relative to nautical dusk, the sun is 12 degrees below the horizon
+	TimeTriggerModeNauticalDusk string = "nautical_dusk"
+
+	// TimeTriggerModeAstronomicalDawn - the time trigger is relative to astronomical dawn, the sun is 18 degrees
+	// below the horizon
+	TimeTriggerModeAstronomicalDawn string = "astronomical_dawn"
+
+	// TimeTriggerModeAstronomicalDusk - the time trigger is relative to astronomical dusk, the sun is 18 degrees
+	// below the horizon
+	TimeTriggerModeAstronomicalDusk string = "astronomical_dusk"
+
 	// TimeTriggerModeExact - the time trigger is an exact time
 	TimeTriggerModeExact string = "exact"
+
+	// TimeTriggerModeCron - the time trigger fires at the times matching a cron expression
+	TimeTriggerModeCron string = "cron"
 )
 
 const (
@@ -31,15 +55,54 @@ const (
 	TimeTriggerDaysSat   uint32 = 64
 )
 
-// TimeTrigger is a trigger that can be used to execute actions either at sunrise/sunset or at an exact
-// time.  You can also specify for the trigger to only fire on certain days of the week
+// TimeTrigger is a trigger that can be used to execute actions either at an exact time, at a time
+// relative to the position of the sun e.g. 30 minutes before sunset, or at the times matching a cron
+// expression.  You can also specify for the trigger to only fire on certain days of the week
 type TimeTrigger struct {
-	Name      string
-	Mode      string
-	At        time.Time
-	Days      uint32
+	Name string
+	Mode string
+	At   time.Time
+
+	// Offset is added to the time of the solar event for the sunrise/sunset/dawn/dusk modes, it can
+	// be negative to fire before the event
+	Offset time.Duration
+
+	// Days is a bitmask of the TimeTriggerDays values, the trigger only fires if the time it is
+	// scheduled for falls on one of the days
+	Days uint32
+
+	// Cron is the schedule used by the cron mode
+	Cron *CronSchedule
+
+	// Latitude and Longitude are the location used to calculate the solar event times, longitude
+	// is positive west of Greenwich
+	Latitude  float64
+	Longitude float64
+
 	Time      clock.Time
 	Triggered func()
+
+	// CatchUp is how long after a run was missed, because the trigger was not running at the time, the
+	// run is executed once when the trigger starts. Zero means missed runs are skipped
+	CatchUp time.Duration
+
+	// Runs records the last time the trigger was scheduled to run, so missed runs can be found when the
+	// trigger starts. Missed runs are not detected if it is nil
+	Runs *ScheduledRuns
+
+	// RunKey is the key of the trigger in Runs
+	RunKey string
+
+	// Scheduler runs the trigger at each of its times. If it is nil the trigger creates its own
+	// scheduler when it starts
+	Scheduler *Scheduler
+
+	// Description is shown next to the automation name in the list of upcoming runs
+	Description string
+
+	mutex        sync.Mutex
+	scheduler    *Scheduler
+	ownScheduler *Scheduler
 }
 
 func (t *TimeTrigger) Trigger() {
@@ -52,99 +115,200 @@ func (t *TimeTrigger) ConsumerName() string {
 
 func (t *TimeTrigger) StartConsuming(ch chan evtbus.Event) {
 	go func() {
-		switch t.Mode {
-		case TimeTriggerModeSunrise:
-			t.scheduleSunrise(ch)
-		case TimeTriggerModeSunset:
-			t.scheduleSunset(ch)
-		case TimeTriggerModeExact:
-			t.scheduleExact()
+		// The trigger doesn't use any events, but we need to drain the channel so that the
+		// bus doesn't have to drop events, the channel is closed when we are removed from the bus
+		for range ch {
 		}
 	}()
+
+	if isSolarMode(t.Mode) && t.Latitude == 0 && t.Longitude == 0 {
+		log.E("TimeTrigger[%s] - %s trigger will not fire, location not set.  Update config.json with the "+
+			"correct lat/long values then restart the server", t.Name, t.Mode)
+		return
+	}
+
+	t.mutex.Lock()
+	scheduler := t.Scheduler
+	if scheduler == nil {
+		scheduler = NewScheduler(t.Time)
+		scheduler.Start()
+		t.ownScheduler = scheduler
+	}
+	t.scheduler = scheduler
+	t.mutex.Unlock()
+
+	now := t.Time.Now()
+	go t.catchUp(now)
+
+	at, ok := t.next(now)
+	if !ok {
+		log.V("TimeTrigger[%s] - no future trigger time, will not fire", t.Name)
+		return
+	}
+	scheduler.Schedule(ScheduleItem{
+		Key:        t.scheduleKey(),
+		Automation: t.Name,
+		Trigger:    t.Description,
+		At:         at,
+		Next:       t.next,
+		Fire:       t.fire,
+	})
 }
 
+// StopConsuming stops the trigger, it will not fire again until StartConsuming is called
 func (t *TimeTrigger) StopConsuming() {
-	//TODO:
-}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
 
-func (t *TimeTrigger) scheduleSunrise(ch chan evtbus.Event) {
-	for e := range ch {
-		if _, ok := e.(*SunriseEvt); !ok {
-			continue
-		}
-		t.scheduleAction()
+	if t.scheduler != nil {
+		t.scheduler.Cancel(t.scheduleKey())
+		t.scheduler = nil
+	}
+	if t.ownScheduler != nil {
+		t.ownScheduler.Stop()
+		t.ownScheduler = nil
 	}
 }
 
-func (t *TimeTrigger) scheduleSunset(ch chan evtbus.Event) {
-	for e := range ch {
-		if _, ok := e.(*SunsetEvt); !ok {
-			continue
-		}
-		t.scheduleAction()
+// fire is called by the scheduler at each of the trigger times
+func (t *TimeTrigger) fire(at time.Time) {
+	if t.Runs != nil {
+		t.Runs.Record(t.RunKey, at)
 	}
+	t.Triggered()
 }
 
-func (t *TimeTrigger) scheduleExact() {
-	// If the time does not have a date it will be 0000 as the year (the null time)
-	// if we have a date then this fires only once, otherwise if it doesn't have a
-	// date it is just a time so we look at the days of the week to see if it should
-	// execute
-	hasDate := t.At.Year() != 0
-
-	if hasDate {
-		// Was this for before the current date, if so ignore
-		delta := t.At.Sub(t.Time.Now())
-		if delta < 0 {
-			return
-		}
+// scheduleKey is the key of the trigger in the scheduler
+func (t *TimeTrigger) scheduleKey() string {
+	if t.RunKey != "" {
+		return t.RunKey
+	}
+	return fmt.Sprintf("timetrigger-%p", t)
+}
 
-		<-t.Time.After(delta)
-		t.Triggered()
+// catchUp looks for runs that were missed between the last recorded run and now, the time the trigger
+// started. If the most recent missed run is within the CatchUp window the trigger fires once for it
+func (t *TimeTrigger) catchUp(now time.Time) {
+	if t.Runs == nil {
 		return
 	}
 
-	for {
-		now := t.Time.Now()
-		absoluteAt := t.nextTriggerTime()
-
-		log.V("TimeTrigger[%s] - next trigger time: %s", t.Name, absoluteAt)
-		delta := absoluteAt.Sub(now)
+	prev, ok := t.Runs.Last(t.RunKey)
+	t.Runs.Record(t.RunKey, now)
+	if !ok {
+		return
+	}
 
-		// Sleep until the correct time
-		<-t.Time.After(delta)
-		t.scheduleAction()
+	missed, ok := t.next(prev)
+	if !ok || missed.After(now) {
+		return
+	}
+	if t.CatchUp == 0 {
+		log.V("TimeTrigger[%s] - missed run at %s, catch_up is skip", t.Name, missed)
+		return
+	}
 
-		// Small wait to make sure we don't re-run the automation on the same day
-		time.Sleep(time.Second * 1)
+	// Only the most recent missed run can be caught up, and only if it is within the window
+	from := missed
+	if windowStart := now.Add(-t.CatchUp); windowStart.After(from) {
+		from = windowStart
 	}
+	latest := missed
+	for at, ok := t.next(from); ok && !at.After(now); at, ok = t.next(at) {
+		latest = at
+	}
+	if now.Sub(latest) > t.CatchUp {
+		log.V("TimeTrigger[%s] - missed run at %s, outside of the catch_up window", t.Name, latest)
+		return
+	}
+
+	log.V("TimeTrigger[%s] - missed run at %s, catching up", t.Name, latest)
+	t.Triggered()
 }
 
-func (t *TimeTrigger) nextTriggerTime() time.Time {
-	now := t.Time.Now()
-	absoluteAt := time.Date(now.Year(), now.Month(), now.Day(), t.At.Hour(), t.At.Minute(), t.At.Second(), 0, now.Location())
-	delta := absoluteAt.Sub(now)
+// next returns the first time after from that the trigger should fire. The bool return value is false
+// if the trigger will never fire again
+func (t *TimeTrigger) next(from time.Time) (time.Time, bool) {
+	loc := from.Location()
+
+	switch {
+	case t.Mode == TimeTriggerModeExact:
+		// If the time does not have a date it will be 0000 as the year (the null time)
+		// if we have a date then this fires only once, otherwise if it doesn't have a
+		// date it is just a time so we look at the days of the week to see if it should
+		// execute
+		if t.At.Year() != 0 {
+			return t.At, t.At.After(from)
+		}
 
-	if delta < 0 {
-		// Event was before this time on this day, go to the next day
-		absoluteAt = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
-		absoluteAt = absoluteAt.Add(time.Hour * 24)
-		absoluteAt = time.Date(absoluteAt.Year(), absoluteAt.Month(), absoluteAt.Day(),
-			t.At.Hour(), t.At.Minute(), t.At.Second(), 0, now.Location())
+		for i := 0; i <= 7; i++ {
+			at := time.Date(from.Year(), from.Month(), from.Day()+i,
+				t.At.Hour(), t.At.Minute(), t.At.Second(), 0, loc)
+			if at.After(from) && t.matchesDay(at) {
+				return at, true
+			}
+		}
+
+	case t.Mode == TimeTriggerModeCron:
+		if t.Cron == nil {
+			return time.Time{}, false
+		}
+		return t.Cron.Next(from)
+
+	case isSolarMode(t.Mode):
+		// Start one day early, with an offset the previous days event may fire today. Near the
+		// poles some events don't happen for months, so look ahead for up to a year
+		for i := -1; i <= 366; i++ {
+			day := time.Date(from.Year(), from.Month(), from.Day()+i, 12, 0, 0, 0, loc)
+			solar, ok := SolarTime(t.Mode, day, t.Latitude, t.Longitude)
+			if !ok {
+				continue
+			}
+
+			at := solar.Add(t.Offset)
+			if at.After(from) && t.matchesDay(at) {
+				return at, true
+			}
+		}
 	}
-	return absoluteAt
+	return time.Time{}, false
 }
 
-func (t *TimeTrigger) scheduleAction() {
-	now := t.Time.Now()
-
-	// Make sure this is a day of the week we should execute this trigger
-	dayOfWeekOrdinal := int(now.Weekday())
+// matchesDay returns true if the day of the week of the time is one of the trigger days
+func (t *TimeTrigger) matchesDay(at time.Time) bool {
+	return dayInMask(t.Days, at)
+}
 
+// dayInMask returns true if the day of the week of the time is in the TimeTriggerDays bitmask
+func dayInMask(days uint32, at time.Time) bool {
 	// Convert time.Weekday to our representation of days of week
-	daysValue := uint32(math.Pow(2, float64(dayOfWeekOrdinal)))
+	daysValue := uint32(1) << uint(at.Weekday())
+	return (days & daysValue) != 0
+}
 
-	if (t.Days & daysValue) != 0 {
-		t.Triggered()
+// parseDays converts a list of days such as mon|wed|fri in to a bitmask of the TimeTriggerDays values
+func parseDays(val string) uint32 {
+	var days uint32
+	if strings.Index(val, "sun") != -1 {
+		days |= TimeTriggerDaysSun
+	}
+	if strings.Index(val, "mon") != -1 {
+		days |= TimeTriggerDaysMon
+	}
+	if strings.Index(val, "tues") != -1 {
+		days |= TimeTriggerDaysTues
+	}
+	if strings.Index(val, "wed") != -1 {
+		days |= TimeTriggerDaysWed
+	}
+	if strings.Index(val, "thurs") != -1 {
+		days |= TimeTriggerDaysThurs
+	}
+	if strings.Index(val, "fri") != -1 {
+		days |= TimeTriggerDaysFri
+	}
+	if strings.Index(val, "sat") != -1 {
+		days |= TimeTriggerDaysSat
 	}
+	return days
 }
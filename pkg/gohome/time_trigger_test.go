@@ -1,174 +1,525 @@
 package gohome_test
 
 import (
+	"math"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/cpucycle/astrotime"
 	"github.com/go-home-iot/event-bus"
 	"github.com/markdaws/gohome/pkg/gohome"
 	"github.com/stretchr/testify/require"
 )
 
+// Seattle, longitude is positive to the west
+const (
+	testLatitude  = 47.6062
+	testLongitude = 122.3321
+)
+
 type MockTime struct {
+	mutex sync.Mutex
 	now   time.Time
-	after func(time.Duration) <-chan time.Time
+	after func(mt *MockTime, d time.Duration) <-chan time.Time
 }
 
-func (mt MockTime) Now() time.Time {
+func (mt *MockTime) Now() time.Time {
+	mt.mutex.Lock()
+	defer mt.mutex.Unlock()
 	return mt.now
 }
 
-func (mt MockTime) After(d time.Duration) <-chan time.Time {
-	return mt.after(d)
+func (mt *MockTime) After(d time.Duration) <-chan time.Time {
+	return mt.after(mt, d)
+}
+
+// jumpAfter returns an after function that moves the mock time forward by the duration and returns
+// immediately, once it has been called max times it blocks forever
+func jumpAfter(max int) func(mt *MockTime, d time.Duration) <-chan time.Time {
+	count := 0
+	return func(mt *MockTime, d time.Duration) <-chan time.Time {
+		mt.mutex.Lock()
+		defer mt.mutex.Unlock()
+
+		count++
+		if count > max {
+			return make(chan time.Time)
+		}
+
+		mt.now = mt.now.Add(d)
+		c := make(chan time.Time, 1)
+		c <- mt.now
+		return c
+	}
+}
+
+func seattle(t *testing.T) *time.Location {
+	loc, err := time.LoadLocation("America/Los_Angeles")
+	require.Nil(t, err)
+	return loc
+}
+
+// startTrigger starts the trigger and returns the first count times the trigger fired
+func startTrigger(t *testing.T, trigger *gohome.TimeTrigger, mt *MockTime, count int) []time.Time {
+	fired := make(chan time.Time, count)
+	trigger.Triggered = func() {
+		fired <- mt.Now()
+	}
+
+	ch := make(chan evtbus.Event)
+	trigger.StartConsuming(ch)
+	defer trigger.StopConsuming()
+	defer close(ch)
+
+	var times []time.Time
+	for i := 0; i < count; i++ {
+		select {
+		case at := <-fired:
+			times = append(times, at)
+		case <-time.After(time.Second * 2):
+			require.FailNow(t, "trigger did not fire")
+		}
+	}
+	return times
+}
+
+func solarTime(t *testing.T, mode string, day time.Time) time.Time {
+	at, ok := gohome.SolarTime(mode, day, testLatitude, testLongitude)
+	require.True(t, ok)
+	return at
 }
 
 func TestSunrise(t *testing.T) {
 	t.Parallel()
 
-	mt := MockTime{
-		now:   time.Date(2016, time.December, 5, 10, 0, 0, 0, time.UTC),
-		after: func(d time.Duration) <-chan time.Time { return time.After(d) },
+	loc := seattle(t)
+	mt := &MockTime{
+		// This is a monday
+		now:   time.Date(2016, time.December, 5, 0, 0, 0, 0, loc),
+		after: jumpAfter(3),
 	}
 
-	wasTriggered := false
 	trigger := &gohome.TimeTrigger{
-		Time:   mt,
-		Mode:   gohome.TimeTriggerModeSunrise,
-		Offset: 0,
-		Days:   gohome.TimeTriggerDaysMon | gohome.TimeTriggerDaysFri,
-		Triggered: func() {
-			wasTriggered = true
-		},
+		Time:      mt,
+		Mode:      gohome.TimeTriggerModeSunrise,
+		Days:      gohome.TimeTriggerDaysMon | gohome.TimeTriggerDaysFri,
+		Latitude:  testLatitude,
+		Longitude: testLongitude,
 	}
 
-	ch := make(chan evtbus.Event)
-	trigger.StartConsuming(ch)
+	start := mt.Now()
+	times := startTrigger(t, trigger, mt, 3)
+	require.Equal(t, solarTime(t, gohome.TimeTriggerModeSunrise, start), times[0])
+	require.Equal(t, time.Monday, times[0].Weekday())
+	require.Equal(t, 7, times[0].Hour())
+	require.Equal(t, solarTime(t, gohome.TimeTriggerModeSunrise, times[1]), times[1])
+	require.Equal(t, time.Friday, times[1].Weekday())
+	require.Equal(t, 9, times[1].Day())
+	require.Equal(t, time.Monday, times[2].Weekday())
+	require.Equal(t, 12, times[2].Day())
+}
 
-	// Send sunrise event, check offset
-	ch <- &gohome.SunriseEvt{}
+func TestSunsetWithOffset(t *testing.T) {
+	t.Parallel()
 
-	// Send sunset - nothing should happen
-	time.Sleep(time.Second * 1)
-	require.True(t, wasTriggered)
+	loc := seattle(t)
+	mt := &MockTime{
+		now:   time.Date(2016, time.December, 5, 10, 0, 0, 0, loc),
+		after: jumpAfter(2),
+	}
+
+	trigger := &gohome.TimeTrigger{
+		Time:      mt,
+		Mode:      gohome.TimeTriggerModeSunset,
+		Offset:    -30 * time.Minute,
+		Days:      gohome.TimeTriggerDaysMon | gohome.TimeTriggerDaysTues,
+		Latitude:  testLatitude,
+		Longitude: testLongitude,
+	}
+
+	start := mt.Now()
+	times := startTrigger(t, trigger, mt, 2)
+	require.Equal(t, solarTime(t, gohome.TimeTriggerModeSunset, start).Add(-30*time.Minute), times[0])
+	require.Equal(t, 15, times[0].Hour())
+	require.Equal(t, solarTime(t, gohome.TimeTriggerModeSunset, start.AddDate(0, 0, 1)).Add(-30*time.Minute), times[1])
 }
 
-func TestSunset(t *testing.T) {
+func TestSunsetOffsetAfterMidnight(t *testing.T) {
 	t.Parallel()
 
-	mt := MockTime{
-		now:   time.Date(2016, time.December, 5, 10, 0, 0, 0, time.UTC),
-		after: func(d time.Duration) <-chan time.Time { return time.After(d) },
+	loc := seattle(t)
+	mt := &MockTime{
+		// Monday
+		now:   time.Date(2016, time.December, 5, 10, 0, 0, 0, loc),
+		after: jumpAfter(1),
 	}
 
-	wasTriggered := false
+	// Sunset on Monday + 9h is Tuesday morning, days applies to the day the trigger fires
 	trigger := &gohome.TimeTrigger{
-		Time:   mt,
-		Mode:   gohome.TimeTriggerModeSunset,
-		Offset: 0,
-		Days:   gohome.TimeTriggerDaysMon | gohome.TimeTriggerDaysFri,
-		Triggered: func() {
-			wasTriggered = true
-		},
+		Time:      mt,
+		Mode:      gohome.TimeTriggerModeSunset,
+		Offset:    9 * time.Hour,
+		Days:      gohome.TimeTriggerDaysTues,
+		Latitude:  testLatitude,
+		Longitude: testLongitude,
 	}
 
-	ch := make(chan evtbus.Event)
-	trigger.StartConsuming(ch)
+	start := mt.Now()
+	times := startTrigger(t, trigger, mt, 1)
+	require.Equal(t, solarTime(t, gohome.TimeTriggerModeSunset, start).Add(9*time.Hour), times[0])
+	require.Equal(t, time.Tuesday, times[0].Weekday())
+}
+
+func TestSunriseOffsetAlreadyPassed(t *testing.T) {
+	t.Parallel()
 
-	// Send sunrise event, check offset
-	ch <- &gohome.SunsetEvt{}
+	loc := seattle(t)
+	mt := &MockTime{
+		// After sunrise + 1h15m
+		now:   time.Date(2016, time.December, 5, 9, 30, 0, 0, loc),
+		after: jumpAfter(1),
+	}
 
-	// Send sunset - nothing should happen
-	time.Sleep(time.Second * 1)
+	trigger := &gohome.TimeTrigger{
+		Time:      mt,
+		Mode:      gohome.TimeTriggerModeSunrise,
+		Offset:    time.Hour + 15*time.Minute,
+		Days:      gohome.TimeTriggerDaysMon | gohome.TimeTriggerDaysTues,
+		Latitude:  testLatitude,
+		Longitude: testLongitude,
+	}
+
+	start := mt.Now()
+	times := startTrigger(t, trigger, mt, 1)
+	expected := solarTime(t, gohome.TimeTriggerModeSunrise, start.AddDate(0, 0, 1)).Add(time.Hour + 15*time.Minute)
+	require.Equal(t, expected, times[0])
+}
+
+func TestCivilDusk(t *testing.T) {
+	t.Parallel()
+
+	loc := seattle(t)
+	mt := &MockTime{
+		now:   time.Date(2016, time.December, 5, 10, 0, 0, 0, loc),
+		after: jumpAfter(1),
+	}
+
+	trigger := &gohome.TimeTrigger{
+		Time:      mt,
+		Mode:      gohome.TimeTriggerModeCivilDusk,
+		Days:      gohome.TimeTriggerDaysMon,
+		Latitude:  testLatitude,
+		Longitude: testLongitude,
+	}
+
+	start := mt.Now()
+	times := startTrigger(t, trigger, mt, 1)
+	require.Equal(t, solarTime(t, gohome.TimeTriggerModeCivilDusk, start), times[0])
+
+	// In Seattle in December civil dusk is just over half an hour after sunset
+	delta := times[0].Sub(solarTime(t, gohome.TimeTriggerModeSunset, start))
+	require.True(t, delta > 30*time.Minute && delta < 45*time.Minute, "%s", delta)
+}
+
+func TestSolarTimeOrder(t *testing.T) {
+	t.Parallel()
+
+	day := time.Date(2016, time.March, 20, 12, 0, 0, 0, seattle(t))
+	modes := []string{
+		gohome.TimeTriggerModeAstronomicalDawn,
+		gohome.TimeTriggerModeNauticalDawn,
+		gohome.TimeTriggerModeCivilDawn,
+		gohome.TimeTriggerModeSunrise,
+		gohome.TimeTriggerModeSunset,
+		gohome.TimeTriggerModeCivilDusk,
+		gohome.TimeTriggerModeNauticalDusk,
+		gohome.TimeTriggerModeAstronomicalDusk,
+	}
+
+	var prev time.Time
+	for _, mode := range modes {
+		at := solarTime(t, mode, day)
+		require.Equal(t, 20, at.Day(), mode)
+		require.True(t, at.After(prev), mode)
+		prev = at
+	}
+}
+
+func TestSolarTimeMatchesAstrotime(t *testing.T) {
+	t.Parallel()
+
+	locs := []struct {
+		lat, long float64
+		tz        string
+	}{
+		{testLatitude, testLongitude, "America/Los_Angeles"},
+		{51.5074, 0.1278, "Europe/London"},
+		{-33.8688, -151.2093, "Australia/Sydney"},
+	}
+
+	for _, l := range locs {
+		loc, err := time.LoadLocation(l.tz)
+		require.Nil(t, err)
+
+		for month := time.January; month <= time.December; month++ {
+			day := time.Date(2016, month, 15, 12, 0, 0, 0, loc)
+
+			sunrise, ok := gohome.SolarTime(gohome.TimeTriggerModeSunrise, day, l.lat, l.long)
+			require.True(t, ok)
+			expected := astrotime.CalcSunrise(day, l.lat, l.long)
+			require.True(t, math.Abs(sunrise.Sub(expected).Minutes()) < 2, "%s %s %s", l.tz, sunrise, expected)
+
+			sunset, ok := gohome.SolarTime(gohome.TimeTriggerModeSunset, day, l.lat, l.long)
+			require.True(t, ok)
+			expected = astrotime.CalcSunset(day, l.lat, l.long)
+			require.True(t, math.Abs(sunset.Sub(expected).Minutes()) < 2, "%s %s %s", l.tz, sunset, expected)
+		}
+	}
+}
+
+func TestSolarTimeDoesNotOccur(t *testing.T) {
+	t.Parallel()
+
+	// Never gets dark enough in the summer this far north
+	day := time.Date(2016, time.June, 21, 12, 0, 0, 0, time.UTC)
+	_, ok := gohome.SolarTime(gohome.TimeTriggerModeAstronomicalDusk, day, 60, 0)
+	require.False(t, ok)
 
-	require.True(t, wasTriggered)
+	// Next one is in August
+	at, ok := gohome.NextSolarTime(gohome.TimeTriggerModeAstronomicalDusk, day, 60, 0)
+	require.True(t, ok)
+	require.Equal(t, time.August, at.Month())
 }
 
 func TestExactWithDate(t *testing.T) {
 	t.Parallel()
 
-	mt := MockTime{
+	mt := &MockTime{
 		now:   time.Date(2016, time.December, 5, 10, 0, 0, 0, time.UTC),
-		after: func(d time.Duration) <-chan time.Time { return time.After(d) },
+		after: func(mt *MockTime, d time.Duration) <-chan time.Time { return time.After(d) },
 	}
 
-	wasTriggered := false
 	trigger := &gohome.TimeTrigger{
 		Time: mt,
 		Mode: gohome.TimeTriggerModeExact,
 		At:   mt.Now().Add(time.Second * 1),
-		Triggered: func() {
-			wasTriggered = true
-		},
 	}
 
-	ch := make(chan evtbus.Event)
-	trigger.StartConsuming(ch)
-
-	time.Sleep(time.Second * 2)
-
-	require.True(t, wasTriggered)
+	times := startTrigger(t, trigger, mt, 1)
+	require.Equal(t, 1, len(times))
 }
 
 func TestExactWithoutDate(t *testing.T) {
 	t.Parallel()
 
-	mt := MockTime{
+	mt := &MockTime{
 		// This is a monday
-		now: time.Date(2016, time.December, 5, 10, 10, 0, 0, time.UTC),
-		after: func(d time.Duration) <-chan time.Time {
-			// Return immediately
-			c := make(chan time.Time, 1)
-			c <- time.Now()
-			return c
-		},
+		now:   time.Date(2016, time.December, 5, 10, 10, 0, 0, time.UTC),
+		after: jumpAfter(3),
 	}
 
-	// This is the same as the current mock time
-	at := time.Date(
-		0, 1, 1,
-		mt.Now().Hour(), mt.Now().Minute(), mt.Now().Second(), 0, mt.Now().Location())
+	// One second after the current mock time
+	at := time.Date(0, 1, 1, 10, 10, 1, 0, time.UTC)
 
-	// move in to the future
-	at = at.Add(time.Second)
+	trigger := &gohome.TimeTrigger{
+		Time: mt,
+		Mode: gohome.TimeTriggerModeExact,
+		Days: gohome.TimeTriggerDaysMon | gohome.TimeTriggerDaysFri,
+		At:   at,
+	}
 
-	evalCount := 0
-	wasTriggered := false
-	eval := func() {
-		// This is called each time the trigger evaluates if it should run
-
-		// If this is not the first time it is evaluating, then pretend we incremented
-		// the current time by 23 hours to the next day (not 24 incase we jump past the
-		// execution time), so that the test can run over multiple days. We only want the
-		// test to execute on Monday and Friday
-		if evalCount > 0 {
-			mt.now = mt.now.Add(time.Hour * 23)
-		}
+	times := startTrigger(t, trigger, mt, 3)
+	require.Equal(t, time.Date(2016, time.December, 5, 10, 10, 1, 0, time.UTC), times[0])
+	require.Equal(t, time.Date(2016, time.December, 9, 10, 10, 1, 0, time.UTC), times[1])
+	require.Equal(t, time.Date(2016, time.December, 12, 10, 10, 1, 0, time.UTC), times[2])
+}
 
-		// Start on Monday, if eval is one, it means we ran on monday, so we should have got
-		// an execute scene, then also on friday
-		if evalCount == 1 || evalCount == 5 {
-			require.True(t, wasTriggered)
-			wasTriggered = false
-		} else {
-			require.False(t, wasTriggered)
-		}
-		evalCount++
+func TestStopConsuming(t *testing.T) {
+	t.Parallel()
+
+	mt := &MockTime{
+		now:   time.Date(2016, time.December, 5, 10, 0, 0, 0, time.UTC),
+		after: func(mt *MockTime, d time.Duration) <-chan time.Time { return time.After(d) },
 	}
 
+	var mutex sync.Mutex
+	wasTriggered := false
 	trigger := &gohome.TimeTrigger{
-		Time:       &mt,
-		Mode:       gohome.TimeTriggerModeExact,
-		Days:       gohome.TimeTriggerDaysMon | gohome.TimeTriggerDaysFri,
-		At:         at,
-		Evaluating: eval,
+		Time: mt,
+		Mode: gohome.TimeTriggerModeExact,
+		At:   mt.Now().Add(time.Millisecond * 500),
 		Triggered: func() {
+			mutex.Lock()
 			wasTriggered = true
+			mutex.Unlock()
 		},
 	}
 
 	ch := make(chan evtbus.Event)
 	trigger.StartConsuming(ch)
+	trigger.StopConsuming()
 
-	time.Sleep(time.Second * 2)
-	require.Equal(t, 6, evalCount)
+	time.Sleep(time.Second * 1)
+	mutex.Lock()
+	defer mutex.Unlock()
+	require.False(t, wasTriggered)
+}
+
+// cronTrigger returns a trigger for the cron expression, using mock time starting at now
+func cronTrigger(t *testing.T, expr string, now time.Time, count int) (*gohome.TimeTrigger, *MockTime) {
+	schedule, err := gohome.ParseCron(expr)
+	require.Nil(t, err)
+
+	mt := &MockTime{now: now, after: jumpAfter(count)}
+	return &gohome.TimeTrigger{
+		Time: mt,
+		Mode: gohome.TimeTriggerModeCron,
+		Cron: schedule,
+	}, mt
+}
+
+func TestCronWeekdayBusinessHours(t *testing.T) {
+	t.Parallel()
+
+	loc := seattle(t)
+
+	// This is a friday
+	trigger, mt := cronTrigger(t, "*/15 8-17 * * mon-fri", time.Date(2016, time.December, 9, 17, 40, 0, 0, loc), 4)
+	times := startTrigger(t, trigger, mt, 4)
+	require.Equal(t, time.Date(2016, time.December, 9, 17, 45, 0, 0, loc), times[0])
+	require.Equal(t, time.Date(2016, time.December, 12, 8, 0, 0, 0, loc), times[1])
+	require.Equal(t, time.Date(2016, time.December, 12, 8, 15, 0, 0, loc), times[2])
+	require.Equal(t, time.Date(2016, time.December, 12, 8, 30, 0, 0, loc), times[3])
+}
+
+func TestCronFirstMondayOfMonth(t *testing.T) {
+	t.Parallel()
+
+	loc := seattle(t)
+	trigger, mt := cronTrigger(t, "0 9 * * mon#1", time.Date(2016, time.December, 20, 0, 0, 0, 0, loc), 3)
+	times := startTrigger(t, trigger, mt, 3)
+	require.Equal(t, time.Date(2017, time.January, 2, 9, 0, 0, 0, loc), times[0])
+	require.Equal(t, time.Date(2017, time.February, 6, 9, 0, 0, 0, loc), times[1])
+	require.Equal(t, time.Date(2017, time.March, 6, 9, 0, 0, 0, loc), times[2])
+}
+
+func TestCronWithSeconds(t *testing.T) {
+	t.Parallel()
+
+	loc := seattle(t)
+	trigger, mt := cronTrigger(t, "*/20 * * * * *", time.Date(2016, time.December, 5, 10, 0, 5, 0, loc), 3)
+	times := startTrigger(t, trigger, mt, 3)
+	require.Equal(t, time.Date(2016, time.December, 5, 10, 0, 20, 0, loc), times[0])
+	require.Equal(t, time.Date(2016, time.December, 5, 10, 0, 40, 0, loc), times[1])
+	require.Equal(t, time.Date(2016, time.December, 5, 10, 1, 0, 0, loc), times[2])
+}
+
+func TestCronSpringForwardSkippedTime(t *testing.T) {
+	t.Parallel()
+
+	// On 2017/03/12 the clocks in Seattle went from 02:00 PST to 03:00 PDT, so 02:30 doesn't
+	// exist, the trigger should fire at the transition instead of skipping the day
+	loc := seattle(t)
+	trigger, mt := cronTrigger(t, "30 2 * * *", time.Date(2017, time.March, 11, 12, 0, 0, 0, loc), 3)
+	times := startTrigger(t, trigger, mt, 3)
+	require.Equal(t, time.Date(2017, time.March, 12, 10, 0, 0, 0, time.UTC), times[0].UTC())
+	require.Equal(t, 3, times[0].Hour())
+	require.Equal(t, time.Date(2017, time.March, 13, 2, 30, 0, 0, loc), times[1])
+	require.Equal(t, time.Date(2017, time.March, 14, 2, 30, 0, 0, loc), times[2])
+}
+
+func TestCronSpringForwardEveryFifteenMinutes(t *testing.T) {
+	t.Parallel()
+
+	loc := seattle(t)
+	trigger, mt := cronTrigger(t, "*/15 * * * *", time.Date(2017, time.March, 12, 1, 30, 0, 0, loc), 3)
+	times := startTrigger(t, trigger, mt, 3)
+	require.Equal(t, time.Date(2017, time.March, 12, 1, 45, 0, 0, loc), times[0])
+
+	// All of the times in the skipped hour fire once, when the clocks change
+	require.Equal(t, time.Date(2017, time.March, 12, 3, 0, 0, 0, loc), times[1])
+	require.Equal(t, time.Date(2017, time.March, 12, 3, 15, 0, 0, loc), times[2])
+}
+
+func TestCronFallBackFiresOnce(t *testing.T) {
+	t.Parallel()
+
+	// On 2017/11/05 the clocks in Seattle went from 02:00 PDT back to 01:00 PST, so 01:30 happens
+	// twice, a daily trigger should only fire the first time
+	loc := seattle(t)
+	trigger, mt := cronTrigger(t, "30 1 * * *", time.Date(2017, time.November, 4, 12, 0, 0, 0, loc), 2)
+	times := startTrigger(t, trigger, mt, 2)
+	require.Equal(t, time.Date(2017, time.November, 5, 8, 30, 0, 0, time.UTC), times[0].UTC())
+	require.Equal(t, time.Date(2017, time.November, 6, 1, 30, 0, 0, loc), times[1])
+}
+
+func TestCronFallBackHourly(t *testing.T) {
+	t.Parallel()
+
+	// Hourly schedules fire in both the PDT and the PST 01:30
+	loc := seattle(t)
+	trigger, mt := cronTrigger(t, "30 * * * *", time.Date(2017, time.November, 5, 0, 45, 0, 0, loc), 3)
+	times := startTrigger(t, trigger, mt, 3)
+	require.Equal(t, time.Date(2017, time.November, 5, 8, 30, 0, 0, time.UTC), times[0].UTC())
+	require.Equal(t, time.Date(2017, time.November, 5, 9, 30, 0, 0, time.UTC), times[1].UTC())
+	require.Equal(t, time.Date(2017, time.November, 5, 10, 30, 0, 0, time.UTC), times[2].UTC())
+	require.Equal(t, 2, times[2].Hour())
+}
+
+func TestCronNext(t *testing.T) {
+	t.Parallel()
+
+	loc := seattle(t)
+	tests := []struct {
+		expr string
+		from time.Time
+		next time.Time
+	}{
+		// Leap day
+		{"0 0 29 2 *", time.Date(2017, time.March, 1, 0, 0, 0, 0, loc), time.Date(2020, time.February, 29, 0, 0, 0, 0, loc)},
+
+		// Day of month and day of week are OR'd when both are restricted, 2017/01/06 is a friday
+		{"0 12 13 * fri", time.Date(2017, time.January, 1, 0, 0, 0, 0, loc), time.Date(2017, time.January, 6, 12, 0, 0, 0, loc)},
+		{"0 12 13 * fri", time.Date(2017, time.January, 12, 13, 0, 0, 0, loc), time.Date(2017, time.January, 13, 12, 0, 0, 0, loc)},
+
+		// Sunday can be 0 or 7
+		{"0 8 * * 7", time.Date(2017, time.January, 2, 0, 0, 0, 0, loc), time.Date(2017, time.January, 8, 8, 0, 0, 0, loc)},
+		{"@monthly", time.Date(2017, time.January, 2, 0, 0, 0, 0, loc), time.Date(2017, time.February, 1, 0, 0, 0, 0, loc)},
+	}
+
+	for _, test := range tests {
+		schedule, err := gohome.ParseCron(test.expr)
+		require.Nil(t, err, test.expr)
+
+		next, ok := schedule.Next(test.from)
+		require.True(t, ok, test.expr)
+		require.Equal(t, test.next, next, test.expr)
+	}
+
+	schedule, err := gohome.ParseCron("0 0 30 2 *")
+	require.Nil(t, err)
+	_, ok := schedule.Next(time.Date(2017, time.January, 1, 0, 0, 0, 0, loc))
+	require.False(t, ok)
+}
+
+func TestParseCronInvalid(t *testing.T) {
+	t.Parallel()
+
+	for _, expr := range []string{
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"10-5 * * * *",
+		"* * * * mon#6",
+		"* * * foo *",
+		"0 22 L * *",
+	} {
+		_, err := gohome.ParseCron(expr)
+		require.NotNil(t, err, expr)
+	}
 }
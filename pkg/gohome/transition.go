@@ -0,0 +1,301 @@
+package gohome
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/markdaws/gohome/pkg/attr"
+	"github.com/markdaws/gohome/pkg/cmd"
+	"github.com/markdaws/gohome/pkg/feature"
+	"github.com/markdaws/gohome/pkg/log"
+)
+
+const (
+	// rampInterval is how often the values are stepped when a transition is done in software, stepping
+	// more often than this floods devices such as wifi bulbs with commands
+	rampInterval = 200 * time.Millisecond
+
+	// maxRampSteps limits the number of commands sent for long transitions
+	maxRampSteps = 100
+)
+
+// canTransition returns true if the builder fades the attributes of the command natively
+func canTransition(builder cmd.Builder, command *cmd.FeatureSetAttrs) bool {
+	tb, ok := builder.(cmd.TransitionBuilder)
+	return ok && tb.CanTransition(command)
+}
+
+// rampSteps returns the attributes to set at each step of a software transition from the current values
+// of the feature to the values in the command. Only brightness and HSL values are stepped, the steps only
+// contain the attributes being stepped, the last step is always all of the attributes of the command. If
+// there is nothing to step, for example the current values are unknown, the only step is the command
+func rampSteps(current map[string]*attr.Attribute, command *cmd.FeatureSetAttrs) []map[string]*attr.Attribute {
+	final := []map[string]*attr.Attribute{command.Attrs}
+
+	steps := int(command.Transition / rampInterval)
+	if steps > maxRampSteps {
+		steps = maxRampSteps
+	}
+	if steps < 2 || current == nil {
+		return final
+	}
+
+	isOff := func(attrs map[string]*attr.Attribute) bool {
+		onoff, ok := attrs[feature.LightZoneOnOffLocalID]
+		if !ok {
+			return false
+		}
+		value, ok := onoff.Value.(int32)
+		return ok && value == attr.OnOffOff
+	}
+
+	var interpolate []func(fraction float64) *attr.Attribute
+	for localID, target := range command.Attrs {
+		from, ok := current[localID]
+		if !ok || from.Type != target.Type {
+			continue
+		}
+
+		target := target
+		switch target.Type {
+		case attr.ATBrightness:
+			start, ok1 := from.Value.(float32)
+			end, ok2 := target.Value.(float32)
+			if isOff(current) {
+				start = 0
+			}
+			if !ok1 || !ok2 || start == end {
+				continue
+			}
+			interpolate = append(interpolate, func(fraction float64) *attr.Attribute {
+				a := target.Clone()
+				a.Value = start + float32(float64(end-start)*fraction)
+				return a
+			})
+
+		case attr.ATHSL:
+			fromHSL, ok1 := from.Value.(string)
+			targetHSL, ok2 := target.Value.(string)
+			if !ok1 || !ok2 {
+				continue
+			}
+			h1, s1, l1, err := attr.HSLDeconstruct(fromHSL)
+			if err != nil {
+				continue
+			}
+			h2, s2, l2, err := attr.HSLDeconstruct(targetHSL)
+			if err != nil || (h1 == h2 && s1 == s2 && l1 == l2) {
+				continue
+			}
+
+			// Go around the color wheel the shortest way
+			dh := h2 - h1
+			if dh > 180 {
+				dh -= 360
+			} else if dh < -180 {
+				dh += 360
+			}
+			interpolate = append(interpolate, func(fraction float64) *attr.Attribute {
+				a := target.Clone()
+				h := (h1 + int32(float64(dh)*fraction) + 360) % 360
+				a.Value = attr.HSLConstruct(
+					h,
+					s1+int32(float64(s2-s1)*fraction),
+					l1+int32(float64(l2-l1)*fraction))
+				return a
+			})
+		}
+	}
+
+	// Turning a dimmable light off fades the brightness down before it is turned off
+	if _, ok := command.Attrs[feature.LightZoneBrightnessLocalID]; !ok && isOff(command.Attrs) && !isOff(current) {
+		if from, ok := current[feature.LightZoneBrightnessLocalID]; ok {
+			if start, ok := from.Value.(float32); ok && start > 0 {
+				interpolate = append(interpolate, func(fraction float64) *attr.Attribute {
+					a := from.Clone()
+					a.Value = start - float32(float64(start)*fraction)
+					return a
+				})
+			}
+		}
+	}
+
+	if len(interpolate) == 0 {
+		return final
+	}
+
+	var out []map[string]*attr.Attribute
+	for i := 1; i < steps; i++ {
+		attrs := make(map[string]*attr.Attribute)
+		for _, fn := range interpolate {
+			a := fn(float64(i) / float64(steps))
+			attrs[a.LocalID] = a
+		}
+		out = append(out, attrs)
+	}
+	return append(out, command.Attrs)
+}
+
+// rampCommand builds the transition of the feature to the values in the command in software, by setting
+// the values in steps. If there is nothing to transition the ramp only has one step, which should be
+// executed immediately
+func (cp *commandProcessor) rampCommand(
+	f *feature.Feature, builder cmd.Builder, command *cmd.FeatureSetAttrs,
+) (*ramp, error) {
+
+	var current map[string]*attr.Attribute
+	if cp.system.Services.Monitor != nil {
+		current, _ = cp.system.Services.Monitor.FeatureValues(f.ID)
+	}
+
+	steps := rampSteps(current, command)
+	if len(steps) == 1 {
+		log.V("CommandProcessor - no values to transition, setting immediately: %s", command.FriendlyString())
+	}
+
+	r := &ramp{
+		featureID: f.ID,
+		interval:  command.Transition / time.Duration(len(steps)),
+	}
+	for i, attrs := range steps {
+		built, err := builder.Build(&cmd.FeatureSetAttrs{
+			ID:          command.ID,
+			FeatureID:   command.FeatureID,
+			FeatureType: command.FeatureType,
+			FeatureName: command.FeatureName,
+			Attrs:       attrs,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if built == nil {
+			continue
+		}
+
+		friendly := command.FriendlyString()
+		if len(steps) > 1 {
+			friendly = fmt.Sprintf("%s, transition step %d of %d", friendly, i+1, len(steps))
+		}
+		r.steps = append(r.steps, &cmd.Func{Friendly: friendly, Func: built.Func})
+	}
+	return r, nil
+}
+
+// ramp is a transition done in software that is in progress. Executing all of the steps in one go would
+// hold up the lane of the hub for the whole transition, instead a timer sends each step to the lane as
+// its own batch once it is due. The group the ramp is part of finishes once the last step has executed.
+// A ramp is cancelled if another command sets the feature before it finishes
+type ramp struct {
+	featureID string
+	steps     []*cmd.Func
+	interval  time.Duration
+
+	// Set when the lane of the hub starts the ramp
+	lane  *hubLane
+	run   *groupRun
+	owner int
+	start time.Time
+
+	mutex sync.Mutex
+	next  int
+	timer *time.Timer
+	done  bool
+}
+
+// startRamp is called from the lane of the hub when it reaches the ramp, the first step is executed
+// after one interval
+func (cp *commandProcessor) startRamp(lane *hubLane, run *groupRun, owner int, r *ramp) {
+	r.lane = lane
+	r.run = run
+	r.owner = owner
+	r.start = time.Now()
+	run.addPending()
+
+	cp.rampsMutex.Lock()
+	cp.ramps[r.featureID] = r
+	cp.rampsMutex.Unlock()
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.schedule(cp)
+}
+
+// schedule starts the timer that sends the next step to the lane, the mutex must be held
+func (r *ramp) schedule(cp *commandProcessor) {
+	due := r.start.Add(time.Duration(r.next+1) * r.interval)
+	r.timer = time.AfterFunc(due.Sub(time.Now()), func() {
+		if !r.lane.send(laneBatch{run: r.run, ramp: r}) {
+			cp.finishRamp(r, fmt.Errorf("command processor stopped before the transition finished"))
+		}
+	})
+}
+
+// executeRampStep executes the next step of the ramp from the lane of the hub, then schedules the step
+// after it
+func (cp *commandProcessor) executeRampStep(lane *hubLane, r *ramp) {
+	r.mutex.Lock()
+	if r.done {
+		// Cancelled after the step was sent to the lane
+		r.mutex.Unlock()
+		return
+	}
+	step := r.steps[r.next]
+	r.next++
+	r.mutex.Unlock()
+
+	lane.wait()
+	duration, err := cp.executeFunc(step)
+	r.run.record(r.owner, duration, err)
+
+	r.mutex.Lock()
+	if !r.done && r.next < len(r.steps) {
+		r.schedule(cp)
+		r.mutex.Unlock()
+		return
+	}
+	r.mutex.Unlock()
+	cp.finishRamp(r, nil)
+}
+
+// cancelRamp cancels the ramp in progress for the feature, if there is one. It is called from the lane
+// of the hub the feature belongs to
+func (cp *commandProcessor) cancelRamp(featureID string) {
+	cp.rampsMutex.Lock()
+	r := cp.ramps[featureID]
+	cp.rampsMutex.Unlock()
+
+	if r != nil {
+		log.V("CommandProcessor - cancelling transition of feature %s, it has been set again", featureID)
+		cp.finishRamp(r, nil)
+	}
+}
+
+// finishRamp stops the ramp, err is recorded as the result of the ramp if it is not nil. Once the ramp
+// has finished the group it is part of may be finished
+func (cp *commandProcessor) finishRamp(r *ramp, err error) {
+	r.mutex.Lock()
+	if r.done {
+		r.mutex.Unlock()
+		return
+	}
+	r.done = true
+	if r.timer != nil {
+		r.timer.Stop()
+	}
+	r.mutex.Unlock()
+
+	cp.rampsMutex.Lock()
+	if cp.ramps[r.featureID] == r {
+		delete(cp.ramps, r.featureID)
+	}
+	cp.rampsMutex.Unlock()
+
+	if err != nil {
+		log.V("CommandProcessor - transition error: %s", err)
+		r.run.record(r.owner, 0, err)
+	}
+	if r.run.laneDone() {
+		cp.finished(r.run.cg, r.run.results)
+	}
+}
@@ -0,0 +1,209 @@
+package gohome_test
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-home-iot/event-bus"
+	"github.com/markdaws/gohome/pkg/attr"
+	"github.com/markdaws/gohome/pkg/cmd"
+	"github.com/markdaws/gohome/pkg/feature"
+	"github.com/markdaws/gohome/pkg/gohome"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingBuilder records the commands it executes
+type recordingBuilder struct {
+	mutex sync.Mutex
+	cmds  []*cmd.FeatureSetAttrs
+}
+
+func (b *recordingBuilder) Build(c cmd.Command) (*cmd.Func, error) {
+	command := c.(*cmd.FeatureSetAttrs)
+	return &cmd.Func{
+		Func: func() error {
+			b.mutex.Lock()
+			defer b.mutex.Unlock()
+			b.cmds = append(b.cmds, command)
+			return nil
+		},
+	}, nil
+}
+
+func (b *recordingBuilder) executed() []*cmd.FeatureSetAttrs {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.cmds
+}
+
+// nativeBuilder is a builder whose hardware fades all of the attributes itself
+type nativeBuilder struct {
+	recordingBuilder
+}
+
+func (b *nativeBuilder) CanTransition(c *cmd.FeatureSetAttrs) bool {
+	return true
+}
+
+// transitionSystem returns a system with a dimmable light zone that the monitor knows is at 20% brightness
+func transitionSystem(t *testing.T, builder cmd.Builder) (*gohome.System, *feature.Feature) {
+	sys := gohome.NewSystem("test system")
+	bus := evtbus.NewBus(100, 100)
+	sys.Services.EvtBus = bus
+	sys.Services.Monitor = gohome.NewMonitor(sys, bus)
+
+	d := gohome.NewDevice("bulbs", "bulbs", "", "", "", "", "", nil, builder, nil, nil)
+	sys.AddDevice(d)
+
+	lounge := feature.NewLightZone("lounge", feature.LightZoneModeContinuous)
+	lounge.DeviceID = d.ID
+	lounge.Name = "lounge"
+	sys.AddFeature(lounge)
+
+	onoff, brightness, _ := feature.LightZoneCloneAttrs(lounge)
+	onoff.Value = attr.OnOffOn
+	brightness.Value = float32(20)
+	bus.Enqueue(&gohome.FeatureReportingEvt{FeatureID: lounge.ID, Attrs: feature.NewAttrs(onoff, brightness)})
+	for i := 0; i < 100; i++ {
+		if _, ok := sys.Services.Monitor.FeatureValues(lounge.ID); ok {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return sys, lounge
+}
+
+// setBrightness sets the brightness of the feature with a transition, waiting for the commands to execute
+func setBrightness(t *testing.T, sys *gohome.System, f *feature.Feature, value float32, transition time.Duration) {
+	cp := gohome.NewCommandProcessor(sys, 10)
+	cp.Start()
+	defer cp.Stop()
+
+	_, brightness, _ := feature.LightZoneCloneAttrs(f)
+	brightness.Value = value
+
+	done := make(chan []gohome.CommandResult, 1)
+	group := gohome.NewCommandGroup("fade", &cmd.FeatureSetAttrs{
+		FeatureID:  f.ID,
+		Attrs:      feature.NewAttrs(brightness),
+		Transition: transition,
+	})
+	group.Executed = func(results []gohome.CommandResult) { done <- results }
+	require.Nil(t, cp.Enqueue(group))
+
+	select {
+	case results := <-done:
+		require.Nil(t, results[0].Err)
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "commands not executed")
+	}
+}
+
+func TestTransitionSoftwareRamp(t *testing.T) {
+	builder := &recordingBuilder{}
+	sys, lounge := transitionSystem(t, builder)
+
+	start := time.Now()
+	setBrightness(t, sys, lounge, 80, time.Second)
+	require.True(t, time.Since(start) >= time.Second)
+
+	var values []float32
+	for _, c := range builder.executed() {
+		require.Equal(t, time.Duration(0), c.Transition)
+		values = append(values, c.Attrs[feature.LightZoneBrightnessLocalID].Value.(float32))
+	}
+	require.Equal(t, []float32{32, 44, 56, 68, 80}, values)
+}
+
+func TestTransitionNative(t *testing.T) {
+	builder := &nativeBuilder{}
+	sys, lounge := transitionSystem(t, builder)
+
+	setBrightness(t, sys, lounge, 80, time.Second)
+
+	cmds := builder.executed()
+	require.Equal(t, 1, len(cmds))
+	require.Equal(t, time.Second, cmds[0].Transition)
+	require.Equal(t, float32(80), cmds[0].Attrs[feature.LightZoneBrightnessLocalID].Value)
+}
+
+func TestTransitionAction(t *testing.T) {
+	h := newRunHarness(t)
+	lounge := feature.NewLightZone("lounge", feature.LightZoneModeContinuous)
+	lounge.AutomationID = "lounge"
+	lounge.Name = "lounge"
+	h.sys.AddFeature(lounge)
+
+	config := `
+name: Fade
+trigger:
+  event:
+    type: server_started
+actions:
+  - light_zone:
+      aid: lounge
+      brightness: 50
+      transition: %s
+`
+	auto, err := gohome.NewAutomation(h.sys, fmt.Sprintf(config, "1500ms"))
+	require.Nil(t, err)
+	group, err := auto.DryRun()
+	require.Nil(t, err)
+	require.Equal(t, 1, len(group.Cmds))
+	require.Equal(t, 1500*time.Millisecond, group.Cmds[0].(*cmd.FeatureSetAttrs).Transition)
+
+	_, err = gohome.NewAutomation(h.sys, fmt.Sprintf(config, "slowly"))
+	require.NotNil(t, err)
+	require.Equal(t, "actions[0].light_zone.transition", err.(*gohome.AutomationError).Key)
+}
+
+func TestTransitionSoftwareDoesNotHoldLane(t *testing.T) {
+	builder := &recordingBuilder{}
+	sys, lounge := transitionSystem(t, builder)
+	kitchen := feature.NewLightZone("kitchen", feature.LightZoneModeContinuous)
+	kitchen.DeviceID = lounge.DeviceID
+	kitchen.Name = "kitchen"
+	sys.AddFeature(kitchen)
+
+	cp := gohome.NewCommandProcessor(sys, 10)
+	cp.Start()
+	defer cp.Stop()
+
+	fade := gohome.NewCommandGroup("fade", &cmd.FeatureSetAttrs{
+		FeatureID:  lounge.ID,
+		Attrs:      feature.NewAttrs(brightnessAttr(lounge, 80)),
+		Transition: time.Second,
+	})
+	faded := make(chan []gohome.CommandResult, 1)
+	fade.Executed = func(results []gohome.CommandResult) { faded <- results }
+	require.Nil(t, cp.Enqueue(fade))
+
+	// Other features on the same hub are set while the lounge is fading
+	select {
+	case <-enqueueBrightness(t, cp, kitchen, 50):
+	case <-time.After(500 * time.Millisecond):
+		require.FailNow(t, "command held up by the transition")
+	}
+
+	// Setting the lounge again cancels the rest of the transition
+	time.Sleep(500 * time.Millisecond)
+	select {
+	case <-enqueueBrightness(t, cp, lounge, 10):
+	case <-time.After(time.Second):
+		require.FailNow(t, "command not executed")
+	}
+	select {
+	case results := <-faded:
+		require.Nil(t, results[0].Err)
+	case <-time.After(time.Second):
+		require.FailNow(t, "transition not finished")
+	}
+	time.Sleep(500 * time.Millisecond)
+
+	values := brightnessValues(builder)
+	require.Equal(t, float32(50), values[0])
+	require.Equal(t, float32(10), values[len(values)-1])
+	require.True(t, len(values) < 6)
+}
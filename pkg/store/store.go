@@ -10,6 +10,7 @@ import (
 	"github.com/go-home-iot/connection-pool"
 	"github.com/markdaws/gohome/pkg/attr"
 	"github.com/markdaws/gohome/pkg/cmd"
+	"github.com/markdaws/gohome/pkg/feature"
 	"github.com/markdaws/gohome/pkg/gohome"
 	"github.com/markdaws/gohome/pkg/intg"
 	"github.com/markdaws/gohome/pkg/log"
@@ -180,12 +181,49 @@ func LoadSystem(path string) (*gohome.System, error) {
 					return nil, fmt.Errorf("invalid feature ID: %s", featureID)
 				}
 
+				transition, err := commandTransition(command.Attributes)
+				if err != nil {
+					return nil, err
+				}
+
 				finalCmd = &cmd.FeatureSetAttrs{
 					ID:          command.ID,
 					FeatureID:   f.ID,
 					FeatureName: f.Name,
 					FeatureType: f.Type,
 					Attrs:       attrs,
+					Transition:  transition,
+				}
+
+			case "selectorSetAttrs":
+				// Same as featureSetAttrs, marshal then unmarshal to get the concrete types
+				b, err := json.Marshal(command.Attributes)
+				if err != nil {
+					return nil, errExt.Wrap(err, "failed to retrieve selector fields")
+				}
+
+				var fields struct {
+					Selector feature.Selector           `json:"selector"`
+					Attrs    map[string]*attr.Attribute `json:"attrs"`
+				}
+				if err = json.Unmarshal(b, &fields); err != nil {
+					return nil, errExt.Wrap(err, "failed to unmarshal selector")
+				}
+				if err = fields.Selector.Validate(); err != nil {
+					return nil, errExt.Wrap(err, "invalid selector")
+				}
+				attr.FixJSON(fields.Attrs)
+
+				transition, err := commandTransition(command.Attributes)
+				if err != nil {
+					return nil, err
+				}
+
+				finalCmd = &cmd.SelectorSetAttrs{
+					ID:         command.ID,
+					Selector:   fields.Selector,
+					Attrs:      fields.Attrs,
+					Transition: transition,
 				}
 
 			default:
@@ -195,6 +233,11 @@ func LoadSystem(path string) (*gohome.System, error) {
 		}
 	}
 
+	// Setting scenes that set each other in a loop would never finish, refuse to load them
+	if err := sys.ValidateScenes(); err != nil {
+		return nil, err
+	}
+
 	for _, u := range s.Users {
 		user := &gohome.User{
 			ID:        u.ID,
@@ -248,6 +291,21 @@ func SaveSystem(savePath string, s *gohome.System) error {
 						"attrs":     xCmd.Attrs,
 					},
 				}
+				if xCmd.Transition > 0 {
+					cmds[j].Attributes["transition"] = xCmd.Transition.String()
+				}
+			case *cmd.SelectorSetAttrs:
+				cmds[j] = commandJSON{
+					ID:   xCmd.ID,
+					Type: "selectorSetAttrs",
+					Attributes: map[string]interface{}{
+						"selector": xCmd.Selector,
+						"attrs":    xCmd.Attrs,
+					},
+				}
+				if xCmd.Transition > 0 {
+					cmds[j].Attributes["transition"] = xCmd.Transition.String()
+				}
 			default:
 				return fmt.Errorf("unknown command type")
 			}
@@ -323,3 +381,22 @@ func SaveSystem(savePath string, s *gohome.System) error {
 	err = ioutil.WriteFile(savePath, b, 0644)
 	return err
 }
+
+// commandTransition returns the transition of a scene command, it is saved as a duration string such
+// as 1.5s, commands without a transition change the values immediately
+func commandTransition(attributes map[string]interface{}) (time.Duration, error) {
+	value, ok := attributes["transition"]
+	if !ok {
+		return 0, nil
+	}
+
+	str, ok := value.(string)
+	if !ok {
+		return 0, fmt.Errorf("invalid transition: %v, must be a duration such as 1.5s", value)
+	}
+	transition, err := time.ParseDuration(str)
+	if err != nil || transition < 0 {
+		return 0, fmt.Errorf("invalid transition: %s, must be a duration such as 1.5s", str)
+	}
+	return transition, nil
+}
@@ -105,6 +105,16 @@ func resp(r apiResponse, w http.ResponseWriter) {
 			}{Err: struct {
 				ValErr validation.ErrorJSON `json:"validation"`
 			}{validation.NewErrorJSON(err.Data, err.ID, err.Errors)}})
+		case *gohome.AutomationError:
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(struct {
+				Err jsonAutomationErr `json:"err"`
+			}{Err: jsonAutomationErr{
+				Msg:    err.Error(),
+				Key:    err.Key,
+				Line:   err.Line,
+				Column: err.Column,
+			}})
 		case *badRequestErr:
 			w.WriteHeader(http.StatusBadRequest)
 			json.NewEncoder(w).Encode(struct {
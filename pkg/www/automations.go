@@ -3,16 +3,141 @@ package www
 import (
 	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/go-yaml/yaml"
 	"github.com/gorilla/mux"
+	"github.com/markdaws/gohome/pkg/cmd"
 	"github.com/markdaws/gohome/pkg/gohome"
+	errExt "github.com/pkg/errors"
 )
 
 // RegisterAutomationHandlers registers all of the automation specific API REST routes
 func RegisterAutomationHandlers(r *mux.Router, s *Server) {
 	r.HandleFunc("/v1/automations", apiAutomationHandler(s.system)).Methods("GET")
+	r.HandleFunc("/v1/automations", apiAutomationHandlerCreate(s.cfg.AutomationPath, s.system)).Methods("POST")
+	r.HandleFunc("/v1/automations/validate", apiAutomationHandlerValidate(s.system)).Methods("POST")
+	r.HandleFunc("/v1/automations/dryrun", apiAutomationHandlerDryRunScript(s.system)).Methods("POST")
+	r.HandleFunc("/v1/automations/lint", apiAutomationHandlerLintScript(s.system)).Methods("POST")
+	r.HandleFunc("/v1/automations/{ID}", apiAutomationHandlerGet(s.system)).Methods("GET")
+	r.HandleFunc("/v1/automations/{ID}", apiAutomationHandlerUpdate(s.cfg.AutomationPath, s.system)).Methods("PUT")
+	r.HandleFunc("/v1/automations/{ID}", apiAutomationHandlerDelete(s.system)).Methods("DELETE")
 	r.HandleFunc("/v1/automations/{ID}/test", apiAutomationTestHandler(s.system)).Methods("POST")
+	r.HandleFunc("/v1/automations/{ID}/dryrun", apiAutomationHandlerDryRun(s.system)).Methods("POST")
+	r.HandleFunc("/v1/automations/{ID}/runs", apiAutomationHandlerRuns(s.system)).Methods("GET")
+	r.HandleFunc("/v1/automations/{ID}/lint", apiAutomationHandlerLint(s.system)).Methods("GET")
+	r.HandleFunc("/v1/schedule", apiScheduleHandler(s.system)).Methods("GET")
+}
+
+// AutomationToJSON converts the automation to its JSON representation. If includeScript is true
+// the source of the automation script is included in the response
+func AutomationToJSON(automation *gohome.Automation, includeScript bool) jsonAutomation {
+	item := jsonAutomation{
+		Name:    automation.Name,
+		TempID:  automation.TempID,
+		Enabled: automation.Enabled,
+		Trigger: automation.TriggerSummary(),
+		OnlyIf:  automation.OnlyIfSummary(),
+		Actions: automation.ActionSummary(),
+	}
+	if includeScript {
+		item.Script = automation.Script
+	}
+	return item
+}
+
+// AutomationRunToJSON converts a record of an automation run to its JSON representation
+func AutomationRunToJSON(run gohome.AutomationRun) jsonAutomationRun {
+	item := jsonAutomationRun{
+		ID:         run.ID,
+		Trigger:    run.Trigger,
+		Chain:      run.Chain,
+		Conditions: make([]jsonRunCondition, 0, len(run.Conditions)),
+		Status:     run.Status,
+		Reason:     run.Reason,
+		Started:    run.Started,
+		Commands:   make([]jsonRunCommand, 0, len(run.Commands)),
+	}
+	if !run.Finished.IsZero() {
+		finished := run.Finished
+		item.Finished = &finished
+	}
+	for _, c := range run.Conditions {
+		item.Conditions = append(item.Conditions, jsonRunCondition{
+			Key:       c.Key,
+			Condition: c.Condition,
+			Result:    c.Result,
+			Failed:    c.Failed,
+		})
+	}
+	for _, c := range run.Commands {
+		item.Commands = append(item.Commands, jsonRunCommand{
+			Desc:       c.Desc,
+			Sent:       c.Sent,
+			Status:     c.Status,
+			Err:        c.Err,
+			DurationMs: float64(c.Duration) / float64(time.Millisecond),
+		})
+	}
+	return item
+}
+
+// CommandGroupToJSON converts the commands in the command group to their JSON representation
+func CommandGroupToJSON(group *gohome.CommandGroup) jsonCommandGroup {
+	item := jsonCommandGroup{
+		Desc:     group.Desc,
+		Commands: make([]jsonCommand, 0, len(group.Cmds)),
+	}
+
+	for _, command := range group.Cmds {
+		switch xCmd := command.(type) {
+		case *cmd.SceneSet:
+			item.Commands = append(item.Commands, jsonCommand{
+				ID:   xCmd.ID,
+				Type: "sceneSet",
+				Attributes: map[string]interface{}{
+					"id":   xCmd.SceneID,
+					"name": xCmd.SceneName,
+				},
+			})
+
+		case *cmd.SceneUndo:
+			item.Commands = append(item.Commands, jsonCommand{
+				ID:   xCmd.ID,
+				Type: "sceneUndo",
+			})
+
+		case *cmd.FeatureSetAttrs:
+			item.Commands = append(item.Commands, jsonCommand{
+				ID:   xCmd.ID,
+				Type: "featureSetAttrs",
+				Attributes: map[string]interface{}{
+					"id":    xCmd.FeatureID,
+					"type":  xCmd.FeatureType,
+					"name":  xCmd.FeatureName,
+					"attrs": xCmd.Attrs,
+				},
+			})
+			if xCmd.Transition > 0 {
+				item.Commands[len(item.Commands)-1].Attributes["transition"] = xCmd.Transition.String()
+			}
+
+		default:
+			item.Commands = append(item.Commands, jsonCommand{
+				ID:   command.GetID(),
+				Type: command.String(),
+			})
+		}
+	}
+	return item
 }
 
 func apiAutomationHandler(system *gohome.System) func(http.ResponseWriter, *http.Request) {
@@ -20,15 +145,13 @@ func apiAutomationHandler(system *gohome.System) func(http.ResponseWriter, *http
 		w.Header().Set("Content-Type", "application/json;charset=UTF-8")
 
 		i := 0
-		automations := system.Automations()
-		items := make([]jsonAutomation, len(automations))
-		for _, automation := range automations {
-			items[i] = jsonAutomation{
-				Name:   automation.Name,
-				TempID: automation.TempID,
-			}
+		all := system.Automations()
+		items := make(automations, len(all))
+		for _, automation := range all {
+			items[i] = AutomationToJSON(automation, false)
 			i++
 		}
+		sort.Sort(items)
 
 		if err := json.NewEncoder(w).Encode(items); err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
@@ -36,6 +159,242 @@ func apiAutomationHandler(system *gohome.System) func(http.ResponseWriter, *http
 	}
 }
 
+func apiAutomationHandlerGet(system *gohome.System) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		automationID := mux.Vars(r)["ID"]
+		automation := system.AutomationByTempID(automationID)
+		if automation == nil {
+			respBadRequest(fmt.Sprintf("invalid automation ID: %s", automationID), w)
+			return
+		}
+
+		resp(apiResponse{Data: AutomationToJSON(automation, true)}, w)
+	}
+}
+
+func apiAutomationHandlerRuns(system *gohome.System) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		automationID := mux.Vars(r)["ID"]
+		automation := system.AutomationByTempID(automationID)
+		if automation == nil {
+			respBadRequest(fmt.Sprintf("invalid automation ID: %s", automationID), w)
+			return
+		}
+
+		items := []jsonAutomationRun{}
+		if automation.History != nil {
+			for _, run := range automation.History.Runs(automation.Name) {
+				items = append(items, AutomationRunToJSON(run))
+			}
+		}
+		resp(apiResponse{Data: items}, w)
+	}
+}
+
+// apiScheduleHandler returns the next scheduled runs of automation, the n query parameter sets how many
+// runs are returned, by default 20
+func apiScheduleHandler(system *gohome.System) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		n := 20
+		if value := r.URL.Query().Get("n"); value != "" {
+			var err error
+			n, err = strconv.Atoi(value)
+			if err != nil || n < 1 {
+				respBadRequest(fmt.Sprintf("invalid n: %s, must be a positive number", value), w)
+				return
+			}
+		}
+
+		items := []jsonScheduledRun{}
+		if system.Services.Scheduler != nil {
+			for _, run := range system.Services.Scheduler.Upcoming(n) {
+				items = append(items, jsonScheduledRun{
+					At:         run.At,
+					Automation: run.Automation,
+					Trigger:    run.Trigger,
+				})
+			}
+		}
+		resp(apiResponse{Data: items}, w)
+	}
+}
+
+func apiAutomationHandlerValidate(system *gohome.System) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		automation, _, ok := readAutomation(system, w, r)
+		if !ok {
+			return
+		}
+		resp(apiResponse{Data: AutomationToJSON(automation, true)}, w)
+	}
+}
+
+func apiAutomationHandlerDryRunScript(system *gohome.System) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		automation, _, ok := readAutomation(system, w, r)
+		if !ok {
+			return
+		}
+		automationDryRun(automation, w)
+	}
+}
+
+func apiAutomationHandlerDryRun(system *gohome.System) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		automationID := mux.Vars(r)["ID"]
+		automation := system.AutomationByTempID(automationID)
+		if automation == nil {
+			respBadRequest(fmt.Sprintf("invalid automation ID: %s", automationID), w)
+			return
+		}
+		automationDryRun(automation, w)
+	}
+}
+
+// automationDryRun writes the commands the automation would execute if it was triggered now to the
+// response, nothing is sent to the command processor
+func automationDryRun(automation *gohome.Automation, w http.ResponseWriter) {
+	group, err := automation.DryRun()
+	if err != nil {
+		respErr(err, w)
+		return
+	}
+	resp(apiResponse{Data: CommandGroupToJSON(group)}, w)
+}
+
+func apiAutomationHandlerLintScript(system *gohome.System) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, 65536))
+		if err != nil {
+			respBadRequest("unable to read request body", w)
+			return
+		}
+		automationLint(system, string(body), w)
+	}
+}
+
+func apiAutomationHandlerLint(system *gohome.System) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		automationID := mux.Vars(r)["ID"]
+		automation := system.AutomationByTempID(automationID)
+		if automation == nil {
+			respBadRequest(fmt.Sprintf("invalid automation ID: %s", automationID), w)
+			return
+		}
+		automationLint(system, automation.Script, w)
+	}
+}
+
+// automationLint writes all of the problems found in the script to the response, the list is empty
+// if the script is valid
+func automationLint(system *gohome.System, script string, w http.ResponseWriter) {
+	items := []jsonAutomationErr{}
+	for _, err := range gohome.LintAutomation(system, script) {
+		items = append(items, jsonAutomationErr{
+			Msg:    err.Error(),
+			Key:    err.Key,
+			Line:   err.Line,
+			Column: err.Column,
+		})
+	}
+	resp(apiResponse{Data: items}, w)
+}
+
+func apiAutomationHandlerCreate(automationPath string, system *gohome.System) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		automation, script, ok := readAutomation(system, w, r)
+		if !ok {
+			return
+		}
+
+		if system.AutomationByName(automation.Name) != nil {
+			respBadRequest(fmt.Sprintf("an automation with the name %s already exists", automation.Name), w)
+			return
+		}
+
+		path := filepath.Join(automationPath, automation.TempID+".yaml")
+		if _, err := os.Stat(path); err == nil {
+			respBadRequest(fmt.Sprintf("automation file already exists: %s", path), w)
+			return
+		}
+
+		saved, err := saveAutomation(system, automation, path, script)
+		if err != nil {
+			respErr(err, w)
+			return
+		}
+		resp(apiResponse{Data: AutomationToJSON(saved, true)}, w)
+	}
+}
+
+func apiAutomationHandlerUpdate(automationPath string, system *gohome.System) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		automationID := mux.Vars(r)["ID"]
+		existing := system.AutomationByTempID(automationID)
+		if existing == nil {
+			respBadRequest(fmt.Sprintf("invalid automation ID: %s", automationID), w)
+			return
+		}
+
+		automation, script, ok := readAutomation(system, w, r)
+		if !ok {
+			return
+		}
+
+		if other := system.AutomationByName(automation.Name); other != nil && other != existing {
+			respBadRequest(fmt.Sprintf("an automation with the name %s already exists", automation.Name), w)
+			return
+		}
+
+		// Keep the same file even if the automation was renamed
+		path := existing.Path
+		if path == "" {
+			path = filepath.Join(automationPath, automation.TempID+".yaml")
+		}
+
+		saved, err := saveAutomation(system, automation, path, script)
+		if err != nil {
+			respErr(err, w)
+			return
+		}
+
+		// The automation may not have been loaded from a file, in which case it won't
+		// be replaced when the file is loaded
+		if existing.Name != saved.Name && existing.Path == "" {
+			system.StopAutomation(existing)
+		}
+		resp(apiResponse{Data: AutomationToJSON(saved, true)}, w)
+	}
+}
+
+func apiAutomationHandlerDelete(system *gohome.System) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		automationID := mux.Vars(r)["ID"]
+		automation := system.AutomationByTempID(automationID)
+		if automation == nil {
+			respBadRequest(fmt.Sprintf("invalid automation ID: %s", automationID), w)
+			return
+		}
+
+		if automation.Path != "" {
+			if err := os.Remove(automation.Path); err != nil && !os.IsNotExist(err) {
+				respErr(errExt.Wrap(err, "error deleting automation file"), w)
+				return
+			}
+		}
+
+		// If the automation was loaded from a file, the watcher will see the file was removed and stop
+		// it, we stop it here anyway so that it has stopped before we return
+		system.StopAutomation(automation)
+		if watcher := system.Services.AutomationWatcher; watcher != nil {
+			watcher.Scan()
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(struct{}{})
+	}
+}
+
 func apiAutomationTestHandler(system *gohome.System) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		automationID := mux.Vars(r)["ID"]
@@ -52,3 +411,61 @@ func apiAutomationTestHandler(system *gohome.System) func(http.ResponseWriter, *
 		json.NewEncoder(w).Encode(struct{}{})
 	}
 }
+
+// readAutomation reads the automation script from the request body and validates it, the script can
+// either be YAML or JSON. The script is returned as YAML so it can be written to the automation
+// directory. If the bool return value is false an error has already been written to the client
+func readAutomation(system *gohome.System, w http.ResponseWriter, r *http.Request) (*gohome.Automation, []byte, bool) {
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 65536))
+	if err != nil {
+		respBadRequest("unable to read request body", w)
+		return nil, nil, false
+	}
+
+	automation, err := gohome.NewAutomation(system, string(body))
+	if err != nil {
+		respErr(err, w)
+		return nil, nil, false
+	}
+
+	if !strings.HasPrefix(strings.TrimSpace(string(body)), "{") {
+		return automation, body, true
+	}
+
+	// All of the scripts in the automation directory are YAML, so convert the JSON, keeping the
+	// order of the keys the same
+	var script yaml.MapSlice
+	if err = yaml.Unmarshal(body, &script); err != nil {
+		respBadRequest(errExt.Wrap(err, "unable to parse JSON in request body").Error(), w)
+		return nil, nil, false
+	}
+	out, err := yaml.Marshal(script)
+	if err != nil {
+		respErr(errExt.Wrap(err, "unable to convert JSON to YAML"), w)
+		return nil, nil, false
+	}
+	return automation, out, true
+}
+
+// saveAutomation writes the automation script to the file at path then loads it in to the system,
+// replacing any existing automation with the same name or loaded from the same file
+func saveAutomation(system *gohome.System, automation *gohome.Automation, path string, script []byte) (*gohome.Automation, error) {
+	if err := ioutil.WriteFile(path, script, 0644); err != nil {
+		return nil, errExt.Wrap(err, "error writing automation file")
+	}
+
+	watcher := system.Services.AutomationWatcher
+	if watcher == nil {
+		automation.Path = path
+		system.StartAutomation(automation)
+		return automation, nil
+	}
+
+	// Load the file now instead of waiting for the watcher to see the change
+	watcher.Load(path)
+	saved := system.AutomationByName(automation.Name)
+	if saved == nil || saved.Path != path {
+		return nil, fmt.Errorf("failed to load automation file: %s", path)
+	}
+	return saved, nil
+}
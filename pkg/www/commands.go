@@ -0,0 +1,61 @@
+package www
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/markdaws/gohome/pkg/gohome"
+)
+
+// RegisterCommandHandlers registers the REST API routes for the status of executed commands
+func RegisterCommandHandlers(r *mux.Router, s *Server) {
+	r.HandleFunc("/v1/commands/{ID}", apiCommandStatusHandler(s.system)).Methods("GET")
+}
+
+// apiCommandStatusHandler returns the status of a command group sent to the command processor
+func apiCommandStatusHandler(system *gohome.System) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ID := mux.Vars(r)["ID"]
+		status, ok := system.Services.CmdProcessor.Status(ID)
+		if !ok {
+			respBadRequest(fmt.Sprintf("invalid command ID: %s", ID), w)
+			return
+		}
+		resp(apiResponse{Data: CommandStatusToJSON(status)}, w)
+	}
+}
+
+// CommandStatusToJSON converts the status of a command group to its JSON representation
+func CommandStatusToJSON(status gohome.CommandGroupStatus) jsonCommandGroupStatus {
+	item := jsonCommandGroupStatus{
+		ID:       status.ID,
+		Desc:     status.Desc,
+		Status:   status.Status,
+		Queued:   status.Queued,
+		Commands: commandStatusesToJSON(status.Commands),
+	}
+	if !status.Started.IsZero() {
+		started := status.Started
+		item.Started = &started
+	}
+	if !status.Finished.IsZero() {
+		finished := status.Finished
+		item.Finished = &finished
+	}
+	return item
+}
+
+func commandStatusesToJSON(commands []gohome.CommandStatus) []jsonCommandStatus {
+	out := make([]jsonCommandStatus, 0, len(commands))
+	for _, c := range commands {
+		out = append(out, jsonCommandStatus{
+			Desc:       c.Desc,
+			Status:     c.Status,
+			Err:        c.Err,
+			DurationMs: float64(c.Duration) / float64(time.Millisecond),
+		})
+	}
+	return out
+}
@@ -169,18 +169,20 @@ func apiDeviceApplyFeaturesAttrsHandler(savePath string, system *gohome.System)
 		}
 
 		desc := "FeatureSetAttrs"
-		err = system.Services.CmdProcessor.Enqueue(gohome.NewCommandGroup(desc, &cmd.FeatureSetAttrs{
+		group := gohome.NewCommandGroup(desc, &cmd.FeatureSetAttrs{
 			FeatureID:   featureID,
 			FeatureName: f.Name,
 			Attrs:       finalAttrs,
-		}))
+		})
+		group.ID = system.NewID()
+		err = system.Services.CmdProcessor.Enqueue(group)
 
 		if err != nil {
 			respErr(errExt.Wrap(err, "failed to enqueue FeatureSetAttrs command"), w)
 			return
 		}
 		w.Header().Set("Content-Type", "application/json; charset=utf-8")
-		json.NewEncoder(w).Encode(struct{}{})
+		json.NewEncoder(w).Encode(jsonCommandEnqueued{CommandID: group.ID})
 	}
 }
 
@@ -2,14 +2,92 @@ package www
 
 import (
 	"strings"
+	"time"
 
 	"github.com/markdaws/gohome/pkg/attr"
 	"github.com/markdaws/gohome/pkg/feature"
 )
 
 type jsonAutomation struct {
-	TempID string `json:"tempId"`
-	Name   string `json:"name"`
+	TempID  string   `json:"tempId"`
+	Name    string   `json:"name"`
+	Enabled bool     `json:"enabled"`
+	Trigger string   `json:"trigger"`
+	OnlyIf  string   `json:"onlyIf,omitempty"`
+	Actions []string `json:"actions"`
+	Script  string   `json:"script,omitempty"`
+}
+type automations []jsonAutomation
+
+func (slice automations) Len() int {
+	return len(slice)
+}
+func (slice automations) Less(i, j int) bool {
+	return slice[i].Name < slice[j].Name
+}
+func (slice automations) Swap(i, j int) {
+	slice[i], slice[j] = slice[j], slice[i]
+}
+
+type jsonAutomationErr struct {
+	Msg    string `json:"msg"`
+	Key    string `json:"key"`
+	Line   int    `json:"line"`
+	Column int    `json:"column"`
+}
+
+type jsonAutomationRun struct {
+	ID         int64              `json:"id"`
+	Trigger    string             `json:"trigger"`
+	Chain      []string           `json:"chain,omitempty"`
+	Conditions []jsonRunCondition `json:"conditions"`
+	Status     string             `json:"status"`
+	Reason     string             `json:"reason,omitempty"`
+	Started    time.Time          `json:"started"`
+	Finished   *time.Time         `json:"finished,omitempty"`
+	Commands   []jsonRunCommand   `json:"commands"`
+}
+
+type jsonScheduledRun struct {
+	At         time.Time `json:"at"`
+	Automation string    `json:"automation"`
+	Trigger    string    `json:"trigger"`
+}
+
+type jsonRunCondition struct {
+	Key       string `json:"key"`
+	Condition string `json:"condition"`
+	Result    bool   `json:"result"`
+	Failed    string `json:"failed,omitempty"`
+}
+
+type jsonRunCommand struct {
+	Desc       string    `json:"desc"`
+	Sent       time.Time `json:"sent"`
+	Status     string    `json:"status"`
+	Err        string    `json:"err,omitempty"`
+	DurationMs float64   `json:"durationMs"`
+}
+
+type jsonCommandGroupStatus struct {
+	ID       string              `json:"id"`
+	Desc     string              `json:"desc"`
+	Status   string              `json:"status"`
+	Queued   time.Time           `json:"queued"`
+	Started  *time.Time          `json:"started,omitempty"`
+	Finished *time.Time          `json:"finished,omitempty"`
+	Commands []jsonCommandStatus `json:"commands"`
+}
+
+type jsonCommandEnqueued struct {
+	CommandID string `json:"commandId"`
+}
+
+type jsonCommandStatus struct {
+	Desc       string  `json:"desc"`
+	Status     string  `json:"status"`
+	Err        string  `json:"err,omitempty"`
+	DurationMs float64 `json:"durationMs"`
 }
 
 type jsonCommand struct {
@@ -18,6 +96,11 @@ type jsonCommand struct {
 	Attributes map[string]interface{} `json:"attributes"`
 }
 
+type jsonCommandGroup struct {
+	Desc     string        `json:"desc"`
+	Commands []jsonCommand `json:"commands"`
+}
+
 type jsonConnPool struct {
 	Name     string `json:"name"`
 	PoolSize int32  `json:"poolSize"`
@@ -77,10 +160,21 @@ type jsonDiscovererInfo struct {
 type jsonMonitorGroup struct {
 	TimeoutInSeconds int      `json:"timeoutInSeconds"`
 	FeatureIDs       []string `json:"featureIds"`
+	Scenes           bool     `json:"scenes"`
+	Commands         bool     `json:"commands"`
 }
 
 type jsonMonitorGroupResponse struct {
 	Features map[string]map[string]*attr.Attribute `json:"features"`
+	Scenes   map[string]bool                       `json:"scenes,omitempty"`
+	Command  *jsonCommandUpdate                    `json:"command,omitempty"`
+}
+
+type jsonCommandUpdate struct {
+	ID       string              `json:"id"`
+	Desc     string              `json:"desc"`
+	Status   string              `json:"status"`
+	Commands []jsonCommandStatus `json:"commands"`
 }
 
 type jsonRecipe struct {
@@ -111,6 +205,52 @@ type jsonScene struct {
 }
 type scenes []jsonScene
 
+type jsonSceneCapture struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	FeatureIDs  []string `json:"featureIds"`
+	FeatureType string   `json:"featureType"`
+	DeviceID    string   `json:"deviceId"`
+}
+
+type jsonCapturedScene struct {
+	Scene   jsonScene `json:"scene"`
+	Missing []string  `json:"missing"`
+}
+
+type jsonSceneGraph struct {
+	Scenes   []jsonSceneGraphScene   `json:"scenes"`
+	Features []jsonSceneGraphFeature `json:"features"`
+	Edges    []jsonSceneGraphEdge    `json:"edges"`
+}
+
+type jsonSceneGraphScene struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type jsonSceneGraphFeature struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	DeviceID string `json:"deviceId"`
+}
+
+type jsonSceneGraphEdge struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	Type string `json:"type"`
+}
+
+type jsonSceneSnapshot struct {
+	SceneID    string    `json:"sceneId"`
+	SceneName  string    `json:"sceneName"`
+	Time       time.Time `json:"time"`
+	FeatureIDs []string  `json:"featureIds"`
+	Missing    []string  `json:"missing"`
+	CommandID  string    `json:"commandId,omitempty"`
+}
+
 func (slice scenes) Len() int {
 	return len(slice)
 }
@@ -15,7 +15,7 @@ import (
 func RegisterMonitorHandlers(r *mux.Router, s *Server) {
 	//TODO: Need a way to check the SID used for the user against the current valid
 	//SIDs and make sure it has not expired, otherwise someone can listen forever
-	wsHelper := NewWSHelper(s.system.Services.Monitor, s.system.Services.EvtBus)
+	wsHelper := NewWSHelper(s.system)
 
 	// Clients call to subscribe to items, api returns a monitorID that can then be used
 	// to subscribe and unsubscribe to notifications
@@ -75,6 +75,8 @@ func apiSubscribeHandler(system *gohome.System, wsHelper *WSHelper) func(http.Re
 			Timeout:  time.Duration(groupJSON.TimeoutInSeconds) * time.Second,
 			Features: make(map[string]bool),
 			Handler:  wsHelper,
+			Scenes:   groupJSON.Scenes,
+			Commands: groupJSON.Commands,
 		}
 		for _, featureID := range groupJSON.FeatureIDs {
 			group.Features[featureID] = true
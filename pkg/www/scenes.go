@@ -7,10 +7,12 @@ import (
 	"io/ioutil"
 	"net/http"
 	"sort"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/markdaws/gohome/pkg/attr"
 	"github.com/markdaws/gohome/pkg/cmd"
+	"github.com/markdaws/gohome/pkg/feature"
 	"github.com/markdaws/gohome/pkg/gohome"
 	"github.com/markdaws/gohome/pkg/store"
 	"github.com/markdaws/gohome/pkg/validation"
@@ -27,6 +29,15 @@ func RegisterSceneHandlers(r *mux.Router, s *Server) {
 	r.HandleFunc("/v1/scenes",
 		apiSceneHandlerCreate(s.systemSavePath, s.system)).Methods("POST")
 
+	r.HandleFunc("/v1/scenes/capture",
+		apiSceneHandlerCapture(s.systemSavePath, s.system)).Methods("POST")
+
+	r.HandleFunc("/v1/scenes/undo",
+		apiSceneHandlerUndo(s.system)).Methods("POST")
+
+	r.HandleFunc("/v1/scenes/history",
+		apiSceneHistoryHandler(s.system)).Methods("GET")
+
 	r.HandleFunc("/v1/scenes/{sceneID}/commands/{commandID}",
 		apiSceneHandlerCommandDelete(s.systemSavePath, s.system)).Methods("DELETE")
 
@@ -36,6 +47,12 @@ func RegisterSceneHandlers(r *mux.Router, s *Server) {
 	r.HandleFunc("/v1/scenes/{ID}",
 		apiSceneHandlerDelete(s.systemSavePath, s.system)).Methods("DELETE")
 
+	r.HandleFunc("/v1/scenes/{ID}/graph",
+		apiSceneGraphHandler(s.system)).Methods("GET")
+
+	r.HandleFunc("/v1/scenes/active",
+		apiActiveScenesListHandler(s.system)).Methods("GET")
+
 	r.HandleFunc("/v1/scenes/active",
 		apiActiveScenesHandler(s.system)).Methods("POST")
 }
@@ -75,6 +92,21 @@ func ScenesToJSON(inputScenes map[string]*gohome.Scene) scenes {
 						"attrs": xCmd.Attrs,
 					},
 				}
+				if xCmd.Transition > 0 {
+					cmds[j].Attributes["transition"] = xCmd.Transition.String()
+				}
+			case *cmd.SelectorSetAttrs:
+				cmds[j] = jsonCommand{
+					ID:   xCmd.ID,
+					Type: "selectorSetAttrs",
+					Attributes: map[string]interface{}{
+						"selector": xCmd.Selector,
+						"attrs":    xCmd.Attrs,
+					},
+				}
+				if xCmd.Transition > 0 {
+					cmds[j].Attributes["transition"] = xCmd.Transition.String()
+				}
 			default:
 				fmt.Println("unknown scene command")
 			}
@@ -110,10 +142,12 @@ func apiActiveScenesHandler(system *gohome.System) func(http.ResponseWriter, *ht
 		}
 
 		desc := fmt.Sprintf("Set scene: %s", scene.Name)
-		err = system.Services.CmdProcessor.Enqueue(gohome.NewCommandGroup(desc, &cmd.SceneSet{
+		group := gohome.NewCommandGroup(desc, &cmd.SceneSet{
 			SceneID:   scene.ID,
 			SceneName: scene.Name,
-		}))
+		})
+		group.ID = system.NewID()
+		err = system.Services.CmdProcessor.Enqueue(group)
 		if err != nil {
 			//TODO: log
 			fmt.Printf("enqueue failed: %s\n", err)
@@ -123,7 +157,24 @@ func apiActiveScenesHandler(system *gohome.System) func(http.ResponseWriter, *ht
 
 		w.Header().Set("Content-Type", "application/json; charset=utf-8")
 		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(struct{}{})
+		json.NewEncoder(w).Encode(jsonCommandEnqueued{CommandID: group.ID})
+	}
+}
+
+// apiActiveScenesListHandler returns the IDs of the scenes that are active, the current values of the
+// features they set match the scene
+func apiActiveScenesListHandler(system *gohome.System) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		active := []string{}
+		if system.Services.Monitor != nil {
+			for sceneID, isActive := range system.Services.Monitor.ActiveScenes() {
+				if isActive {
+					active = append(active, sceneID)
+				}
+			}
+		}
+		sort.Strings(active)
+		resp(apiResponse{Data: active}, w)
 	}
 }
 
@@ -147,6 +198,8 @@ func apiSceneHandlerDelete(savePath string, system *gohome.System) func(http.Res
 			return
 		}
 		system.DeleteScene(scene)
+		updateActiveScenes(system)
+
 		err := store.SaveSystem(savePath, system)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
@@ -187,6 +240,8 @@ func apiSceneHandlerCommandDelete(savePath string, system *gohome.System) func(h
 			return
 		}
 
+		updateActiveScenes(system)
+
 		err = store.SaveSystem(savePath, system)
 		if err != nil {
 			respErr(errExt.Wrap(err, "error writing changes to disk"), w)
@@ -256,12 +311,65 @@ func apiSceneHandlerCommandAdd(savePath string, system *gohome.System) func(http
 			}
 			attr.FixJSON(attrs)
 
+			var transition string
+			if cmdAttrs["transition"] != nil {
+				if err = json.Unmarshal(*cmdAttrs["transition"], &transition); err != nil {
+					respBadRequest("invalid JSON body, transition must be a string", w)
+					return
+				}
+			}
+			duration, ok := parseTransition(transition, w)
+			if !ok {
+				return
+			}
+
 			finalCmd = &cmd.FeatureSetAttrs{
 				ID:          system.NewID(),
 				FeatureID:   featureID,
 				FeatureName: f.Name,
 				FeatureType: f.Type,
 				Attrs:       attrs,
+				Transition:  duration,
+			}
+
+		case "selectorSetAttrs":
+			var cmdAttrs struct {
+				Selector   *feature.Selector          `json:"selector"`
+				Attrs      map[string]*attr.Attribute `json:"attrs"`
+				Transition string                     `json:"transition"`
+			}
+			if command["attributes"] == nil {
+				respBadRequest("invalid JSON body, missing attributes key", w)
+				return
+			}
+			if err = json.Unmarshal(*command["attributes"], &cmdAttrs); err != nil {
+				respBadRequest("invalid JSON body, unable to parse attributes key", w)
+				return
+			}
+			if cmdAttrs.Selector == nil {
+				respBadRequest("invalid JSON body, missing selector key", w)
+				return
+			}
+			if err = cmdAttrs.Selector.Validate(); err != nil {
+				respBadRequest(err.Error(), w)
+				return
+			}
+			if len(cmdAttrs.Attrs) == 0 {
+				respBadRequest("invalid JSON body, missing attrs key", w)
+				return
+			}
+			attr.FixJSON(cmdAttrs.Attrs)
+
+			duration, ok := parseTransition(cmdAttrs.Transition, w)
+			if !ok {
+				return
+			}
+
+			finalCmd = &cmd.SelectorSetAttrs{
+				ID:         system.NewID(),
+				Selector:   *cmdAttrs.Selector,
+				Attrs:      cmdAttrs.Attrs,
+				Transition: duration,
 			}
 
 		case "sceneSet":
@@ -299,6 +407,14 @@ func apiSceneHandlerCommandAdd(savePath string, system *gohome.System) func(http
 			return
 		}
 
+		// Check the new command doesn't make the scene set itself, before it is added
+		candidate := *scene
+		candidate.Commands = append(append([]cmd.Command{}, scene.Commands...), finalCmd)
+		if err = system.ValidateSceneGraph(&candidate); err != nil {
+			respBadRequest(err.Error(), w)
+			return
+		}
+
 		cmdID := finalCmd.GetID()
 		err = scene.AddCommand(finalCmd)
 		if err != nil {
@@ -306,6 +422,8 @@ func apiSceneHandlerCommandAdd(savePath string, system *gohome.System) func(http
 			return
 		}
 
+		updateActiveScenes(system)
+
 		err = store.SaveSystem(savePath, system)
 		if err != nil {
 			respErr(errExt.Wrap(err, "error writing changes to disk"), w)
@@ -364,9 +482,15 @@ func apiSceneHandlerUpdate(savePath string, system *gohome.System) func(http.Res
 			respValErr(&updates, sceneID, valErrs, w)
 			return
 		}
+		if err = system.ValidateSceneGraph(&updatedScene); err != nil {
+			respBadRequest(err.Error(), w)
+			return
+		}
 
 		system.AddScene(&updatedScene)
 
+		updateActiveScenes(system)
+
 		err = store.SaveSystem(savePath, system)
 		if err != nil {
 			respErr(errExt.Wrap(err, "failed to save system to disk"), w)
@@ -408,6 +532,8 @@ func apiSceneHandlerCreate(savePath string, system *gohome.System) func(http.Res
 		}
 		system.AddScene(newScene)
 
+		updateActiveScenes(system)
+
 		err = store.SaveSystem(savePath, system)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
@@ -419,3 +545,197 @@ func apiSceneHandlerCreate(savePath string, system *gohome.System) func(http.Res
 		json.NewEncoder(w).Encode(scene)
 	}
 }
+
+// apiSceneHandlerCapture creates a new scene from the current values of a set of features. The features
+// are either a list of feature IDs, all the features of a type, or all the features of a device
+func apiSceneHandlerCapture(savePath string, system *gohome.System) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, 65536))
+		if err != nil {
+			respBadRequest("unable to read request body", w)
+			return
+		}
+
+		var req jsonSceneCapture
+		if err = json.Unmarshal(body, &req); err != nil {
+			respBadRequest(errExt.Wrap(err, "unable to parse JSON in request body").Error(), w)
+			return
+		}
+
+		// Check the scene is valid before waiting for features to report their values
+		if valErrs := (&gohome.Scene{Name: req.Name}).Validate(); valErrs != nil {
+			respValErr(&req, "", valErrs, w)
+			return
+		}
+
+		selected := 0
+		for _, set := range []bool{len(req.FeatureIDs) > 0, req.FeatureType != "", req.DeviceID != ""} {
+			if set {
+				selected++
+			}
+		}
+		if selected != 1 {
+			respBadRequest("one of the featureIds, featureType or deviceId keys must be specified", w)
+			return
+		}
+
+		var features []*feature.Feature
+		switch {
+		case len(req.FeatureIDs) > 0:
+			for _, featureID := range req.FeatureIDs {
+				f := system.FeatureByID(featureID)
+				if f == nil {
+					respBadRequest(fmt.Sprintf("invalid feature ID: %s", featureID), w)
+					return
+				}
+				features = append(features, f)
+			}
+		case req.FeatureType != "":
+			for _, f := range system.FeaturesByType(req.FeatureType) {
+				features = append(features, f)
+			}
+		default:
+			d := system.DeviceByID(req.DeviceID)
+			if d == nil {
+				respBadRequest(fmt.Sprintf("invalid device ID: %s", req.DeviceID), w)
+				return
+			}
+			features = d.Features
+		}
+
+		scene, missing, err := gohome.CaptureScene(system, req.Name, features, 5*time.Second)
+		if err != nil {
+			respBadRequest(err.Error(), w)
+			return
+		}
+		scene.Description = req.Description
+		system.AddScene(scene)
+
+		updateActiveScenes(system)
+
+		if err = store.SaveSystem(savePath, system); err != nil {
+			respErr(errExt.Wrap(err, "failed to save the captured scene"), w)
+			return
+		}
+
+		if missing == nil {
+			missing = []string{}
+		}
+		jsonScenes := ScenesToJSON(map[string]*gohome.Scene{scene.ID: scene})
+		resp(apiResponse{Data: jsonCapturedScene{Scene: jsonScenes[0], Missing: missing}}, w)
+	}
+}
+
+// apiSceneGraphHandler returns all of the scenes and features a scene ends up setting, following any
+// scenes it sets
+func apiSceneGraphHandler(system *gohome.System) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sceneID := mux.Vars(r)["ID"]
+		scene := system.SceneByID(sceneID)
+		if scene == nil {
+			respBadRequest(fmt.Sprintf("invalid scene ID: %s", sceneID), w)
+			return
+		}
+
+		graph, err := system.SceneGraph(scene)
+		if err != nil {
+			respBadRequest(err.Error(), w)
+			return
+		}
+
+		out := jsonSceneGraph{
+			Scenes:   make([]jsonSceneGraphScene, len(graph.Scenes)),
+			Features: make([]jsonSceneGraphFeature, len(graph.Features)),
+			Edges:    make([]jsonSceneGraphEdge, len(graph.Edges)),
+		}
+		for i, scn := range graph.Scenes {
+			out.Scenes[i] = jsonSceneGraphScene{ID: scn.ID, Name: scn.Name}
+		}
+		for i, f := range graph.Features {
+			out.Features[i] = jsonSceneGraphFeature{ID: f.ID, Name: f.Name, Type: f.Type, DeviceID: f.DeviceID}
+		}
+		for i, edge := range graph.Edges {
+			out.Edges[i] = jsonSceneGraphEdge{From: edge.From, To: edge.To, Type: edge.Type}
+		}
+		resp(apiResponse{Data: out}, w)
+	}
+}
+
+// apiSceneHandlerUndo restores the features set by the most recent scene to the values they had before
+// the scene was set, responding with the snapshot that is restored
+func apiSceneHandlerUndo(system *gohome.System) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if system.Services.SceneHistory == nil {
+			respBadRequest("scene history is not enabled", w)
+			return
+		}
+
+		snapshot := system.Services.SceneHistory.Last()
+		if snapshot == nil {
+			respBadRequest("there are no scenes to undo", w)
+			return
+		}
+
+		desc := fmt.Sprintf("Undo scene: %s", snapshot.SceneName)
+		group := gohome.NewCommandGroup(desc, &cmd.SceneUndo{ID: system.NewID()})
+		group.ID = system.NewID()
+		if err := system.Services.CmdProcessor.Enqueue(group); err != nil {
+			respErr(errExt.Wrap(err, "failed to undo the scene"), w)
+			return
+		}
+
+		out := sceneSnapshotToJSON(snapshot)
+		out.CommandID = group.ID
+		resp(apiResponse{Data: out}, w)
+	}
+}
+
+// apiSceneHistoryHandler returns the snapshots of the scenes that can be undone, most recent first
+func apiSceneHistoryHandler(system *gohome.System) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		out := []jsonSceneSnapshot{}
+		if system.Services.SceneHistory != nil {
+			for _, snapshot := range system.Services.SceneHistory.Snapshots() {
+				out = append(out, sceneSnapshotToJSON(snapshot))
+			}
+		}
+		resp(apiResponse{Data: out}, w)
+	}
+}
+
+func sceneSnapshotToJSON(snapshot *gohome.SceneSnapshot) jsonSceneSnapshot {
+	out := jsonSceneSnapshot{
+		SceneID:    snapshot.SceneID,
+		SceneName:  snapshot.SceneName,
+		Time:       snapshot.Time,
+		FeatureIDs: []string{},
+		Missing:    []string{},
+	}
+	for _, restore := range snapshot.Commands {
+		out.FeatureIDs = append(out.FeatureIDs, restore.FeatureID)
+	}
+	out.Missing = append(out.Missing, snapshot.Missing...)
+	return out
+}
+
+// updateActiveScenes checks which scenes are active after scenes have been changed
+func updateActiveScenes(system *gohome.System) {
+	if system.Services.Monitor != nil {
+		system.Services.Monitor.UpdateActiveScenes()
+	}
+}
+
+// parseTransition parses the transition of a scene command, a duration string such as 1.5s. If the value
+// is invalid a bad request response is written and the bool return value is false
+func parseTransition(value string, w http.ResponseWriter) (time.Duration, bool) {
+	if value == "" {
+		return 0, true
+	}
+
+	transition, err := time.ParseDuration(value)
+	if err != nil || transition < 0 {
+		respBadRequest(fmt.Sprintf("invalid transition: %s, must be a duration such as 1.5s", value), w)
+		return 0, false
+	}
+	return transition, true
+}
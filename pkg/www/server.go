@@ -193,6 +193,7 @@ func (s *Server) listenAndServe(addr string) error {
 	RegisterDiscoveryHandlers(apiRouter, s)
 	RegisterMonitorHandlers(apiRouter, s)
 	RegisterAutomationHandlers(apiRouter, s)
+	RegisterCommandHandlers(apiRouter, s)
 
 	r.PathPrefix("/api").Handler(negroni.New(
 		negroni.HandlerFunc(CheckValidSession(s.sessions)),
@@ -19,6 +19,7 @@ import (
 var upgrader = websocket.Upgrader{CheckOrigin: func(r *http.Request) bool { return true }}
 
 type WSHelper struct {
+	system      *gohome.System
 	monitor     *gohome.Monitor
 	evtBus      *evtbus.Bus
 	nextID      int64
@@ -26,6 +27,7 @@ type WSHelper struct {
 	conn        *websocket.Conn
 	mutex       sync.RWMutex
 	updates     chan *gohome.ChangeBatch
+	commands    chan *jsonCommandUpdate
 }
 
 type connection struct {
@@ -36,15 +38,21 @@ type connection struct {
 	readChan     chan bool
 }
 
-func NewWSHelper(monitor *gohome.Monitor, evtBus *evtbus.Bus) *WSHelper {
+func NewWSHelper(system *gohome.System) *WSHelper {
 	h := WSHelper{
-		monitor:     monitor,
-		evtBus:      evtBus,
+		system:      system,
+		monitor:     system.Services.Monitor,
+		evtBus:      system.Services.EvtBus,
 		nextID:      time.Now().UnixNano(),
 		connections: make(map[string]map[*connection]bool),
 		updates:     make(chan *gohome.ChangeBatch, 1000),
+		commands:    make(chan *jsonCommandUpdate, 100),
 	}
 	h.processUpdates()
+	h.processCommands()
+
+	// Command results are sent to the clients of the monitor groups that asked for them
+	h.evtBus.AddConsumer(&h)
 	return &h
 }
 
@@ -87,7 +95,7 @@ func (h *WSHelper) unregister(c *connection) {
 	close(c.writeChan)
 	close(c.readChan)
 
-	h.evtBus.Enqueue(&gohome.ClientDisconnectedEvt{ConnectionID: c.connectionID})
+	h.system.ClientDisconnected(c.connectionID)
 }
 
 func (h *WSHelper) HTTPHandler() func(http.ResponseWriter, *http.Request) {
@@ -124,7 +132,7 @@ func (h *WSHelper) HTTPHandler() func(http.ResponseWriter, *http.Request) {
 		}
 
 		// Let the system know a new client has connected
-		h.evtBus.Enqueue(&gohome.ClientConnectedEvt{
+		h.system.ClientConnected(&gohome.ClientConnectedEvt{
 			MonitorID:    monitorID,
 			Origin:       origin,
 			ConnectionID: conn.connectionID,
@@ -161,26 +169,66 @@ func (h *WSHelper) processUpdates() {
 			for featureID, attrs := range update.Features {
 				evt.Features[featureID] = attrs
 			}
-
-			bytes, err := json.Marshal(evt)
-			if err != nil {
-				log.E("failed to marshal change batch to JSON for update: %s", err)
-				continue
+			if len(update.Scenes) > 0 {
+				evt.Scenes = make(map[string]bool)
+				for sceneID, active := range update.Scenes {
+					evt.Scenes[sceneID] = active
+				}
 			}
+			h.send(connList, evt)
+		}
+	}()
+}
 
-			// Serial, if we ever get a lot of conncurrent users, would want to push
-			// these in parallel
-			for _, conn := range connList {
-				conn.ws.SetWriteDeadline(time.Now().Add(10 * time.Second))
-				err = conn.ws.WriteMessage(websocket.TextMessage, bytes)
-				if err != nil {
-					h.unregister(conn)
+// processCommands sends the result of each command group to the connections of the monitor groups
+// that asked for command results
+func (h *WSHelper) processCommands() {
+	go func() {
+		for update := range h.commands {
+			h.mutex.RLock()
+			var connList []*connection
+			for monitorID, conns := range h.connections {
+				group, ok := h.monitor.Group(monitorID)
+				if !ok || !group.Commands {
+					continue
+				}
+				for conn := range conns {
+					connList = append(connList, conn)
 				}
 			}
+			h.mutex.RUnlock()
+
+			h.send(connList, jsonMonitorGroupResponse{
+				Features: make(map[string]map[string]*attr.Attribute),
+				Command:  update,
+			})
 		}
 	}()
 }
 
+// send writes the message to each of the connections
+func (h *WSHelper) send(connList []*connection, msg jsonMonitorGroupResponse) {
+	if len(connList) == 0 {
+		return
+	}
+
+	bytes, err := json.Marshal(msg)
+	if err != nil {
+		log.E("failed to marshal change batch to JSON for update: %s", err)
+		return
+	}
+
+	// Serial, if we ever get a lot of conncurrent users, would want to push
+	// these in parallel
+	for _, conn := range connList {
+		conn.ws.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		err = conn.ws.WriteMessage(websocket.TextMessage, bytes)
+		if err != nil {
+			h.unregister(conn)
+		}
+	}
+}
+
 // ========= gohome.MonitorDelegate interface ==============
 
 // Update is the callback to the monitor service, it will get change notifications
@@ -217,6 +265,42 @@ func (h *WSHelper) Expired(monitorID string) {
 
 // =========================================================
 
+// ========= evtbus.Consumer interface ==============
+
+func (h *WSHelper) ConsumerName() string {
+	return "WSHelper"
+}
+
+// StartConsuming sends the result of each command group to the clients that asked for them. The results
+// are dropped if the clients can't keep up, rather than holding up the event bus
+func (h *WSHelper) StartConsuming(ch chan evtbus.Event) {
+	go func() {
+		for e := range ch {
+			var update *jsonCommandUpdate
+			switch evt := e.(type) {
+			case *gohome.CommandCompletedEvt:
+				update = &jsonCommandUpdate{ID: evt.ID, Desc: evt.Desc, Status: gohome.CommandGroupDone,
+					Commands: commandStatusesToJSON(evt.Commands)}
+			case *gohome.CommandFailedEvt:
+				update = &jsonCommandUpdate{ID: evt.ID, Desc: evt.Desc, Status: gohome.CommandGroupFailed,
+					Commands: commandStatusesToJSON(evt.Commands)}
+			default:
+				continue
+			}
+
+			select {
+			case h.commands <- update:
+			default:
+				log.V("WSHelper - command results queue is full, dropping result: %s", update.ID)
+			}
+		}
+	}()
+}
+
+func (h *WSHelper) StopConsuming() {}
+
+// =========================================================
+
 func (c *connection) writeLoop(l *WSHelper) {
 	ticker := time.NewTicker(50 * time.Second)
 	defer func() {